@@ -0,0 +1,208 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// alarmKey identifies an alarm, etcdserverpb.AlarmMember cannot be a map
+// key as it's not comparable.
+type alarmKey struct {
+	memberID uint64
+	alarm    etcdserverpb.AlarmType
+}
+
+// alarmStore keeps the activated alarms.
+type alarmStore struct {
+	mu     sync.RWMutex
+	alarms map[alarmKey]struct{}
+}
+
+func newAlarmStore() *alarmStore {
+	return &alarmStore{
+		alarms: make(map[alarmKey]struct{}),
+	}
+}
+
+// activate activates the alarm, it returns false if the alarm is already
+// activated.
+func (as *alarmStore) activate(alarm etcdserverpb.AlarmMember) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	key := alarmKey{memberID: alarm.MemberID, alarm: alarm.Alarm}
+	if _, ok := as.alarms[key]; ok {
+		return false
+	}
+	as.alarms[key] = struct{}{}
+	return true
+}
+
+// deactivate deactivates the alarm, it returns false if the alarm isn't
+// activated.
+func (as *alarmStore) deactivate(alarm etcdserverpb.AlarmMember) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	key := alarmKey{memberID: alarm.MemberID, alarm: alarm.Alarm}
+	if _, ok := as.alarms[key]; !ok {
+		return false
+	}
+	delete(as.alarms, key)
+	return true
+}
+
+// active checks whether any alarm of the type is activated.
+func (as *alarmStore) active(typ etcdserverpb.AlarmType) bool {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	for key := range as.alarms {
+		if key.alarm == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the activated alarms of the type, or all of them if the type
+// is AlarmType_NONE. They're sorted by the member ids and then the types.
+func (as *alarmStore) list(typ etcdserverpb.AlarmType) []*etcdserverpb.AlarmMember {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	alarms := make([]*etcdserverpb.AlarmMember, 0, len(as.alarms))
+	for key := range as.alarms {
+		if typ == etcdserverpb.AlarmType_NONE || key.alarm == typ {
+			alarms = append(alarms, &etcdserverpb.AlarmMember{
+				MemberID: key.memberID,
+				Alarm:    key.alarm,
+			})
+		}
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].MemberID != alarms[j].MemberID {
+			return alarms[i].MemberID < alarms[j].MemberID
+		}
+		return alarms[i].Alarm < alarms[j].Alarm
+	})
+	return alarms
+}
+
+// alarmString formats the alarm like ETCD does in the errors of the Status
+// responses.
+func alarmString(alarm *etcdserverpb.AlarmMember) string {
+	return fmt.Sprintf("memberID:%d alarm:%s ", alarm.MemberID, alarm.Alarm)
+}
+
+// checkQuota raises the NOSPACE alarm if the size of the backend exceeds the
+// quota, cost is the number of bytes that are going to be written.
+func (a *adapter) checkQuota(ctx context.Context, cost int64) bool {
+	if a.quotaBackendBytes <= 0 {
+		return true
+	}
+	size, err := a.backend.DbSize(ctx)
+	if err != nil {
+		a.logger.Error("failed to get db size",
+			zap.Error(err),
+		)
+		return true
+	}
+	if size+cost <= a.quotaBackendBytes {
+		return true
+	}
+	alarm := etcdserverpb.AlarmMember{
+		MemberID: a.memberID,
+		Alarm:    etcdserverpb.AlarmType_NOSPACE,
+	}
+	if a.alarms.activate(alarm) {
+		a.logger.Warn("database space exceeded, NOSPACE alarm is raised",
+			zap.Int64("size", size),
+			zap.Int64("quota", a.quotaBackendBytes),
+		)
+	}
+	return false
+}
+
+// checkEventsQuota checks whether the events fit in the quota, if
+// RejectEventsOverQuota is set. Only the add, the update and the upsert
+// events take space.
+func (a *adapter) checkEventsQuota(ctx context.Context, events ...*Event) bool {
+	if !a.rejectEventsOverQuota {
+		return true
+	}
+	var cost int64
+	for _, ev := range events {
+		switch ev.Type {
+		case EventAdd, EventUpdate, EventUpsert:
+			cost += int64(len(ev.Key) + len(ev.Value))
+		}
+	}
+	if cost == 0 {
+		return true
+	}
+	return a.checkQuota(ctx, cost)
+}
+
+// quotaUnaryInterceptor rejects the requests which take more space while the
+// NOSPACE alarm is activated, or which would exceed the quota. Like ETCD,
+// the deletions are still allowed so that the space can be reclaimed.
+func (a *adapter) quotaUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var cost int64
+	switch r := req.(type) {
+	case *etcdserverpb.PutRequest:
+		cost = putCost(r)
+	case *etcdserverpb.TxnRequest:
+		cost = txnCost(r)
+		if cost == 0 {
+			return handler(ctx, req)
+		}
+	case *etcdserverpb.LeaseGrantRequest:
+	default:
+		return handler(ctx, req)
+	}
+	if a.alarms.active(etcdserverpb.AlarmType_NOSPACE) || !a.checkQuota(ctx, cost) {
+		return nil, rpctypes.ErrGRPCNoSpace
+	}
+	return handler(ctx, req)
+}
+
+// putCost estimates the number of bytes taken by the put.
+func putCost(r *etcdserverpb.PutRequest) int64 {
+	return int64(len(r.Key) + len(r.Value))
+}
+
+// txnCost is the sum of the costs of the puts in the transaction (and the
+// nested ones).
+func txnCost(r *etcdserverpb.TxnRequest) int64 {
+	var cost int64
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch {
+			case op.GetRequestPut() != nil:
+				cost += putCost(op.GetRequestPut())
+			case op.GetRequestTxn() != nil:
+				cost += txnCost(op.GetRequestTxn())
+			}
+		}
+	}
+	return cost
+}
@@ -0,0 +1,210 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestQuotaUnaryInterceptor(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		QuotaBackendBytes: 64,
+	}).(*adapter)
+	handled := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled++
+		return nil, nil
+	}
+	put := &etcdserverpb.PutRequest{
+		Key:   []byte("/apisix/routes/1"),
+		Value: []byte("v1"),
+	}
+	_, err := a.quotaUnaryInterceptor(context.Background(), put, nil, handler)
+	assert.Nil(t, err, "checking error")
+
+	// The put which would exceed the quota raises the alarm.
+	large := &etcdserverpb.PutRequest{
+		Key:   []byte("/apisix/routes/1"),
+		Value: []byte(strings.Repeat("v", 64)),
+	}
+	_, err = a.quotaUnaryInterceptor(context.Background(), large, nil, handler)
+	assert.Equal(t, rpctypes.ErrGRPCNoSpace, err, "checking error")
+	assert.True(t, a.alarms.active(etcdserverpb.AlarmType_NOSPACE), "checking alarm")
+	_, err = a.quotaUnaryInterceptor(context.Background(), put, nil, handler)
+	assert.Equal(t, rpctypes.ErrGRPCNoSpace, err, "checking error")
+	_, err = a.quotaUnaryInterceptor(context.Background(), &etcdserverpb.TxnRequest{
+		Failure: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestTxn{
+					RequestTxn: &etcdserverpb.TxnRequest{
+						Success: []*etcdserverpb.RequestOp{
+							{
+								Request: &etcdserverpb.RequestOp_RequestPut{
+									RequestPut: put,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, nil, handler)
+	assert.Equal(t, rpctypes.ErrGRPCNoSpace, err, "checking error")
+
+	// The deletions and reads are still allowed.
+	for _, req := range []interface{}{
+		&etcdserverpb.DeleteRangeRequest{Key: []byte("/apisix/routes/1")},
+		&etcdserverpb.RangeRequest{Key: []byte("/apisix/routes/1")},
+		&etcdserverpb.TxnRequest{
+			Success: []*etcdserverpb.RequestOp{
+				{
+					Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+						RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{Key: []byte("/apisix/routes/1")},
+					},
+				},
+			},
+		},
+	} {
+		_, err = a.quotaUnaryInterceptor(context.Background(), req, nil, handler)
+		assert.Nil(t, err, "checking error")
+	}
+	assert.Equal(t, 4, handled, "checking handled requests")
+
+	assert.True(t, a.alarms.deactivate(etcdserverpb.AlarmMember{
+		MemberID: DefaultMemberID,
+		Alarm:    etcdserverpb.AlarmType_NOSPACE,
+	}), "checking deactivating result")
+	_, err = a.quotaUnaryInterceptor(context.Background(), put, nil, handler)
+	assert.Nil(t, err, "checking error")
+}
+
+func TestEtcdAdapterNoSpaceAlarm(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		QuotaBackendBytes: 1024,
+	})
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	// The events are applied even if they exceed the quota.
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte(strings.Repeat("v", 1024)),
+			Type:  EventAdd,
+		},
+	})
+	resp, err := client.AlarmList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Alarms, 1, "checking alarms")
+	alarm := resp.Alarms[0]
+	assert.Equal(t, DefaultMemberID, alarm.MemberID, "checking member id")
+	assert.Equal(t, etcdserverpb.AlarmType_NOSPACE, alarm.Alarm, "checking alarm type")
+	status, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{alarmString(alarm)}, status.Errors, "checking errors")
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Equal(t, rpctypes.ErrNoSpace, err, "checking error")
+	_, err = client.Grant(context.Background(), 60)
+	assert.Equal(t, rpctypes.ErrNoSpace, err, "checking error")
+	// The space can be reclaimed while the alarm is activated.
+	delResp, err := client.Delete(context.Background(), "/apisix/routes/2")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Compact(context.Background(), delResp.Header.Revision)
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Equal(t, rpctypes.ErrNoSpace, err, "checking error")
+	// Like ETCD, the compacted space is not released until defragmented.
+	_, err = client.Defragment(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+
+	disarmResp, err := client.AlarmDisarm(context.Background(), (*clientv3.AlarmMember)(alarm))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, disarmResp.Alarms, 1, "checking alarms")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	resp, err = client.AlarmList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Alarms, 0, "checking alarms")
+}
+
+func TestEtcdAdapterRejectEventsOverQuota(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		QuotaBackendBytes:     1024,
+		RejectEventsOverQuota: true,
+	})
+	defer shutdown()
+
+	large := []byte(strings.Repeat("v", 512))
+	_, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/1", Value: large, Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/2",
+			Value: large,
+			Type:  EventAdd,
+		},
+	}
+	// The events which fit are still applied while the alarm is activated.
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/3", Value: []byte("v1"), Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+	select {
+	case evErr := <-a.Errors():
+		assert.Equal(t, "/apisix/routes/2", evErr.Event.Key, "checking key")
+		assert.True(t, errors.Is(evErr, ErrNoSpace), "checking error")
+	default:
+		t.Fatal("no event error reported")
+	}
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/2", Value: large, Type: EventAdd})
+	assert.Equal(t, ErrNoSpace, err, "checking error")
+	assert.Equal(t, int64(546), a.Stats().DbSize, "checking db size")
+	_, err = client.Put(context.Background(), "/apisix/routes/4", "v1")
+	assert.Equal(t, rpctypes.ErrNoSpace, err, "checking error")
+
+	// The space is reclaimed by the compaction and the defragmentation.
+	rev, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/1", Type: EventDelete})
+	assert.Nil(t, err, "checking error")
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/2", Value: large, Type: EventAdd})
+	assert.Equal(t, ErrNoSpace, err, "checking error")
+	assert.Nil(t, a.CompactTo(context.Background(), rev), "checking error")
+	_, err = client.Defragment(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/2", Value: large, Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+
+	// The clients are rejected until the alarm is disarmed, like ETCD.
+	_, err = client.Put(context.Background(), "/apisix/routes/4", "v1")
+	assert.Equal(t, rpctypes.ErrNoSpace, err, "checking error")
+
+	// The desired objects are counted as the puts, and nothing is changed
+	// if they don't fit.
+	_, err = a.ReplaceAll(context.Background(), "/apisix/upstreams/", []*Event{
+		{Key: "/apisix/upstreams/1", Value: large},
+	})
+	assert.Equal(t, ErrNoSpace, err, "checking error")
+	resp, err := client.Get(context.Background(), "/apisix/upstreams/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 0, "checking key-values")
+}
@@ -0,0 +1,199 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// AllowlistTokenHeader is the gRPC metadata carrying the static token of a
+// client, it identifies the client in the Allowlist.Tokens.
+const AllowlistTokenHeader = "x-allowlist-token"
+
+// Allowlist permits the clients to read and watch the keys with the given
+// prefixes, a lightweight alternative to the authentication. Once it's set,
+// the clients not in it are denied, and so are the changes made by all the
+// clients. An empty prefix means all the keys.
+type Allowlist struct {
+	// CommonNames maps the CommonNames of the verified client certificates
+	// to the prefixes, the adapter must serve on a TLS listener which
+	// verifies the client certificates. The requests of the gRPC gateway are
+	// never matched, as it presents the server certificate.
+	CommonNames map[string][]string
+	// Tokens maps the static tokens in the AllowlistTokenHeader metadata to
+	// the prefixes. The certificate wins if a client carries both.
+	Tokens map[string][]string
+}
+
+// allowlist enforces the Allowlist, it can be replaced at runtime.
+type allowlist struct {
+	logger *zap.Logger
+
+	mu sync.RWMutex
+	// enabled is false if the Allowlist is not set.
+	enabled     bool
+	commonNames map[string]rangePerms
+	tokens      map[string]rangePerms
+}
+
+func newAllowlist(logger *zap.Logger, list *Allowlist) *allowlist {
+	al := &allowlist{
+		logger: logger,
+	}
+	al.set(list)
+	return al
+}
+
+func compilePrefixes(m map[string][]string) map[string]rangePerms {
+	compiled := make(map[string]rangePerms, len(m))
+	for identity, prefixes := range m {
+		ranges := make([]keyRange, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			ranges = append(ranges, keyRange{
+				start: []byte(prefix),
+				end:   prefixEnd([]byte(prefix)),
+			})
+		}
+		compiled[identity] = mergeRanges(ranges)
+	}
+	return compiled
+}
+
+// set replaces the Allowlist, a nil one disables the allowlist.
+func (al *allowlist) set(list *Allowlist) {
+	var commonNames, tokens map[string]rangePerms
+	if list != nil {
+		commonNames = compilePrefixes(list.CommonNames)
+		tokens = compilePrefixes(list.Tokens)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.enabled = list != nil
+	al.commonNames = commonNames
+	al.tokens = tokens
+}
+
+// lookupLocked returns the permitted ranges of the client, the client is
+// described for the logs. It returns false if the client is not in the
+// allowlist.
+func (al *allowlist) lookupLocked(ctx context.Context) (rangePerms, string, bool) {
+	if cn := certUserFromContext(ctx); cn != "" {
+		perms, ok := al.commonNames[cn]
+		return perms, "cn=" + cn, ok
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if tokens := md.Get(AllowlistTokenHeader); len(tokens) > 0 {
+			perms, ok := al.tokens[tokens[0]]
+			// Don't leak the token to the logs.
+			return perms, "token", ok
+		}
+	}
+	return nil, "anonymous", false
+}
+
+// checkRead checks whether the client of the request is permitted to read
+// or watch the range, which is interpreted in the same way as the
+// RangeRequest. A nil allowlist permits all the requests, like a disabled
+// one.
+func (al *allowlist) checkRead(ctx context.Context, method string, key, end []byte) error {
+	if al == nil {
+		return nil
+	}
+	al.mu.RLock()
+	enabled := al.enabled
+	perms, client, ok := al.lookupLocked(ctx)
+	al.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	if ok && perms.contains(newKeyRange(key, end)) {
+		return nil
+	}
+	al.deny(ctx, method, client, key, end)
+	return rpctypes.ErrGRPCPermissionDenied
+}
+
+// checkWrite denies the changes if the allowlist is enabled.
+func (al *allowlist) checkWrite(ctx context.Context, method string, key, end []byte) error {
+	if al == nil {
+		return nil
+	}
+	al.mu.RLock()
+	enabled := al.enabled
+	_, client, _ := al.lookupLocked(ctx)
+	al.mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	al.deny(ctx, method, client, key, end)
+	return rpctypes.ErrGRPCPermissionDenied
+}
+
+// checkTxn checks the compares and the operations of both branches of the
+// transaction, including the nested ones.
+func (al *allowlist) checkTxn(ctx context.Context, r *etcdserverpb.TxnRequest) error {
+	for _, c := range r.Compare {
+		if err := al.checkRead(ctx, "Txn", c.Key, c.RangeEnd); err != nil {
+			return err
+		}
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			var err error
+			switch tv := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestRange:
+				err = al.checkRead(ctx, "Txn", tv.RequestRange.Key, tv.RequestRange.RangeEnd)
+			case *etcdserverpb.RequestOp_RequestPut:
+				err = al.checkWrite(ctx, "Txn", tv.RequestPut.Key, nil)
+			case *etcdserverpb.RequestOp_RequestDeleteRange:
+				err = al.checkWrite(ctx, "Txn", tv.RequestDeleteRange.Key, tv.RequestDeleteRange.RangeEnd)
+			case *etcdserverpb.RequestOp_RequestTxn:
+				err = al.checkTxn(ctx, tv.RequestTxn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (al *allowlist) deny(ctx context.Context, method, client string, key, end []byte) {
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("client", client),
+		zap.String("key", string(key)),
+	}
+	if len(end) > 0 {
+		fields = append(fields, zap.String("range_end", string(end)))
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields = append(fields, zap.String("peer", p.Addr.String()))
+	}
+	al.logger.Warn("request denied by the allowlist", fields...)
+}
+
+func (a *adapter) SetAllowlist(list *Allowlist) {
+	a.allowlist.set(list)
+}
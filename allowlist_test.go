@@ -0,0 +1,189 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func certContext(cn string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}},
+			},
+		},
+	})
+}
+
+func tokenContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(AllowlistTokenHeader, token))
+}
+
+func TestAllowlist(t *testing.T) {
+	al := newAllowlist(zap.NewNop(), nil)
+	// Everything is permitted if it's disabled.
+	assert.Nil(t, al.checkRead(context.Background(), "Range", []byte("/foo"), nil), "checking error")
+	assert.Nil(t, al.checkWrite(context.Background(), "Put", []byte("/foo"), nil), "checking error")
+	// So is a nil one, e.g. the one of a kvServer made without it.
+	var nilAllowlist *allowlist
+	assert.Nil(t, nilAllowlist.checkRead(context.Background(), "Range", []byte("/foo"), nil), "checking error")
+	assert.Nil(t, nilAllowlist.checkWrite(context.Background(), "Put", []byte("/foo"), nil), "checking error")
+
+	al.set(&Allowlist{
+		CommonNames: map[string][]string{
+			"team-a": {"/apisix/routes/", "/apisix/upstreams/"},
+		},
+		Tokens: map[string][]string{
+			"secret": {"/apisix/"},
+		},
+	})
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		key     string
+		end     string
+		allowed bool
+	}{
+		{name: "cn", ctx: certContext("team-a"), key: "/apisix/routes/1", allowed: true},
+		{name: "cn prefix", ctx: certContext("team-a"), key: "/apisix/routes/", end: "/apisix/routes0", allowed: true},
+		{name: "cn out of prefix", ctx: certContext("team-a"), key: "/apisix/services/1"},
+		{name: "cn partially out of prefix", ctx: certContext("team-a"), key: "/apisix/", end: "/apisix0"},
+		{name: "unknown cn", ctx: certContext("team-b"), key: "/apisix/routes/1"},
+		{name: "token", ctx: tokenContext("secret"), key: "/apisix/services/1", allowed: true},
+		{name: "unknown token", ctx: tokenContext("guess"), key: "/apisix/services/1"},
+		{name: "anonymous", ctx: context.Background(), key: "/apisix/routes/1"},
+	}
+	for _, c := range cases {
+		var end []byte
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		err := al.checkRead(c.ctx, "Range", []byte(c.key), end)
+		if c.allowed {
+			assert.Nil(t, err, "checking error of %s", c.name)
+		} else {
+			assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error of %s", c.name)
+		}
+	}
+	// The changes are denied even though the keys are readable.
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, al.checkWrite(certContext("team-a"), "Put", []byte("/apisix/routes/1"), nil), "checking error")
+	txn := &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestRange{
+					RequestRange: &etcdserverpb.RangeRequest{Key: []byte("/apisix/routes/1")},
+				},
+			},
+		},
+	}
+	assert.Nil(t, al.checkTxn(certContext("team-a"), txn), "checking error")
+	txn.Failure = []*etcdserverpb.RequestOp{
+		{
+			Request: &etcdserverpb.RequestOp_RequestTxn{
+				RequestTxn: &etcdserverpb.TxnRequest{
+					Compare: []*etcdserverpb.Compare{{Key: []byte("/apisix/services/1")}},
+				},
+			},
+		},
+	}
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, al.checkTxn(certContext("team-a"), txn), "checking error")
+
+	// Add a team at runtime.
+	al.set(&Allowlist{
+		CommonNames: map[string][]string{
+			"team-a": {"/apisix/routes/"},
+			"team-b": {""},
+		},
+	})
+	assert.Nil(t, al.checkRead(certContext("team-b"), "Range", []byte("/foo"), []byte("\x00")), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, al.checkRead(tokenContext("secret"), "Range", []byte("/apisix/routes/1"), nil), "checking error")
+	al.set(nil)
+	assert.Nil(t, al.checkRead(context.Background(), "Range", []byte("/foo"), nil), "checking error")
+}
+
+func TestEtcdAdapterAllowlist(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Allowlist: &Allowlist{
+			Tokens: map[string][]string{
+				"team-a": {"/apisix/routes/"},
+			},
+		},
+	})
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/services/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+	})
+	teamA := metadata.AppendToOutgoingContext(context.Background(), AllowlistTokenHeader, "team-a")
+	teamB := metadata.AppendToOutgoingContext(context.Background(), AllowlistTokenHeader, "team-b")
+
+	resp, err := client.Get(teamA, "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	_, err = client.Get(teamA, "/apisix/services/1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = client.Get(teamA, "/apisix/", clientv3.WithPrefix())
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = client.Put(teamA, "/apisix/routes/2", "2")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = client.Get(context.Background(), "/apisix/routes/1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = client.Get(teamB, "/apisix/services/1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+
+	ctx, cancel := context.WithCancel(teamA)
+	defer cancel()
+	wresp := <-client.Watch(ctx, "/apisix/services/", clientv3.WithPrefix())
+	assert.True(t, wresp.Canceled, "checking canceled")
+	assert.Contains(t, wresp.Err().Error(), "permission denied", "checking error")
+
+	// Add a team at runtime.
+	a.SetAllowlist(&Allowlist{
+		Tokens: map[string][]string{
+			"team-a": {"/apisix/routes/"},
+			"team-b": {"/apisix/services/"},
+		},
+	})
+	resp, err = client.Get(teamB, "/apisix/services/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	a.SetAllowlist(nil)
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "2")
+	assert.Nil(t, err, "checking error")
+}
@@ -0,0 +1,497 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultAuthTokenTTL is the default TTL of the auth tokens, it's same as
+// the tokens of ETCD.
+const DefaultAuthTokenTTL = 5 * time.Minute
+
+// AuthOptions contains the settings of the authentication, the ETCD clients
+// authenticate as one of the users like they do against ETCD, e.g. with
+// `etcdctl --user`. The authentication is enabled on start if the options
+// are given, otherwise it can be enabled by `etcdctl auth enable` later.
+type AuthOptions struct {
+	// Users are the initial users who can authenticate, they can be managed
+	// by the user RPCs (e.g. `etcdctl user add`) later.
+	Users []User
+	// Roles are the initial roles which can be granted to the users,
+	// RootRole is built in.
+	Roles []Role
+	// TokenTTL is the TTL of the tokens. A simple token expires if it's not
+	// used in the TTL, while a JWT expires the TTL after it's issued.
+	// Default is DefaultAuthTokenTTL.
+	TokenTTL time.Duration
+	// JWT makes the tokens JWTs if it's not nil, otherwise they're simple
+	// tokens, which are only valid on the adapter issuing them.
+	JWT *JWTOptions
+	// ClientCertAuth authenticates the clients by the CommonName of their
+	// verified certificates, like the --client-cert-auth of ETCD, so they
+	// don't need the tokens. The adapter must serve over the TLS which
+	// verifies the client certificates, e.g. with TLSOptions.ClientCAFile.
+	// Like ETCD, the token wins if a client carries both, and the requests
+	// of the gRPC gateway are never authenticated by the certificate.
+	ClientCertAuth bool
+	// BcryptCost is the cost to hash the passwords of the users added by
+	// the RPCs. Default is bcrypt.DefaultCost.
+	BcryptCost int
+}
+
+// User is a user who can authenticate.
+type User struct {
+	Name string
+	// Password is the bcrypt hash of the password, e.g. the one generated
+	// by `htpasswd -bnBC 10 "" password`. The user cannot authenticate by
+	// the password if it's empty, e.g. if it authenticates by the client
+	// certificate.
+	Password string
+	// Roles are the names of the roles granted to the user, a user without
+	// any role is not permitted to access any key, like ETCD.
+	Roles []string
+}
+
+// authStore keeps the users and the roles, and issues the tokens to the
+// users.
+type authStore struct {
+	tokens         tokenProvider
+	clientCertAuth bool
+	bcryptCost     int
+
+	mu       sync.RWMutex
+	enabled  bool
+	revision uint64
+	users    map[string]*authUser
+	roles    map[string]*authRole
+}
+
+// newAuthStore creates the store of the options, the authentication is
+// disabled if the options are nil.
+func newAuthStore(opts *AuthOptions, clock Clock) (*authStore, error) {
+	enabled := opts != nil
+	if opts == nil {
+		opts = &AuthOptions{}
+	}
+	ttl := opts.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultAuthTokenTTL
+	}
+	cost := opts.BcryptCost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost %d is out of range [%d, %d]", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	as := &authStore{
+		clientCertAuth: opts.ClientCertAuth,
+		bcryptCost:     cost,
+		enabled:        enabled,
+		revision:       1,
+		users:          make(map[string]*authUser, len(opts.Users)),
+	}
+	if opts.JWT != nil {
+		tp, err := newJWTTokenProvider(opts.JWT, ttl, clock)
+		if err != nil {
+			return nil, err
+		}
+		as.tokens = tp
+	} else {
+		as.tokens = newSimpleTokenProvider(ttl, clock)
+	}
+	roles, err := newAuthRoles(opts.Roles)
+	if err != nil {
+		return nil, err
+	}
+	as.roles = roles
+	for _, user := range opts.Users {
+		if user.Name == "" {
+			return nil, fmt.Errorf("user name is empty")
+		}
+		if _, ok := as.users[user.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %q", user.Name)
+		}
+		if user.Password != "" {
+			if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+				return nil, fmt.Errorf("invalid password hash of user %q: %s", user.Name, err)
+			}
+		}
+		u, err := newAuthUser([]byte(user.Password), user.Roles, roles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid roles of user %q: %s", user.Name, err)
+		}
+		as.users[user.Name] = u
+	}
+	return as, nil
+}
+
+// authenticate checks the password of the user, and it issues a token on
+// success.
+func (as *authStore) authenticate(name, password string) (string, error) {
+	as.mu.RLock()
+	enabled := as.enabled
+	revision := as.revision
+	var hashed []byte
+	if u, ok := as.users[name]; ok {
+		hashed = u.password
+	}
+	as.mu.RUnlock()
+	if !enabled {
+		return "", rpctypes.ErrGRPCAuthNotEnabled
+	}
+	if len(hashed) == 0 {
+		return "", rpctypes.ErrGRPCAuthFailed
+	}
+	// The comparison is expensive, don't hold the lock. The token carries
+	// the revision before the comparison, so it's rejected if the password
+	// is changed meanwhile.
+	if err := bcrypt.CompareHashAndPassword(hashed, []byte(password)); err != nil {
+		return "", rpctypes.ErrGRPCAuthFailed
+	}
+	return as.tokens.assign(name, revision)
+}
+
+// user returns the user that the token is issued to, the token is rejected
+// if it's issued before the auth revision changes. The clients of ETCD 3.5
+// only authenticate again on ErrGRPCInvalidAuthToken, so it's returned for
+// such tokens as well.
+func (as *authStore) user(token string) (string, error) {
+	name, revision, err := as.tokens.info(token)
+	if err != nil {
+		return "", err
+	}
+	if revision < as.status() {
+		return "", rpctypes.ErrGRPCInvalidAuthToken
+	}
+	return name, nil
+}
+
+// status returns the auth revision.
+func (as *authStore) status() uint64 {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	return as.revision
+}
+
+// isEnabled checks whether the authentication is enabled.
+func (as *authStore) isEnabled() bool {
+	if as == nil {
+		return false
+	}
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	return as.enabled
+}
+
+// tokenFromContext returns the token in the metadata of the request, the
+// token is in the "authorization" field if the request is from the gRPC
+// gateway.
+func tokenFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, field := range []string{rpctypes.TokenFieldNameGRPC, rpctypes.TokenFieldNameSwagger} {
+		if ts := md.Get(field); len(ts) > 0 {
+			return ts[0]
+		}
+	}
+	return ""
+}
+
+type authUserKey struct{}
+
+// authUserFromContext returns the authenticated user of the request, it's
+// empty if the request doesn't need the authentication.
+func authUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(authUserKey{}).(string)
+	return user
+}
+
+// requiresAuth checks whether the RPC needs an authenticated user. The
+// services not listed, e.g. the health and the reflection services, are
+// served to everyone.
+func requiresAuth(method string) bool {
+	switch method {
+	case "/etcdserverpb.Auth/Authenticate", "/etcdserverpb.Auth/AuthStatus", "/etcdserverpb.Auth/AuthEnable":
+		return false
+	}
+	for _, service := range []string{"/etcdserverpb.KV/", "/etcdserverpb.Watch/", "/etcdserverpb.Lease/", "/etcdserverpb.Auth/"} {
+		if strings.HasPrefix(method, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateContext checks the token or the client certificate of the
+// request, and it returns the context carrying the authenticated user. Like
+// ETCD, an explicit token is preferred to the certificate.
+func (a *adapter) authenticateContext(ctx context.Context) (context.Context, error) {
+	if token := tokenFromContext(ctx); token != "" {
+		user, err := a.auth.user(token)
+		if err != nil {
+			return nil, err
+		}
+		return context.WithValue(ctx, authUserKey{}, user), nil
+	}
+	if a.auth.clientCertAuth {
+		if user := certUserFromContext(ctx); user != "" {
+			return context.WithValue(ctx, authUserKey{}, user), nil
+		}
+	}
+	return nil, rpctypes.ErrGRPCUserEmpty
+}
+
+// authUnaryInterceptor rejects the KV, Lease and Auth requests without a
+// valid token when the authentication is enabled.
+func (a *adapter) authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !requiresAuth(info.FullMethod) || !a.auth.isEnabled() {
+		return handler(ctx, req)
+	}
+	ctx, err := a.authenticateContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authStreamInterceptor is the stream version of authUnaryInterceptor, the
+// token is checked when the stream is created.
+func (a *adapter) authStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !requiresAuth(info.FullMethod) || !a.auth.isEnabled() {
+		return handler(srv, ss)
+	}
+	ctx, err := a.authenticateContext(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authServerStream{
+		ServerStream: ss,
+		ctx:          ctx,
+	})
+}
+
+// authServerStream carries the authenticated user in the context.
+type authServerStream struct {
+	grpc.ServerStream
+
+	ctx context.Context
+}
+
+func (ss *authServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// authServer implements the etcdserverpb.AuthServer, like ETCD, the users
+// and the roles can only be managed by the root users once the
+// authentication is enabled.
+type authServer struct {
+	store *authStore
+}
+
+func (s *authServer) Authenticate(ctx context.Context, r *etcdserverpb.AuthenticateRequest) (*etcdserverpb.AuthenticateResponse, error) {
+	token, err := s.store.authenticate(r.Name, r.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthenticateResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Token:  token,
+	}, nil
+}
+
+func (s *authServer) AuthStatus(ctx context.Context, r *etcdserverpb.AuthStatusRequest) (*etcdserverpb.AuthStatusResponse, error) {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+	return &etcdserverpb.AuthStatusResponse{
+		Header:       &etcdserverpb.ResponseHeader{},
+		Enabled:      s.store.enabled,
+		AuthRevision: s.store.revision,
+	}, nil
+}
+
+func (s *authServer) AuthEnable(ctx context.Context, r *etcdserverpb.AuthEnableRequest) (*etcdserverpb.AuthEnableResponse, error) {
+	if err := s.store.enable(); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthEnableResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) AuthDisable(ctx context.Context, r *etcdserverpb.AuthDisableRequest) (*etcdserverpb.AuthDisableResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	s.store.disable()
+	return &etcdserverpb.AuthDisableResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) UserAdd(ctx context.Context, r *etcdserverpb.AuthUserAddRequest) (*etcdserverpb.AuthUserAddResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	noPassword := r.Options != nil && r.Options.NoPassword
+	if err := s.store.addUser(r.Name, r.Password, r.HashedPassword, noPassword); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserAddResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) UserGet(ctx context.Context, r *etcdserverpb.AuthUserGetRequest) (*etcdserverpb.AuthUserGetResponse, error) {
+	// Like ETCD, a user can get itself.
+	if authUserFromContext(ctx) != r.Name {
+		if err := s.store.checkAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	roles, err := s.store.getUser(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserGetResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Roles:  roles,
+	}, nil
+}
+
+func (s *authServer) UserList(ctx context.Context, r *etcdserverpb.AuthUserListRequest) (*etcdserverpb.AuthUserListResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserListResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Users:  s.store.listUsers(),
+	}, nil
+}
+
+func (s *authServer) UserDelete(ctx context.Context, r *etcdserverpb.AuthUserDeleteRequest) (*etcdserverpb.AuthUserDeleteResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.deleteUser(r.Name); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserDeleteResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) UserChangePassword(ctx context.Context, r *etcdserverpb.AuthUserChangePasswordRequest) (*etcdserverpb.AuthUserChangePasswordResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.changePassword(r.Name, r.Password, r.HashedPassword); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserChangePasswordResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) UserGrantRole(ctx context.Context, r *etcdserverpb.AuthUserGrantRoleRequest) (*etcdserverpb.AuthUserGrantRoleResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.grantRole(r.User, r.Role); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserGrantRoleResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) UserRevokeRole(ctx context.Context, r *etcdserverpb.AuthUserRevokeRoleRequest) (*etcdserverpb.AuthUserRevokeRoleResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.revokeRole(r.Name, r.Role); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserRevokeRoleResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) RoleAdd(ctx context.Context, r *etcdserverpb.AuthRoleAddRequest) (*etcdserverpb.AuthRoleAddResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.addRole(r.Name); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleAddResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) RoleGet(ctx context.Context, r *etcdserverpb.AuthRoleGetRequest) (*etcdserverpb.AuthRoleGetResponse, error) {
+	// Like ETCD, a user can get the roles granted to it.
+	if !s.store.hasRole(authUserFromContext(ctx), r.Role) {
+		if err := s.store.checkAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	perms, err := s.store.getRole(r.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleGetResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Perm:   perms,
+	}, nil
+}
+
+func (s *authServer) RoleList(ctx context.Context, r *etcdserverpb.AuthRoleListRequest) (*etcdserverpb.AuthRoleListResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleListResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Roles:  s.store.listRoles(),
+	}, nil
+}
+
+func (s *authServer) RoleDelete(ctx context.Context, r *etcdserverpb.AuthRoleDeleteRequest) (*etcdserverpb.AuthRoleDeleteResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.deleteRole(r.Role); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleDeleteResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) RoleGrantPermission(ctx context.Context, r *etcdserverpb.AuthRoleGrantPermissionRequest) (*etcdserverpb.AuthRoleGrantPermissionResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.grantPermission(r.Name, r.Perm); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleGrantPermissionResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *authServer) RoleRevokePermission(ctx context.Context, r *etcdserverpb.AuthRoleRevokePermissionRequest) (*etcdserverpb.AuthRoleRevokePermissionResponse, error) {
+	if err := s.store.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.store.revokePermission(r.Role, r.Key, r.RangeEnd); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleRevokePermissionResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
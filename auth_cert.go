@@ -0,0 +1,100 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// gatewayAcceptMetadata is the metadata carried by the requests proxied by
+// the gRPC gateway.
+const gatewayAcceptMetadata = "grpcgateway-accept"
+
+// certUserFromContext returns the CommonName of the verified client
+// certificate of the request, it's same as ETCD. Like ETCD, the requests
+// proxied by the gateway have no certificate user, as the gateway presents
+// the server certificate on behalf of all the HTTP clients.
+func certUserFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(gatewayAcceptMetadata)) > 0 {
+		return ""
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p == nil {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	for _, chain := range tlsInfo.State.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		if cn := chain[0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	return ""
+}
+
+// tlsConnCredentials exposes the TLS state of the connections to the gRPC
+// server. The connections have been handshaked by the TLS listener passed to
+// Serve before they're multiplexed, so the gRPC server cannot use the TLS
+// credentials, which do the handshake by themselves.
+type tlsConnCredentials struct{}
+
+func (tlsConnCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	raw := conn
+	if mc, ok := raw.(*cmux.MuxConn); ok {
+		raw = mc.Conn
+	}
+	tlsConn, ok := raw.(*tls.Conn)
+	if !ok {
+		return conn, nil, nil
+	}
+	return conn, credentials.TLSInfo{
+		State: tlsConn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+	}, nil
+}
+
+func (tlsConnCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("etcd adapter: client handshake is not supported")
+}
+
+func (tlsConnCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+	}
+}
+
+func (c tlsConnCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (tlsConnCredentials) OverrideServerName(string) error {
+	return nil
+}
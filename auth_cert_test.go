@@ -0,0 +1,446 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// testCA issues the certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t testing.TB) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "checking error")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err, "checking error")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "checking error")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pool: pool,
+	}
+}
+
+// issue issues a certificate with the CommonName, it's for the localhost if
+// it's a server certificate, which is a client one too, like the certificates
+// of the ETCD members.
+func (ca *testCA) issue(t testing.TB, cn string, server bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "checking error")
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err, "checking error")
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err, "checking error")
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestCertUserFromContext(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "readonly"}}
+	cases := []struct {
+		name string
+		peer *peer.Peer
+		user string
+	}{
+		{
+			name: "verified",
+			peer: &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+				},
+			},
+			user: "readonly",
+		},
+		{
+			name: "not verified",
+			peer: &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+				},
+			},
+		},
+		{
+			name: "plaintext",
+			peer: &peer.Peer{},
+		},
+	}
+	for _, c := range cases {
+		ctx := peer.NewContext(context.Background(), c.peer)
+		assert.Equal(t, c.user, certUserFromContext(ctx), "checking user of %s", c.name)
+	}
+	// The gateway presents the server certificate.
+	ctx := metadata.NewIncomingContext(peer.NewContext(context.Background(), cases[0].peer), metadata.Pairs(gatewayAcceptMetadata, "*/*"))
+	assert.Equal(t, "", certUserFromContext(ctx), "checking user of gateway")
+	assert.Equal(t, "", certUserFromContext(context.Background()), "checking user without peer")
+}
+
+func TestAuthClientCert(t *testing.T) {
+	newAdapter := func(clientCertAuth bool) *adapter {
+		return NewEtcdAdapter(&AdapterOptions{
+			Auth: &AuthOptions{
+				Users: []User{
+					newTestUser(t, "foo", "bar", RootRole),
+					{Name: "readonly"},
+				},
+				ClientCertAuth: clientCertAuth,
+			},
+		}).(*adapter)
+	}
+	a := newAdapter(true)
+	token, err := a.auth.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	// The users without the password cannot authenticate by the password.
+	_, err = a.auth.authenticate("readonly", "")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+
+	certPeer := &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "readonly"}}}},
+			},
+		},
+	}
+	tokenMD := metadata.Pairs(rpctypes.TokenFieldNameGRPC, token)
+	cases := []struct {
+		name    string
+		adapter *adapter
+		peer    *peer.Peer
+		md      metadata.MD
+		user    string
+		err     error
+	}{
+		{
+			name:    "cert",
+			adapter: a,
+			peer:    certPeer,
+			user:    "readonly",
+		},
+		{
+			name:    "token wins",
+			adapter: a,
+			peer:    certPeer,
+			md:      tokenMD,
+			user:    "foo",
+		},
+		{
+			name:    "gateway",
+			adapter: a,
+			peer:    certPeer,
+			md:      metadata.Pairs(gatewayAcceptMetadata, "*/*"),
+			err:     rpctypes.ErrGRPCUserEmpty,
+		},
+		{
+			name:    "gateway token",
+			adapter: a,
+			peer:    certPeer,
+			md:      metadata.Pairs(gatewayAcceptMetadata, "*/*", rpctypes.TokenFieldNameSwagger, token),
+			user:    "foo",
+		},
+		{
+			name:    "token",
+			adapter: a,
+			md:      tokenMD,
+			user:    "foo",
+		},
+		{
+			name:    "no cert",
+			adapter: a,
+			err:     rpctypes.ErrGRPCUserEmpty,
+		},
+		{
+			name:    "cert auth disabled",
+			adapter: newAdapter(false),
+			peer:    certPeer,
+			err:     rpctypes.ErrGRPCUserEmpty,
+		},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.KV/Range"}
+	for _, c := range cases {
+		ctx := context.Background()
+		if c.peer != nil {
+			ctx = peer.NewContext(ctx, c.peer)
+		}
+		if c.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, c.md)
+		}
+		var user string
+		_, err := c.adapter.authUnaryInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			user = authUserFromContext(ctx)
+			return nil, nil
+		})
+		assert.Equal(t, c.err, err, "checking error of %s", c.name)
+		assert.Equal(t, c.user, user, "checking user of %s", c.name)
+	}
+}
+
+func TestAuthClientCertGateway(t *testing.T) {
+	ca := newTestCA(t)
+	a := NewEtcdAdapter(&AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{
+				// The CommonName of the server certificate, which is
+				// presented by the gateway.
+				{Name: "localhost", Roles: []string{RootRole}},
+				newTestUser(t, "foo", "bar", RootRole),
+				newTestUser(t, "readonly", "bar", "viewer"),
+			},
+			Roles: []Role{
+				{
+					Name: "viewer",
+					Permissions: []Permission{
+						{
+							Type:   authpb.READ,
+							Key:    "/apisix/",
+							Prefix: true,
+						},
+					},
+				},
+			},
+			ClientCertAuth: true,
+		},
+		TLS: &TLSOptions{
+			Config: &tls.Config{
+				Certificates: []tls.Certificate{ca.issue(t, "localhost", true)},
+				ClientCAs:    ca.pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			},
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}},
+	}
+	post := func(path, token, body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, "https://"+ln.Addr().String()+path, strings.NewReader(body))
+		assert.Nil(t, err, "checking error")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := httpClient.Do(req)
+		assert.Nil(t, err, "checking error")
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result), "checking error")
+		return resp.StatusCode, result
+	}
+	authenticate := func(name string) string {
+		code, result := post("/v3/auth/authenticate", "", `{"name":"`+name+`","password":"bar"}`)
+		assert.Equal(t, http.StatusOK, code, "checking status code")
+		token, _ := result["token"].(string)
+		assert.NotEmpty(t, token, "checking token")
+		return token
+	}
+	put := `{"key":"` + base64.StdEncoding.EncodeToString([]byte("/apisix/routes/1")) + `","value":"` + base64.StdEncoding.EncodeToString([]byte("v1")) + `"}`
+
+	// The requests are not authenticated as the server certificate.
+	code, result := post("/v3/kv/put", "", put)
+	assert.NotEqual(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, rpctypes.ErrorDesc(rpctypes.ErrGRPCUserEmpty), result["message"], "checking error")
+	code, result = post("/v3/kv/put", authenticate("readonly"), put)
+	assert.NotEqual(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, rpctypes.ErrorDesc(rpctypes.ErrGRPCPermissionDenied), result["message"], "checking error")
+	code, _ = post("/v3/kv/put", authenticate("foo"), put)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+}
+
+func TestTLSConnCredentials(t *testing.T) {
+	ca := newTestCA(t)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	// The plaintext connections are kept as is.
+	conn, authInfo, err := tlsConnCredentials{}.ServerHandshake(serverConn)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, authInfo, "checking auth info")
+	assert.Equal(t, serverConn, conn, "checking connection")
+
+	tlsServer := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "localhost", true)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	tlsClient := tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "readonly", false)},
+		RootCAs:      ca.pool,
+		ServerName:   "localhost",
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tlsClient.Handshake()
+	}()
+	assert.Nil(t, tlsServer.Handshake(), "checking handshake error")
+	assert.Nil(t, <-errc, "checking handshake error")
+
+	_, authInfo, err = tlsConnCredentials{}.ServerHandshake(tlsServer)
+	assert.Nil(t, err, "checking error")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: authInfo})
+	assert.Equal(t, "readonly", certUserFromContext(ctx), "checking user")
+}
+
+func TestEtcdAdapterClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	a := NewEtcdAdapter(&AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{
+				{Name: "admin", Roles: []string{RootRole}},
+				{Name: "readonly", Roles: []string{"viewer"}},
+				newTestUser(t, "foo", "bar", RootRole),
+			},
+			Roles: []Role{
+				{
+					Name: "viewer",
+					Permissions: []Permission{
+						{
+							Type:   authpb.READ,
+							Key:    "/apisix/",
+							Prefix: true,
+						},
+					},
+				},
+			},
+			ClientCertAuth: true,
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ln = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "localhost", true)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	newClient := func(cn, user, password string) *clientv3.Client {
+		tlsConfig := &tls.Config{
+			RootCAs: ca.pool,
+		}
+		if cn != "" {
+			tlsConfig.Certificates = []tls.Certificate{ca.issue(t, cn, false)}
+		}
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints: []string{ln.Addr().String()},
+			TLS:       tlsConfig,
+			Username:  user,
+			Password:  password,
+		})
+		assert.Nil(t, err, "checking error")
+		return client
+	}
+	admin := newClient("admin", "", "")
+	defer admin.Close()
+	readonly := newClient("readonly", "", "")
+	defer readonly.Close()
+	// The password wins over the certificate.
+	both := newClient("readonly", "foo", "bar")
+	defer both.Close()
+	password := newClient("", "foo", "bar")
+	defer password.Close()
+	anonymous := newClient("", "", "")
+	defer anonymous.Close()
+
+	_, err = admin.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	resp, err := readonly.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	_, err = readonly.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = readonly.Get(context.Background(), "/foo")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = both.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	_, err = password.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	_, err = anonymous.Get(context.Background(), "/apisix/routes/1")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+}
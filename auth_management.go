@@ -0,0 +1,339 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The users and the roles are managed in the same way as ETCD, and every
+// change increases the auth revision, so the tokens issued before are
+// rejected by ErrGRPCInvalidAuthToken, and the clients authenticate again.
+
+// checkAdmin checks whether the user of the request is permitted to manage
+// the authentication, i.e. it has the root role.
+func (as *authStore) checkAdmin(ctx context.Context) error {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	if !as.enabled {
+		return nil
+	}
+	u, ok := as.users[authUserFromContext(ctx)]
+	if !ok || !u.root {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// hasRole checks whether the role is granted to the user.
+func (as *authStore) hasRole(name, role string) bool {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	u, ok := as.users[name]
+	return ok && u.hasRole(role)
+}
+
+// enable enables the authentication, the root user with the root role must
+// exist.
+func (as *authStore) enable() error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.enabled {
+		return nil
+	}
+	u, ok := as.users[RootRole]
+	if !ok {
+		return rpctypes.ErrGRPCRootUserNotExist
+	}
+	if !u.root {
+		return rpctypes.ErrGRPCRootRoleNotExist
+	}
+	as.enabled = true
+	as.revision++
+	return nil
+}
+
+func (as *authStore) disable() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if !as.enabled {
+		return
+	}
+	as.enabled = false
+	as.revision++
+}
+
+// hashPassword returns the hash of the password, or the hashed one if it's
+// given. The hashing is expensive, so it's done before taking the lock.
+func (as *authStore) hashPassword(password, hashed string) ([]byte, error) {
+	if hashed != "" {
+		if _, err := bcrypt.Cost([]byte(hashed)); err != nil {
+			return nil, rpctypes.ErrGRPCInvalidAuthMgmt
+		}
+		return []byte(hashed), nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), as.bcryptCost)
+}
+
+func (as *authStore) addUser(name, password, hashed string, noPassword bool) error {
+	if name == "" {
+		return rpctypes.ErrGRPCUserEmpty
+	}
+	var hash []byte
+	if !noPassword {
+		var err error
+		if hash, err = as.hashPassword(password, hashed); err != nil {
+			return err
+		}
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.users[name]; ok {
+		return rpctypes.ErrGRPCUserAlreadyExist
+	}
+	as.users[name] = &authUser{password: hash}
+	as.revision++
+	return nil
+}
+
+func (as *authStore) deleteUser(name string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.enabled && name == RootRole {
+		return rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+	if _, ok := as.users[name]; !ok {
+		return rpctypes.ErrGRPCUserNotFound
+	}
+	delete(as.users, name)
+	as.tokens.invalidateUser(name)
+	as.revision++
+	return nil
+}
+
+func (as *authStore) changePassword(name, password, hashed string) error {
+	hash, err := as.hashPassword(password, hashed)
+	if err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	u, ok := as.users[name]
+	if !ok {
+		return rpctypes.ErrGRPCUserNotFound
+	}
+	// The password is replaced rather than modified, as authenticate
+	// compares it without the lock.
+	u.password = hash
+	as.tokens.invalidateUser(name)
+	as.revision++
+	return nil
+}
+
+func (as *authStore) grantRole(name, role string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	u, ok := as.users[name]
+	if !ok {
+		return rpctypes.ErrGRPCUserNotFound
+	}
+	if _, ok := as.roles[role]; !ok && role != RootRole {
+		return rpctypes.ErrGRPCRoleNotFound
+	}
+	if u.hasRole(role) {
+		return nil
+	}
+	u.grant(role)
+	u.mergePermissions(as.roles)
+	as.revision++
+	return nil
+}
+
+func (as *authStore) revokeRole(name, role string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.enabled && name == RootRole && role == RootRole {
+		return rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+	u, ok := as.users[name]
+	if !ok {
+		return rpctypes.ErrGRPCUserNotFound
+	}
+	if !u.revoke(role) {
+		return rpctypes.ErrGRPCRoleNotGranted
+	}
+	u.mergePermissions(as.roles)
+	as.revision++
+	return nil
+}
+
+// getUser returns the roles granted to the user.
+func (as *authStore) getUser(name string) ([]string, error) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	u, ok := as.users[name]
+	if !ok {
+		return nil, rpctypes.ErrGRPCUserNotFound
+	}
+	roles := make([]string, len(u.roles))
+	copy(roles, u.roles)
+	return roles, nil
+}
+
+// listUsers returns the sorted names of the users.
+func (as *authStore) listUsers() []string {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	names := make([]string, 0, len(as.users))
+	for name := range as.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addRole adds an empty role. Adding RootRole succeeds as it's built in, so
+// that `etcdctl auth enable` works, which adds it on ErrRootRoleNotExist.
+func (as *authStore) addRole(name string) error {
+	if name == "" {
+		return rpctypes.ErrGRPCRoleEmpty
+	}
+	if name == RootRole {
+		return nil
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.roles[name]; ok {
+		return rpctypes.ErrGRPCRoleAlreadyExist
+	}
+	as.roles[name] = &authRole{}
+	as.revision++
+	return nil
+}
+
+// deleteRole deletes the role and revokes it from the users.
+func (as *authStore) deleteRole(name string) error {
+	if name == RootRole {
+		return rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.roles[name]; !ok {
+		return rpctypes.ErrGRPCRoleNotFound
+	}
+	delete(as.roles, name)
+	for _, u := range as.users {
+		if u.revoke(name) {
+			u.mergePermissions(as.roles)
+		}
+	}
+	as.revision++
+	return nil
+}
+
+// getRole returns the permissions of the role, the root role doesn't have
+// any explicit permission.
+func (as *authStore) getRole(name string) ([]*authpb.Permission, error) {
+	if name == RootRole {
+		return nil, nil
+	}
+
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	role, ok := as.roles[name]
+	if !ok {
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+	perms := make([]*authpb.Permission, len(role.perms))
+	for i, perm := range role.perms {
+		perms[i] = &authpb.Permission{
+			PermType: perm.PermType,
+			Key:      perm.Key,
+			RangeEnd: perm.RangeEnd,
+		}
+	}
+	return perms, nil
+}
+
+// listRoles returns the sorted names of the roles, including RootRole.
+func (as *authStore) listRoles() []string {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	names := make([]string, 0, len(as.roles)+1)
+	names = append(names, RootRole)
+	for name := range as.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (as *authStore) grantPermission(name string, perm *authpb.Permission) error {
+	if perm == nil {
+		return rpctypes.ErrGRPCPermissionNotGiven
+	}
+	if name == RootRole || validatePermission(perm) != nil {
+		return rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	role, ok := as.roles[name]
+	if !ok {
+		return rpctypes.ErrGRPCRoleNotFound
+	}
+	role.grant(&authpb.Permission{
+		PermType: perm.PermType,
+		Key:      perm.Key,
+		RangeEnd: perm.RangeEnd,
+	})
+	as.refreshUsersLocked(name)
+	return nil
+}
+
+func (as *authStore) revokePermission(name string, key, end []byte) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	role, ok := as.roles[name]
+	if !ok {
+		return rpctypes.ErrGRPCRoleNotFound
+	}
+	if !role.revoke(key, end) {
+		return rpctypes.ErrGRPCPermissionNotGranted
+	}
+	as.refreshUsersLocked(name)
+	return nil
+}
+
+// refreshUsersLocked merges the permissions of the users with the changed
+// role again, and increases the auth revision.
+func (as *authStore) refreshUsersLocked(role string) {
+	for _, u := range as.users {
+		if u.hasRole(role) {
+			u.mergePermissions(as.roles)
+		}
+	}
+	as.revision++
+}
@@ -0,0 +1,315 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestAuthStoreEnable(t *testing.T) {
+	as, err := newAuthStore(nil, newFakeClock())
+	assert.Nil(t, err, "checking error")
+	assert.False(t, as.isEnabled(), "checking enabled")
+	_, err = as.authenticate("root", "bar")
+	assert.Equal(t, rpctypes.ErrGRPCAuthNotEnabled, err, "checking error")
+
+	// The root user with the root role must exist.
+	assert.Equal(t, rpctypes.ErrGRPCRootUserNotExist, as.enable(), "checking error")
+	assert.Nil(t, as.addUser("root", "bar", "", false), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRootRoleNotExist, as.enable(), "checking error")
+	assert.Nil(t, as.addRole(RootRole), "checking error")
+	assert.Nil(t, as.grantRole("root", RootRole), "checking error")
+	assert.Nil(t, as.enable(), "checking error")
+	assert.True(t, as.isEnabled(), "checking enabled")
+	assert.Nil(t, as.enable(), "checking error")
+	revision := as.status()
+
+	token, err := as.authenticate("root", "bar")
+	assert.Nil(t, err, "checking error")
+	user, err := as.user(token)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "root", user, "checking user")
+
+	// The root user cannot be removed while the authentication is enabled.
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.deleteUser("root"), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.revokeRole("root", RootRole), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.deleteRole(RootRole), "checking error")
+	assert.Equal(t, revision, as.status(), "checking auth revision")
+
+	as.disable()
+	assert.False(t, as.isEnabled(), "checking enabled")
+	assert.Equal(t, revision+1, as.status(), "checking auth revision")
+	_, err = as.user(token)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+}
+
+func TestAuthStoreUsers(t *testing.T) {
+	as, err := newAuthStore(&AuthOptions{
+		Users:      []User{newTestUser(t, "root", "bar", RootRole)},
+		Roles:      []Role{{Name: "viewer"}},
+		BcryptCost: 4,
+	}, newFakeClock())
+	assert.Nil(t, err, "checking error")
+
+	assert.Equal(t, rpctypes.ErrGRPCUserEmpty, as.addUser("", "bar", "", false), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCUserAlreadyExist, as.addUser("root", "bar", "", false), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.addUser("foo", "", "bar", false), "checking error")
+	assert.Nil(t, as.addUser("foo", "bar", "", false), "checking error")
+	assert.Nil(t, as.addUser("nopass", "", "", true), "checking error")
+	assert.Equal(t, []string{"foo", "nopass", "root"}, as.listUsers(), "checking users")
+	_, err = as.authenticate("nopass", "")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+
+	assert.Equal(t, rpctypes.ErrGRPCUserNotFound, as.grantRole("unknown", "viewer"), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRoleNotFound, as.grantRole("foo", "unknown"), "checking error")
+	assert.Nil(t, as.grantRole("foo", "viewer"), "checking error")
+	assert.Nil(t, as.grantRole("foo", "viewer"), "checking error")
+	assert.Nil(t, as.grantRole("foo", RootRole), "checking error")
+	roles, err := as.getUser("foo")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{RootRole, "viewer"}, roles, "checking roles")
+	assert.Nil(t, as.revokeRole("foo", RootRole), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRoleNotGranted, as.revokeRole("foo", RootRole), "checking error")
+	_, err = as.getUser("unknown")
+	assert.Equal(t, rpctypes.ErrGRPCUserNotFound, err, "checking error")
+
+	// The tokens of the user are revoked when the password is changed.
+	token, err := as.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	other, err := as.authenticate("root", "bar")
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, as.changePassword("foo", "baz", ""), "checking error")
+	_, err = as.user(token)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+	_, err = as.user(other)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+	_, err = as.authenticate("foo", "bar")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+	_, err = as.authenticate("foo", "baz")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCUserNotFound, as.changePassword("unknown", "baz", ""), "checking error")
+
+	assert.Nil(t, as.deleteUser("foo"), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCUserNotFound, as.deleteUser("foo"), "checking error")
+	_, err = as.authenticate("foo", "baz")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+	assert.Len(t, as.tokens.(*simpleTokenProvider).tokens, 1, "checking tokens")
+}
+
+func TestAuthStoreRoles(t *testing.T) {
+	as, err := newAuthStore(&AuthOptions{
+		Users: []User{newTestUser(t, "foo", "bar", "editor")},
+		Roles: []Role{{Name: "editor"}},
+	}, newFakeClock())
+	assert.Nil(t, err, "checking error")
+	ctx := context.WithValue(context.Background(), authUserKey{}, "foo")
+
+	assert.Equal(t, rpctypes.ErrGRPCRoleEmpty, as.addRole(""), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRoleAlreadyExist, as.addRole("editor"), "checking error")
+	assert.Nil(t, as.addRole("viewer"), "checking error")
+	assert.Equal(t, []string{"editor", RootRole, "viewer"}, as.listRoles(), "checking roles")
+
+	routes := &authpb.Permission{
+		PermType: authpb.READ,
+		Key:      []byte("/apisix/routes/"),
+		RangeEnd: []byte("/apisix/routes0"),
+	}
+	assert.Equal(t, rpctypes.ErrGRPCPermissionNotGiven, as.grantPermission("editor", nil), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRoleNotFound, as.grantPermission("unknown", routes), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.grantPermission(RootRole, routes), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthMgmt, as.grantPermission("editor", &authpb.Permission{
+		PermType: authpb.READ,
+		Key:      []byte("/b"),
+		RangeEnd: []byte("/a"),
+	}), "checking error")
+
+	// The permissions take effect immediately.
+	key := []byte("/apisix/routes/1")
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, as.checkPermission(ctx, key, nil, authpb.READ), "checking error")
+	assert.Nil(t, as.grantPermission("editor", routes), "checking error")
+	assert.Nil(t, as.checkPermission(ctx, key, nil, authpb.READ), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, as.checkPermission(ctx, key, nil, authpb.WRITE), "checking error")
+
+	// The type of the permission of the same range is updated.
+	assert.Nil(t, as.grantPermission("editor", &authpb.Permission{
+		PermType: authpb.READWRITE,
+		Key:      []byte("/apisix/routes/"),
+		RangeEnd: []byte("/apisix/routes0"),
+	}), "checking error")
+	assert.Nil(t, as.grantPermission("editor", &authpb.Permission{
+		PermType: authpb.READ,
+		Key:      []byte("/apisix/"),
+		RangeEnd: []byte("/apisix0"),
+	}), "checking error")
+	assert.Nil(t, as.checkPermission(ctx, key, nil, authpb.WRITE), "checking error")
+	perms, err := as.getRole("editor")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, perms, 2, "checking permissions")
+	assert.Equal(t, "/apisix/", string(perms[0].Key), "checking permission order")
+	assert.Equal(t, authpb.READWRITE, perms[1].PermType, "checking permission type")
+	perms, err = as.getRole(RootRole)
+	assert.Nil(t, err, "checking error")
+	assert.Empty(t, perms, "checking permissions")
+
+	assert.Equal(t, rpctypes.ErrGRPCPermissionNotGranted, as.revokePermission("editor", []byte("/foo"), nil), "checking error")
+	assert.Nil(t, as.revokePermission("editor", routes.Key, routes.RangeEnd), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, as.checkPermission(ctx, key, nil, authpb.WRITE), "checking error")
+	assert.Nil(t, as.checkPermission(ctx, key, nil, authpb.READ), "checking error")
+
+	// The deleted role is revoked from the users.
+	assert.Nil(t, as.deleteRole("editor"), "checking error")
+	assert.Equal(t, rpctypes.ErrGRPCRoleNotFound, as.deleteRole("editor"), "checking error")
+	_, err = as.getRole("editor")
+	assert.Equal(t, rpctypes.ErrGRPCRoleNotFound, err, "checking error")
+	roles, err := as.getUser("foo")
+	assert.Nil(t, err, "checking error")
+	assert.Empty(t, roles, "checking roles")
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, as.checkPermission(ctx, key, nil, authpb.READ), "checking error")
+}
+
+func TestAuthServerCheckAdmin(t *testing.T) {
+	as, err := newAuthStore(&AuthOptions{
+		Users: []User{
+			newTestUser(t, "root", "bar", RootRole),
+			newTestUser(t, "foo", "bar", "viewer"),
+		},
+		Roles: []Role{{Name: "viewer"}, {Name: "editor"}},
+	}, newFakeClock())
+	assert.Nil(t, err, "checking error")
+	s := &authServer{store: as}
+	ctx := func(user string) context.Context {
+		return context.WithValue(context.Background(), authUserKey{}, user)
+	}
+
+	_, err = s.UserList(ctx("foo"), nil)
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error")
+	_, err = s.UserList(ctx("root"), nil)
+	assert.Nil(t, err, "checking error")
+	_, err = s.AuthDisable(ctx("foo"), nil)
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error")
+
+	// A user can get itself and the roles granted to it.
+	_, err = s.UserGet(ctx("foo"), &etcdserverpb.AuthUserGetRequest{Name: "foo"})
+	assert.Nil(t, err, "checking error")
+	_, err = s.UserGet(ctx("foo"), &etcdserverpb.AuthUserGetRequest{Name: "root"})
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error")
+	_, err = s.RoleGet(ctx("foo"), &etcdserverpb.AuthRoleGetRequest{Role: "viewer"})
+	assert.Nil(t, err, "checking error")
+	_, err = s.RoleGet(ctx("foo"), &etcdserverpb.AuthRoleGetRequest{Role: "editor"})
+	assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error")
+
+	// Anyone can manage the authentication while it's disabled.
+	_, err = s.AuthDisable(ctx("root"), nil)
+	assert.Nil(t, err, "checking error")
+	_, err = s.UserList(ctx("foo"), nil)
+	assert.Nil(t, err, "checking error")
+}
+
+func TestEtcdAdapterAuthManagement(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{})
+	defer shutdown()
+
+	// Enable the authentication like `etcdctl auth enable`.
+	_, err := client.UserAdd(context.Background(), "root", "bar")
+	assert.Nil(t, err, "checking error")
+	_, err = client.AuthEnable(context.Background())
+	assert.Equal(t, rpctypes.ErrRootRoleNotExist, err, "checking error")
+	_, err = client.RoleAdd(context.Background(), RootRole)
+	assert.Nil(t, err, "checking error")
+	_, err = client.UserGrantRole(context.Background(), "root", RootRole)
+	assert.Nil(t, err, "checking error")
+	_, err = client.AuthEnable(context.Background())
+	assert.Nil(t, err, "checking error")
+	_, err = client.Get(context.Background(), "/x")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+	_, err = client.UserList(context.Background())
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+
+	root, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+		Username:  "root",
+		Password:  "bar",
+	})
+	assert.Nil(t, err, "checking error")
+	defer root.Close()
+	_, err = root.RoleAdd(context.Background(), "editor")
+	assert.Nil(t, err, "checking error")
+	_, err = root.RoleGrantPermission(context.Background(), "editor", "/apisix/", "/apisix0", clientv3.PermissionType(clientv3.PermReadWrite))
+	assert.Nil(t, err, "checking error")
+	_, err = root.UserAdd(context.Background(), "foo", "bar")
+	assert.Nil(t, err, "checking error")
+	_, err = root.UserGrantRole(context.Background(), "foo", "editor")
+	assert.Nil(t, err, "checking error")
+	users, err := root.UserList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"foo", "root"}, users.Users, "checking users")
+	roles, err := root.RoleList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"editor", RootRole}, roles.Roles, "checking roles")
+
+	foo, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+		Username:  "foo",
+		Password:  "bar",
+	})
+	assert.Nil(t, err, "checking error")
+	defer foo.Close()
+	_, err = foo.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = foo.Put(context.Background(), "/x", "v1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = foo.UserList(context.Background())
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	user, err := foo.UserGet(context.Background(), "foo")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"editor"}, user.Roles, "checking roles")
+
+	// The permissions are revoked immediately.
+	_, err = root.RoleRevokePermission(context.Background(), "editor", "/apisix/", "/apisix0")
+	assert.Nil(t, err, "checking error")
+	_, err = foo.Get(context.Background(), "/apisix/routes/1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+
+	// The old password is rejected once it's changed.
+	_, err = root.UserChangePassword(context.Background(), "foo", "baz")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Authenticate(context.Background(), "foo", "bar")
+	assert.Equal(t, rpctypes.ErrAuthFailed, err, "checking error")
+	_, err = client.Authenticate(context.Background(), "foo", "baz")
+	assert.Nil(t, err, "checking error")
+
+	_, err = root.UserDelete(context.Background(), "root")
+	assert.Equal(t, rpctypes.ErrInvalidAuthMgmt, err, "checking error")
+	_, err = root.UserDelete(context.Background(), "foo")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Authenticate(context.Background(), "foo", "baz")
+	assert.Equal(t, rpctypes.ErrAuthFailed, err, "checking error")
+
+	_, err = root.AuthDisable(context.Background())
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/x", "v1")
+	assert.Nil(t, err, "checking error")
+	authStatus, err := client.AuthStatus(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.False(t, authStatus.Enabled, "checking auth status")
+}
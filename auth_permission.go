@@ -0,0 +1,322 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// RootRole is the built-in role which is permitted to access all the keys,
+// like the root role of ETCD.
+const RootRole = "root"
+
+// Role is a set of permissions which can be granted to the users.
+type Role struct {
+	Name        string
+	Permissions []Permission
+}
+
+// Permission permits the access to a range of keys.
+type Permission struct {
+	// Type is one of authpb.READ, authpb.WRITE and authpb.READWRITE.
+	Type authpb.Permission_Type
+	// Key and RangeEnd are interpreted in the same way as the RangeRequest,
+	// an empty RangeEnd means only the key, and a RangeEnd of "\x00" means
+	// all the keys which are greater than or equal to the key.
+	Key      string
+	RangeEnd string
+	// Prefix means all the keys with the prefix Key, and RangeEnd must be
+	// empty. An empty Key with Prefix means all the keys.
+	Prefix bool
+}
+
+// toProto converts the permission to the one of ETCD, the prefix is turned
+// into the range end.
+func (p *Permission) toProto() (*authpb.Permission, error) {
+	perm := &authpb.Permission{
+		PermType: p.Type,
+		Key:      []byte(p.Key),
+		RangeEnd: []byte(p.RangeEnd),
+	}
+	if p.Prefix {
+		if p.RangeEnd != "" {
+			return nil, fmt.Errorf("range end of the prefix %q is not empty", p.Key)
+		}
+		perm.RangeEnd = prefixEnd(perm.Key)
+		if perm.RangeEnd == nil {
+			perm.RangeEnd = []byte{0}
+		}
+	}
+	if err := validatePermission(perm); err != nil {
+		return nil, err
+	}
+	return perm, nil
+}
+
+// validatePermission checks the type and the range of the permission.
+func validatePermission(perm *authpb.Permission) error {
+	switch perm.PermType {
+	case authpb.READ, authpb.WRITE, authpb.READWRITE:
+	default:
+		return fmt.Errorf("invalid permission type %d", perm.PermType)
+	}
+	if len(perm.Key) == 0 && len(perm.RangeEnd) == 0 {
+		return fmt.Errorf("key is empty")
+	}
+	r := newKeyRange(perm.Key, perm.RangeEnd)
+	if r.end != nil && bytes.Compare(r.start, r.end) >= 0 {
+		return fmt.Errorf("range end %q is not greater than the key %q", perm.RangeEnd, perm.Key)
+	}
+	return nil
+}
+
+// prefixEnd returns the end of the range of the keys with the prefix, it's
+// nil if there is no upper bound.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// rangePerms are the sorted and disjoint ranges of keys that a user is
+// permitted to access.
+type rangePerms []keyRange
+
+// mergeRanges sorts the ranges and merges the overlapping and adjacent ones.
+func mergeRanges(ranges []keyRange) rangePerms {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := make([]keyRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].start, sorted[j].start) < 0
+	})
+	merged := rangePerms{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if last.end != nil && bytes.Compare(r.start, last.end) > 0 {
+			merged = append(merged, r)
+			continue
+		}
+		if last.end != nil && (r.end == nil || bytes.Compare(r.end, last.end) > 0) {
+			last.end = r.end
+		}
+	}
+	return merged
+}
+
+// contains checks whether the whole range is permitted. Like ETCD, a range
+// which partially exceeds the permitted ones is not permitted.
+func (p rangePerms) contains(r keyRange) bool {
+	// The last range starting at or before the start of r is the only
+	// candidate, as the ranges are disjoint.
+	i := sort.Search(len(p), func(i int) bool {
+		return bytes.Compare(p[i].start, r.start) > 0
+	}) - 1
+	if i < 0 {
+		return false
+	}
+	if p[i].end == nil {
+		return true
+	}
+	return r.end != nil && bytes.Compare(r.end, p[i].end) <= 0
+}
+
+// authRole is a role, the permissions are sorted by the keys and the range
+// ends, like ETCD.
+type authRole struct {
+	perms []*authpb.Permission
+}
+
+func newAuthRoles(roles []Role) (map[string]*authRole, error) {
+	authRoles := make(map[string]*authRole, len(roles))
+	for _, role := range roles {
+		if role.Name == "" {
+			return nil, fmt.Errorf("role name is empty")
+		}
+		if role.Name == RootRole {
+			return nil, fmt.Errorf("role %q is built in", RootRole)
+		}
+		if _, ok := authRoles[role.Name]; ok {
+			return nil, fmt.Errorf("duplicate role %q", role.Name)
+		}
+		ar := &authRole{}
+		for i := range role.Permissions {
+			perm, err := role.Permissions[i].toProto()
+			if err != nil {
+				return nil, fmt.Errorf("invalid permission of role %q: %s", role.Name, err)
+			}
+			ar.grant(perm)
+		}
+		authRoles[role.Name] = ar
+	}
+	return authRoles, nil
+}
+
+// find returns the index of the permission of the range, or the index to
+// insert it.
+func (r *authRole) find(key, end []byte) (int, bool) {
+	i := sort.Search(len(r.perms), func(i int) bool {
+		if c := bytes.Compare(r.perms[i].Key, key); c != 0 {
+			return c > 0
+		}
+		return bytes.Compare(r.perms[i].RangeEnd, end) >= 0
+	})
+	return i, i < len(r.perms) && bytes.Equal(r.perms[i].Key, key) && bytes.Equal(r.perms[i].RangeEnd, end)
+}
+
+// grant adds the permission, or updates the type of the one of the same
+// range.
+func (r *authRole) grant(perm *authpb.Permission) {
+	i, ok := r.find(perm.Key, perm.RangeEnd)
+	if ok {
+		r.perms[i].PermType = perm.PermType
+		return
+	}
+	r.perms = append(r.perms, nil)
+	copy(r.perms[i+1:], r.perms[i:])
+	r.perms[i] = perm
+}
+
+// revoke removes the permission of the range, it returns false if there is
+// no such permission.
+func (r *authRole) revoke(key, end []byte) bool {
+	i, ok := r.find(key, end)
+	if !ok {
+		return false
+	}
+	r.perms = append(r.perms[:i], r.perms[i+1:]...)
+	return true
+}
+
+// authUser is a user, the permissions are merged from the roles.
+type authUser struct {
+	password []byte
+	// roles are sorted.
+	roles []string
+	root  bool
+	read  rangePerms
+	write rangePerms
+}
+
+func newAuthUser(password []byte, roleNames []string, roles map[string]*authRole) (*authUser, error) {
+	u := &authUser{
+		password: password,
+	}
+	for _, name := range roleNames {
+		if _, ok := roles[name]; !ok && name != RootRole {
+			return nil, fmt.Errorf("role %q not found", name)
+		}
+		if !u.hasRole(name) {
+			u.grant(name)
+		}
+	}
+	u.mergePermissions(roles)
+	return u, nil
+}
+
+// grant adds the role to the sorted roles of the user, the permissions need
+// to be merged again.
+func (u *authUser) grant(role string) {
+	i := sort.SearchStrings(u.roles, role)
+	u.roles = append(u.roles, "")
+	copy(u.roles[i+1:], u.roles[i:])
+	u.roles[i] = role
+}
+
+// revoke removes the role from the user, it returns false if the role is
+// not granted.
+func (u *authUser) revoke(role string) bool {
+	i := sort.SearchStrings(u.roles, role)
+	if i == len(u.roles) || u.roles[i] != role {
+		return false
+	}
+	u.roles = append(u.roles[:i], u.roles[i+1:]...)
+	return true
+}
+
+// hasRole checks whether the role is granted to the user.
+func (u *authUser) hasRole(role string) bool {
+	i := sort.SearchStrings(u.roles, role)
+	return i < len(u.roles) && u.roles[i] == role
+}
+
+// mergePermissions merges the permissions of the roles granted to the user,
+// the roles must exist.
+func (u *authUser) mergePermissions(roles map[string]*authRole) {
+	u.root = false
+	var read, write []keyRange
+	for _, name := range u.roles {
+		if name == RootRole {
+			u.root = true
+			continue
+		}
+		for _, perm := range roles[name].perms {
+			r := newKeyRange(perm.Key, perm.RangeEnd)
+			if perm.PermType == authpb.READ || perm.PermType == authpb.READWRITE {
+				read = append(read, r)
+			}
+			if perm.PermType == authpb.WRITE || perm.PermType == authpb.READWRITE {
+				write = append(write, r)
+			}
+		}
+	}
+	u.read = mergeRanges(read)
+	u.write = mergeRanges(write)
+}
+
+// checkPermission checks whether the user of the request is permitted to
+// access the range, the range is interpreted in the same way as the
+// RangeRequest, and typ is either authpb.READ or authpb.WRITE. It's always
+// permitted if the authentication is disabled.
+func (as *authStore) checkPermission(ctx context.Context, key, end []byte, typ authpb.Permission_Type) error {
+	if as == nil {
+		return nil
+	}
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	if !as.enabled {
+		return nil
+	}
+	u, ok := as.users[authUserFromContext(ctx)]
+	if !ok {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	if u.root {
+		return nil
+	}
+	perms := u.read
+	if typ == authpb.WRITE {
+		perms = u.write
+	}
+	if !perms.contains(newKeyRange(key, end)) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
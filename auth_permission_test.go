@@ -0,0 +1,340 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestRangePermsContains(t *testing.T) {
+	perms := mergeRanges([]keyRange{
+		newKeyRange([]byte("/apisix/routes/"), prefixEnd([]byte("/apisix/routes/"))),
+		newKeyRange([]byte("/apisix/services/1"), nil),
+		// Adjacent to the previous one.
+		newKeyRange([]byte("/apisix/services/1\x00"), []byte("/apisix/services/3")),
+		newKeyRange([]byte("/apisix/upstreams/"), []byte("\x00")),
+	})
+	assert.Len(t, perms, 3, "checking merged ranges")
+
+	cases := []struct {
+		key       string
+		end       string
+		contained bool
+	}{
+		{key: "/apisix/routes/1", contained: true},
+		{key: "/apisix/routes/", end: "/apisix/routes0", contained: true},
+		{key: "/apisix/routes/1", end: "/apisix/routes/2", contained: true},
+		{key: "/apisix/routes", end: "/apisix/routes0"},
+		{key: "/apisix/routes/1", end: "/apisix/services/"},
+		{key: "/apisix/routes/1", end: "\x00"},
+		{key: "/apisix/"},
+		{key: "/apisix/services/1", end: "/apisix/services/3", contained: true},
+		{key: "/apisix/services/2", contained: true},
+		{key: "/apisix/services/3"},
+		{key: "/apisix/services/1", end: "/apisix/services/4"},
+		{key: "/apisix/upstreams/", end: "\x00", contained: true},
+		{key: "/apisix/upstreams/1", end: "/apisix/zzz", contained: true},
+		{key: "/apisix/", end: "\x00"},
+	}
+	for _, c := range cases {
+		var end []byte
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		assert.Equal(t, c.contained, perms.contains(newKeyRange([]byte(c.key), end)),
+			"checking range [%q, %q)", c.key, c.end)
+	}
+}
+
+func TestNewAuthRoles(t *testing.T) {
+	cases := []struct {
+		name  string
+		roles []Role
+	}{
+		{
+			name:  "empty name",
+			roles: []Role{{}},
+		},
+		{
+			name:  "root role",
+			roles: []Role{{Name: RootRole}},
+		},
+		{
+			name:  "duplicate role",
+			roles: []Role{{Name: "foo"}, {Name: "foo"}},
+		},
+		{
+			name: "empty key",
+			roles: []Role{
+				{
+					Name:        "foo",
+					Permissions: []Permission{{Type: authpb.READ}},
+				},
+			},
+		},
+		{
+			name: "range end of prefix",
+			roles: []Role{
+				{
+					Name: "foo",
+					Permissions: []Permission{
+						{
+							Type:     authpb.READ,
+							Key:      "/apisix/",
+							RangeEnd: "/apisix0",
+							Prefix:   true,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid range",
+			roles: []Role{
+				{
+					Name: "foo",
+					Permissions: []Permission{
+						{
+							Type:     authpb.READ,
+							Key:      "/b",
+							RangeEnd: "/a",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid type",
+			roles: []Role{
+				{
+					Name: "foo",
+					Permissions: []Permission{
+						{
+							Type: authpb.Permission_Type(3),
+							Key:  "/a",
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		_, err := newAuthRoles(c.roles)
+		assert.NotNil(t, err, "checking error of %s", c.name)
+	}
+
+	_, err := newAuthStore(&AuthOptions{
+		Users: []User{newTestUser(t, "foo", "bar", "unknown")},
+	}, newFakeClock())
+	assert.NotNil(t, err, "checking error of unknown role")
+}
+
+func TestAuthStoreCheckPermission(t *testing.T) {
+	as, err := newAuthStore(&AuthOptions{
+		Users: []User{
+			newTestUser(t, "root", "bar", RootRole),
+			newTestUser(t, "dashboard", "bar", "viewer", "route-editor"),
+			newTestUser(t, "nobody", "bar"),
+		},
+		Roles: []Role{
+			{
+				Name: "viewer",
+				Permissions: []Permission{
+					{
+						Type:   authpb.READ,
+						Key:    "/apisix/",
+						Prefix: true,
+					},
+				},
+			},
+			{
+				Name: "route-editor",
+				Permissions: []Permission{
+					{
+						Type:   authpb.READWRITE,
+						Key:    "/apisix/routes/",
+						Prefix: true,
+					},
+				},
+			},
+		},
+	}, newFakeClock())
+	assert.Nil(t, err, "checking error")
+
+	ctx := func(user string) context.Context {
+		return context.WithValue(context.Background(), authUserKey{}, user)
+	}
+	cases := []struct {
+		user    string
+		key     string
+		typ     authpb.Permission_Type
+		allowed bool
+	}{
+		{user: "root", key: "/foo", typ: authpb.WRITE, allowed: true},
+		{user: "dashboard", key: "/apisix/services/1", typ: authpb.READ, allowed: true},
+		{user: "dashboard", key: "/apisix/services/1", typ: authpb.WRITE},
+		{user: "dashboard", key: "/apisix/routes/1", typ: authpb.WRITE, allowed: true},
+		{user: "dashboard", key: "/foo", typ: authpb.READ},
+		{user: "nobody", key: "/apisix/routes/1", typ: authpb.READ},
+		{user: "unknown", key: "/apisix/routes/1", typ: authpb.READ},
+	}
+	for _, c := range cases {
+		err := as.checkPermission(ctx(c.user), []byte(c.key), nil, c.typ)
+		if c.allowed {
+			assert.Nil(t, err, "checking error of %s on %s", c.user, c.key)
+		} else {
+			assert.Equal(t, rpctypes.ErrGRPCPermissionDenied, err, "checking error of %s on %s", c.user, c.key)
+		}
+	}
+
+	// Everything is permitted if the authentication is disabled.
+	var disabled *authStore
+	assert.Nil(t, disabled.checkPermission(context.Background(), []byte("/foo"), nil, authpb.WRITE), "checking error")
+}
+
+func TestEtcdAdapterAuthPermissions(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{
+				newTestUser(t, "admin", "pw", RootRole),
+				newTestUser(t, "dashboard", "pw", "viewer"),
+				newTestUser(t, "partner", "pw", "routes"),
+			},
+			Roles: []Role{
+				{
+					Name: "viewer",
+					Permissions: []Permission{
+						{
+							Type:   authpb.READ,
+							Key:    "/apisix/",
+							Prefix: true,
+						},
+					},
+				},
+				{
+					Name: "routes",
+					Permissions: []Permission{
+						{
+							Type:   authpb.READ,
+							Key:    "/apisix/routes/",
+							Prefix: true,
+						},
+						{
+							Type:     authpb.READWRITE,
+							Key:      "/apisix/routes/own/1",
+							RangeEnd: "/apisix/routes/own/9",
+						},
+					},
+				},
+			},
+		},
+	})
+	defer shutdown()
+
+	newClient := func(user string) *clientv3.Client {
+		authClient, err := clientv3.New(clientv3.Config{
+			Endpoints: client.Endpoints(),
+			Username:  user,
+			Password:  "pw",
+		})
+		assert.Nil(t, err, "checking error")
+		return authClient
+	}
+	admin := newClient("admin")
+	defer admin.Close()
+	dashboard := newClient("dashboard")
+	defer dashboard.Close()
+	partner := newClient("partner")
+	defer partner.Close()
+
+	ctx := context.Background()
+	// The root role bypasses the checks.
+	for _, key := range []string{"/apisix/routes/1", "/apisix/services/1", "/foo"} {
+		_, err := admin.Put(ctx, key, "v1")
+		assert.Nil(t, err, "checking error")
+	}
+
+	resp, err := dashboard.Get(ctx, "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking key-values")
+	_, err = dashboard.Get(ctx, "/foo")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = dashboard.Put(ctx, "/apisix/routes/1", "v2")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = dashboard.Delete(ctx, "/apisix/routes/1")
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+
+	resp, err = partner.Get(ctx, "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	// The range partially exceeds the granted one, it's denied even though
+	// the keys out of the granted range would be filtered out.
+	_, err = partner.Get(ctx, "/apisix/", clientv3.WithPrefix())
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Get(ctx, "/apisix/routes/1", clientv3.WithRange("/apisix/services/"))
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Get(ctx, "/apisix/routes/1", clientv3.WithFromKey())
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Put(ctx, "/apisix/routes/own/2", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = partner.Delete(ctx, "/apisix/routes/own/", clientv3.WithPrefix())
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Delete(ctx, "/apisix/routes/own/1", clientv3.WithRange("/apisix/routes/own/9"))
+	assert.Nil(t, err, "checking error")
+
+	// The compares count as reads, and both branches are checked.
+	_, err = partner.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version("/apisix/services/1"), ">", 0)).
+		Then(clientv3.OpGet("/apisix/routes/1")).
+		Commit()
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version("/apisix/routes/1"), ">", 0)).
+		Then(clientv3.OpGet("/apisix/routes/1")).
+		Else(clientv3.OpPut("/apisix/routes/1", "v2")).
+		Commit()
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	_, err = partner.Txn(ctx).
+		Then(clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpDelete("/apisix/routes/1")}, nil)).
+		Commit()
+	assert.Equal(t, rpctypes.ErrPermissionDenied, err, "checking error")
+	txnResp, err := partner.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version("/apisix/routes/1"), ">", 0)).
+		Then(clientv3.OpGet("/apisix/routes/1")).
+		Else(clientv3.OpPut("/apisix/routes/own/3", "v1")).
+		Commit()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, txnResp.Succeeded, "checking txn result")
+
+	// The permission is checked when the watcher is created.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wresp := <-partner.Watch(wctx, "/apisix/", clientv3.WithPrefix())
+	assert.True(t, wresp.Canceled, "checking canceled")
+	assert.Contains(t, wresp.Err().Error(), "permission denied", "checking error")
+	wch := partner.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix())
+	_, err = admin.Put(ctx, "/apisix/routes/2", "v1")
+	assert.Nil(t, err, "checking error")
+	wresp = <-wch
+	assert.Nil(t, wresp.Err(), "checking error")
+	assert.Len(t, wresp.Events, 1, "checking events")
+}
@@ -0,0 +1,250 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// newTestUser returns the user with the password hashed at the min cost.
+func newTestUser(t testing.TB, name, password string, roles ...string) User {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.Nil(t, err, "checking error")
+	return User{
+		Name:     name,
+		Password: string(hashed),
+		Roles:    roles,
+	}
+}
+
+func TestNewAuthStore(t *testing.T) {
+	cases := []struct {
+		name  string
+		users []User
+	}{
+		{
+			name:  "empty name",
+			users: []User{newTestUser(t, "", "bar")},
+		},
+		{
+			name:  "duplicate user",
+			users: []User{newTestUser(t, "foo", "bar"), newTestUser(t, "foo", "baz")},
+		},
+		{
+			name: "plain password",
+			users: []User{
+				{
+					Name:     "foo",
+					Password: "bar",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		_, err := newAuthStore(&AuthOptions{Users: c.users}, newFakeClock())
+		assert.NotNil(t, err, "checking error of %s", c.name)
+	}
+}
+
+func TestAuthStoreTokens(t *testing.T) {
+	clock := newFakeClock()
+	as, err := newAuthStore(&AuthOptions{
+		Users:    []User{newTestUser(t, "foo", "bar")},
+		TokenTTL: time.Minute,
+	}, clock)
+	assert.Nil(t, err, "checking error")
+
+	_, err = as.authenticate("foo", "baz")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+	_, err = as.authenticate("bar", "bar")
+	assert.Equal(t, rpctypes.ErrGRPCAuthFailed, err, "checking error")
+	token, err := as.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	assert.True(t, strings.HasSuffix(token, ".1"), "checking auth revision of the token")
+	assert.Len(t, token, simpleTokenLength+2, "checking token length")
+
+	// The TTL is refreshed when the token is used.
+	clock.Advance(30 * time.Second)
+	user, err := as.user(token)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "foo", user, "checking user")
+	clock.Advance(59 * time.Second)
+	_, err = as.user(token)
+	assert.Nil(t, err, "checking error")
+	clock.Advance(time.Minute)
+	_, err = as.user(token)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+	_, err = as.user("unknown.1")
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+
+	// The expired tokens are dropped.
+	_, err = as.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	clock.Advance(time.Minute)
+	_, err = as.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, as.tokens.(*simpleTokenProvider).tokens, 1, "checking tokens")
+}
+
+func TestAuthUnaryInterceptor(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{newTestUser(t, "foo", "bar")},
+		},
+	}).(*adapter)
+	token, err := a.auth.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+
+	var user string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		user = authUserFromContext(ctx)
+		return nil, nil
+	}
+	kv := &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.KV/Range"}
+	cases := []struct {
+		name string
+		md   metadata.MD
+		info *grpc.UnaryServerInfo
+		user string
+		err  error
+	}{
+		{
+			name: "no token",
+			info: kv,
+			err:  rpctypes.ErrGRPCUserEmpty,
+		},
+		{
+			name: "invalid token",
+			md:   metadata.Pairs(rpctypes.TokenFieldNameGRPC, "invalid.1"),
+			info: kv,
+			err:  rpctypes.ErrGRPCInvalidAuthToken,
+		},
+		{
+			name: "token",
+			md:   metadata.Pairs(rpctypes.TokenFieldNameGRPC, token),
+			info: kv,
+			user: "foo",
+		},
+		{
+			name: "gateway token",
+			md:   metadata.Pairs(rpctypes.TokenFieldNameSwagger, token),
+			info: &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.Lease/LeaseGrant"},
+			user: "foo",
+		},
+		{
+			name: "no auth required",
+			info: &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.Auth/Authenticate"},
+		},
+	}
+	for _, c := range cases {
+		user = ""
+		ctx := context.Background()
+		if c.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, c.md)
+		}
+		_, err := a.authUnaryInterceptor(ctx, nil, c.info, handler)
+		assert.Equal(t, c.err, err, "checking error of %s", c.name)
+		assert.Equal(t, c.user, user, "checking user of %s", c.name)
+	}
+}
+
+func TestEtcdAdapterAuth(t *testing.T) {
+	clock := newFakeClock()
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+		Auth: &AuthOptions{
+			Users:    []User{newTestUser(t, "foo", "bar", RootRole)},
+			TokenTTL: time.Second,
+		},
+	})
+	defer shutdown()
+
+	// The requests without the credentials are rejected.
+	_, err := client.Get(context.Background(), "/x")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+	_, err = client.Put(context.Background(), "/x", "v1")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+	_, err = client.Grant(context.Background(), 60)
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+	wresp := <-client.Watch(context.Background(), "/x")
+	assert.Equal(t, rpctypes.ErrUserEmpty, wresp.Err(), "checking error")
+	authStatus, err := client.AuthStatus(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.True(t, authStatus.Enabled, "checking auth status")
+
+	_, err = clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+		Username:  "foo",
+		Password:  "baz",
+	})
+	assert.Equal(t, rpctypes.ErrAuthFailed, err, "checking error")
+
+	authClient, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+		Username:  "foo",
+		Password:  "bar",
+	})
+	assert.Nil(t, err, "checking error")
+	defer authClient.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := authClient.Watch(ctx, "/x")
+	_, err = authClient.Put(context.Background(), "/x", "v1")
+	assert.Nil(t, err, "checking error")
+	wresp = <-wch
+	assert.Nil(t, wresp.Err(), "checking error")
+	assert.Len(t, wresp.Events, 1, "checking events")
+	resp, err := authClient.Get(context.Background(), "/x")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+
+	// The client authenticates again after the token expires.
+	clock.Advance(1500 * time.Millisecond)
+	resp, err = authClient.Get(context.Background(), "/x")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v1", string(resp.Kvs[0].Value), "checking value")
+}
+
+func TestEtcdAdapterAuthNotEnabled(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Authenticate(context.Background(), "foo", "bar")
+	assert.Equal(t, rpctypes.ErrAuthNotEnabled, err, "checking error")
+	// The credentials are ignored like ETCD.
+	authClient, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+		Username:  "foo",
+		Password:  "bar",
+	})
+	assert.Nil(t, err, "checking error")
+	defer authClient.Close()
+	_, err = authClient.Get(context.Background(), "/x")
+	assert.Nil(t, err, "checking error")
+	authStatus, err := client.AuthStatus(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.False(t, authStatus.Enabled, "checking auth status")
+}
@@ -0,0 +1,316 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// DefaultJWTSignMethod is the default signing method of the JWTs.
+const DefaultJWTSignMethod = "RS256"
+
+// simpleTokenLength is the length of the random part of a simple token, it's
+// same as ETCD.
+const simpleTokenLength = 16
+
+// JWTOptions contains the settings of the JWTs, like the `--auth-token jwt`
+// of ETCD. The JWTs are verified without any state, so the tokens issued by
+// an adapter are accepted by the others configured with the same keys.
+type JWTOptions struct {
+	// SignMethod is the signing method, the HMAC (HS256, HS384, HS512), the
+	// RSA (RS256, RS384, RS512, PS256, PS384, PS512) and the ECDSA (ES256,
+	// ES384, ES512) ones are supported. Default is DefaultJWTSignMethod.
+	SignMethod string
+	// PrivateKeyFile is the PEM file of the private key to sign the tokens,
+	// or the file of the secret for the HMAC methods. If it's empty, the
+	// tokens are only verified by the PublicKeyFile, and the Authenticate
+	// RPC fails.
+	PrivateKeyFile string
+	// PublicKeyFile is the PEM file of the public key (or the certificate)
+	// to verify the tokens, it's derived from the private key if empty. It's
+	// not used by the HMAC methods.
+	PublicKeyFile string
+	// ClockSkew is the tolerance of the expiry check, for the clock skew
+	// between the adapters.
+	ClockSkew time.Duration
+}
+
+// tokenProvider issues the tokens and resolves them.
+type tokenProvider interface {
+	// assign issues a token to the user at the auth revision.
+	assign(user string, revision uint64) (string, error)
+	// info returns the user and the auth revision of the token, the error
+	// is ErrGRPCInvalidAuthToken if it's invalid or expired.
+	info(token string) (string, uint64, error)
+	// invalidateUser revokes the tokens of the user, e.g. when the password
+	// is changed.
+	invalidateUser(user string)
+}
+
+// simpleTokenProvider issues the random tokens and keeps them in the memory,
+// the TTL of a token is refreshed when it's used.
+type simpleTokenProvider struct {
+	clock Clock
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*simpleToken
+}
+
+// simpleToken is a simple token issued to the user.
+type simpleToken struct {
+	user     string
+	revision uint64
+	expiry   time.Time
+}
+
+func newSimpleTokenProvider(ttl time.Duration, clock Clock) *simpleTokenProvider {
+	return &simpleTokenProvider{
+		clock:  clock,
+		ttl:    ttl,
+		tokens: make(map[string]*simpleToken),
+	}
+}
+
+func (tp *simpleTokenProvider) assign(user string, revision uint64) (string, error) {
+	random, err := randomString(simpleTokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	now := tp.clock.Now()
+	for token, t := range tp.tokens {
+		if !now.Before(t.expiry) {
+			delete(tp.tokens, token)
+		}
+	}
+	// Like the simple tokens of ETCD, the auth revision is attached.
+	token := random + "." + strconv.FormatUint(revision, 10)
+	tp.tokens[token] = &simpleToken{
+		user:     user,
+		revision: revision,
+		expiry:   now.Add(tp.ttl),
+	}
+	return token, nil
+}
+
+func (tp *simpleTokenProvider) info(token string) (string, uint64, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	t, ok := tp.tokens[token]
+	if !ok {
+		return "", 0, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	now := tp.clock.Now()
+	if !now.Before(t.expiry) {
+		delete(tp.tokens, token)
+		return "", 0, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	t.expiry = now.Add(tp.ttl)
+	return t.user, t.revision, nil
+}
+
+func (tp *simpleTokenProvider) invalidateUser(user string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	for token, t := range tp.tokens {
+		if t.user == user {
+			delete(tp.tokens, token)
+		}
+	}
+}
+
+const tokenLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(tokenLetters)))
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = tokenLetters[j.Int64()]
+	}
+	return string(b), nil
+}
+
+// jwtTokenProvider issues the signed JWTs, which carry the user, the auth
+// revision and the expiry, so they're verified without any state.
+type jwtTokenProvider struct {
+	clock     Clock
+	ttl       time.Duration
+	skew      time.Duration
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// jwtClaims are the claims of the JWTs, they're same as ETCD.
+type jwtClaims struct {
+	Username string `json:"username"`
+	Revision uint64 `json:"revision"`
+	Expiry   int64  `json:"exp"`
+}
+
+// Valid implements jwt.Claims, the expiry is checked by the token provider
+// with its clock and the clock skew.
+func (c *jwtClaims) Valid() error {
+	return nil
+}
+
+func newJWTTokenProvider(opts *JWTOptions, ttl time.Duration, clock Clock) (*jwtTokenProvider, error) {
+	name := opts.SignMethod
+	if name == "" {
+		name = DefaultJWTSignMethod
+	}
+	method := jwt.GetSigningMethod(name)
+	var parsePrivateKey func([]byte) (crypto.Signer, error)
+	var parsePublicKey func([]byte) (crypto.PublicKey, error)
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		parsePrivateKey = func(data []byte) (crypto.Signer, error) {
+			return jwt.ParseRSAPrivateKeyFromPEM(data)
+		}
+		parsePublicKey = func(data []byte) (crypto.PublicKey, error) {
+			return jwt.ParseRSAPublicKeyFromPEM(data)
+		}
+	case *jwt.SigningMethodECDSA:
+		parsePrivateKey = func(data []byte) (crypto.Signer, error) {
+			return jwt.ParseECPrivateKeyFromPEM(data)
+		}
+		parsePublicKey = func(data []byte) (crypto.PublicKey, error) {
+			return jwt.ParseECPublicKeyFromPEM(data)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing method %q", name)
+	}
+	tp := &jwtTokenProvider{
+		clock:  clock,
+		ttl:    ttl,
+		skew:   opts.ClockSkew,
+		method: method,
+	}
+
+	if parsePrivateKey == nil {
+		if opts.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("private key file is required by %s", name)
+		}
+		secret, err := ioutil.ReadFile(opts.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("secret in %s is empty", opts.PrivateKeyFile)
+		}
+		tp.signKey, tp.verifyKey = secret, secret
+		return tp, nil
+	}
+	if opts.PrivateKeyFile != "" {
+		data, err := ioutil.ReadFile(opts.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %s", opts.PrivateKeyFile, err)
+		}
+		tp.signKey, tp.verifyKey = key, key.Public()
+	}
+	if opts.PublicKeyFile != "" {
+		data, err := ioutil.ReadFile(opts.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %s", opts.PublicKeyFile, err)
+		}
+		tp.verifyKey = key
+	}
+	if tp.verifyKey == nil {
+		return nil, fmt.Errorf("either private key file or public key file is required by %s", name)
+	}
+	// Make sure the keys fit the method, rather than failing the requests.
+	if tp.signKey != nil {
+		token, err := tp.sign(&jwtClaims{})
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key for %s: %s", name, err)
+		}
+		if err := tp.verify(token, &jwtClaims{}); err != nil {
+			return nil, fmt.Errorf("public key doesn't match the private key: %s", err)
+		}
+	}
+	return tp, nil
+}
+
+func (tp *jwtTokenProvider) sign(claims *jwtClaims) (string, error) {
+	return jwt.NewWithClaims(tp.method, claims).SignedString(tp.signKey)
+}
+
+// verify parses the token into the claims, only the signing method of the
+// token provider is accepted, so that the tokens signed by the other
+// methods, e.g. "none", are rejected.
+func (tp *jwtTokenProvider) verify(token string, claims *jwtClaims) error {
+	parser := &jwt.Parser{
+		ValidMethods: []string{tp.method.Alg()},
+	}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return tp.verifyKey, nil
+	})
+	return err
+}
+
+func (tp *jwtTokenProvider) assign(user string, revision uint64) (string, error) {
+	if tp.signKey == nil {
+		return "", errGRPCAuthVerifyOnly
+	}
+	return tp.sign(&jwtClaims{
+		Username: user,
+		Revision: revision,
+		Expiry:   tp.clock.Now().Add(tp.ttl).Unix(),
+	})
+}
+
+func (tp *jwtTokenProvider) info(token string) (string, uint64, error) {
+	var claims jwtClaims
+	if err := tp.verify(token, &claims); err != nil {
+		return "", 0, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	expiry := time.Unix(claims.Expiry, 0).Add(tp.skew)
+	if claims.Username == "" || !tp.clock.Now().Before(expiry) {
+		return "", 0, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	return claims.Username, claims.Revision, nil
+}
+
+// invalidateUser does nothing, as a JWT cannot be revoked. The JWTs issued
+// before are rejected anyway, since the auth revision is increased whenever
+// a user is changed.
+func (tp *jwtTokenProvider) invalidateUser(user string) {}
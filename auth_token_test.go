@@ -0,0 +1,213 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// writeTestRSAKeys writes a new RSA key pair into the dir, it returns the
+// paths of the private key and the public key.
+func writeTestRSAKeys(t testing.TB, dir, name string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "checking error")
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err, "checking error")
+
+	privPath := filepath.Join(dir, name+".key")
+	pubPath := filepath.Join(dir, name+".pub")
+	err = ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	assert.Nil(t, err, "checking error")
+	err = ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0644)
+	assert.Nil(t, err, "checking error")
+	return privPath, pubPath
+}
+
+func TestNewJWTTokenProvider(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := writeTestRSAKeys(t, dir, "foo")
+	otherPriv, _ := writeTestRSAKeys(t, dir, "bar")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "checking error")
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	assert.Nil(t, err, "checking error")
+	ecPriv := filepath.Join(dir, "ec.key")
+	err = ioutil.WriteFile(ecPriv, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	assert.Nil(t, err, "checking error")
+
+	valid := []*JWTOptions{
+		{PrivateKeyFile: priv},
+		{PublicKeyFile: pub},
+		{PrivateKeyFile: priv, PublicKeyFile: pub, SignMethod: "PS256"},
+		{PrivateKeyFile: ecPriv, SignMethod: "ES256"},
+		{PrivateKeyFile: pub, SignMethod: "HS256"},
+	}
+	for _, opts := range valid {
+		_, err := newJWTTokenProvider(opts, time.Minute, newFakeClock())
+		assert.Nil(t, err, "checking error of %+v", opts)
+	}
+	invalid := []*JWTOptions{
+		{},
+		{PrivateKeyFile: priv, SignMethod: "none"},
+		{PrivateKeyFile: filepath.Join(dir, "unknown")},
+		{PrivateKeyFile: pub},
+		{PublicKeyFile: priv},
+		{PrivateKeyFile: otherPriv, PublicKeyFile: pub},
+		{PrivateKeyFile: ecPriv, SignMethod: "RS256"},
+		{PrivateKeyFile: ecPriv, SignMethod: "ES384"},
+		{SignMethod: "HS256"},
+	}
+	for _, opts := range invalid {
+		_, err := newJWTTokenProvider(opts, time.Minute, newFakeClock())
+		assert.NotNil(t, err, "checking error of %+v", opts)
+	}
+}
+
+func TestJWTTokenProvider(t *testing.T) {
+	priv, pub := writeTestRSAKeys(t, t.TempDir(), "foo")
+	clock := newFakeClock()
+	signer, err := newJWTTokenProvider(&JWTOptions{PrivateKeyFile: priv}, time.Minute, clock)
+	assert.Nil(t, err, "checking error")
+	// The verifier's clock is behind.
+	verifierClock := newFakeClock()
+	verifier, err := newJWTTokenProvider(&JWTOptions{
+		PublicKeyFile: pub,
+		ClockSkew:     10 * time.Second,
+	}, time.Minute, verifierClock)
+	assert.Nil(t, err, "checking error")
+
+	token, err := signer.assign("foo", 2)
+	assert.Nil(t, err, "checking error")
+	for _, tp := range []*jwtTokenProvider{signer, verifier} {
+		user, revision, err := tp.info(token)
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, "foo", user, "checking user")
+		assert.Equal(t, uint64(2), revision, "checking revision")
+	}
+	_, err = verifier.assign("foo", 2)
+	assert.Equal(t, errGRPCAuthVerifyOnly, err, "checking error")
+
+	// The JWTs are not refreshed, and the skew is tolerated.
+	clock.Advance(time.Minute)
+	verifierClock.Advance(time.Minute)
+	_, _, err = signer.info(token)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+	_, _, err = verifier.info(token)
+	assert.Nil(t, err, "checking error")
+	verifierClock.Advance(10 * time.Second)
+	_, _, err = verifier.info(token)
+	assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error")
+
+	// The unsigned tokens are rejected.
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, &jwtClaims{
+		Username: "foo",
+		Revision: 2,
+		Expiry:   clock.Now().Add(time.Minute).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.Nil(t, err, "checking error")
+	for _, invalid := range []string{
+		"",
+		"abcdefghijklmnop.1",
+		token[:strings.LastIndex(token, ".")] + ".c2lnbmF0dXJl",
+		unsigned,
+	} {
+		_, _, err = signer.info(invalid)
+		assert.Equal(t, rpctypes.ErrGRPCInvalidAuthToken, err, "checking error of %q", invalid)
+	}
+}
+
+func TestJWTAcrossAdapters(t *testing.T) {
+	priv, pub := writeTestRSAKeys(t, t.TempDir(), "foo")
+	newAdapter := func(jwt *JWTOptions) *adapter {
+		return NewEtcdAdapter(&AdapterOptions{
+			Auth: &AuthOptions{
+				Users: []User{newTestUser(t, "foo", "bar", RootRole)},
+				JWT:   jwt,
+			},
+		}).(*adapter)
+	}
+	first := newAdapter(&JWTOptions{PrivateKeyFile: priv})
+	second := newAdapter(&JWTOptions{PrivateKeyFile: priv})
+	verifier := newAdapter(&JWTOptions{PublicKeyFile: pub})
+
+	token, err := first.auth.authenticate("foo", "bar")
+	assert.Nil(t, err, "checking error")
+	info := &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.KV/Range"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpctypes.TokenFieldNameGRPC, token))
+	for _, a := range []*adapter{first, second, verifier} {
+		var user string
+		_, err := a.authUnaryInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			user = authUserFromContext(ctx)
+			return nil, nil
+		})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, "foo", user, "checking user")
+	}
+}
+
+func TestEtcdAdapterAuthJWT(t *testing.T) {
+	priv, _ := writeTestRSAKeys(t, t.TempDir(), "foo")
+	opts := &AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{newTestUser(t, "foo", "bar", RootRole)},
+			JWT: &JWTOptions{
+				SignMethod:     "RS256",
+				PrivateKeyFile: priv,
+			},
+		},
+	}
+	_, first, shutdown := startTestAdapter(t, opts)
+	defer shutdown()
+	_, second, shutdown2 := startTestAdapter(t, opts)
+	defer shutdown2()
+
+	authResp, err := first.Authenticate(context.Background(), "foo", "bar")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, 2, strings.Count(authResp.Token, "."), "checking token format")
+
+	// The token issued by the first adapter is accepted by the second one.
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(rpctypes.TokenFieldNameGRPC, authResp.Token))
+	_, err = second.Put(ctx, "/x", "v1")
+	assert.Nil(t, err, "checking error")
+	resp, err := second.Get(ctx, "/x")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	_, err = second.Get(context.Background(), "/x")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+}
@@ -0,0 +1,313 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package backends
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+var (
+	// ErrCompacted means the required revision has been compacted.
+	ErrCompacted = server.ErrCompacted
+	// ErrFutureRevision means the required revision is greater than the
+	// current revision.
+	ErrFutureRevision = errors.New("required revision is a future revision")
+	// ErrWatcherNotExist means the watcher doesn't exist in the watch stream.
+	ErrWatcherNotExist = errors.New("watcher does not exist")
+	// ErrWatcherDuplicateID means the watch id is already used in the watch
+	// stream.
+	ErrWatcherDuplicateID = errors.New("duplicate watch ID provided on the WatchStream")
+	// ErrWatcherInvalidID means the watch id is negative, which is reserved
+	// by the responses for the whole stream.
+	ErrWatcherInvalidID = errors.New("watch ID must not be negative")
+)
+
+// AutoWatchID is the watch id which asks the WatchStream to assign an
+// unused one.
+const AutoWatchID int64 = 0
+
+// Backend is the extended backend interface. Besides the kine server.Backend
+// interface, it provides the abilities that kine doesn't cover, so that
+// etcd adapter can mimic more ETCD V3 APIs. Backends which don't implement
+// it can still be used, but only the kine-compatible subset of APIs will be
+// served.
+//
+// The methods are called concurrently by the events loop and the gRPC
+// handlers, so they must be safe for concurrent use. The write transactions
+// and the other changes must be serialized, each change is assigned the next
+// revision (the changes in a transaction share one), and the readers never
+// see a transaction applied partially. The package backendtest verifies an
+// implementation satisfies the contract.
+type Backend interface {
+	server.Backend
+
+	// Range returns the key-values whose keys are in the range [key, end),
+	// sorted by key as bytes. A nil (or empty) end means only the key itself will be
+	// looked up, and an end of "\x00" means all keys which are greater than
+	// or equal to the key, otherwise an end which is not greater than the
+	// key means an empty range. ErrCompacted or ErrFutureRevision will be
+	// returned if the revision in opts cannot be read.
+	Range(ctx context.Context, key, end []byte, opts RangeOptions) (*RangeResult, error)
+	// Write starts a write transaction, all the changes in the transaction
+	// share the same revision, and they should be delivered to the watchers
+	// in one batch. The backend is locked exclusively until the transaction
+	// ends, so that other changes won't be interleaved.
+	Write(ctx context.Context) TxnWrite
+	// Compact discards all the revisions which are not needed to read at
+	// or after the given revision, and it returns the current revision.
+	// ErrCompacted will be returned if the revision has been compacted,
+	// and ErrFutureRevision will be returned if the revision is greater
+	// than the current revision.
+	Compact(ctx context.Context, revision int64) (int64, error)
+	// CurrentRevision returns the current revision of the backend.
+	CurrentRevision() int64
+	// CompactRevision returns the compacted revision of the backend.
+	CompactRevision() int64
+	// HashKV hashes the key-values in the history up to the revision in the
+	// same way as ETCD, so that the hash can be compared with the one of an
+	// ETCD holding the same history. A non-positive revision means the
+	// current revision. ErrCompacted will be returned if the revision is not
+	// greater than the compacted revision, and ErrFutureRevision will be
+	// returned if it's greater than the current revision.
+	HashKV(ctx context.Context, revision int64) (*HashKVResult, error)
+	// History returns all the changes retained in the history, sorted by
+	// their revisions. The changes shouldn't be modified, as they may share
+	// the memory with the backend.
+	History(ctx context.Context) (*HistoryResult, error)
+	// GetAt returns the key-value of the key at the revision, or nil if the
+	// key doesn't exist at it. The revision is interpreted in the same way
+	// as RangeOptions.Revision, and the same errors as Range are returned.
+	GetAt(ctx context.Context, key []byte, revision int64) (*mvccpb.KeyValue, error)
+	// RangeAt is same as Range at the revision, without any limit.
+	RangeAt(ctx context.Context, key, end []byte, revision int64) (*RangeResult, error)
+	// KeyHistory returns the changes of the key at or after fromRev which
+	// are retained in the history, sorted by their revisions, in the same
+	// form as the ones returned by History. A non-positive fromRev means
+	// the compacted revision, i.e. all the retained changes. ErrCompacted
+	// will be returned if fromRev is less than the compacted revision, and
+	// ErrFutureRevision will be returned if it's greater than the current
+	// revision.
+	KeyHistory(ctx context.Context, key []byte, fromRev int64) ([]*Change, error)
+	// DbSizeInUse returns the number of bytes in use, while DbSize returns
+	// the number of bytes allocated, which might include the space freed
+	// by the compactions.
+	DbSizeInUse(ctx context.Context) (int64, error)
+	// Defragment releases the space freed by the compactions, so that the
+	// DbSize shrinks to the DbSizeInUse. Reads shouldn't be blocked for the
+	// whole duration.
+	Defragment(ctx context.Context) error
+	// NewWatchStream creates a WatchStream, watchers on it will be notified
+	// of the changes made by the Backend.
+	NewWatchStream(opts WatchStreamOptions) WatchStream
+	// Batch calls fn, the changes made during it are delivered to the
+	// watchers together after fn returns, so that a watcher sees them in
+	// one WatchResponse.
+	Batch(fn func())
+}
+
+// Restorer is implemented by the backends which can be restored from the
+// result of History, e.g. the btree backend.
+type Restorer interface {
+	// Restore replaces the data with the history, so that the revisions,
+	// the versions and the historical reads since the compacted revision
+	// are same as the ones of the backend which it's taken from. The
+	// watchers are not notified, so it should be called before the backend
+	// is used.
+	Restore(ctx context.Context, history *HistoryResult) error
+}
+
+// TombstoneCounter is implemented by the backends which retain the
+// tombstones of the deleted keys in the history, e.g. the btree backend.
+type TombstoneCounter interface {
+	// Tombstones returns the number of the tombstones retained, so that
+	// the historical reads and the watchers see the deletions. They're
+	// removed once they're before the compacted revision.
+	Tombstones() int64
+}
+
+// TxnWrite is the write transaction of the Backend.
+type TxnWrite interface {
+	// Range is same as the Backend.Range, but the changes made in this
+	// transaction are visible.
+	Range(key, end []byte, opts RangeOptions) (*RangeResult, error)
+	// Put puts the key-value and returns the revision of the transaction.
+	Put(key, value []byte, lease int64) int64
+	// DeleteRange deletes the keys in the range [key, end), the range is
+	// interpreted in the same way as Range. It returns the number of deleted
+	// keys and the revision of the transaction.
+	DeleteRange(key, end []byte) (int64, int64)
+	// Rev returns the revision that the transaction sees, it's the revision
+	// of the transaction if there are changes.
+	Rev() int64
+	// End ends the transaction, the revision of the backend will be
+	// increased if there are changes in the transaction.
+	End()
+}
+
+// RangeOptions contains settings for the Range operation.
+type RangeOptions struct {
+	// Revision is the revision that the range is performed at, a
+	// non-positive value means the current revision.
+	Revision int64
+	// Limit limits the number of returned key-values, a non-positive
+	// value means no limit.
+	Limit int64
+	// CountOnly indicates only the number of keys is needed, no key-values
+	// will be returned. Backends should count the keys without collecting
+	// them, as it's used by the count_only ranges, the compares of the
+	// versions in transactions and the metrics.
+	CountOnly bool
+}
+
+// RangeResult is the result of the Range operation.
+type RangeResult struct {
+	// Revision is the current revision of the backend.
+	Revision int64
+	// KVs are the matched key-values, at most RangeOptions.Limit ones.
+	KVs []*mvccpb.KeyValue
+	// Count is the total number of keys in the range, regardless of
+	// the limit.
+	Count int64
+}
+
+// HashKVResult is the result of the HashKV operation.
+type HashKVResult struct {
+	// Hash is the CRC-32C checksum of the key-values.
+	Hash uint32
+	// Revision is the revision that the key-values are hashed at.
+	Revision int64
+	// CompactRevision is the compacted revision of the backend.
+	CompactRevision int64
+}
+
+// Change is a change of a key in the history.
+type Change struct {
+	// Revision is the revision of the change.
+	Revision int64
+	// Sub is the index of the change among the ones of the same revision.
+	Sub int64
+	// Tombstone indicates the key was deleted by the change.
+	Tombstone bool
+	// KV is the key-value after the change, only the Key is set if it's a
+	// tombstone.
+	KV *mvccpb.KeyValue
+}
+
+// HistoryResult is the result of the History operation.
+type HistoryResult struct {
+	// Revision is the current revision of the backend.
+	Revision int64
+	// CompactRevision is the compacted revision of the backend.
+	CompactRevision int64
+	// Changes are the changes retained in the history.
+	Changes []*Change
+}
+
+// SlowWatcherCancelReason is the cancel reason of the watchers which are too
+// slow to catch up with the history.
+const SlowWatcherCancelReason = "watcher is too slow, required revision has been compacted"
+
+// WatchStreamOptions contains settings for the WatchStream.
+type WatchStreamOptions struct {
+	// BufferSize is the max number of the pending responses of a watcher,
+	// a watcher whose pending responses exceed it stops receiving the new
+	// changes. It catches up with the history when the pending responses
+	// drain, or it's canceled with SlowWatcherCancelReason if the history
+	// has been compacted. A non-positive value means the default size of
+	// the backend.
+	BufferSize int
+}
+
+// WatchStream is a stream of watchers, the responses of all the watchers in
+// it are delivered to the same channel, in the order of revision.
+type WatchStream interface {
+	// Watch creates a watcher on the range [key, end), the range is
+	// interpreted in the same way as Backend.Range. Changes since startRev
+	// will be delivered, historical ones are delivered before the others,
+	// and a non-positive startRev means the changes after the current
+	// revision. If the historical changes have been compacted, the watcher
+	// will be canceled with the CompactRevision set. The id might be
+	// AutoWatchID, so that an unused one will be assigned, otherwise
+	// ErrWatcherDuplicateID is returned if it's used by another watcher in
+	// the stream, and ErrWatcherInvalidID if it's negative. Events are not
+	// delivered to the watcher if any of the filters returns true. It
+	// returns the id of the watcher.
+	Watch(id int64, key, end []byte, startRev int64, filters ...FilterFunc) (int64, error)
+	// Chan returns the channel of the WatchResponses.
+	Chan() <-chan WatchResponse
+	// RequestProgress requests a WatchResponse without events for the
+	// watcher, the revision in it is the current revision. It's delivered
+	// after the pending responses of the watcher, so that the watcher knows
+	// it has caught up with the revision.
+	RequestProgress(id int64)
+	// RequestProgressAll requests a WatchResponse without events for all
+	// the watchers in the stream, its WatchID is -1. It's delivered after
+	// the pending responses of all the watchers.
+	RequestProgressAll()
+	// Cancel cancels the watcher, a WatchResponse with Canceled set will be
+	// delivered as its last response. ErrWatcherNotExist will be returned
+	// if the watcher doesn't exist.
+	Cancel(id int64) error
+	// Close closes the stream and cancels all the watchers in it, no more
+	// WatchResponse will be delivered.
+	Close()
+	// Watchers returns the states of the watchers in the stream, sorted by
+	// their ids.
+	Watchers() []WatcherState
+}
+
+// WatcherState is the state of a watcher in a WatchStream.
+type WatcherState struct {
+	// ID is the id of the watcher.
+	ID int64
+	// Key and End are the range of the watcher, they're interpreted in the
+	// same way as Backend.Range.
+	Key []byte
+	End []byte
+	// Pending is the number of the pending responses of the watcher.
+	Pending int
+	// Slow indicates the watcher has too many pending responses, it stops
+	// receiving the new changes until they drain.
+	Slow bool
+}
+
+// FilterFunc returns true if the event should be filtered out.
+type FilterFunc func(ev *mvccpb.Event) bool
+
+// WatchResponse is the response of a watcher.
+type WatchResponse struct {
+	// WatchID is the id of the watcher.
+	WatchID int64
+	// Events are the changes happened on the watcher range, in the order
+	// of revision. Note the events might be shared among watchers, so
+	// don't modify them.
+	Events []*mvccpb.Event
+	// Revision is the revision of the backend when the response was
+	// generated.
+	Revision int64
+	// CompactRevision is set if the watcher was canceled as the changes
+	// since its start revision have been compacted.
+	CompactRevision int64
+	// Canceled indicates the watcher was canceled, it's the last response
+	// of the watcher.
+	Canceled bool
+	// CancelReason is the reason why the watcher was canceled.
+	CancelReason string
+}
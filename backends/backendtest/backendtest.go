@@ -0,0 +1,436 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package backendtest contains the compliance tests of the backends.Backend
+// contract, so that the backends provided by the applications can verify
+// they're usable by etcd-adapter.
+package backendtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// Run runs the compliance tests, each of them on a new backend created by
+// newBackend.
+func Run(t *testing.T, newBackend func() backends.Backend) {
+	cases := []struct {
+		name string
+		fn   func(*testing.T, backends.Backend)
+	}{
+		{name: "Create", fn: testCreate},
+		{name: "Update", fn: testUpdate},
+		{name: "Delete", fn: testDelete},
+		{name: "Range", fn: testRange},
+		{name: "Write", fn: testWrite},
+		{name: "Compact", fn: testCompact},
+		{name: "HistoricalReads", fn: testHistoricalReads},
+		{name: "Watch", fn: testWatch},
+		{name: "Concurrent", fn: testConcurrent},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newBackend())
+		})
+	}
+}
+
+func testCreate(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	rev, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, base+1, rev, "checking revision")
+	assert.Equal(t, base+1, b.CurrentRevision(), "checking current revision")
+	_, err = b.Create(ctx, "/apisix/routes/1", []byte("v2"), 0)
+	assert.Equal(t, server.ErrKeyExists, err, "checking error")
+
+	rev, kv, err := b.Get(ctx, "/apisix/routes/1", 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, base+1, rev, "checking revision")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, []byte("v1"), kv.Value, "checking value")
+		assert.Equal(t, base+1, kv.CreateRevision, "checking create revision")
+		assert.Equal(t, base+1, kv.ModRevision, "checking mod revision")
+	}
+	_, kv, err = b.Get(ctx, "/apisix/routes/2", 0)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, kv, "checking missing kv")
+}
+
+func testUpdate(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	rev, kv, ok, err := b.Update(ctx, "/apisix/routes/1", []byte("v2"), base+1, 0)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking update success flag")
+	assert.Equal(t, base+2, rev, "checking revision")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, base+1, kv.CreateRevision, "checking create revision")
+		assert.Equal(t, base+2, kv.ModRevision, "checking mod revision")
+	}
+
+	// The update fails if the revision doesn't match, and the current kv
+	// is returned.
+	_, kv, ok, err = b.Update(ctx, "/apisix/routes/1", []byte("v3"), base+3, 0)
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking update success flag")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, base+2, kv.ModRevision, "checking mod revision")
+	}
+	_, kv, ok, err = b.Update(ctx, "/apisix/routes/2", []byte("v1"), base+1, 0)
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking update success flag")
+	assert.Nil(t, kv, "checking missing kv")
+
+	res, err := b.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, res.KVs, 1, "checking kvs") {
+		assert.Equal(t, []byte("v2"), res.KVs[0].Value, "checking value")
+		assert.Equal(t, int64(2), res.KVs[0].Version, "checking version")
+	}
+}
+
+func testDelete(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, ok, err := b.Delete(ctx, "/apisix/routes/1", base+2)
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking delete success flag")
+	rev, kv, ok, err := b.Delete(ctx, "/apisix/routes/1", base+1)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking delete success flag")
+	assert.Equal(t, base+2, rev, "checking revision")
+	if assert.NotNil(t, kv, "checking deleted kv") {
+		assert.Equal(t, []byte("v1"), kv.Value, "checking value")
+	}
+
+	res, err := b.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 0, "checking kvs")
+	// The deleted key is still visible at the former revision.
+	res, err = b.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{Revision: base + 1})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 1, "checking kvs")
+}
+
+func testRange(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	for _, key := range []string{"/apisix/routes/2", "/apisix/routes/1", "/apisix/upstreams/1", "/apisix/routes/3"} {
+		_, err := b.Create(ctx, key, []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	keys := func(res *backends.RangeResult) []string {
+		var keys []string
+		for _, kv := range res.KVs {
+			keys = append(keys, string(kv.Key))
+		}
+		return keys
+	}
+
+	res, err := b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, base+4, res.Revision, "checking revision")
+	assert.Equal(t, int64(3), res.Count, "checking count")
+	assert.Equal(t, []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes/3"}, keys(res), "checking keys")
+
+	res, err = b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{Limit: 2})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), res.Count, "checking count")
+	assert.Equal(t, []string{"/apisix/routes/1", "/apisix/routes/2"}, keys(res), "checking keys")
+
+	res, err = b.Range(ctx, []byte("/apisix/routes/3"), []byte{0}, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"/apisix/routes/3", "/apisix/upstreams/1"}, keys(res), "checking keys")
+
+	res, err = b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{CountOnly: true})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), res.Count, "checking count")
+	assert.Len(t, res.KVs, 0, "checking kvs")
+
+	res, err = b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{Revision: base + 2})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"/apisix/routes/1", "/apisix/routes/2"}, keys(res), "checking keys")
+
+	_, err = b.Range(ctx, []byte("/apisix/routes/"), nil, backends.RangeOptions{Revision: base + 5})
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+}
+
+func testWrite(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	txn := b.Write(ctx)
+	assert.Equal(t, base, txn.Rev(), "checking revision")
+	assert.Equal(t, base+1, txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0), "checking revision")
+	assert.Equal(t, base+1, txn.Put([]byte("/apisix/routes/2"), []byte("v1"), 0), "checking revision")
+	// The changes in the transaction are visible to itself.
+	res, err := txn.Range([]byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 1, "checking kvs")
+	txn.End()
+	assert.Equal(t, base+1, b.CurrentRevision(), "checking current revision")
+
+	txn = b.Write(ctx)
+	deleted, rev := txn.DeleteRange([]byte("/apisix/routes/"), []byte("/apisix/routes0"))
+	assert.Equal(t, int64(2), deleted, "checking deleted keys")
+	assert.Equal(t, base+2, rev, "checking revision")
+	txn.End()
+	assert.Equal(t, base+2, b.CurrentRevision(), "checking current revision")
+
+	// The transaction without changes doesn't increase the revision.
+	txn = b.Write(ctx)
+	deleted, _ = txn.DeleteRange([]byte("/apisix/routes/1"), nil)
+	assert.Equal(t, int64(0), deleted, "checking deleted keys")
+	txn.End()
+	assert.Equal(t, base+2, b.CurrentRevision(), "checking current revision")
+}
+
+func testCompact(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = b.Update(ctx, "/apisix/routes/1", []byte("v2"), base+1, 0)
+	assert.Nil(t, err, "checking error")
+
+	_, err = b.Compact(ctx, base+3)
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+	rev, err := b.Compact(ctx, base+2)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, base+2, rev, "checking revision")
+	assert.Equal(t, base+2, b.CompactRevision(), "checking compact revision")
+	_, err = b.Compact(ctx, base+2)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+
+	_, err = b.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{Revision: base + 1})
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	res, err := b.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{Revision: base + 2})
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, res.KVs, 1, "checking kvs") {
+		assert.Equal(t, []byte("v2"), res.KVs[0].Value, "checking value")
+	}
+}
+
+func testHistoricalReads(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+	key := []byte("/apisix/routes/1")
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = b.Create(ctx, "/apisix/routes/2", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = b.Update(ctx, "/apisix/routes/1", []byte("v2"), base+1, 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = b.Delete(ctx, "/apisix/routes/1", base+3)
+	assert.Nil(t, err, "checking error")
+	_, err = b.Create(ctx, "/apisix/routes/1", []byte("v3"), 0)
+	assert.Nil(t, err, "checking error")
+
+	kv, err := b.GetAt(ctx, key, base+3)
+	assert.Nil(t, err, "checking error")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, []byte("v2"), kv.Value, "checking value")
+		assert.Equal(t, base+1, kv.CreateRevision, "checking create revision")
+		assert.Equal(t, base+3, kv.ModRevision, "checking mod revision")
+		assert.Equal(t, int64(2), kv.Version, "checking version")
+	}
+	kv, err = b.GetAt(ctx, key, base+4)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, kv, "checking deleted kv")
+	kv, err = b.GetAt(ctx, key, 0)
+	assert.Nil(t, err, "checking error")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, []byte("v3"), kv.Value, "checking value")
+		assert.Equal(t, int64(1), kv.Version, "checking version")
+	}
+	_, err = b.GetAt(ctx, key, base+6)
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+
+	res, err := b.RangeAt(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), base+2)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, base+5, res.Revision, "checking revision")
+	assert.Equal(t, int64(2), res.Count, "checking count")
+	if assert.Len(t, res.KVs, 2, "checking kvs") {
+		assert.Equal(t, []byte("v1"), res.KVs[0].Value, "checking value")
+		assert.Equal(t, []byte("/apisix/routes/2"), res.KVs[1].Key, "checking key")
+	}
+	res, err = b.RangeAt(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), base+4)
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, res.KVs, 1, "checking kvs") {
+		assert.Equal(t, []byte("/apisix/routes/2"), res.KVs[0].Key, "checking key")
+	}
+
+	changes, err := b.KeyHistory(ctx, key, 0)
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, changes, 4, "checking changes") {
+		for i, rev := range []int64{base + 1, base + 3, base + 4, base + 5} {
+			assert.Equal(t, rev, changes[i].Revision, "checking revision")
+			assert.Equal(t, key, changes[i].KV.Key, "checking key")
+		}
+		assert.Equal(t, []byte("v2"), changes[1].KV.Value, "checking value")
+		assert.Equal(t, int64(2), changes[1].KV.Version, "checking version")
+		assert.True(t, changes[2].Tombstone, "checking tombstone")
+		assert.Equal(t, base+5, changes[3].KV.CreateRevision, "checking create revision")
+	}
+	changes, err = b.KeyHistory(ctx, key, base+4)
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, changes, 2, "checking changes") {
+		assert.True(t, changes[0].Tombstone, "checking tombstone")
+		assert.Equal(t, []byte("v3"), changes[1].KV.Value, "checking value")
+	}
+	changes, err = b.KeyHistory(ctx, []byte("/apisix/routes/3"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, changes, 0, "checking changes")
+	_, err = b.KeyHistory(ctx, key, base+6)
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+
+	// The changes before the compacted revision cannot be read, while the
+	// one at it is still retained.
+	_, err = b.Compact(ctx, base+3)
+	assert.Nil(t, err, "checking error")
+	_, err = b.GetAt(ctx, key, base+2)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	_, err = b.RangeAt(ctx, key, nil, base+2)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	_, err = b.KeyHistory(ctx, key, base+2)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	changes, err = b.KeyHistory(ctx, key, 0)
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, changes, 3, "checking changes") {
+		for i, rev := range []int64{base + 3, base + 4, base + 5} {
+			assert.Equal(t, rev, changes[i].Revision, "checking revision")
+		}
+	}
+}
+
+func testWatch(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	ws := b.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+	// The historical change is delivered before the new ones.
+	// The zero id asks for an unused one, so an explicit id is used to
+	// check the duplicate.
+	id, err := ws.Watch(1, []byte("/apisix/routes/"), []byte("/apisix/routes0"), base+1)
+	assert.Nil(t, err, "checking error")
+	_, err = ws.Watch(id, []byte("/apisix/routes/"), nil, 0)
+	assert.Equal(t, backends.ErrWatcherDuplicateID, err, "checking error")
+
+	txn := b.Write(ctx)
+	txn.Put([]byte("/apisix/routes/2"), []byte("v1"), 0)
+	txn.Put([]byte("/apisix/upstreams/1"), []byte("v1"), 0)
+	txn.DeleteRange([]byte("/apisix/routes/1"), nil)
+	txn.End()
+
+	var events []*mvccpb.Event
+	for len(events) < 3 {
+		select {
+		case resp := <-ws.Chan():
+			assert.Equal(t, id, resp.WatchID, "checking watch id")
+			events = append(events, resp.Events...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch response")
+		}
+	}
+	expected := []struct {
+		typ mvccpb.Event_EventType
+		key string
+		rev int64
+	}{
+		{typ: mvccpb.PUT, key: "/apisix/routes/1", rev: base + 1},
+		{typ: mvccpb.PUT, key: "/apisix/routes/2", rev: base + 2},
+		{typ: mvccpb.DELETE, key: "/apisix/routes/1", rev: base + 2},
+	}
+	for i, exp := range expected {
+		assert.Equal(t, exp.typ, events[i].Type, "checking event type")
+		assert.Equal(t, exp.key, string(events[i].Kv.Key), "checking key")
+		assert.Equal(t, exp.rev, events[i].Kv.ModRevision, "checking revision")
+	}
+
+	assert.Nil(t, ws.Cancel(id), "checking error")
+	select {
+	case resp := <-ws.Chan():
+		assert.True(t, resp.Canceled, "checking canceled flag")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+	assert.Equal(t, backends.ErrWatcherNotExist, ws.Cancel(id), "checking error")
+}
+
+func testConcurrent(t *testing.T, b backends.Backend) {
+	ctx := context.Background()
+	base := b.CurrentRevision()
+
+	const (
+		writers = 4
+		writes  = 50
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				// The transactions are never seen applied partially.
+				txn := b.Write(ctx)
+				txn.Put([]byte(fmt.Sprintf("/apisix/routes/%d/%d/a", i, j)), []byte("v1"), 0)
+				txn.Put([]byte(fmt.Sprintf("/apisix/routes/%d/%d/b", i, j)), []byte("v1"), 0)
+				txn.End()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				res, err := b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{CountOnly: true})
+				assert.Nil(t, err, "checking error")
+				if err == nil && res.Count%2 != 0 {
+					t.Errorf("range sees a partial transaction with %d keys", res.Count)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, base+writers*writes, b.CurrentRevision(), "checking current revision")
+	res, err := b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{CountOnly: true})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2*writers*writes), res.Count, "checking count")
+}
@@ -0,0 +1,546 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package bolt implements a backends.Backend persisted to a bolt file, so
+// that a restarted adapter serves the last known keyspace immediately, and
+// the revisions continue from the ones before the restart.
+//
+// The reads and the watches are served by the btree backend in memory, the
+// bolt file is only written, every change is committed to it before it's
+// visible, and it's read once when the backend is opened. The file keeps
+// the history since the compacted revision in the same layout as the key
+// bucket of ETCD, i.e. the marshaled key-values keyed by their revisions,
+// and the tombstones are marked by a trailing 't'.
+//
+// The leases are not persisted, as the lessor of the adapter is in memory,
+// so the keys are restored without their leases, and they're kept until
+// they're deleted.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	bbolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+var (
+	keyBucketName  = []byte("key")
+	metaBucketName = []byte("meta")
+	// revisionKey and compactRevisionKey are the keys of the current and
+	// the compacted revisions in the meta bucket.
+	revisionKey        = []byte("revision")
+	compactRevisionKey = []byte("compactRevision")
+)
+
+const (
+	// revBytesLen is the length of the revision keys, the big-endian main
+	// and sub revisions separated by '_', so they're sorted by revision.
+	revBytesLen = 8 + 1 + 8
+	// markTombstone is appended to the revision keys of the tombstones.
+	markTombstone = byte('t')
+	// openTimeout is the time waiting for the lock of the file, which is
+	// held by the process opening it.
+	openTimeout = 10 * time.Second
+)
+
+// Options contains settings for the bolt backend.
+type Options struct {
+	// Path is the path of the bolt file, it's created if it doesn't exist.
+	// It can be opened by one backend at a time.
+	Path string
+	// NoSync skips the fsync of every commit. The committed changes
+	// survive a crash of the process, but the latest ones might be lost,
+	// and the file might be corrupted, if the OS crashes or the power is
+	// lost.
+	NoSync bool
+	// HistoryRevisions and NotifyWorkers are the ones of btree.Options,
+	// the history compacted in memory is compacted in the file as well.
+	HistoryRevisions int64
+	NotifyWorkers    int
+}
+
+// Backend is a backends.Backend which serves the reads from the btree
+// backend in memory, and commits the changes to the bolt file before they
+// are visible. It's a backends.Restorer, and Close should be called after
+// the adapter is shut down.
+type Backend struct {
+	backends.Backend
+
+	// mu serializes the writes, so that the changes are committed to the
+	// file in the order of the revisions.
+	mu     sync.Mutex
+	db     *bbolt.DB
+	logger *zap.Logger
+	// compactRevision is the revision compacted in the file.
+	compactRevision int64
+	// compacted maps the keys to the revision keys of their last changes
+	// at or before the compacted revision, so that the compaction only
+	// reads the changes after the previous one.
+	compacted map[string][]byte
+}
+
+// NewBoltCache is same as OpenBoltCache, but it panics if the file cannot
+// be opened or loaded.
+func NewBoltCache(logger *zap.Logger, opts *Options) *Backend {
+	b, err := OpenBoltCache(logger, opts)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open bolt file: %s", err))
+	}
+	return b
+}
+
+// OpenBoltCache opens the bolt file in the options, and loads the keyspace
+// and its history in it to the btree backend.
+func OpenBoltCache(logger *zap.Logger, opts *Options) (*Backend, error) {
+	if opts == nil || opts.Path == "" {
+		return nil, errors.New("bolt path is not specified")
+	}
+	db, err := bbolt.Open(opts.Path, 0600, &bbolt.Options{
+		Timeout: openTimeout,
+		NoSync:  opts.NoSync,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{
+		Backend: btree.NewBTreeCacheWithOptions(logger, &btree.Options{
+			HistoryRevisions: opts.HistoryRevisions,
+			NotifyWorkers:    opts.NotifyWorkers,
+		}),
+		db:     db,
+		logger: logger,
+	}
+	if err := b.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load %s: %w", opts.Path, err)
+	}
+	return b, nil
+}
+
+// load restores the btree backend from the history in the file, without the
+// leases of the keys.
+func (b *Backend) load() error {
+	history := &backends.HistoryResult{}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		kb, err := tx.CreateBucketIfNotExists(keyBucketName)
+		if err != nil {
+			return err
+		}
+		mb, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		history.Revision = getInt64(mb, revisionKey)
+		history.CompactRevision = getInt64(mb, compactRevisionKey)
+		return kb.ForEach(func(k, v []byte) error {
+			change, err := decodeChange(k, v)
+			if err != nil {
+				return err
+			}
+			change.KV.Lease = 0
+			history.Changes = append(history.Changes, change)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if history.Revision == 0 {
+		// Nothing has been written yet.
+		b.compacted = make(map[string][]byte)
+		return nil
+	}
+	if err := b.Backend.(backends.Restorer).Restore(context.Background(), history); err != nil {
+		return err
+	}
+	b.compactRevision = history.CompactRevision
+	b.compacted = compactedIndex(history)
+	b.logger.Info("bolt file loaded",
+		zap.String("path", b.db.Path()),
+		zap.Int64("revision", history.Revision),
+		zap.Int64("compact_revision", history.CompactRevision),
+	)
+	return nil
+}
+
+// Close closes the bolt file, the backend shouldn't be used after it.
+func (b *Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.db.Close()
+}
+
+// Tombstones returns the number of the tombstones retained in memory.
+func (b *Backend) Tombstones() int64 {
+	return b.Backend.(backends.TombstoneCounter).Tombstones()
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	txn := b.Write(ctx)
+	defer txn.End()
+	res, err := txn.Range([]byte(key), nil, backends.RangeOptions{CountOnly: true})
+	if err != nil {
+		return txn.Rev(), err
+	}
+	if res.Count > 0 {
+		return txn.Rev(), server.ErrKeyExists
+	}
+	return txn.Put([]byte(key), value, lease), nil
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, atRev, lease int64) (int64, *server.KeyValue, bool, error) {
+	txn := b.Write(ctx)
+	defer txn.End()
+	kv, err := getKeyValue(txn, key)
+	if err != nil || kv == nil {
+		return txn.Rev(), nil, false, err
+	}
+	if kv.ModRevision != atRev {
+		return txn.Rev(), kv, false, nil
+	}
+	rev := txn.Put([]byte(key), value, lease)
+	return rev, &server.KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    rev,
+		Lease:          lease,
+	}, true, nil
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, atRev int64) (int64, *server.KeyValue, bool, error) {
+	txn := b.Write(ctx)
+	defer txn.End()
+	kv, err := getKeyValue(txn, key)
+	if err != nil || kv == nil {
+		return txn.Rev(), nil, false, err
+	}
+	if kv.ModRevision != atRev {
+		return txn.Rev(), kv, false, nil
+	}
+	_, rev := txn.DeleteRange([]byte(key), nil)
+	return rev, kv, true, nil
+}
+
+// getKeyValue gets the current key-value of the key in the transaction.
+func getKeyValue(txn backends.TxnWrite, key string) (*server.KeyValue, error) {
+	res, err := txn.Range([]byte(key), nil, backends.RangeOptions{})
+	if err != nil || len(res.KVs) == 0 {
+		return nil, err
+	}
+	kv := res.KVs[0]
+	return &server.KeyValue{
+		Key:            key,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Value:          kv.Value,
+		Lease:          kv.Lease,
+	}, nil
+}
+
+// Write starts a write transaction of the btree backend, the changes in it
+// are committed to the file when it ends, before they're visible.
+func (b *Backend) Write(ctx context.Context) backends.TxnWrite {
+	b.mu.Lock()
+	return &txnWrite{
+		TxnWrite: b.Backend.Write(ctx),
+		b:        b,
+	}
+}
+
+func (b *Backend) Compact(ctx context.Context, revision int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rev, err := b.Backend.Compact(ctx, revision)
+	if err != nil {
+		return rev, err
+	}
+	b.compactFileLocked()
+	return rev, nil
+}
+
+// Restore restores the btree backend from the history, and replaces the
+// history in the file with it.
+func (b *Backend) Restore(ctx context.Context, history *backends.HistoryResult) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.Backend.(backends.Restorer).Restore(ctx, history); err != nil {
+		return err
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(keyBucketName); err != nil {
+			return err
+		}
+		kb, err := tx.CreateBucket(keyBucketName)
+		if err != nil {
+			return err
+		}
+		for _, c := range history.Changes {
+			if err := putChange(kb, c); err != nil {
+				return err
+			}
+		}
+		mb := tx.Bucket(metaBucketName)
+		if err := putInt64(mb, revisionKey, history.Revision); err != nil {
+			return err
+		}
+		return putInt64(mb, compactRevisionKey, history.CompactRevision)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write the restored history: %w", err)
+	}
+	b.compactRevision = history.CompactRevision
+	b.compacted = compactedIndex(history)
+	return nil
+}
+
+// commitLocked commits the changes of a transaction and the revision to the
+// file. Note this method should be invoked only if the mutex is locked.
+func (b *Backend) commitLocked(rev int64, changes []*backends.Change) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		kb := tx.Bucket(keyBucketName)
+		for _, c := range changes {
+			if err := putChange(kb, c); err != nil {
+				return err
+			}
+		}
+		return putInt64(tx.Bucket(metaBucketName), revisionKey, rev)
+	})
+}
+
+// compactFileLocked compacts the file to the compacted revision of the
+// btree backend, which might be advanced by a transaction as well. Only the
+// last change of each key at or before the revision is kept, unless it's a
+// tombstone, which is how the btree backend restores the history. Only the
+// changes after the previous compacted revision are read. Note this method
+// should be invoked only if the mutex is locked.
+func (b *Backend) compactFileLocked() {
+	compactRev := b.Backend.CompactRevision()
+	if compactRev <= b.compactRevision {
+		return
+	}
+	// updates are the changes to the compacted index, a nil revision key
+	// means the key is removed.
+	updates := make(map[string][]byte)
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		kb := tx.Bucket(keyBucketName)
+		end := revToBytes(compactRev+1, 0)
+		var stale [][]byte
+		c := kb.Cursor()
+		for k, v := c.Seek(revToBytes(b.compactRevision+1, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			var kv mvccpb.KeyValue
+			if err := kv.Unmarshal(v); err != nil {
+				return err
+			}
+			prev, ok := updates[string(kv.Key)]
+			if !ok {
+				prev = b.compacted[string(kv.Key)]
+			}
+			if prev != nil {
+				stale = append(stale, prev)
+			}
+			// The keys are only valid in the transaction, and the
+			// deletions might modify them.
+			k = append([]byte(nil), k...)
+			if isTombstone(k) {
+				stale = append(stale, k)
+				updates[string(kv.Key)] = nil
+			} else {
+				updates[string(kv.Key)] = k
+			}
+		}
+		for _, k := range stale {
+			if err := kb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return putInt64(tx.Bucket(metaBucketName), compactRevisionKey, compactRev)
+	})
+	if err != nil {
+		// The history is compacted again with the next compaction.
+		b.logger.Error("failed to compact bolt file",
+			zap.Error(err),
+			zap.Int64("revision", compactRev),
+		)
+		return
+	}
+	for key, k := range updates {
+		if k == nil {
+			delete(b.compacted, key)
+		} else {
+			b.compacted[key] = k
+		}
+	}
+	b.compactRevision = compactRev
+}
+
+// compactedIndex returns the revision keys of the last changes of the keys
+// at or before the compacted revision of the history.
+func compactedIndex(history *backends.HistoryResult) map[string][]byte {
+	index := make(map[string][]byte)
+	for _, c := range history.Changes {
+		if c.Revision > history.CompactRevision {
+			continue
+		}
+		if c.Tombstone {
+			delete(index, string(c.KV.Key))
+		} else {
+			index[string(c.KV.Key)] = revToBytes(c.Revision, c.Sub)
+		}
+	}
+	return index
+}
+
+// txnWrite records the changes made by the transaction of the btree
+// backend, with the create revisions and the versions, so that they can be
+// committed when it ends.
+type txnWrite struct {
+	backends.TxnWrite
+	b       *Backend
+	changes []*backends.Change
+}
+
+func (txn *txnWrite) Put(key, value []byte, lease int64) int64 {
+	kv := &mvccpb.KeyValue{
+		Key:     key,
+		Value:   value,
+		Lease:   lease,
+		Version: 1,
+	}
+	if res, err := txn.TxnWrite.Range(key, nil, backends.RangeOptions{}); err == nil && len(res.KVs) > 0 {
+		kv.CreateRevision = res.KVs[0].CreateRevision
+		kv.Version = res.KVs[0].Version + 1
+	}
+	rev := txn.TxnWrite.Put(key, value, lease)
+	kv.ModRevision = rev
+	if kv.CreateRevision == 0 {
+		kv.CreateRevision = rev
+	}
+	txn.changes = append(txn.changes, &backends.Change{
+		Revision: rev,
+		Sub:      int64(len(txn.changes)),
+		KV:       kv,
+	})
+	return rev
+}
+
+func (txn *txnWrite) DeleteRange(key, end []byte) (int64, int64) {
+	res, err := txn.TxnWrite.Range(key, end, backends.RangeOptions{})
+	n, rev := txn.TxnWrite.DeleteRange(key, end)
+	if err != nil || n == 0 {
+		return n, rev
+	}
+	// The keys are deleted in the order of the range.
+	for _, kv := range res.KVs {
+		txn.changes = append(txn.changes, &backends.Change{
+			Revision:  rev,
+			Sub:       int64(len(txn.changes)),
+			Tombstone: true,
+			KV: &mvccpb.KeyValue{
+				Key: kv.Key,
+			},
+		})
+	}
+	return n, rev
+}
+
+func (txn *txnWrite) End() {
+	defer txn.b.mu.Unlock()
+	if len(txn.changes) == 0 {
+		txn.TxnWrite.End()
+		return
+	}
+	if err := txn.b.commitLocked(txn.Rev(), txn.changes); err != nil {
+		// Like the journal of the btree backend, a change which is
+		// not committed is still applied in memory.
+		txn.b.logger.Error("failed to commit to bolt file",
+			zap.Error(err),
+			zap.Int64("revision", txn.Rev()),
+		)
+	}
+	txn.TxnWrite.End()
+	txn.b.compactFileLocked()
+}
+
+// revToBytes encodes the revision in the same way as ETCD.
+func revToBytes(main, sub int64) []byte {
+	b := make([]byte, revBytesLen, revBytesLen+1)
+	binary.BigEndian.PutUint64(b, uint64(main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(sub))
+	return b
+}
+
+func isTombstone(k []byte) bool {
+	return len(k) == revBytesLen+1 && k[revBytesLen] == markTombstone
+}
+
+func putChange(kb *bbolt.Bucket, c *backends.Change) error {
+	k := revToBytes(c.Revision, c.Sub)
+	kv := c.KV
+	if c.Tombstone {
+		k = append(k, markTombstone)
+		kv = &mvccpb.KeyValue{
+			Key: c.KV.Key,
+		}
+	}
+	v, err := kv.Marshal()
+	if err != nil {
+		return err
+	}
+	return kb.Put(k, v)
+}
+
+func decodeChange(k, v []byte) (*backends.Change, error) {
+	if len(k) != revBytesLen && !isTombstone(k) {
+		return nil, fmt.Errorf("invalid revision key %x", k)
+	}
+	kv := &mvccpb.KeyValue{}
+	if err := kv.Unmarshal(v); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key-value at %x: %w", k, err)
+	}
+	return &backends.Change{
+		Revision:  int64(binary.BigEndian.Uint64(k)),
+		Sub:       int64(binary.BigEndian.Uint64(k[9:])),
+		Tombstone: isTombstone(k),
+		KV:        kv,
+	}, nil
+}
+
+func getInt64(mb *bbolt.Bucket, key []byte) int64 {
+	v := mb.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func putInt64(mb *bbolt.Bucket, key []byte, v int64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return mb.Put(key, buf)
+}
@@ -0,0 +1,364 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package bolt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bbolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/backendtest"
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+func openTestBoltCache(t *testing.T, opts *Options) *Backend {
+	b, err := OpenBoltCache(zap.NewNop(), opts)
+	if !assert.Nil(t, err, "checking error") {
+		t.FailNow()
+	}
+	return b
+}
+
+// rangeAll returns all the keys of the backend.
+func rangeAll(t *testing.T, b backends.Backend) *backends.RangeResult {
+	res, err := b.Range(context.Background(), []byte{}, []byte{0}, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	return res
+}
+
+// countFileChanges returns the number of the changes kept in the file.
+func countFileChanges(t *testing.T, b *Backend) int {
+	var n int
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(keyBucketName).Stats().KeyN
+		return nil
+	})
+	assert.Nil(t, err, "checking error")
+	return n
+}
+
+func TestBoltCacheCompliance(t *testing.T) {
+	backendtest.Run(t, func() backends.Backend {
+		b := openTestBoltCache(t, &Options{
+			Path: filepath.Join(t.TempDir(), "bolt.db"),
+		})
+		t.Cleanup(func() {
+			assert.Nil(t, b.Close(), "checking error")
+		})
+		return b
+	})
+}
+
+func TestBoltCacheReopen(t *testing.T) {
+	opts := &Options{
+		Path: filepath.Join(t.TempDir(), "bolt.db"),
+	}
+	b := openTestBoltCache(t, opts)
+	ctx := context.Background()
+
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = b.Create(ctx, "/apisix/routes/2", []byte("v1"), 5)
+	assert.Nil(t, err, "checking error")
+	_, _, ok, err := b.Update(ctx, "/apisix/routes/1", []byte("v2"), 2, 0)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking update success flag")
+	_, _, ok, err = b.Update(ctx, "/apisix/routes/1", []byte("v3"), 2, 0)
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking update success flag")
+	txn := b.Write(ctx)
+	txn.Put([]byte("/apisix/upstreams/1"), []byte("v1"), 0)
+	txn.Put([]byte("/apisix/upstreams/2"), []byte("v1"), 0)
+	txn.DeleteRange([]byte("/apisix/routes/2"), nil)
+	txn.End()
+	_, _, ok, err = b.Delete(ctx, "/apisix/upstreams/2", 5)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking delete success flag")
+	// The transactions without changes are not committed.
+	txn = b.Write(ctx)
+	txn.DeleteRange([]byte("/apisix/ssls/"), []byte("/apisix/ssls0"))
+	txn.End()
+	_, err = b.Compact(ctx, 4)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(6), b.CurrentRevision(), "checking revision")
+
+	before := rangeAll(t, b)
+	history, err := b.KeyHistory(ctx, []byte("/apisix/upstreams/2"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, b.Close(), "checking error")
+
+	b = openTestBoltCache(t, opts)
+	defer func() {
+		assert.Nil(t, b.Close(), "checking error")
+	}()
+	assert.Equal(t, int64(6), b.CurrentRevision(), "checking revision")
+	assert.Equal(t, int64(4), b.CompactRevision(), "checking compact revision")
+	assert.Equal(t, before, rangeAll(t, b), "checking key-values")
+	restored, err := b.KeyHistory(ctx, []byte("/apisix/upstreams/2"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, history, restored, "checking history")
+	kv, err := b.GetAt(ctx, []byte("/apisix/routes/1"), 4)
+	assert.Nil(t, err, "checking error")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, []byte("v2"), kv.Value, "checking value")
+		assert.Equal(t, int64(2), kv.CreateRevision, "checking create revision")
+		assert.Equal(t, int64(4), kv.ModRevision, "checking mod revision")
+		assert.Equal(t, int64(2), kv.Version, "checking version")
+	}
+	_, err = b.GetAt(ctx, []byte("/apisix/routes/1"), 3)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+
+	// The revisions continue from the ones before.
+	rev, err := b.Create(ctx, "/apisix/routes/2", []byte("v2"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(7), rev, "checking revision")
+	rev, _, ok, err = b.Update(ctx, "/apisix/upstreams/1", []byte("v2"), 5, 0)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking update success flag")
+	assert.Equal(t, int64(8), rev, "checking revision")
+	kv, err = b.GetAt(ctx, []byte("/apisix/upstreams/1"), 0)
+	assert.Nil(t, err, "checking error")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, int64(5), kv.CreateRevision, "checking create revision")
+		assert.Equal(t, int64(2), kv.Version, "checking version")
+	}
+
+	_, err = OpenBoltCache(zap.NewNop(), &Options{})
+	assert.NotNil(t, err, "checking error")
+	assert.Panics(t, func() {
+		NewBoltCache(zap.NewNop(), nil)
+	}, "checking panic")
+}
+
+func TestBoltCacheReopenLeases(t *testing.T) {
+	opts := &Options{
+		Path: filepath.Join(t.TempDir(), "bolt.db"),
+	}
+	b := openTestBoltCache(t, opts)
+	ctx := context.Background()
+	_, err := b.Create(ctx, "/apisix/routes/1", []byte("v1"), 5)
+	assert.Nil(t, err, "checking error")
+	kv, err := b.GetAt(ctx, []byte("/apisix/routes/1"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(5), kv.Lease, "checking lease")
+	assert.Nil(t, b.Close(), "checking error")
+
+	// The lease doesn't exist after the restart, so the key is restored
+	// without it.
+	b = openTestBoltCache(t, opts)
+	defer func() {
+		assert.Nil(t, b.Close(), "checking error")
+	}()
+	kv, err = b.GetAt(ctx, []byte("/apisix/routes/1"), 0)
+	assert.Nil(t, err, "checking error")
+	if assert.NotNil(t, kv, "checking kv") {
+		assert.Equal(t, []byte("v1"), kv.Value, "checking value")
+		assert.Equal(t, int64(0), kv.Lease, "checking lease")
+	}
+}
+
+func TestBoltCacheCompactFile(t *testing.T) {
+	opts := &Options{
+		Path:             filepath.Join(t.TempDir(), "bolt.db"),
+		HistoryRevisions: 64,
+		NoSync:           true,
+	}
+	b := openTestBoltCache(t, opts)
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		txn := b.Write(ctx)
+		key := []byte(fmt.Sprintf("/apisix/routes/%d", i%10))
+		if i%3 == 2 {
+			txn.DeleteRange(key, nil)
+		} else {
+			txn.Put(key, []byte(strconv.Itoa(i)), 0)
+		}
+		txn.End()
+	}
+	// The history is compacted in the file as it's compacted in memory,
+	// at most the retained revisions and the keys at the compacted one.
+	assert.Greater(t, b.CompactRevision(), int64(1), "checking compact revision")
+	assert.LessOrEqual(t, countFileChanges(t, b), 64+64/8+10, "checking changes in the file")
+
+	before := rangeAll(t, b)
+	history, err := b.History(ctx)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, b.Close(), "checking error")
+
+	b = openTestBoltCache(t, opts)
+	defer func() {
+		assert.Nil(t, b.Close(), "checking error")
+	}()
+	assert.Equal(t, before, rangeAll(t, b), "checking key-values")
+	restored, err := b.History(ctx)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, history, restored, "checking history")
+}
+
+func TestBoltCacheRestore(t *testing.T) {
+	src := btree.NewBTreeCache(zap.NewNop())
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := src.Create(ctx, fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	_, _, _, err := src.Delete(ctx, "/apisix/routes/0", 2)
+	assert.Nil(t, err, "checking error")
+	_, err = src.Compact(ctx, 5)
+	assert.Nil(t, err, "checking error")
+	history, err := src.History(ctx)
+	assert.Nil(t, err, "checking error")
+
+	opts := &Options{
+		Path: filepath.Join(t.TempDir(), "bolt.db"),
+	}
+	b := openTestBoltCache(t, opts)
+	_, err = b.Create(ctx, "/apisix/ssls/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, b.Restore(ctx, history), "checking error")
+	assert.Nil(t, b.Close(), "checking error")
+
+	// The restored history replaces the one in the file.
+	b = openTestBoltCache(t, opts)
+	defer func() {
+		assert.Nil(t, b.Close(), "checking error")
+	}()
+	assert.Equal(t, rangeAll(t, src), rangeAll(t, b), "checking key-values")
+	restored, err := b.History(ctx)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, history, restored, "checking history")
+}
+
+// The helper writes to the file in BOLT_CRASH_PATH until it's killed, and
+// prints the revision of every transaction after it ends.
+func TestBoltCacheCrashHelper(t *testing.T) {
+	path := os.Getenv("BOLT_CRASH_PATH")
+	if path == "" {
+		t.Skip("only run by TestBoltCacheCrash")
+	}
+	b := openTestBoltCache(t, &Options{
+		Path:             path,
+		NoSync:           os.Getenv("BOLT_CRASH_NOSYNC") != "",
+		HistoryRevisions: 256,
+	})
+	ctx := context.Background()
+	for i := 0; ; i++ {
+		txn := b.Write(ctx)
+		rev := strconv.FormatInt(txn.Rev()+1, 10)
+		txn.Put([]byte(fmt.Sprintf("/apisix/routes/%d", i%64)), []byte(rev), 0)
+		txn.Put([]byte(fmt.Sprintf("/apisix/upstreams/%d", i%64)), []byte(rev), 0)
+		txn.End()
+		fmt.Println(rev)
+	}
+}
+
+// runCrashHelper runs the helper until it has written at least the number
+// of revisions, then kills it, and returns the last revision it printed.
+func runCrashHelper(t *testing.T, path string, noSync bool, revisions int) int64 {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBoltCacheCrashHelper$")
+	cmd.Env = append(os.Environ(), "BOLT_CRASH_PATH="+path)
+	if noSync {
+		cmd.Env = append(cmd.Env, "BOLT_CRASH_NOSYNC=1")
+	}
+	stdout, err := cmd.StdoutPipe()
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, cmd.Start(), "checking error")
+
+	var last int64
+	scanner := bufio.NewScanner(stdout)
+	for n := 0; n < revisions && scanner.Scan(); {
+		if rev, err := strconv.ParseInt(scanner.Text(), 10, 64); err == nil {
+			last = rev
+			n++
+		}
+	}
+	// The helper is killed in the middle of the writes.
+	assert.Nil(t, cmd.Process.Kill(), "checking error")
+	_ = cmd.Wait()
+	assert.Greater(t, last, int64(0), "checking helper progress")
+	return last
+}
+
+// checkCrashedFile checks the file left by the helper is consistent, and
+// returns its revision.
+func checkCrashedFile(t *testing.T, path string, lastRev int64) int64 {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if !assert.Nil(t, err, "checking error") {
+		t.FailNow()
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	})
+	assert.Nil(t, err, "checking file consistency")
+	assert.Nil(t, db.Close(), "checking error")
+
+	b := openTestBoltCache(t, &Options{Path: path, HistoryRevisions: 256})
+	defer func() {
+		assert.Nil(t, b.Close(), "checking error")
+	}()
+	ctx := context.Background()
+	rev := b.CurrentRevision()
+	// The printed revisions were committed, the helper might commit more
+	// before it's killed.
+	assert.GreaterOrEqual(t, rev, lastRev, "checking revision")
+
+	// Every transaction is restored as a whole.
+	for _, kv := range rangeAll(t, b).KVs {
+		assert.Equal(t, strconv.FormatInt(kv.ModRevision, 10), string(kv.Value), "checking value of "+string(kv.Key))
+	}
+	history, err := b.History(ctx)
+	assert.Nil(t, err, "checking error")
+	changes := make(map[int64]int)
+	for _, c := range history.Changes {
+		if c.Revision > history.CompactRevision {
+			changes[c.Revision]++
+		}
+	}
+	for r := history.CompactRevision + 1; r <= rev; r++ {
+		assert.Equal(t, 2, changes[r], fmt.Sprintf("checking changes at revision %d", r))
+	}
+	return rev
+}
+
+func TestBoltCacheCrash(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		noSync := noSync
+		t.Run(fmt.Sprintf("NoSync=%v", noSync), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bolt.db")
+			var rev int64
+			// The revisions keep increasing across the crashes.
+			for i := 0; i < 3; i++ {
+				last := runCrashHelper(t, path, noSync, 300)
+				assert.Greater(t, last, rev, "checking revision")
+				rev = checkCrashedFile(t, path, last)
+			}
+		})
+	}
+}
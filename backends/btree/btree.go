@@ -16,29 +16,69 @@
 package btree
 
 import (
+	"bytes"
 	"container/list"
 	"context"
+	"fmt"
+	"hash/crc32"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/btree"
 	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
 )
 
 var (
 	noPrefixEnd = []byte{0}
+	// keyBucketName is the name of the ETCD bucket which stores the
+	// key-values, it's the first thing hashed by HashKV.
+	keyBucketName = []byte("key")
 )
 
 type btreeCache struct {
 	sync.RWMutex
+	// cloneMu serializes the clones of the tree made by the readers, as
+	// cloning modifies the tree.
+	cloneMu         sync.Mutex
 	currentRevision int64
-	index           index
-	logger          *zap.Logger
-	tree            *btree.BTree
-	events          *list.List
-	watcherHub      map[string]map[*watcher]struct{}
+	compactRevision int64
+	// historyRevisions is the number of revisions retained, a non-positive
+	// value means no limit.
+	historyRevisions int64
+	index            index
+	logger           *zap.Logger
+	tree             *btree.BTree
+	events           *list.List
+	watcherHub       map[string]map[*watcher]struct{}
+	streamWatchers   *watcherGroup
+	// batching is the depth of the Batch calls, events are deferred
+	// to deferredEvents until the outermost call returns.
+	batching       int
+	deferredEvents []*mvccpb.Event
+	// notifiedRevision is the revision whose changes have been delivered
+	// to the stream watchers.
+	notifiedRevision int64
+	// notifyWorkers is the max number of the goroutines which deliver a
+	// change to the watchers.
+	notifyWorkers int
+	// size is the number of bytes of the keys and values in the tree,
+	// including the history.
+	size int64
+	// allocated is the max size since the last defragmentation, like the
+	// file of ETCD, the space freed by the compactions is not returned
+	// until the backend is defragmented.
+	allocated int64
+	// tombstones is the number of the tombstones in the tree, they're
+	// retained until the compactions pass them.
+	tombstones int64
+	// journal is nil if the journal is not enabled.
+	journal *journal
 }
 
 type watcher struct {
@@ -52,6 +92,18 @@ type item struct {
 	key   revision
 	value []byte
 	lease int64
+	// k is the key of the object, createRev and version are the ones at
+	// this revision, so that the history can be replayed from the tree.
+	k         []byte
+	createRev int64
+	version   int64
+	// tombstone indicates the object was deleted at this revision.
+	tombstone bool
+}
+
+// size returns the number of bytes accounted for the item.
+func (i *item) size() int64 {
+	return int64(len(i.k) + len(i.value))
 }
 
 func (i *item) Less(j btree.Item) bool {
@@ -60,18 +112,68 @@ func (i *item) Less(j btree.Item) bool {
 	return !(left == right || left.GreaterThan(right))
 }
 
-// NewBTreeCache returns a server.Backend interface which was implemented with
+// rangeCloneThreshold is the number of the keys in a range, beyond which the
+// key-values are made without holding the mutex.
+const rangeCloneThreshold = 256
+
+// DefaultHistoryRevisions is the default number of revisions retained for
+// the historical reads and watches.
+const DefaultHistoryRevisions = 100000
+
+// Options contains settings for the btree backend.
+type Options struct {
+	// HistoryRevisions is the number of revisions retained for the historical
+	// reads and watches, older revisions are compacted automatically. Default
+	// is DefaultHistoryRevisions, and a negative value means the history is
+	// retained until it's compacted explicitly.
+	HistoryRevisions int64
+	// NotifyWorkers is the max number of the goroutines which deliver a
+	// change to the watchers concurrently, default is GOMAXPROCS.
+	NotifyWorkers int
+	// Journal enables the journal, so that the backend is rebuilt from it
+	// when it's created again, see JournalOptions.
+	Journal *JournalOptions
+}
+
+// NewBTreeCache returns a backends.Backend interface which was implemented with
 // the b-tree.
 // Note this implementation is thread-safe. So feel free to use it among
 // different goroutines.
-func NewBTreeCache(logger *zap.Logger) server.Backend {
+func NewBTreeCache(logger *zap.Logger) backends.Backend {
+	return NewBTreeCacheWithOptions(logger, nil)
+}
+
+// NewBTreeCacheWithOptions is same as NewBTreeCache, but the backend is
+// customized by the options. It panics if the journal cannot be opened, use
+// OpenBTreeCache to handle the error.
+func NewBTreeCacheWithOptions(logger *zap.Logger, opts *Options) backends.Backend {
+	b, err := OpenBTreeCache(logger, opts)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open journal: %s", err))
+	}
+	return b
+}
+
+func newBTreeCache(logger *zap.Logger, opts *Options) *btreeCache {
+	historyRevisions := int64(DefaultHistoryRevisions)
+	if opts != nil && opts.HistoryRevisions != 0 {
+		historyRevisions = opts.HistoryRevisions
+	}
+	notifyWorkers := runtime.GOMAXPROCS(0)
+	if opts != nil && opts.NotifyWorkers > 0 {
+		notifyWorkers = opts.NotifyWorkers
+	}
 	return &btreeCache{
-		currentRevision: 1,
-		logger:          logger,
-		tree:            btree.New(32),
-		index:           newTreeIndex(logger),
-		events:          list.New(),
-		watcherHub:      make(map[string]map[*watcher]struct{}),
+		currentRevision:  1,
+		notifiedRevision: 1,
+		historyRevisions: historyRevisions,
+		notifyWorkers:    notifyWorkers,
+		logger:           logger,
+		tree:             btree.New(32),
+		index:            newTreeIndex(logger),
+		events:           list.New(),
+		watcherHub:       make(map[string]map[*watcher]struct{}),
+		streamWatchers:   newWatcherGroup(),
 	}
 }
 
@@ -80,6 +182,18 @@ func (b *btreeCache) Start(ctx context.Context) error {
 	return nil
 }
 
+func (b *btreeCache) CurrentRevision() int64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.currentRevision
+}
+
+func (b *btreeCache) CompactRevision() int64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.compactRevision
+}
+
 func (b *btreeCache) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
 	b.RLock()
 	defer b.RUnlock()
@@ -118,75 +232,76 @@ func (b *btreeCache) getLocked(_ context.Context, key string, revision int64) (i
 
 }
 
+// DbSize returns the number of bytes allocated for the keys and values, it
+// doesn't shrink after compactions until the backend is defragmented.
 func (b *btreeCache) DbSize(_ context.Context) (int64, error) {
-	return 0, nil
+	b.RLock()
+	defer b.RUnlock()
+	return b.allocated, nil
 }
 
-func (b *btreeCache) Create(_ context.Context, key string, value []byte, lease int64) (int64, error) {
-	b.Lock()
-	defer b.Unlock()
-	if _, _, _, err := b.index.Get([]byte(key), b.currentRevision); err == nil || err != ErrRevisionNotFound {
-		if err == nil {
-			return b.currentRevision, server.ErrKeyExists
-		}
-		return b.currentRevision, err
+// DbSizeInUse returns the number of bytes of the keys and values, including
+// the ones in the history.
+func (b *btreeCache) DbSizeInUse(_ context.Context) (int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.size, nil
+}
+
+// Tombstones returns the number of the tombstones retained in the history.
+func (b *btreeCache) Tombstones() int64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.tombstones
+}
+
+// insertLocked inserts the item into the tree and accounts its size. Note
+// this method should be invoked only if the mutex is locked.
+func (b *btreeCache) insertLocked(it *item) {
+	b.tree.ReplaceOrInsert(it)
+	b.size += it.size()
+	if it.tombstone {
+		b.tombstones++
+	}
+	if b.size > b.allocated {
+		b.allocated = b.size
 	}
-	b.currentRevision++
+}
 
-	rev := revision{
-		main: b.currentRevision,
-		sub:  0,
+func (b *btreeCache) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	txn := b.Write(ctx)
+	defer txn.End()
+	res, err := txn.Range([]byte(key), nil, backends.RangeOptions{CountOnly: true})
+	if err != nil {
+		return txn.Rev(), err
 	}
-	b.index.Put([]byte(key), rev)
-	it := &item{
-		key:   rev,
-		value: value,
-		lease: lease,
+	if res.Count > 0 {
+		return txn.Rev(), server.ErrKeyExists
 	}
-	b.tree.ReplaceOrInsert(it)
-	b.makeEvent(&server.KeyValue{
-		Key:            key,
-		CreateRevision: b.currentRevision,
-		ModRevision:    b.currentRevision,
-		Value:          value,
-		Lease:          lease,
-	}, nil, false)
-	return rev.main, nil
+	return txn.Put([]byte(key), value, lease), nil
 }
 
 func (b *btreeCache) Update(ctx context.Context, key string, value []byte, atRev, lease int64) (int64, *server.KeyValue, bool, error) {
-	b.Lock()
-	defer b.Unlock()
+	txn := b.Write(ctx)
+	defer txn.End()
 	_, kv, err := b.getLocked(ctx, key, atRev)
 	if err != nil {
-		return b.currentRevision, nil, false, err
+		return txn.Rev(), nil, false, err
 	}
 	if kv == nil {
-		return b.currentRevision, nil, false, nil
+		return txn.Rev(), nil, false, nil
 	}
 	if kv.ModRevision != atRev {
-		return b.currentRevision, kv, false, nil
-	}
-	b.currentRevision++
-	rev := revision{
-		main: b.currentRevision,
-	}
-	b.index.Put([]byte(key), rev)
-	it := &item{
-		key:   rev,
-		value: value,
-		lease: lease,
+		return txn.Rev(), kv, false, nil
 	}
-	b.tree.ReplaceOrInsert(it)
-	newKV := &server.KeyValue{
+	rev := txn.Put([]byte(key), value, lease)
+	return rev, &server.KeyValue{
 		Key:            key,
 		Value:          value,
 		CreateRevision: kv.CreateRevision,
-		ModRevision:    b.currentRevision,
+		ModRevision:    rev,
 		Lease:          lease,
-	}
-	b.makeEvent(newKV, kv, false)
-	return b.currentRevision, newKV, true, nil
+	}, true, nil
 }
 
 func (b *btreeCache) List(_ context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
@@ -238,39 +353,492 @@ func (b *btreeCache) List(_ context.Context, prefix, startKey string, limit, rev
 	return b.currentRevision, kvs, nil
 }
 
+func (b *btreeCache) Range(_ context.Context, key, end []byte, opts backends.RangeOptions) (*backends.RangeResult, error) {
+	b.RLock()
+	res, keys, revs, err := b.rangeKeysLocked(key, end, opts, b.currentRevision)
+	if err != nil || len(keys) <= rangeCloneThreshold {
+		if err == nil {
+			res.KVs = makeKVs(b.tree, keys, revs)
+		}
+		b.RUnlock()
+		return res, err
+	}
+	// The key-values of a large range are made from a clone of the tree,
+	// so that the writers are not blocked meanwhile. The clone shares the
+	// nodes until they're written, and the items are never modified.
+	b.cloneMu.Lock()
+	tree := b.tree.Clone()
+	b.cloneMu.Unlock()
+	b.RUnlock()
+	res.KVs = makeKVs(tree, keys, revs)
+	return res, nil
+}
+
+// rangeLocked ranges the keys with the given current revision. Note this
+// method should be invoked only if the mutex is locked.
+func (b *btreeCache) rangeLocked(key, end []byte, opts backends.RangeOptions, currentRevision int64) (*backends.RangeResult, error) {
+	res, keys, revs, err := b.rangeKeysLocked(key, end, opts, currentRevision)
+	if err != nil {
+		return nil, err
+	}
+	res.KVs = makeKVs(b.tree, keys, revs)
+	return res, nil
+}
+
+// rangeKeysLocked finds the keys in the range and their revisions, which
+// are limited by opts.Limit, the key-values in the result are left to be
+// made. Note this method should be invoked only if the mutex is locked.
+func (b *btreeCache) rangeKeysLocked(key, end []byte, opts backends.RangeOptions, currentRevision int64) (*backends.RangeResult, [][]byte, []revision, error) {
+	revision := opts.Revision
+	if revision <= 0 {
+		revision = currentRevision
+	}
+	if revision > currentRevision {
+		return nil, nil, nil, backends.ErrFutureRevision
+	}
+	if revision < b.compactRevision {
+		return nil, nil, nil, backends.ErrCompacted
+	}
+	if len(end) == 0 {
+		end = nil
+	} else if bytes.Equal(end, noPrefixEnd) {
+		// An empty (but not nil) end means to the end of the index.
+		end = []byte{}
+	}
+
+	if opts.CountOnly {
+		// The keys are counted without being collected.
+		return &backends.RangeResult{
+			Revision: currentRevision,
+			Count:    int64(b.index.CountRevisions(key, end, revision)),
+		}, nil, nil, nil
+	}
+	keys, revs := b.index.Range(key, end, revision)
+	res := &backends.RangeResult{
+		Revision: currentRevision,
+		Count:    int64(len(keys)),
+	}
+	if opts.Limit > 0 && int64(len(keys)) > opts.Limit {
+		keys = keys[:opts.Limit]
+		revs = revs[:opts.Limit]
+	}
+	return res, keys, revs, nil
+}
+
+// makeKVs makes the key-values from the items of the tree at the revisions,
+// the items keep the create revisions and the versions at their revisions.
+func makeKVs(tree *btree.BTree, keys [][]byte, revs []revision) []*mvccpb.KeyValue {
+	kvs := make([]*mvccpb.KeyValue, 0, len(keys))
+	for i, key := range keys {
+		v := tree.Get(&item{
+			key: revs[i],
+		})
+		if v == nil {
+			// Should not happen.
+			continue
+		}
+		it := v.(*item)
+		kvs = append(kvs, &mvccpb.KeyValue{
+			Key:            key,
+			CreateRevision: it.createRev,
+			ModRevision:    revs[i].main,
+			Version:        it.version,
+			Value:          it.value,
+			Lease:          it.lease,
+		})
+	}
+	return kvs
+}
+
 func (b *btreeCache) Delete(ctx context.Context, key string, atRev int64) (int64, *server.KeyValue, bool, error) {
-	b.Lock()
-	defer b.Unlock()
+	txn := b.Write(ctx)
+	defer txn.End()
 	_, kv, err := b.getLocked(ctx, key, atRev)
 	if err != nil {
-		return b.currentRevision, nil, false, err
+		return txn.Rev(), nil, false, err
 	}
 	if kv == nil {
-		return b.currentRevision, nil, false, nil
+		return txn.Rev(), nil, false, nil
 	}
 	if kv.ModRevision != atRev {
-		return b.currentRevision, kv, false, nil
+		return txn.Rev(), kv, false, nil
+	}
+	_, rev := txn.DeleteRange([]byte(key), nil)
+	return rev, kv, true, nil
+}
+
+func (b *btreeCache) Count(_ context.Context, prefix string) (int64, int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	// An empty prefix counts all the keys, as its range end is noPrefixEnd.
+	res, _, _, err := b.rangeKeysLocked([]byte(prefix), getPrefix([]byte(prefix)), backends.RangeOptions{CountOnly: true}, b.currentRevision)
+	if err != nil {
+		return 0, 0, err
 	}
+	return res.Revision, res.Count, nil
+}
 
-	b.currentRevision++
-	rev := revision{
-		main: b.currentRevision,
+func (b *btreeCache) Compact(_ context.Context, revision int64) (int64, error) {
+	b.Lock()
+	defer b.Unlock()
+	if revision <= b.compactRevision {
+		return b.currentRevision, backends.ErrCompacted
 	}
-	if err := b.index.Tombstone([]byte(key), rev); err != nil {
-		return b.currentRevision, nil, false, err
+	if revision > b.currentRevision {
+		return b.currentRevision, backends.ErrFutureRevision
 	}
-	b.makeEvent(nil, kv, true)
+	b.compactLocked(revision)
+	b.journalCompactLocked(revision)
+	b.logger.Info("compacted",
+		zap.Int64("revision", revision),
+	)
+	return b.currentRevision, nil
+}
 
-	return b.currentRevision, kv, true, nil
+// HashKV hashes the items in the same way as the key bucket of ETCD is
+// hashed, the revision is the bucket key and the marshaled key-value is the
+// bucket value. Like ETCD, the tombstones before the compacted revision are
+// skipped as they're not kept by the compaction.
+func (b *btreeCache) HashKV(_ context.Context, rev int64) (*backends.HashKVResult, error) {
+	b.RLock()
+	defer b.RUnlock()
+	// Same as ETCD, the compacted revision itself cannot be hashed.
+	if rev > 0 && rev <= b.compactRevision {
+		return nil, backends.ErrCompacted
+	}
+	if rev > b.currentRevision {
+		return nil, backends.ErrFutureRevision
+	}
+	if rev <= 0 {
+		rev = b.currentRevision
+	}
+
+	var err error
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	h.Write(keyBucketName)
+	b.tree.AscendLessThan(&item{key: revision{main: rev + 1}}, func(i btree.Item) bool {
+		it := i.(*item)
+		if it.tombstone && it.key.main <= b.compactRevision {
+			return true
+		}
+		kv := &mvccpb.KeyValue{
+			Key: it.k,
+		}
+		revBytes := newRevBytes()
+		revToBytes(it.key, revBytes)
+		if it.tombstone {
+			revBytes = append(revBytes, markTombstone)
+		} else {
+			kv.CreateRevision = it.createRev
+			kv.ModRevision = it.key.main
+			kv.Version = it.version
+			kv.Value = it.value
+			kv.Lease = it.lease
+		}
+		var data []byte
+		if data, err = kv.Marshal(); err != nil {
+			return false
+		}
+		h.Write(revBytes)
+		h.Write(data)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &backends.HashKVResult{
+		Hash:            h.Sum32(),
+		Revision:        rev,
+		CompactRevision: b.compactRevision,
+	}, nil
 }
 
-func (b *btreeCache) Count(_ context.Context, prefix string) (int64, int64, error) {
+// History returns all the items in the tree as the changes.
+func (b *btreeCache) History(_ context.Context) (*backends.HistoryResult, error) {
 	b.RLock()
 	defer b.RUnlock()
+	res := &backends.HistoryResult{
+		Revision:        b.currentRevision,
+		CompactRevision: b.compactRevision,
+		Changes:         make([]*backends.Change, 0, b.tree.Len()),
+	}
+	b.tree.Ascend(func(i btree.Item) bool {
+		res.Changes = append(res.Changes, makeChange(i.(*item)))
+		return true
+	})
+	return res, nil
+}
 
-	end := getPrefixRangeEnd(prefix)
-	keys, _ := b.index.Range([]byte(prefix), []byte(end), b.currentRevision)
-	return b.currentRevision, int64(len(keys)), nil
+// makeChange makes the change of the item, only the key is kept if it's a
+// tombstone.
+func makeChange(it *item) *backends.Change {
+	change := &backends.Change{
+		Revision:  it.key.main,
+		Sub:       it.key.sub,
+		Tombstone: it.tombstone,
+		KV: &mvccpb.KeyValue{
+			Key: it.k,
+		},
+	}
+	if !it.tombstone {
+		change.KV.CreateRevision = it.createRev
+		change.KV.ModRevision = it.key.main
+		change.KV.Version = it.version
+		change.KV.Value = it.value
+		change.KV.Lease = it.lease
+	}
+	return change
+}
+
+// GetAt gets the key-value of the key at the revision by Range.
+func (b *btreeCache) GetAt(ctx context.Context, key []byte, revision int64) (*mvccpb.KeyValue, error) {
+	res, err := b.RangeAt(ctx, key, nil, revision)
+	if err != nil || len(res.KVs) == 0 {
+		return nil, err
+	}
+	return res.KVs[0], nil
+}
+
+// RangeAt is same as Range without the limit.
+func (b *btreeCache) RangeAt(ctx context.Context, key, end []byte, revision int64) (*backends.RangeResult, error) {
+	return b.Range(ctx, key, end, backends.RangeOptions{Revision: revision})
+}
+
+// KeyHistory looks up the revisions of the key since fromRev in the index,
+// so only the items of the key are visited in the tree.
+func (b *btreeCache) KeyHistory(_ context.Context, key []byte, fromRev int64) ([]*backends.Change, error) {
+	b.RLock()
+	defer b.RUnlock()
+	if fromRev <= 0 {
+		fromRev = b.compactRevision
+	}
+	if fromRev > b.currentRevision {
+		return nil, backends.ErrFutureRevision
+	}
+	if fromRev < b.compactRevision {
+		return nil, backends.ErrCompacted
+	}
+	revs := b.index.RangeSince(key, nil, fromRev)
+	changes := make([]*backends.Change, 0, len(revs))
+	for _, rev := range revs {
+		v := b.tree.Get(&item{
+			key: rev,
+		})
+		if v == nil {
+			// Should not happen.
+			continue
+		}
+		changes = append(changes, makeChange(v.(*item)))
+	}
+	return changes, nil
+}
+
+// Restore rebuilds the tree and the index from the history, the changes
+// before the compacted revision are the key-values at it, so the first
+// change of such a key restores its generation.
+func (b *btreeCache) Restore(_ context.Context, history *backends.HistoryResult) error {
+	if history.CompactRevision > history.Revision {
+		return fmt.Errorf("compacted revision %d is greater than revision %d", history.CompactRevision, history.Revision)
+	}
+	for i, c := range history.Changes {
+		if c.Revision > history.Revision {
+			return fmt.Errorf("change at revision %d is greater than revision %d", c.Revision, history.Revision)
+		}
+		if i > 0 {
+			prev := history.Changes[i-1]
+			if !(revision{main: c.Revision, sub: c.Sub}).GreaterThan(revision{main: prev.Revision, sub: prev.Sub}) {
+				return fmt.Errorf("changes are not sorted by revision at %d", c.Revision)
+			}
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.tree = btree.New(32)
+	b.index = newTreeIndex(b.logger)
+	b.size = 0
+	b.allocated = 0
+	b.tombstones = 0
+	for _, c := range history.Changes {
+		rev := revision{main: c.Revision, sub: c.Sub}
+		if c.Tombstone {
+			if err := b.index.Tombstone(c.KV.Key, rev); err != nil {
+				// The key was deleted before the compacted revision.
+				continue
+			}
+			b.insertLocked(&item{
+				key:       rev,
+				k:         c.KV.Key,
+				tombstone: true,
+			})
+			continue
+		}
+		if b.index.KeyIndex(&keyIndex{key: c.KV.Key}) == nil {
+			ki := &keyIndex{key: c.KV.Key}
+			ki.restore(b.logger, revision{main: c.KV.CreateRevision}, rev, c.KV.Version)
+			b.index.Insert(ki)
+		} else {
+			b.index.Put(c.KV.Key, rev)
+		}
+		b.insertLocked(&item{
+			key:       rev,
+			value:     c.KV.Value,
+			lease:     c.KV.Lease,
+			k:         c.KV.Key,
+			createRev: c.KV.CreateRevision,
+			version:   c.KV.Version,
+		})
+	}
+	b.currentRevision = history.Revision
+	b.compactRevision = history.CompactRevision
+	b.notifiedRevision = history.Revision
+	// Nobody watches the restored changes.
+	b.events = list.New()
+	b.logger.Info("restored",
+		zap.Int64("revision", history.Revision),
+		zap.Int64("compact_revision", history.CompactRevision),
+		zap.Int("changes", len(history.Changes)),
+	)
+	if b.journal != nil {
+		// The journal starts over from the restored keyspace.
+		return b.journal.rotateLocked(b)
+	}
+	return nil
+}
+
+// maxDefragmentRetries is the number of times the tree is rebuilt with the
+// mutex released, if it's compacted during each rebuilding, it's rebuilt
+// with the mutex locked at last, so that Defragment always ends.
+const maxDefragmentRetries = 3
+
+// Defragment rebuilds the tree from the items retained by the compactions,
+// so that the memory of the deleted nodes is released, and the allocated
+// size shrinks to the size in use. The tree is rebuilt from a copy with the
+// mutex released, reads are only blocked while the copy is made and the
+// rebuilt tree is swapped in.
+func (b *btreeCache) Defragment(_ context.Context) error {
+	for i := 0; i < maxDefragmentRetries; i++ {
+		b.Lock()
+		clone := b.tree.Clone()
+		rev := b.currentRevision
+		compactRev := b.compactRevision
+		b.Unlock()
+
+		rebuilt := rebuildTree(clone, compactRev)
+
+		b.Lock()
+		// Compacted during the rebuilding, the rebuilt tree might contain
+		// the discarded items, try again.
+		if b.compactRevision != compactRev {
+			b.Unlock()
+			continue
+		}
+		// Catch up with the changes made during the rebuilding.
+		b.tree.AscendGreaterOrEqual(&item{key: revision{main: rev + 1}}, func(i btree.Item) bool {
+			rebuilt.add(i.(*item))
+			return true
+		})
+		b.swapTreeLocked(rebuilt)
+		b.Unlock()
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.swapTreeLocked(rebuildTree(b.tree, b.compactRevision))
+	return nil
+}
+
+// rebuiltTree is the tree rebuilt by Defragment, with its size and the
+// number of its tombstones.
+type rebuiltTree struct {
+	tree       *btree.BTree
+	size       int64
+	tombstones int64
+}
+
+// rebuildTree copies the items of the tree into a new one, except the
+// tombstones discarded by the compaction at compactRev.
+func rebuildTree(tree *btree.BTree, compactRev int64) *rebuiltTree {
+	rebuilt := &rebuiltTree{
+		tree: btree.New(32),
+	}
+	tree.Ascend(func(i btree.Item) bool {
+		it := i.(*item)
+		// The compaction keeps the tombstones at the compacted revision,
+		// the ones before it are not needed by anyone.
+		if it.tombstone && it.key.main < compactRev {
+			return true
+		}
+		rebuilt.add(it)
+		return true
+	})
+	return rebuilt
+}
+
+func (t *rebuiltTree) add(it *item) {
+	t.tree.ReplaceOrInsert(it)
+	t.size += it.size()
+	if it.tombstone {
+		t.tombstones++
+	}
+}
+
+// swapTreeLocked replaces the tree with the rebuilt one. Note this method
+// should be invoked only if the mutex is locked.
+func (b *btreeCache) swapTreeLocked(rebuilt *rebuiltTree) {
+	b.logger.Info("defragmented",
+		zap.Int64("size", b.allocated),
+		zap.Int64("size_after", rebuilt.size),
+	)
+	b.tree = rebuilt.tree
+	b.size = rebuilt.size
+	b.allocated = rebuilt.size
+	b.tombstones = rebuilt.tombstones
+}
+
+// compactLocked discards all the revisions which are not needed to read
+// at or after the given revision. Note this method should be invoked only
+// if the mutex is locked.
+func (b *btreeCache) compactLocked(rev int64) {
+	available := b.index.Compact(rev)
+	var stale []btree.Item
+	// Items at the compacted revision are kept, so that the changes since
+	// the compacted revision can still be watched.
+	b.tree.AscendLessThan(&item{key: revision{main: rev}}, func(i btree.Item) bool {
+		if _, ok := available[i.(*item).key]; !ok {
+			stale = append(stale, i)
+		}
+		return true
+	})
+	for _, i := range stale {
+		it := i.(*item)
+		b.tree.Delete(it)
+		b.size -= it.size()
+		if it.tombstone {
+			b.tombstones--
+		}
+	}
+	b.compactRevision = rev
+}
+
+// autoCompactLocked compacts the revisions beyond the retained history. To
+// amortize the cost, it doesn't happen until the history exceeds the limit
+// by an eighth. Note this method should be invoked only if the mutex is
+// locked.
+func (b *btreeCache) autoCompactLocked() {
+	if b.historyRevisions <= 0 {
+		return
+	}
+	if b.currentRevision-b.compactRevision <= b.historyRevisions+b.historyRevisions/8 {
+		return
+	}
+	rev := b.currentRevision - b.historyRevisions
+	b.compactLocked(rev)
+	b.logger.Debug("compacted automatically",
+		zap.Int64("revision", rev),
+	)
 }
 
 func (b *btreeCache) Watch(ctx context.Context, key string, startRevision int64) <-chan []*server.Event {
@@ -350,11 +918,14 @@ func (b *btreeCache) removeWatcher(ctx context.Context, key string, w *watcher)
 func (b *btreeCache) makeEvent(kv, prevKV *server.KeyValue, deleteEvent bool) {
 	var ev *server.Event
 	if deleteEvent {
-		ev = &server.Event{
-			Delete: true,
+		if kv == nil {
 			// Kine uses KV field to get the mod revision, so even for delete event,
 			// add the kv field.
-			KV:     prevKV,
+			kv = prevKV
+		}
+		ev = &server.Event{
+			Delete: true,
+			KV:     kv,
 			PrevKV: prevKV,
 		}
 	} else {
@@ -378,6 +949,9 @@ func (b *btreeCache) sendEvents(ctx context.Context) {
 		case <-ticker.C:
 			break
 		}
+		// Changes in a write transaction are made with the mutex locked,
+		// so their events are always in the same backlog, and they are sent
+		// to the watchers in one batch.
 		b.Lock()
 		events := b.events
 		b.events = list.New()
@@ -17,13 +17,21 @@ package btree
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/backendtest"
 )
 
 func init() {
@@ -40,6 +48,12 @@ func generateString(n int) string {
 	return string(b)
 }
 
+func TestBTreeCacheCompliance(t *testing.T) {
+	backendtest.Run(t, func() backends.Backend {
+		return NewBTreeCache(zap.NewNop())
+	})
+}
+
 func TestBTreeCacheSimpleOperations(t *testing.T) {
 	backend := NewBTreeCache(zap.NewExample())
 	assert.Nil(t, backend.Start(context.Background()), "checking error")
@@ -253,6 +267,11 @@ func TestBTreeCacheCount(t *testing.T) {
 	assert.Equal(t, int64(5), rev, "checking rev")
 	assert.Equal(t, int64(1), count, "checking count")
 	assert.Nil(t, err, "checking error")
+
+	rev, count, err = backend.Count(context.Background(), "")
+	assert.Equal(t, int64(5), rev, "checking rev")
+	assert.Equal(t, int64(4), count, "checking count")
+	assert.Nil(t, err, "checking error")
 }
 
 func TestBTreeCacheList(t *testing.T) {
@@ -318,6 +337,437 @@ func TestBTreeCacheList(t *testing.T) {
 	assert.Nil(t, err, "checking error")
 }
 
+func TestBTreeCacheRange(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes2", "/apisix/upstreams/1"} {
+		_, err := backend.Create(context.Background(), key, []byte(key), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	cases := []struct {
+		name string
+		key  string
+		end  string
+		keys []string
+	}{
+		{
+			name: "single key",
+			key:  "/apisix/routes/1",
+			keys: []string{"/apisix/routes/1"},
+		},
+		{
+			name: "single key not found",
+			key:  "/apisix/routes/3",
+		},
+		{
+			name: "prefix",
+			key:  "/apisix/routes",
+			end:  "/apisix/routet",
+			keys: []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes2"},
+		},
+		{
+			name: "range",
+			key:  "/apisix/routes/2",
+			end:  "/apisix/upstreams/1",
+			keys: []string{"/apisix/routes/2", "/apisix/routes2"},
+		},
+		{
+			name: "from key",
+			key:  "/apisix/routes2",
+			end:  "\x00",
+			keys: []string{"/apisix/routes2", "/apisix/upstreams/1"},
+		},
+		{
+			name: "whole keyspace",
+			key:  "",
+			end:  "\x00",
+			keys: []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes2", "/apisix/upstreams/1"},
+		},
+		{
+			name: "whole keyspace from the zero byte",
+			key:  "\x00",
+			end:  "\x00",
+			keys: []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes2", "/apisix/upstreams/1"},
+		},
+		{
+			name: "end before key",
+			key:  "/apisix/upstreams/1",
+			end:  "/apisix/routes/1",
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var end []byte
+			if tc.end != "" {
+				end = []byte(tc.end)
+			}
+			res, err := backend.Range(context.Background(), []byte(tc.key), end, backends.RangeOptions{})
+			assert.Nil(t, err, "checking error")
+			assert.Equal(t, int64(5), res.Revision, "checking revision")
+			var keys []string
+			for _, kv := range res.KVs {
+				keys = append(keys, string(kv.Key))
+				assert.Equal(t, kv.Key, kv.Value, "checking value")
+			}
+			assert.Equal(t, tc.keys, keys, "checking keys")
+		})
+	}
+
+	// range at a historical revision.
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes"), []byte("/apisix/routet"), backends.RangeOptions{
+		Revision: 3,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 2, "checking kvs")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    2,
+		Version:        1,
+		Value:          []byte("/apisix/routes/1"),
+	}, res.KVs[0], "checking kv")
+}
+
+func TestBTreeCacheRangeBinaryKeys(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+
+	// The keys are ordered by bytes, regardless of the encoding.
+	keys := []string{"/k/\x00", "/k/a", "/k/\u00e9", "/k/\u4e2d", "/k/\xff", "/k/\xff\x00", "/k0"}
+	for _, key := range keys {
+		_, err := backend.Create(context.Background(), key, []byte(key), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	cases := []struct {
+		name string
+		key  string
+		end  string
+		keys []string
+	}{
+		{
+			name: "single zero byte key",
+			key:  "/k/\x00",
+			keys: []string{"/k/\x00"},
+		},
+		{
+			name: "single invalid UTF-8 key",
+			key:  "/k/\xff",
+			keys: []string{"/k/\xff"},
+		},
+		{
+			name: "prefix",
+			key:  "/k/",
+			end:  "/k0",
+			keys: keys[:6],
+		},
+		{
+			name: "prefix ending with 0xff",
+			key:  "/k/\xff",
+			end:  "/k0",
+			keys: []string{"/k/\xff", "/k/\xff\x00"},
+		},
+		{
+			name: "unicode range",
+			key:  "/k/\u00e9",
+			end:  "/k/\u4e2e",
+			keys: []string{"/k/\u00e9", "/k/\u4e2d"},
+		},
+		{
+			name: "from key",
+			key:  "/k/\u4e2d",
+			end:  "\x00",
+			keys: []string{"/k/\u4e2d", "/k/\xff", "/k/\xff\x00", "/k0"},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var end []byte
+			if tc.end != "" {
+				end = []byte(tc.end)
+			}
+			res, err := backend.Range(context.Background(), []byte(tc.key), end, backends.RangeOptions{})
+			assert.Nil(t, err, "checking error")
+			var keys []string
+			for _, kv := range res.KVs {
+				keys = append(keys, string(kv.Key))
+				assert.Equal(t, kv.Key, kv.Value, "checking value")
+			}
+			assert.Equal(t, tc.keys, keys, "checking keys")
+			assert.Equal(t, int64(len(tc.keys)), res.Count, "checking count")
+		})
+	}
+}
+
+func TestBTreeCacheRangeLimit(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/apisix/routes/%d", i)
+		_, err := backend.Create(context.Background(), key, []byte(key), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{
+		Limit: 3,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 3, "checking kvs")
+	assert.Equal(t, int64(10), res.Count, "checking count")
+	assert.Equal(t, "/apisix/routes/2", string(res.KVs[2].Key), "checking last key")
+
+	res, err = backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{
+		Limit: 100,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 10, "checking kvs")
+	assert.Equal(t, int64(10), res.Count, "checking count")
+}
+
+func TestBTreeCacheRangeCountOnly(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/apisix/routes/%d", i)
+		_, err := backend.Create(context.Background(), key, []byte(key), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{
+		Limit:     3,
+		CountOnly: true,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 0, "checking kvs")
+	assert.Equal(t, int64(10), res.Count, "checking count")
+	assert.Equal(t, int64(11), res.Revision, "checking revision")
+
+	// From the key to the end.
+	res, err = backend.Range(context.Background(), []byte("/apisix/routes/5"), noPrefixEnd, backends.RangeOptions{
+		CountOnly: true,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(5), res.Count, "checking count")
+
+	// The end is not greater than the key.
+	res, err = backend.Range(context.Background(), []byte("/apisix/routes/5"), []byte("/apisix/routes/5"), backends.RangeOptions{
+		CountOnly: true,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), res.Count, "checking count")
+
+	// Only the key itself.
+	res, err = backend.Range(context.Background(), []byte("/apisix/routes/5"), nil, backends.RangeOptions{
+		CountOnly: true,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), res.Count, "checking count")
+}
+
+func TestBTreeCacheRangeHistory(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	rev, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	rev, _, _, err = backend.Update(context.Background(), "/apisix/routes/1", []byte("v2"), rev, 0)
+	assert.Nil(t, err, "checking error")
+	rev, _, _, err = backend.Update(context.Background(), "/apisix/routes/1", []byte("v3"), rev, 0)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/routes/2", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+
+	for rev, expected := range map[int64]struct {
+		value   string
+		version int64
+	}{
+		2: {"v1", 1},
+		3: {"v2", 2},
+		4: {"v3", 3},
+		5: {"v3", 3},
+	} {
+		res, err := backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{
+			Revision: rev,
+		})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, int64(5), res.Revision, "checking revision")
+		assert.Len(t, res.KVs, 1, "checking kvs")
+		assert.Equal(t, expected.value, string(res.KVs[0].Value), "checking value")
+		assert.Equal(t, expected.version, res.KVs[0].Version, "checking version")
+	}
+
+	_, err = backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{
+		Revision: 6,
+	})
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+
+	_, err = backend.Compact(context.Background(), 6)
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+	rev, err = backend.Compact(context.Background(), 3)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(5), rev, "checking revision")
+	_, err = backend.Compact(context.Background(), 3)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	cache := backend.(*btreeCache)
+
+	_, err = backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{
+		Revision: 2,
+	})
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{
+		Revision: 3,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v2", string(res.KVs[0].Value), "checking value")
+	assert.Equal(t, 3, cache.tree.Len(), "checking the number of items")
+}
+
+func TestBTreeCacheWritePut(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	assert.Nil(t, backend.Start(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := backend.Watch(ctx, "/apisix/routes", 0)
+
+	txn := backend.Write(context.Background())
+	assert.Equal(t, int64(2), txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0), "checking revision")
+	assert.Equal(t, int64(2), txn.Put([]byte("/apisix/routes/1"), []byte("v2"), 0), "checking revision")
+	assert.Equal(t, int64(2), txn.Put([]byte("/apisix/routes/2"), []byte("v1"), 0), "checking revision")
+	res, err := txn.Range([]byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), res.Revision, "checking revision")
+	assert.Equal(t, "v2", string(res.KVs[0].Value), "checking value")
+	txn.End()
+
+	res, err = backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), res.Revision, "checking revision")
+	assert.Equal(t, []*mvccpb.KeyValue{
+		{
+			Key:            []byte("/apisix/routes/1"),
+			CreateRevision: 2,
+			ModRevision:    2,
+			Version:        2,
+			Value:          []byte("v2"),
+		},
+		{
+			Key:            []byte("/apisix/routes/2"),
+			CreateRevision: 2,
+			ModRevision:    2,
+			Version:        1,
+			Value:          []byte("v1"),
+		},
+	}, res.KVs, "checking kvs")
+
+	// A transaction without changes doesn't increase the revision.
+	txn = backend.Write(context.Background())
+	txn.End()
+	txn = backend.Write(context.Background())
+	assert.Equal(t, int64(3), txn.Put([]byte("/apisix/routes/1"), []byte("v3"), 7), "checking revision")
+	txn.End()
+
+	kv, err := backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    3,
+		Version:        3,
+		Value:          []byte("v3"),
+		Lease:          7,
+	}, kv.KVs[0], "checking kv")
+
+	evs := <-ch
+	assert.Len(t, evs, 4, "checking events")
+	assert.Equal(t, "v1", string(evs[0].KV.Value), "checking event value")
+	assert.Nil(t, evs[0].PrevKV, "checking event prev kv")
+	assert.Equal(t, "v2", string(evs[1].KV.Value), "checking event value")
+	assert.Equal(t, "v1", string(evs[1].PrevKV.Value), "checking event prev kv")
+	assert.Equal(t, "/apisix/routes/2", evs[2].KV.Key, "checking event key")
+	assert.Equal(t, int64(3), evs[3].KV.ModRevision, "checking event mod revision")
+	assert.Equal(t, int64(2), evs[3].KV.CreateRevision, "checking event create revision")
+}
+
+func TestBTreeCacheWriteDeleteRange(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	assert.Nil(t, backend.Start(context.Background()))
+
+	txn := backend.Write(context.Background())
+	for _, key := range []string{"/apisix/consumers/1", "/apisix/consumers/2", "/apisix/routes/1"} {
+		txn.Put([]byte(key), []byte(key), 0)
+	}
+	txn.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := backend.Watch(ctx, "/apisix/consumers", 0)
+	// Drain the initial events.
+	<-ch
+
+	txn = backend.Write(context.Background())
+	deleted, rev := txn.DeleteRange([]byte("/apisix/consumers/"), []byte("/apisix/consumers0"))
+	txn.End()
+	assert.Equal(t, int64(2), deleted, "checking deleted")
+	assert.Equal(t, int64(3), rev, "checking revision")
+
+	res, err := backend.Range(context.Background(), []byte("/apisix/"), []byte("/apisix0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), res.Revision, "checking revision")
+	assert.Len(t, res.KVs, 1, "checking kvs")
+	assert.Equal(t, "/apisix/routes/1", string(res.KVs[0].Key), "checking key")
+
+	// Nothing is deleted, the revision keeps unchanged.
+	txn = backend.Write(context.Background())
+	deleted, rev = txn.DeleteRange([]byte("/apisix/consumers/"), []byte("/apisix/consumers0"))
+	txn.End()
+	assert.Equal(t, int64(0), deleted, "checking deleted")
+	assert.Equal(t, int64(3), rev, "checking revision")
+
+	evs := <-ch
+	assert.Len(t, evs, 2, "checking events")
+	for i, ev := range evs {
+		assert.True(t, ev.Delete, "checking delete flag")
+		assert.Equal(t, fmt.Sprintf("/apisix/consumers/%d", i+1), ev.KV.Key, "checking key")
+		assert.Equal(t, int64(3), ev.KV.ModRevision, "checking mod revision")
+		assert.Equal(t, int64(2), ev.PrevKV.ModRevision, "checking prev mod revision")
+	}
+
+	// The deleted key can be created again.
+	txn = backend.Write(context.Background())
+	txn.Put([]byte("/apisix/consumers/1"), []byte("v2"), 0)
+	txn.End()
+	res, err = backend.Range(context.Background(), []byte("/apisix/consumers/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), res.KVs[0].CreateRevision, "checking create revision")
+	assert.Equal(t, int64(1), res.KVs[0].Version, "checking version")
+}
+
+func TestBTreeCacheWriteWatch(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	assert.Nil(t, backend.Start(context.Background()))
+
+	txn := backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/3"), []byte("v1"), 0)
+	txn.End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := backend.Watch(ctx, "/apisix/routes", 0)
+	<-ch
+
+	txn = backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0)
+	txn.Put([]byte("/apisix/routes/2"), []byte("v1"), 0)
+	txn.DeleteRange([]byte("/apisix/routes/3"), nil)
+	txn.End()
+
+	evs := <-ch
+	assert.Len(t, evs, 3, "checking events")
+	for _, ev := range evs {
+		assert.Equal(t, int64(3), ev.KV.ModRevision, "checking revision")
+	}
+	assert.True(t, evs[2].Delete, "checking delete flag")
+}
+
 func TestBTreeCacheWatch(t *testing.T) {
 	backend := NewBTreeCache(zap.NewExample())
 	assert.Nil(t, backend.Start(context.Background()))
@@ -589,3 +1039,1114 @@ func BenchmarkBTreeCacheDelete(b *testing.B) {
 		})
 	}
 }
+
+func TestBTreeCacheWatchStream(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	id, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), id, "checking watch id")
+	id, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/2"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), id, "checking watch id")
+
+	_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/routes/3", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, ok, err := backend.Delete(context.Background(), "/apisix/routes/1", 2)
+	assert.True(t, ok, "checking delete success flag")
+	assert.Nil(t, err, "checking error")
+
+	resp := <-ws.Chan()
+	assert.Equal(t, int64(0), resp.WatchID, "checking watch id")
+	assert.Equal(t, int64(2), resp.Revision, "checking revision")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.PUT, resp.Events[0].Type, "checking event type")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    2,
+		Version:        1,
+		Value:          []byte("v1"),
+	}, resp.Events[0].Kv, "checking kv")
+
+	resp = <-ws.Chan()
+	assert.Equal(t, int64(0), resp.WatchID, "checking watch id")
+	assert.Equal(t, int64(4), resp.Revision, "checking revision")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type, "checking event type")
+	assert.Equal(t, int64(4), resp.Events[0].Kv.ModRevision, "checking revision")
+	assert.Equal(t, []byte("v1"), resp.Events[0].PrevKv.Value, "checking prev kv")
+
+	assert.Nil(t, ws.Cancel(0), "checking error")
+	assert.Equal(t, backends.ErrWatcherNotExist, ws.Cancel(0), "checking error")
+	resp = <-ws.Chan()
+	assert.Equal(t, int64(0), resp.WatchID, "checking watch id")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+
+	_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v2"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/routes/2", []byte("v2"), 0)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Equal(t, int64(1), resp.WatchID, "checking watch id")
+	assert.Equal(t, []byte("/apisix/routes/2"), resp.Events[0].Kv.Key, "checking key")
+}
+
+func TestBTreeCacheWatchStreamBatch(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	_, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+	assert.Nil(t, err, "checking error")
+
+	backend.Batch(func() {
+		for i := 0; i < 3; i++ {
+			_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+			assert.Nil(t, err, "checking error")
+		}
+	})
+
+	resp := <-ws.Chan()
+	assert.Equal(t, int64(4), resp.Revision, "checking revision")
+	assert.Len(t, resp.Events, 3, "checking events")
+	for i, ev := range resp.Events {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i), string(ev.Kv.Key), "checking key")
+		assert.Equal(t, int64(i+2), ev.Kv.ModRevision, "checking revision")
+	}
+}
+
+func TestBTreeCacheWatcherGroup(t *testing.T) {
+	wg := newWatcherGroup()
+	var watchers []*streamWatcher
+	for i := 0; i < 500; i++ {
+		w := &streamWatcher{
+			key: []byte(fmt.Sprintf("/%03d", rand.Intn(100))),
+		}
+		switch rand.Intn(3) {
+		case 0:
+			// single key watcher
+		case 1:
+			w.end = []byte{}
+		default:
+			w.end = []byte(fmt.Sprintf("/%03d", rand.Intn(100)))
+		}
+		wg.add(w)
+		watchers = append(watchers, w)
+	}
+	// remove some watchers randomly.
+	rand.Shuffle(len(watchers), func(i, j int) {
+		watchers[i], watchers[j] = watchers[j], watchers[i]
+	})
+	for _, w := range watchers[:200] {
+		wg.delete(w)
+	}
+	watchers = watchers[200:]
+	assert.Equal(t, len(watchers), wg.size, "checking size")
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("/%03d", i))
+		expected := make(map[*streamWatcher]struct{})
+		for _, w := range watchers {
+			if w.contains(key) {
+				expected[w] = struct{}{}
+			}
+		}
+		found := make(map[*streamWatcher]struct{})
+		wg.watchersOf(key, func(w *streamWatcher) {
+			found[w] = struct{}{}
+		})
+		assert.Equal(t, expected, found, "checking watchers of %s", key)
+	}
+}
+
+func TestBTreeCacheWatchStreamOverlappingPrefixes(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	for _, prefix := range []string{"/a/", "/a/b/", "/a/c/"} {
+		_, err := ws.Watch(backends.AutoWatchID, []byte(prefix), []byte(getPrefixRangeEnd(prefix)), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := ws.Watch(backends.AutoWatchID, []byte("/a/b/1"), []byte("\x00"), 0)
+	assert.Nil(t, err, "checking error")
+
+	_, err = backend.Create(context.Background(), "/a/b/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		resp := <-ws.Chan()
+		assert.Len(t, resp.Events, 1, "checking events")
+		assert.Equal(t, "/a/b/1", string(resp.Events[0].Kv.Key), "checking key")
+		ids = append(ids, resp.WatchID)
+	}
+	assert.ElementsMatch(t, []int64{0, 1, 3}, ids, "checking watch ids")
+
+	_, err = backend.Create(context.Background(), "/a/c/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	ids = ids[:0]
+	for i := 0; i < 3; i++ {
+		resp := <-ws.Chan()
+		assert.Equal(t, "/a/c/1", string(resp.Events[0].Kv.Key), "checking key")
+		ids = append(ids, resp.WatchID)
+	}
+	// "/a/c/1" is greater than "/a/b/1", so the from key watcher gets it too.
+	assert.ElementsMatch(t, []int64{0, 2, 3}, ids, "checking watch ids")
+}
+
+func TestBTreeCacheWatchStreamHistory(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	txn := backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0)
+	txn.Put([]byte("/apisix/upstreams/1"), []byte("v1"), 0)
+	txn.End()
+	txn = backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/1"), []byte("v2"), 0)
+	txn.End()
+	txn = backend.Write(context.Background())
+	txn.DeleteRange([]byte("/apisix/routes/1"), nil)
+	txn.End()
+
+	id, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 2)
+	assert.Nil(t, err, "checking error")
+	resp := <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.Equal(t, int64(4), resp.Revision, "checking revision")
+	assert.Len(t, resp.Events, 3, "checking events")
+	assert.Equal(t, mvccpb.PUT, resp.Events[0].Type, "checking event type")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    2,
+		Version:        1,
+		Value:          []byte("v1"),
+	}, resp.Events[0].Kv, "checking kv")
+	assert.Nil(t, resp.Events[0].PrevKv, "checking prev kv")
+	assert.Equal(t, int64(2), resp.Events[1].Kv.Version, "checking version")
+	assert.Equal(t, []byte("v1"), resp.Events[1].PrevKv.Value, "checking prev kv")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[2].Type, "checking event type")
+	assert.Equal(t, int64(4), resp.Events[2].Kv.ModRevision, "checking revision")
+	assert.Equal(t, []byte("v2"), resp.Events[2].PrevKv.Value, "checking prev kv")
+
+	// The live events follow the historical ones.
+	_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v3"), 0)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, int64(5), resp.Events[0].Kv.ModRevision, "checking revision")
+
+	_, err = backend.Compact(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	id, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 3)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(4), resp.CompactRevision, "checking compact revision")
+
+	// The changes at the compacted revision are retained.
+	id, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 4)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.False(t, resp.Canceled, "checking canceled flag")
+	assert.Len(t, resp.Events, 2, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type, "checking event type")
+	assert.Nil(t, resp.Events[0].PrevKv, "checking prev kv")
+	assert.Equal(t, mvccpb.PUT, resp.Events[1].Type, "checking event type")
+}
+
+func TestBTreeCacheWatchStreamWatchers(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	_, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 2)
+	assert.Nil(t, err, "checking error")
+	resp := <-ws.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	_, err = ws.Watch(5, []byte("/apisix/"), noPrefixEnd, 0)
+	assert.Nil(t, err, "checking error")
+	_, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/upstreams/1"), nil, 0)
+	assert.Nil(t, err, "checking error")
+
+	assert.Equal(t, []backends.WatcherState{
+		{
+			ID:  0,
+			Key: []byte("/apisix/routes/"),
+			End: []byte("/apisix/routes0"),
+		},
+		{
+			ID:  1,
+			Key: []byte("/apisix/upstreams/1"),
+		},
+		{
+			ID:  5,
+			Key: []byte("/apisix/"),
+			End: noPrefixEnd,
+		},
+	}, ws.Watchers(), "checking watchers")
+
+	assert.Nil(t, ws.Cancel(0), "checking error")
+	assert.Len(t, ws.Watchers(), 2, "checking watchers")
+
+	assert.Equal(t, int64(0), backend.CompactRevision(), "checking compact revision")
+	_, err = backend.Compact(context.Background(), 2)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), backend.CompactRevision(), "checking compact revision")
+}
+
+func TestBTreeCacheAutoCompaction(t *testing.T) {
+	backend := NewBTreeCacheWithOptions(zap.NewExample(), &Options{
+		HistoryRevisions: 8,
+	})
+	for i := 0; i < 20; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	cache := backend.(*btreeCache)
+	assert.Equal(t, int64(21), cache.currentRevision, "checking revision")
+	// The history is compacted when it exceeds 8+8/8 revisions.
+	assert.Equal(t, int64(12), cache.compactRevision, "checking compact revision")
+
+	_, err := backend.Range(context.Background(), []byte("/apisix/routes/1"), nil, backends.RangeOptions{
+		Revision: 11,
+	})
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(20), res.Count, "checking count")
+}
+
+func TestBTreeCacheDbSize(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	size, err := backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), size, "checking size")
+
+	_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Update(context.Background(), "/apisix/routes/1", []byte("v22"), 2, 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Delete(context.Background(), "/apisix/routes/1", 3)
+	assert.Nil(t, err, "checking error")
+	// The history and the tombstone are accounted too.
+	size, err = backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3*16+2+3), size, "checking size")
+
+	_, err = backend.Compact(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	size, err = backend.DbSizeInUse(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(16), size, "checking size in use")
+	// The freed space is still allocated.
+	size, err = backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3*16+2+3), size, "checking size")
+}
+
+func TestBTreeCacheDefragment(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	for i := 0; i < 100; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%02d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	var rev int64
+	for i := 0; i < 100; i += 2 {
+		var err error
+		rev, _, _, err = backend.Delete(context.Background(), fmt.Sprintf("/apisix/routes/%02d", i), int64(i+2))
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := backend.Compact(context.Background(), rev-1)
+	assert.Nil(t, err, "checking error")
+	hash, err := backend.HashKV(context.Background(), 0)
+	assert.Nil(t, err, "checking error")
+	before, err := backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+
+	// The writes during the defragmentation are kept.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/upstreams/%d", i), []byte("v1"), 0)
+			assert.Nil(t, err, "checking error")
+		}
+	}()
+	assert.Nil(t, backend.Defragment(context.Background()), "checking error")
+	<-done
+	assert.Nil(t, backend.Defragment(context.Background()), "checking error")
+
+	after, err := backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+	inUse, err := backend.DbSizeInUse(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Less(t, after, before, "checking size")
+	// The keys at the compacted revision (including the last deleted one),
+	// the tombstones since the compacted revision and the new keys.
+	assert.Equal(t, int64(51*(17+2)+2*17+10*(19+2)), after, "checking size")
+	assert.Equal(t, after, inUse, "checking size in use")
+
+	again, err := backend.HashKV(context.Background(), hash.Revision)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, hash, again, "checking hash")
+	res, err := backend.Range(context.Background(), []byte("/apisix/"), []byte("/apisix0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(60), res.Count, "checking count")
+	assert.Equal(t, "/apisix/routes/01", string(res.KVs[0].Key), "checking key")
+	assert.Equal(t, rev+10, res.Revision, "checking revision")
+}
+
+func TestBTreeCacheDefragmentCompacting(t *testing.T) {
+	backend := NewBTreeCacheWithOptions(zap.NewNop(), &Options{
+		HistoryRevisions: 1,
+	})
+	for i := 0; i < 1000; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%03d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	// Every write compacts the tree, the defragmentation still ends.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _, _, err := backend.Update(context.Background(), fmt.Sprintf("/apisix/routes/%03d", i%1000), []byte("v2"), 0, 0)
+			assert.Nil(t, err, "checking error")
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		defragmented := make(chan error, 1)
+		go func() {
+			defragmented <- backend.Defragment(context.Background())
+		}()
+		select {
+		case err := <-defragmented:
+			assert.Nil(t, err, "checking error")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the defragmentation")
+		}
+	}
+	close(stop)
+	<-done
+
+	size, err := backend.DbSize(context.Background())
+	assert.Nil(t, err, "checking error")
+	inUse, err := backend.DbSizeInUse(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, size, inUse, "checking size in use")
+	res, err := backend.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{CountOnly: true})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1000), res.Count, "checking count")
+}
+
+func TestBTreeCacheHashKV(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	for i := 0; i < 3; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	res, err := backend.HashKV(context.Background(), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), res.Revision, "checking revision")
+	assert.Equal(t, int64(0), res.CompactRevision, "checking compact revision")
+	// The hash is stable without writes.
+	again, err := backend.HashKV(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, res, again, "checking hash")
+
+	_, _, _, err = backend.Update(context.Background(), "/apisix/routes/1", []byte("v2"), 3, 0)
+	assert.Nil(t, err, "checking error")
+	changed, err := backend.HashKV(context.Background(), 0)
+	assert.Nil(t, err, "checking error")
+	assert.NotEqual(t, res.Hash, changed.Hash, "checking hash")
+	// The history before the change has the same hash.
+	again, err = backend.HashKV(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, res.Hash, again.Hash, "checking hash")
+
+	_, err = backend.HashKV(context.Background(), 6)
+	assert.Equal(t, backends.ErrFutureRevision, err, "checking error")
+	_, err = backend.Compact(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.HashKV(context.Background(), 4)
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+	again, err = backend.HashKV(context.Background(), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), again.CompactRevision, "checking compact revision")
+}
+
+func TestBTreeCacheHistory(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	txn := backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0)
+	txn.Put([]byte("/apisix/routes/2"), []byte("v1"), 100)
+	txn.End()
+	_, _, _, err := backend.Delete(context.Background(), "/apisix/routes/1", 2)
+	assert.Nil(t, err, "checking error")
+
+	res, err := backend.History(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), res.Revision, "checking revision")
+	assert.Equal(t, []*backends.Change{
+		{
+			Revision: 2,
+			KV: &mvccpb.KeyValue{
+				Key:            []byte("/apisix/routes/1"),
+				CreateRevision: 2,
+				ModRevision:    2,
+				Version:        1,
+				Value:          []byte("v1"),
+			},
+		},
+		{
+			Revision: 2,
+			Sub:      1,
+			KV: &mvccpb.KeyValue{
+				Key:            []byte("/apisix/routes/2"),
+				CreateRevision: 2,
+				ModRevision:    2,
+				Version:        1,
+				Value:          []byte("v1"),
+				Lease:          100,
+			},
+		},
+		{
+			Revision:  3,
+			Tombstone: true,
+			KV: &mvccpb.KeyValue{
+				Key: []byte("/apisix/routes/1"),
+			},
+		},
+	}, res.Changes, "checking changes")
+}
+
+func TestBTreeCacheRestore(t *testing.T) {
+	ctx := context.Background()
+	backend := NewBTreeCache(zap.NewExample())
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("/apisix/routes/%d", i%10)
+		txn := backend.Write(ctx)
+		if i%7 == 6 {
+			txn.DeleteRange([]byte(key), nil)
+		} else {
+			txn.Put([]byte(key), []byte(fmt.Sprintf("v%d", i)), int64(i%3))
+		}
+		txn.End()
+	}
+	_, err := backend.Compact(ctx, 50)
+	assert.Nil(t, err, "checking error")
+	history, err := backend.History(ctx)
+	assert.Nil(t, err, "checking error")
+
+	restored := NewBTreeCache(zap.NewExample())
+	assert.Nil(t, restored.(backends.Restorer).Restore(ctx, history), "checking error")
+	assert.Equal(t, backend.CurrentRevision(), restored.CurrentRevision(), "checking current revision")
+	assert.Equal(t, backend.CompactRevision(), restored.CompactRevision(), "checking compact revision")
+	for rev := int64(50); rev <= backend.CurrentRevision(); rev++ {
+		expected, err := backend.Range(ctx, []byte{}, noPrefixEnd, backends.RangeOptions{Revision: rev})
+		assert.Nil(t, err, "checking error")
+		res, err := restored.Range(ctx, []byte{}, noPrefixEnd, backends.RangeOptions{Revision: rev})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, expected, res, "checking range at revision %d", rev)
+	}
+	expectedHash, err := backend.HashKV(ctx, 0)
+	assert.Nil(t, err, "checking error")
+	hash, err := restored.HashKV(ctx, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, expectedHash, hash, "checking hash")
+
+	// The changes must be sorted.
+	history.Changes[0], history.Changes[1] = history.Changes[1], history.Changes[0]
+	assert.NotNil(t, NewBTreeCache(zap.NewExample()).(backends.Restorer).Restore(ctx, history), "checking error")
+}
+
+func TestBTreeCacheTombstones(t *testing.T) {
+	ctx := context.Background()
+	backend := NewBTreeCache(zap.NewExample())
+	tc := backend.(backends.TombstoneCounter)
+	_, err := backend.Create(ctx, "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Update(ctx, "/apisix/routes/1", []byte("v2"), 2, 0)
+	assert.Nil(t, err, "checking error")
+	rev, _, ok, err := backend.Delete(ctx, "/apisix/routes/1", 3)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking delete success flag")
+	assert.Equal(t, int64(4), rev, "checking revision")
+	assert.Equal(t, int64(1), tc.Tombstones(), "checking tombstones")
+	sizeWithTombstone, err := backend.DbSizeInUse(ctx)
+	assert.Nil(t, err, "checking error")
+
+	// The deleted key is still read at the revisions before the deletion.
+	res, err := backend.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{Revision: 3})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []byte("v2"), res.KVs[0].Value, "checking value")
+	res, err = backend.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 0, "checking kvs")
+
+	// A watcher resumed from before the deletion sees it.
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+	_, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 3)
+	assert.Nil(t, err, "checking error")
+	resp := <-ws.Chan()
+	assert.Len(t, resp.Events, 2, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[1].Type, "checking event type")
+	assert.Equal(t, int64(4), resp.Events[1].Kv.ModRevision, "checking revision")
+
+	// The tombstone is removed once the compaction passes it.
+	_, err = backend.Create(ctx, "/apisix/routes/2", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Compact(ctx, 5)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), tc.Tombstones(), "checking tombstones")
+	size, err := backend.DbSizeInUse(ctx)
+	assert.Nil(t, err, "checking error")
+	assert.Less(t, size, sizeWithTombstone, "checking size")
+	history, err := backend.History(ctx)
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, history.Changes, 1, "checking changes")
+
+	_, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 3)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(5), resp.CompactRevision, "checking compact revision")
+	_, err = backend.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{Revision: 3})
+	assert.Equal(t, backends.ErrCompacted, err, "checking error")
+}
+
+func TestBTreeCacheWatchStreamProgress(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	id, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/upstreams/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+
+	ws.RequestProgress(id)
+	resp := <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.Len(t, resp.Events, 0, "checking events")
+	assert.Equal(t, int64(2), resp.Revision, "checking revision")
+
+	backend.Batch(func() {
+		_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+		// The change of the batch hasn't been delivered.
+		ws.RequestProgress(id)
+	})
+	resp = <-ws.Chan()
+	assert.Len(t, resp.Events, 0, "checking events")
+	assert.Equal(t, int64(2), resp.Revision, "checking revision")
+	resp = <-ws.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, int64(3), resp.Revision, "checking revision")
+
+	// Unknown watchers are ignored.
+	ws.RequestProgress(id + 1)
+	ws.RequestProgress(id)
+	resp = <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.Equal(t, int64(3), resp.Revision, "checking revision")
+}
+
+func TestBTreeCacheWatchStreamProgressAll(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/2"} {
+		_, err := ws.Watch(backends.AutoWatchID, []byte(key), nil, 0)
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	ws.RequestProgressAll()
+
+	resp := <-ws.Chan()
+	assert.Equal(t, int64(0), resp.WatchID, "checking watch id")
+	assert.Len(t, resp.Events, 1, "checking events")
+	resp = <-ws.Chan()
+	assert.Equal(t, int64(-1), resp.WatchID, "checking watch id")
+	assert.Len(t, resp.Events, 0, "checking events")
+	assert.Equal(t, int64(2), resp.Revision, "checking revision")
+}
+
+func TestBTreeCacheWatchStreamFilters(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	noPut := func(ev *mvccpb.Event) bool {
+		return ev.Type == mvccpb.PUT
+	}
+	_, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Delete(context.Background(), "/apisix/routes/1", 2)
+	assert.Nil(t, err, "checking error")
+
+	// The history is filtered too.
+	id, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 2, noPut)
+	assert.Nil(t, err, "checking error")
+	resp := <-ws.Chan()
+	assert.Equal(t, id, resp.WatchID, "checking watch id")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type, "checking event type")
+
+	_, err = backend.Create(context.Background(), "/apisix/routes/2", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Delete(context.Background(), "/apisix/routes/2", 4)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type, "checking event type")
+	assert.Equal(t, int64(5), resp.Revision, "checking revision")
+}
+
+func TestBTreeCacheWatchStreamSlowWatcher(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	slow := backend.NewWatchStream(backends.WatchStreamOptions{
+		BufferSize: 4,
+	})
+	defer slow.Close()
+	fast := backend.NewWatchStream(backends.WatchStreamOptions{
+		BufferSize: 4,
+	})
+	defer fast.Close()
+
+	slowID, err := slow.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+	assert.Nil(t, err, "checking error")
+	_, err = fast.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+	assert.Nil(t, err, "checking error")
+
+	n := 300
+	fastDone := make(chan []int64)
+	go func() {
+		var revs []int64
+		for len(revs) < n {
+			resp := <-fast.Chan()
+			for _, ev := range resp.Events {
+				revs = append(revs, ev.Kv.ModRevision)
+			}
+		}
+		fastDone <- revs
+	}()
+
+	for i := 0; i < n; i++ {
+		_, err = backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	// The slow watcher doesn't block the writes and the fast watcher.
+	revs := <-fastDone
+	for i, rev := range revs {
+		assert.Equal(t, int64(i+2), rev, "checking revision")
+	}
+
+	// The slow watcher catches up from the history without gaps, the
+	// changes are merged when they're replayed.
+	var responses int
+	revs = revs[:0]
+	for len(revs) < n {
+		responses++
+		resp := <-slow.Chan()
+		assert.Equal(t, slowID, resp.WatchID, "checking watch id")
+		assert.False(t, resp.Canceled, "checking canceled flag")
+		for _, ev := range resp.Events {
+			revs = append(revs, ev.Kv.ModRevision)
+		}
+	}
+	for i, rev := range revs {
+		assert.Equal(t, int64(i+2), rev, "checking revision")
+	}
+	assert.Less(t, responses, n, "checking responses")
+	_, err = backend.Create(context.Background(), "/apisix/routes/x", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	resp := <-slow.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, int64(n+2), resp.Events[0].Kv.ModRevision, "checking revision")
+}
+
+func TestBTreeCacheWatchStreamSlowWatcherCompacted(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{
+		BufferSize: 4,
+	})
+	defer ws.Close()
+
+	id, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+	assert.Nil(t, err, "checking error")
+	n := 300
+	for i := 0; i < n; i++ {
+		_, err = backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	_, err = backend.Compact(context.Background(), int64(n+1))
+	assert.Nil(t, err, "checking error")
+
+	// The history which the watcher requires has been compacted.
+	last := int64(1)
+	for {
+		resp := <-ws.Chan()
+		assert.Equal(t, id, resp.WatchID, "checking watch id")
+		if resp.Canceled {
+			assert.Equal(t, backends.SlowWatcherCancelReason, resp.CancelReason, "checking cancel reason")
+			assert.Equal(t, int64(n+1), resp.CompactRevision, "checking compact revision")
+			break
+		}
+		for _, ev := range resp.Events {
+			assert.Equal(t, last+1, ev.Kv.ModRevision, "checking revision")
+			last = ev.Kv.ModRevision
+		}
+	}
+	assert.Less(t, last, int64(n+1), "checking the last revision")
+	assert.Equal(t, backends.ErrWatcherNotExist, ws.Cancel(id), "checking error")
+}
+
+func TestBTreeCacheWatchStreamIDs(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	id, err := ws.Watch(1, []byte("/apisix/routes/1"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), id, "checking watch id")
+	_, err = ws.Watch(1, []byte("/apisix/routes/2"), nil, 0)
+	assert.Equal(t, backends.ErrWatcherDuplicateID, err, "checking error")
+	_, err = ws.Watch(-1, []byte("/apisix/routes/2"), nil, 0)
+	assert.Equal(t, backends.ErrWatcherInvalidID, err, "checking error")
+
+	// The ids in use are skipped.
+	for _, expected := range []int64{0, 2} {
+		id, err = ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/2"), nil, 0)
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, expected, id, "checking watch id")
+	}
+
+	// The id can be reused after the watcher is canceled.
+	assert.Nil(t, ws.Cancel(1), "checking error")
+	resp := <-ws.Chan()
+	assert.Equal(t, int64(1), resp.WatchID, "checking watch id")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	id, err = ws.Watch(1, []byte("/apisix/routes/3"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), id, "checking watch id")
+
+	_, err = backend.Create(context.Background(), "/apisix/routes/3", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	resp = <-ws.Chan()
+	assert.Equal(t, int64(1), resp.WatchID, "checking watch id")
+	assert.Equal(t, []byte("/apisix/routes/3"), resp.Events[0].Kv.Key, "checking key")
+}
+
+func TestBTreeCacheWatchStreamConcurrency(t *testing.T) {
+	backend := NewBTreeCache(zap.NewExample())
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	watchers := 200
+	for i := 0; i < watchers; i++ {
+		_, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+
+	// Half of the watchers are canceled while the changes are applied.
+	writes := 300
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+			assert.Nil(t, err, "checking error")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for id := 0; id < watchers; id += 2 {
+			assert.Nil(t, ws.Cancel(int64(id)), "checking error")
+		}
+	}()
+
+	var (
+		revs      = make(map[int64][]int64)
+		canceled  = make(map[int64]bool)
+		completed int
+		lastRev   = int64(writes + 1)
+		timeout   = time.After(10 * time.Second)
+	)
+	for completed < watchers/2 || len(canceled) < watchers/2 {
+		select {
+		case resp := <-ws.Chan():
+			assert.False(t, canceled[resp.WatchID], "checking response after canceled")
+			if resp.Canceled {
+				canceled[resp.WatchID] = true
+				continue
+			}
+			for _, ev := range resp.Events {
+				revs[resp.WatchID] = append(revs[resp.WatchID], ev.Kv.ModRevision)
+			}
+			if resp.WatchID%2 == 1 && resp.Events[len(resp.Events)-1].Kv.ModRevision == lastRev {
+				completed++
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for watch responses")
+		}
+	}
+	wg.Wait()
+
+	// Every watcher receives the changes in order without gaps.
+	for id, rs := range revs {
+		for i, rev := range rs {
+			if !assert.Equal(t, int64(i+2), rev, "checking revision of watcher %d", id) {
+				break
+			}
+		}
+	}
+	for id := 0; id < watchers; id++ {
+		assert.Equal(t, id%2 == 0, canceled[int64(id)], "checking canceled flag of watcher %d", id)
+	}
+}
+
+func TestBTreeCacheWatchStreamParallelNotify(t *testing.T) {
+	backend := NewBTreeCacheWithOptions(zap.NewExample(), &Options{
+		NotifyWorkers: 4,
+	})
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{
+		BufferSize: 1024,
+	})
+	defer ws.Close()
+
+	watchers := 1000
+	for i := 0; i < watchers; i++ {
+		_, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/"), []byte("/apisix/routes0"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	// Both the matching and the delivery are processed concurrently.
+	writes := 1000
+	backend.Batch(func() {
+		for i := 0; i < writes; i++ {
+			_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+			assert.Nil(t, err, "checking error")
+		}
+	})
+
+	received := make(map[int64]bool)
+	for len(received) < watchers {
+		resp := <-ws.Chan()
+		assert.False(t, received[resp.WatchID], "checking duplicate response")
+		received[resp.WatchID] = true
+		if !assert.Len(t, resp.Events, writes, "checking events") {
+			continue
+		}
+		for i, ev := range resp.Events {
+			assert.Equal(t, int64(i+2), ev.Kv.ModRevision, "checking revision")
+		}
+	}
+}
+
+func BenchmarkBTreeCacheWatchFanOut(b *testing.B) {
+	cases := []struct {
+		name    string
+		workers int
+	}{
+		{
+			name:    "1 worker",
+			workers: 1,
+		},
+		{
+			name:    "GOMAXPROCS workers",
+			workers: runtime.GOMAXPROCS(0),
+		},
+	}
+	const (
+		streams   = 50
+		watchers  = 5000
+		prefixes  = 100
+		writes    = 10000
+		batchSize = 1000
+	)
+	for _, bc := range cases {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				c := NewBTreeCacheWithOptions(zap.NewNop(), &Options{
+					NotifyWorkers: bc.workers,
+				})
+				var (
+					wg  sync.WaitGroup
+					wss []backends.WatchStream
+				)
+				for i := 0; i < streams; i++ {
+					ws := c.NewWatchStream(backends.WatchStreamOptions{
+						BufferSize: writes,
+					})
+					wss = append(wss, ws)
+					for j := i; j < watchers; j += streams {
+						prefix := fmt.Sprintf("/apisix/routes/%d/", j%prefixes)
+						_, err := ws.Watch(backends.AutoWatchID, []byte(prefix), []byte(prefix[:len(prefix)-1]+"0"), 0)
+						assert.Nil(b, err, "checking error")
+					}
+					// Each event is delivered to watchers/prefixes watchers.
+					wg.Add(1)
+					go func(ws backends.WatchStream, expected int) {
+						defer wg.Done()
+						for expected > 0 {
+							expected -= len((<-ws.Chan()).Events)
+						}
+					}(ws, writes*(watchers/streams)/prefixes)
+				}
+				b.StartTimer()
+
+				for i := 0; i < writes; i += batchSize {
+					c.Batch(func() {
+						for j := i; j < i+batchSize; j++ {
+							key := fmt.Sprintf("/apisix/routes/%d/%d", j%prefixes, j)
+							_, err := c.Create(context.Background(), key, []byte("v1"), 0)
+							assert.Nil(b, err, "checking create error")
+						}
+					})
+				}
+				wg.Wait()
+
+				b.StopTimer()
+				for _, ws := range wss {
+					ws.Close()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBTreeCacheRangeWhileWriting(b *testing.B) {
+	cases := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{
+			name: "idle",
+		},
+		{
+			name:     "writing",
+			interval: 100 * time.Microsecond,
+		},
+	}
+	const (
+		keys     = 100000
+		prefixes = 100
+		readers  = 16
+	)
+	c := NewBTreeCache(zap.NewNop())
+	c.Batch(func() {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("/apisix/routes/%d/%d", i%prefixes, i)
+			_, err := c.Create(context.Background(), key, []byte(key), 0)
+			assert.Nil(b, err, "checking create error")
+		}
+	})
+	for _, bc := range cases {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			stopCh := make(chan struct{})
+			writerDone := make(chan struct{})
+			go func() {
+				defer close(writerDone)
+				if bc.interval == 0 {
+					return
+				}
+				// The single writer applies the events at a fixed rate.
+				ticker := time.NewTicker(bc.interval)
+				defer ticker.Stop()
+				for i := 0; ; i++ {
+					select {
+					case <-stopCh:
+						return
+					case <-ticker.C:
+					}
+					txn := c.Write(context.Background())
+					key := fmt.Sprintf("/apisix/routes/%d/%d", i%prefixes, i%keys)
+					txn.Put([]byte(key), []byte(fmt.Sprintf("v%d", i)), 0)
+					txn.End()
+				}
+			}()
+
+			var (
+				wg        sync.WaitGroup
+				latencies = make([][]time.Duration, readers)
+			)
+			b.ResetTimer()
+			for r := 0; r < readers; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					for i := r; i < b.N; i += readers {
+						prefix := fmt.Sprintf("/apisix/routes/%d/", i%prefixes)
+						start := time.Now()
+						res, err := c.Range(context.Background(), []byte(prefix), []byte(prefix[:len(prefix)-1]+"0"), backends.RangeOptions{})
+						latencies[r] = append(latencies[r], time.Since(start))
+						assert.Nil(b, err, "checking range error")
+						assert.Equal(b, int64(keys/prefixes), res.Count, "checking count")
+					}
+				}(r)
+			}
+			wg.Wait()
+			b.StopTimer()
+			close(stopCh)
+			<-writerDone
+
+			var all []time.Duration
+			for _, l := range latencies {
+				all = append(all, l...)
+			}
+			sort.Slice(all, func(i, j int) bool {
+				return all[i] < all[j]
+			})
+			b.ReportMetric(float64(all[len(all)*99/100].Microseconds()), "p99-us")
+			b.ReportMetric(float64(all[len(all)-1].Microseconds()), "max-us")
+		})
+	}
+}
+
+func BenchmarkBTreeCacheRangeCountOnly(b *testing.B) {
+	const keys = 1000000
+	c := NewBTreeCache(zap.NewNop())
+	c.Batch(func() {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("/apisix/routes/%d", i)
+			_, err := c.Create(context.Background(), key, []byte(key), 0)
+			assert.Nil(b, err, "checking create error")
+		}
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := c.Range(context.Background(), []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{
+			CountOnly: true,
+		})
+		assert.Nil(b, err, "checking range error")
+		assert.Equal(b, int64(keys), res.Count, "checking count")
+	}
+}
@@ -0,0 +1,654 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package btree
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// DefaultJournalSegmentBytes is the default size that a journal segment is
+// rotated at.
+const DefaultJournalSegmentBytes = 64 * 1024 * 1024
+
+// JournalSync indicates when the journal is synced to the disk.
+type JournalSync int
+
+const (
+	// JournalSyncAlways indicates every record is synced before the change
+	// is visible, so no change is lost on crash.
+	JournalSyncAlways = JournalSync(iota)
+	// JournalSyncNever indicates the records are left to the OS, so the
+	// latest changes might be lost on crash, but not the earlier ones.
+	JournalSyncNever
+)
+
+// JournalOptions contains settings for the journal of the btree backend.
+// Every change is appended to the journal, and the backend is rebuilt from
+// it when it's opened again. The journal is split into the segments, each
+// of them starts with a snapshot of the keyspace, so the older segments
+// are removed once a new one is created. The history before the snapshot
+// is not kept, and the leases are not journaled, the keys attached to them
+// are restored with the lease ids.
+type JournalOptions struct {
+	// Dir is the directory of the journal segments, it's created if it
+	// doesn't exist. It should be used by one backend at a time.
+	Dir string
+	// SegmentBytes is the size that a segment is rotated at, default is
+	// DefaultJournalSegmentBytes.
+	SegmentBytes int64
+	// Sync indicates when the records are synced to the disk, default is
+	// JournalSyncAlways. The snapshots are always synced.
+	Sync JournalSync
+}
+
+const (
+	journalSuffix = ".journal"
+	// journalHeaderLen is the length of the record header, the length and
+	// the CRC of the payload, in little-endian.
+	journalHeaderLen = 8
+	// maxJournalRecordLen limits the length read from a corrupted header.
+	maxJournalRecordLen = 1 << 30
+)
+
+// The types of the journal records, the first byte of the payload.
+const (
+	// recordTxn contains the changes of a write transaction.
+	recordTxn = byte(iota + 1)
+	// recordCompact contains the revision compacted explicitly, the
+	// automatic compactions are replayed by the transactions.
+	recordCompact
+	// recordSnapshot contains the whole keyspace at a revision, it's the
+	// first record of a segment.
+	recordSnapshot
+)
+
+var (
+	errJournalCorrupted = errors.New("journal record is corrupted")
+	crcTable            = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// journal appends the records to the latest segment. It's guarded by the
+// mutex of the backend.
+type journal struct {
+	dir          string
+	segmentBytes int64
+	sync         JournalSync
+	logger       *zap.Logger
+	file         *os.File
+	// size is the number of bytes in the file.
+	size int64
+	buf  []byte
+}
+
+// segmentName returns the file name of the segment starting with the
+// snapshot at the revision, so that the names are sorted by the revisions.
+func segmentName(rev int64) string {
+	return fmt.Sprintf("%016x%s", rev, journalSuffix)
+}
+
+// listSegments returns the names of the segments in the dir, sorted by the
+// revisions.
+func listSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(name, journalSuffix), 16, 64); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// openJournal rebuilds the backend from the latest segment, and opens it
+// to append the new records. A corrupted tail, which is left by a crash
+// in the middle of an append, is discarded.
+func (b *btreeCache) openJournal(opts *JournalOptions) error {
+	if opts.Dir == "" {
+		return errors.New("journal dir is not specified")
+	}
+	j := &journal{
+		dir:          opts.Dir,
+		segmentBytes: opts.SegmentBytes,
+		sync:         opts.Sync,
+		logger:       b.logger,
+	}
+	if j.segmentBytes <= 0 {
+		j.segmentBytes = DefaultJournalSegmentBytes
+	}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return err
+	}
+	// The temporary files are left by the crashed rotations.
+	tmps, err := filepath.Glob(filepath.Join(j.dir, "*"+journalSuffix+".tmp"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return err
+		}
+	}
+	names, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if len(names) == 0 {
+		if err := j.rotateLocked(b); err != nil {
+			return err
+		}
+		b.journal = j
+		return nil
+	}
+	// The older segments are covered by the snapshot of the latest one,
+	// they're left if the rotation crashed before removing them.
+	latest := filepath.Join(j.dir, names[len(names)-1])
+	if err := j.removeSegments(names[:len(names)-1]); err != nil {
+		return err
+	}
+	size, err := b.replayLocked(latest)
+	if err != nil {
+		return fmt.Errorf("failed to replay %s: %w", latest, err)
+	}
+	j.file, err = os.OpenFile(latest, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// Discard the corrupted tail if there is one.
+	if err := j.file.Truncate(size); err != nil {
+		j.file.Close()
+		return err
+	}
+	if _, err := j.file.Seek(size, io.SeekStart); err != nil {
+		j.file.Close()
+		return err
+	}
+	j.size = size
+	b.journal = j
+	// Nobody watches the replayed changes.
+	b.events = list.New()
+	return nil
+}
+
+// replayLocked rebuilds the backend from the segment, and returns the size
+// of the valid records. Note this method should be invoked only if the
+// mutex is locked.
+func (b *btreeCache) replayLocked(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	payload, n, err := readRecord(r)
+	if err != nil {
+		// The snapshot is synced before the segment is renamed, so it
+		// cannot be partial.
+		return 0, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if len(payload) == 0 || payload[0] != recordSnapshot {
+		return 0, errJournalCorrupted
+	}
+	if err := b.restoreLocked(payload[1:]); err != nil {
+		return 0, err
+	}
+	size := n
+	records := 0
+	for {
+		payload, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.logger.Warn("discard the corrupted tail of the journal",
+				zap.Error(err),
+				zap.String("segment", name),
+				zap.Int64("offset", size),
+			)
+			break
+		}
+		if err := b.applyRecordLocked(payload); err != nil {
+			return 0, fmt.Errorf("failed to apply the record at %d: %w", size, err)
+		}
+		size += n
+		records++
+	}
+	b.logger.Info("journal replayed",
+		zap.String("segment", name),
+		zap.Int("records", records),
+		zap.Int64("revision", b.currentRevision),
+	)
+	return size, nil
+}
+
+// readRecord reads a record and returns its payload and its size. It
+// returns io.EOF if there are no more records, or errJournalCorrupted if
+// the record is partial or doesn't match its CRC.
+func readRecord(r *bufio.Reader) ([]byte, int64, error) {
+	var header [journalHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errJournalCorrupted
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length > maxJournalRecordLen {
+		return nil, 0, errJournalCorrupted
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errJournalCorrupted
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, errJournalCorrupted
+	}
+	return payload, int64(journalHeaderLen + length), nil
+}
+
+// writeRecord writes the payload framed by the header.
+func writeRecord(w io.Writer, payload []byte) (int64, error) {
+	var header [journalHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+	return int64(journalHeaderLen + len(payload)), nil
+}
+
+// appendLocked appends the record to the segment, and rotates the segment
+// if it's full. Note this method should be invoked only if the mutex of the
+// backend is locked.
+func (j *journal) appendLocked(b *btreeCache, payload []byte) {
+	n, err := writeRecord(j.file, payload)
+	if err == nil && j.sync == JournalSyncAlways {
+		err = j.file.Sync()
+	}
+	j.size += n
+	if err != nil {
+		j.logger.Error("failed to append to the journal",
+			zap.Error(err),
+			zap.Int64("revision", b.currentRevision),
+		)
+		return
+	}
+	if j.size >= j.segmentBytes {
+		if err := j.rotateLocked(b); err != nil {
+			j.logger.Error("failed to rotate the journal",
+				zap.Error(err),
+				zap.Int64("revision", b.currentRevision),
+			)
+		}
+	}
+}
+
+// rotateLocked creates a new segment starting with the snapshot of the
+// backend, and removes the older ones. The segment is renamed after the
+// snapshot is synced, so it always has a complete snapshot. Note this
+// method should be invoked only if the mutex of the backend is locked.
+func (j *journal) rotateLocked(b *btreeCache) error {
+	name := filepath.Join(j.dir, segmentName(b.currentRevision))
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	n, err := writeRecord(w, b.snapshotLocked())
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err == nil {
+		err = syncDir(j.dir)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.size = n
+	names, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, old := range names {
+		if old != segmentName(b.currentRevision) {
+			stale = append(stale, old)
+		}
+	}
+	return j.removeSegments(stale)
+}
+
+func (j *journal) removeSegments(names []string) error {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(j.dir, name)); err != nil {
+			return err
+		}
+		j.logger.Debug("journal segment removed",
+			zap.String("segment", name),
+		)
+	}
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// syncDir syncs the directory, so that the renaming is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The payloads are encoded with the uvarints and the length-prefixed bytes.
+//
+//	txn:      type rev n (op key value lease)*n
+//	compact:  type rev
+//	snapshot: type rev n (key value lease createMain createSub modMain modSub version)*n
+const (
+	opPut = iota + 1
+	opDelete
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// txnRecord encodes the changes of a transaction at the revision.
+func txnRecord(buf []byte, rev int64, events []*mvccpb.Event) []byte {
+	buf = append(buf[:0], recordTxn)
+	buf = appendUvarint(buf, uint64(rev))
+	buf = appendUvarint(buf, uint64(len(events)))
+	for _, ev := range events {
+		if ev.Type == mvccpb.DELETE {
+			buf = append(buf, opDelete)
+			buf = appendBytes(buf, ev.Kv.Key)
+			continue
+		}
+		buf = append(buf, opPut)
+		buf = appendBytes(buf, ev.Kv.Key)
+		buf = appendBytes(buf, ev.Kv.Value)
+		buf = appendUvarint(buf, uint64(ev.Kv.Lease))
+	}
+	return buf
+}
+
+// compactRecord encodes the compaction at the revision.
+func compactRecord(buf []byte, rev int64) []byte {
+	buf = append(buf[:0], recordCompact)
+	return appendUvarint(buf, uint64(rev))
+}
+
+// snapshotLocked encodes the keyspace at the current revision. Note this
+// method should be invoked only if the mutex is locked.
+func (b *btreeCache) snapshotLocked() []byte {
+	buf := []byte{recordSnapshot}
+	buf = appendUvarint(buf, uint64(b.currentRevision))
+	keys, _ := b.index.Range([]byte{}, []byte{}, b.currentRevision)
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		modRev, createRev, ver, err := b.index.Get(key, b.currentRevision)
+		if err != nil {
+			// Impossible to reach here as the key was just found.
+			continue
+		}
+		var it item
+		if v := b.tree.Get(&item{key: modRev}); v != nil {
+			it = *v.(*item)
+		}
+		buf = appendBytes(buf, key)
+		buf = appendBytes(buf, it.value)
+		buf = appendUvarint(buf, uint64(it.lease))
+		buf = appendUvarint(buf, uint64(createRev.main))
+		buf = appendUvarint(buf, uint64(createRev.sub))
+		buf = appendUvarint(buf, uint64(modRev.main))
+		buf = appendUvarint(buf, uint64(modRev.sub))
+		buf = appendUvarint(buf, uint64(ver))
+	}
+	return buf
+}
+
+// recordReader decodes a payload, the first error is kept and the later
+// reads return zero values.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) byte() byte {
+	if r.err != nil || len(r.buf) == 0 {
+		r.err = errJournalCorrupted
+		return 0
+	}
+	c := r.buf[0]
+	r.buf = r.buf[1:]
+	return c
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errJournalCorrupted
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) int64() int64 {
+	return int64(r.uvarint())
+}
+
+func (r *recordReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.buf)) < n {
+		r.err = errJournalCorrupted
+		return nil
+	}
+	b := append([]byte(nil), r.buf[:n]...)
+	r.buf = r.buf[n:]
+	return b
+}
+
+// restoreLocked restores the keyspace from the snapshot, the history before
+// it is not available. Note this method should be invoked only if the mutex
+// is locked.
+func (b *btreeCache) restoreLocked(payload []byte) error {
+	r := &recordReader{buf: payload}
+	rev := r.int64()
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		key := r.bytes()
+		it := &item{
+			k:     key,
+			value: r.bytes(),
+			lease: r.int64(),
+		}
+		created := revision{main: r.int64(), sub: r.int64()}
+		it.key = revision{main: r.int64(), sub: r.int64()}
+		it.createRev = created.main
+		it.version = r.int64()
+		if r.err != nil {
+			break
+		}
+		ki := &keyIndex{key: key}
+		ki.restore(b.logger, created, it.key, it.version)
+		b.index.Insert(ki)
+		b.insertLocked(it)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	b.currentRevision = rev
+	b.compactRevision = rev
+	b.notifiedRevision = rev
+	return nil
+}
+
+// applyRecordLocked replays a transaction or a compaction, the revisions
+// must be contiguous. Note this method should be invoked only if the mutex
+// is locked.
+func (b *btreeCache) applyRecordLocked(payload []byte) error {
+	r := &recordReader{buf: payload}
+	typ := r.byte()
+	rev := r.int64()
+	if r.err != nil {
+		return r.err
+	}
+	switch typ {
+	case recordTxn:
+		if rev != b.currentRevision+1 {
+			return fmt.Errorf("revision %d doesn't follow %d", rev, b.currentRevision)
+		}
+		// The transaction is made on the locked backend, the lock is
+		// taken over rather than acquired by Write.
+		txn := &txnWrite{
+			b:        b,
+			beginRev: b.currentRevision,
+		}
+		n := r.uvarint()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			switch r.byte() {
+			case opPut:
+				key := r.bytes()
+				value := r.bytes()
+				lease := r.int64()
+				if r.err == nil {
+					txn.Put(key, value, lease)
+				}
+			case opDelete:
+				key := r.bytes()
+				if r.err == nil {
+					txn.DeleteRange(key, nil)
+				}
+			default:
+				r.err = errJournalCorrupted
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+		// Only the transactions with changes are journaled.
+		if txn.changes == 0 {
+			return fmt.Errorf("no changes are replayed at revision %d", rev)
+		}
+		b.currentRevision = rev
+		b.notifiedRevision = rev
+		b.autoCompactLocked()
+	case recordCompact:
+		if rev > b.compactRevision && rev <= b.currentRevision {
+			b.compactLocked(rev)
+		}
+	default:
+		return errJournalCorrupted
+	}
+	return nil
+}
+
+// journalTxnLocked appends the changes of the transaction to the journal if
+// it's enabled. Note this method should be invoked only if the mutex is
+// locked.
+func (b *btreeCache) journalTxnLocked(rev int64, events []*mvccpb.Event) {
+	if b.journal == nil {
+		return
+	}
+	b.journal.buf = txnRecord(b.journal.buf, rev, events)
+	b.journal.appendLocked(b, b.journal.buf)
+}
+
+// journalCompactLocked appends the compaction to the journal if it's
+// enabled. Note this method should be invoked only if the mutex is locked.
+func (b *btreeCache) journalCompactLocked(rev int64) {
+	if b.journal == nil {
+		return
+	}
+	b.journal.buf = compactRecord(b.journal.buf, rev)
+	b.journal.appendLocked(b, b.journal.buf)
+}
+
+// OpenBTreeCache is same as NewBTreeCacheWithOptions, but it returns the
+// error if the journal in the options cannot be opened or replayed.
+func OpenBTreeCache(logger *zap.Logger, opts *Options) (backends.Backend, error) {
+	b := newBTreeCache(logger, opts)
+	if opts != nil && opts.Journal != nil {
+		if err := b.openJournal(opts.Journal); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
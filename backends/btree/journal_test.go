@@ -0,0 +1,154 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package btree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// rangeAll returns all the keys of the backend.
+func rangeAll(t *testing.T, b backends.Backend) *backends.RangeResult {
+	res, err := b.Range(context.Background(), []byte{}, noPrefixEnd, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	return res
+}
+
+// reopen closes the journal of the backend as if the process crashed, and
+// opens the backend again from the journal.
+func reopen(t *testing.T, b backends.Backend, opts *Options) backends.Backend {
+	assert.Nil(t, b.(*btreeCache).journal.close(), "checking error")
+	b, err := OpenBTreeCache(zap.NewExample(), opts)
+	assert.Nil(t, err, "checking error")
+	return b
+}
+
+func TestBTreeCacheJournalReplay(t *testing.T) {
+	opts := &Options{
+		Journal: &JournalOptions{
+			Dir:          t.TempDir(),
+			SegmentBytes: 16 * 1024,
+			Sync:         JournalSyncNever,
+		},
+	}
+	backend, err := OpenBTreeCache(zap.NewExample(), opts)
+	assert.Nil(t, err, "checking error")
+
+	ctx := context.Background()
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("/apisix/routes/%d", i%100))
+		txn := backend.Write(ctx)
+		switch i % 10 {
+		case 9:
+			txn.DeleteRange([]byte(fmt.Sprintf("/apisix/routes/%d", (i-1)%100)), nil)
+		case 8:
+			// The changes of a transaction share the revision.
+			txn.Put(key, []byte(fmt.Sprintf("v%d", i)), 0)
+			txn.Put([]byte(fmt.Sprintf("/apisix/upstreams/%d", i%100)), []byte(fmt.Sprintf("v%d", i)), 0)
+		default:
+			txn.Put(key, []byte(fmt.Sprintf("v%d", i)), int64(i%3))
+		}
+		txn.End()
+	}
+	_, err = backend.Compact(ctx, backend.CurrentRevision()-10)
+	assert.Nil(t, err, "checking error")
+	expected := rangeAll(t, backend)
+	rev := backend.CurrentRevision()
+
+	// The older segments are removed once rotated, and so are the ones
+	// left by a crashed rotation.
+	segments, err := listSegments(opts.Journal.Dir)
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, segments, 1, "checking segments")
+	stale := filepath.Join(opts.Journal.Dir, segmentName(1))
+	assert.Nil(t, ioutil.WriteFile(stale, nil, 0600), "checking error")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(opts.Journal.Dir, segmentName(rev+1)+".tmp"), nil, 0600), "checking error")
+
+	backend = reopen(t, backend, opts)
+	assert.Equal(t, rev, backend.CurrentRevision(), "checking current revision")
+	assert.GreaterOrEqual(t, backend.CompactRevision(), rev-10, "checking compact revision")
+	assert.Equal(t, expected, rangeAll(t, backend), "checking keys")
+	segments, err = listSegments(opts.Journal.Dir)
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, segments, 1, "checking segments")
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "checking stale segment")
+
+	// The revisions continue after the replay.
+	newRev, kv, ok, err := backend.Update(ctx, "/apisix/routes/1", []byte("v"), expected.KVs[1].ModRevision, 0)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking update success flag")
+	assert.Equal(t, rev+1, newRev, "checking revision")
+	assert.Equal(t, expected.KVs[1].CreateRevision, kv.CreateRevision, "checking create revision")
+	res, err := backend.Range(ctx, []byte("/apisix/routes/1"), nil, backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, expected.KVs[1].Version+1, res.KVs[0].Version, "checking version")
+}
+
+func TestBTreeCacheJournalCorruptedTail(t *testing.T) {
+	opts := &Options{
+		Journal: &JournalOptions{
+			Dir: t.TempDir(),
+		},
+	}
+	backend, err := OpenBTreeCache(zap.NewExample(), opts)
+	assert.Nil(t, err, "checking error")
+	for i := 0; i < 10; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	segments, err := listSegments(opts.Journal.Dir)
+	assert.Nil(t, err, "checking error")
+	segment := filepath.Join(opts.Journal.Dir, segments[0])
+
+	// The last record is partially written.
+	info, err := os.Stat(segment)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, os.Truncate(segment, info.Size()-3), "checking error")
+	backend = reopen(t, backend, opts)
+	assert.Equal(t, int64(10), backend.CurrentRevision(), "checking current revision")
+	assert.Equal(t, int64(9), rangeAll(t, backend).Count, "checking keys")
+
+	// The new records follow the valid ones.
+	rev, err := backend.Create(context.Background(), "/apisix/routes/9", []byte("v2"), 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(11), rev, "checking revision")
+	backend = reopen(t, backend, opts)
+	assert.Equal(t, int64(11), backend.CurrentRevision(), "checking current revision")
+	_, kv, err := backend.Get(context.Background(), "/apisix/routes/9", 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []byte("v2"), kv.Value, "checking value")
+
+	// The last record doesn't match its CRC.
+	data, err := ioutil.ReadFile(segment)
+	assert.Nil(t, err, "checking error")
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(segment, data, 0600), "checking error")
+	backend = reopen(t, backend, opts)
+	assert.Equal(t, int64(10), backend.CurrentRevision(), "checking current revision")
+	_, kv, err = backend.Get(context.Background(), "/apisix/routes/9", 0)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, kv, "checking kv")
+}
@@ -14,10 +14,20 @@
 
 package btree
 
-// revBytesLen is the byte length of a normal revision.
-// First 8 bytes is the revision.main in big-endian format. The 9th byte
-// is a '_'. The last 8 bytes is the revision.sub in big-endian format.
-//const revBytesLen = 8 + 1 + 8
+import (
+	"encoding/binary"
+)
+
+const (
+	// revBytesLen is the byte length of a normal revision.
+	// First 8 bytes is the revision.main in big-endian format. The 9th byte
+	// is a '_'. The last 8 bytes is the revision.sub in big-endian format.
+	revBytesLen = 8 + 1 + 8
+	// markedRevBytesLen is the byte length of a marked revision, the last
+	// byte marks the revision as a tombstone.
+	markedRevBytesLen = revBytesLen + 1
+	markTombstone     = 't'
+)
 
 // A revision indicates modification of the key-value space.
 // The set of changes that share same main revision changes the key-value space atomically.
@@ -41,16 +51,16 @@ func (a revision) GreaterThan(b revision) bool {
 	return a.sub > b.sub
 }
 
-//func newRevBytes() []byte {
-//	return make([]byte, revBytesLen, markedRevBytesLen)
-//}
-//
-//func revToBytes(rev revision, bytes []byte) {
-//	binary.BigEndian.PutUint64(bytes, uint64(rev.main))
-//	bytes[8] = '_'
-//	binary.BigEndian.PutUint64(bytes[9:], uint64(rev.sub))
-//}
-//
+func newRevBytes() []byte {
+	return make([]byte, revBytesLen, markedRevBytesLen)
+}
+
+func revToBytes(rev revision, bytes []byte) {
+	binary.BigEndian.PutUint64(bytes, uint64(rev.main))
+	bytes[8] = '_'
+	binary.BigEndian.PutUint64(bytes[9:], uint64(rev.sub))
+}
+
 //func bytesToRev(bytes []byte) revision {
 //	return revision{
 //		main: int64(binary.BigEndian.Uint64(bytes[0:8])),
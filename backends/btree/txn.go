@@ -0,0 +1,172 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package btree
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// txnWrite implements the backends.TxnWrite interface. All the changes in
+// the transaction have the same main revision, and they are distinguished
+// by the sub revision.
+type txnWrite struct {
+	b        *btreeCache
+	beginRev int64
+	changes  int64
+	events   []*mvccpb.Event
+}
+
+func (b *btreeCache) Write(_ context.Context) backends.TxnWrite {
+	b.Lock()
+	return &txnWrite{
+		b:        b,
+		beginRev: b.currentRevision,
+	}
+}
+
+func (txn *txnWrite) Rev() int64 {
+	if txn.changes > 0 {
+		return txn.beginRev + 1
+	}
+	return txn.beginRev
+}
+
+func (txn *txnWrite) Range(key, end []byte, opts backends.RangeOptions) (*backends.RangeResult, error) {
+	return txn.b.rangeLocked(key, end, opts, txn.Rev())
+}
+
+func (txn *txnWrite) Put(key, value []byte, lease int64) int64 {
+	var (
+		prev   *mvccpb.KeyValue
+		prevKV *server.KeyValue
+	)
+	if res, err := txn.b.rangeLocked(key, nil, backends.RangeOptions{}, txn.Rev()); err == nil && len(res.KVs) > 0 {
+		prev = res.KVs[0]
+		prevKV = toKineKeyValue(prev)
+	}
+
+	rev := revision{
+		main: txn.beginRev + 1,
+		sub:  txn.changes,
+	}
+	txn.b.index.Put(key, rev)
+
+	kv := &server.KeyValue{
+		Key:            string(key),
+		CreateRevision: rev.main,
+		ModRevision:    rev.main,
+		Value:          value,
+		Lease:          lease,
+	}
+	ver := int64(1)
+	if prevKV != nil {
+		kv.CreateRevision = prevKV.CreateRevision
+		ver = prev.Version + 1
+	}
+	it := &item{
+		key:       rev,
+		value:     value,
+		lease:     lease,
+		k:         key,
+		createRev: kv.CreateRevision,
+		version:   ver,
+	}
+	txn.b.insertLocked(it)
+	txn.changes++
+	txn.b.makeEvent(kv, prevKV, false)
+	txn.events = append(txn.events, &mvccpb.Event{
+		Type: mvccpb.PUT,
+		Kv: &mvccpb.KeyValue{
+			Key:            key,
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    rev.main,
+			Version:        ver,
+			Value:          value,
+			Lease:          lease,
+		},
+		PrevKv: prev,
+	})
+	return rev.main
+}
+
+func (txn *txnWrite) DeleteRange(key, end []byte) (int64, int64) {
+	res, err := txn.b.rangeLocked(key, end, backends.RangeOptions{}, txn.Rev())
+	if err != nil || len(res.KVs) == 0 {
+		return 0, txn.Rev()
+	}
+	for _, prev := range res.KVs {
+		rev := revision{
+			main: txn.beginRev + 1,
+			sub:  txn.changes,
+		}
+		if err := txn.b.index.Tombstone(prev.Key, rev); err != nil {
+			// Impossible to reach here as the key was just found.
+			txn.b.logger.Error("failed to tombstone key",
+				zap.Error(err),
+				zap.String("key", string(prev.Key)),
+			)
+			continue
+		}
+		it := &item{
+			key:       rev,
+			k:         prev.Key,
+			tombstone: true,
+		}
+		txn.b.insertLocked(it)
+		txn.changes++
+
+		prevKV := toKineKeyValue(prev)
+		txn.b.makeEvent(&server.KeyValue{
+			Key:         prevKV.Key,
+			ModRevision: rev.main,
+		}, prevKV, true)
+		txn.events = append(txn.events, &mvccpb.Event{
+			Type: mvccpb.DELETE,
+			Kv: &mvccpb.KeyValue{
+				Key:         prev.Key,
+				ModRevision: rev.main,
+			},
+			PrevKv: prev,
+		})
+	}
+	return int64(len(res.KVs)), txn.Rev()
+}
+
+func (txn *txnWrite) End() {
+	if txn.changes > 0 {
+		txn.b.currentRevision = txn.beginRev + 1
+		txn.b.journalTxnLocked(txn.b.currentRevision, txn.events)
+		txn.b.notifyLocked(txn.b.currentRevision, txn.events)
+		txn.b.autoCompactLocked()
+	}
+	txn.b.Unlock()
+}
+
+func toKineKeyValue(kv *mvccpb.KeyValue) *server.KeyValue {
+	return &server.KeyValue{
+		Key:            string(kv.Key),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Value:          kv.Value,
+		Lease:          kv.Lease,
+	}
+}
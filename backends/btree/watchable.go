@@ -0,0 +1,586 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package btree
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/google/btree"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+const (
+	// watchStreamChanSize is the buffer size of the WatchResponse channel
+	// of a watch stream.
+	watchStreamChanSize = 128
+	// defaultWatcherBufferSize is the default max number of the pending
+	// responses of a watcher.
+	defaultWatcherBufferSize = 128
+)
+
+// streamWatcher is a watcher created by the watch stream.
+type streamWatcher struct {
+	id  int64
+	key []byte
+	// end is nil for a single key watcher, and empty means all keys which
+	// are greater than or equal to the key.
+	end []byte
+	// minRev is the minimum revision of the events that the watcher
+	// accepts.
+	minRev  int64
+	filters []backends.FilterFunc
+	ws      *watchStream
+
+	// queued is the number of the pending responses of the watcher.
+	queued int
+	// victim indicates the watcher was too slow, it's removed from the
+	// watcher group until its pending responses drain.
+	victim bool
+}
+
+// accepts tells whether the event should be delivered to the watcher.
+func (w *streamWatcher) accepts(ev *mvccpb.Event) bool {
+	for _, filter := range w.filters {
+		if filter(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *streamWatcher) contains(key []byte) bool {
+	if w.end == nil {
+		return bytes.Equal(w.key, key)
+	}
+	if bytes.Compare(key, w.key) < 0 {
+		return false
+	}
+	return len(w.end) == 0 || bytes.Compare(key, w.end) < 0
+}
+
+// watchStream implements the backends.WatchStream interface. Responses are
+// queued without blocking the backend, and they're moved to the channel by
+// a dedicated goroutine.
+type watchStream struct {
+	b          *btreeCache
+	bufferSize int
+
+	mu       sync.Mutex
+	nextID   int64
+	watchers map[int64]*streamWatcher
+	// pending are the queued pendingResponses.
+	pending *list.List
+	closed  bool
+
+	notifyc chan struct{}
+	closec  chan struct{}
+	ch      chan backends.WatchResponse
+}
+
+// pendingResponse is a queued response, w is nil if the response doesn't
+// belong to a watcher.
+type pendingResponse struct {
+	w    *streamWatcher
+	resp backends.WatchResponse
+}
+
+func (b *btreeCache) NewWatchStream(opts backends.WatchStreamOptions) backends.WatchStream {
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultWatcherBufferSize
+	}
+	ws := &watchStream{
+		b:          b,
+		bufferSize: bufferSize,
+		watchers:   make(map[int64]*streamWatcher),
+		pending:    list.New(),
+		notifyc:    make(chan struct{}, 1),
+		closec:     make(chan struct{}),
+		ch:         make(chan backends.WatchResponse, watchStreamChanSize),
+	}
+	go ws.run()
+	return ws
+}
+
+func (ws *watchStream) Watch(id int64, key, end []byte, startRev int64, filters ...backends.FilterFunc) (int64, error) {
+	ws.b.Lock()
+	defer ws.b.Unlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return -1, backends.ErrWatcherNotExist
+	}
+	if id == backends.AutoWatchID {
+		for ws.watchers[ws.nextID] != nil {
+			ws.nextID++
+		}
+		id = ws.nextID
+		ws.nextID++
+	} else if id < 0 {
+		return -1, backends.ErrWatcherInvalidID
+	} else if _, ok := ws.watchers[id]; ok {
+		return -1, backends.ErrWatcherDuplicateID
+	}
+
+	if len(end) == 0 {
+		end = nil
+	} else if bytes.Equal(end, noPrefixEnd) {
+		end = []byte{}
+	}
+	w := &streamWatcher{
+		id:      id,
+		key:     key,
+		end:     end,
+		minRev:  startRev,
+		filters: filters,
+		ws:      ws,
+	}
+	if startRev <= 0 || startRev > ws.b.currentRevision {
+		if startRev <= 0 {
+			w.minRev = ws.b.currentRevision + 1
+		}
+		ws.watchers[id] = w
+		ws.b.streamWatchers.add(w)
+		return id, nil
+	}
+
+	if startRev < ws.b.compactRevision {
+		ws.enqueueLocked(nil, backends.WatchResponse{
+			WatchID:         id,
+			Revision:        ws.b.currentRevision,
+			CompactRevision: ws.b.compactRevision,
+			Canceled:        true,
+		})
+		return id, nil
+	}
+	// The historical changes are replayed with the mutex locked, so there
+	// are no gaps or duplicates between them and the succeeded ones.
+	ws.watchers[id] = w
+	ws.syncLocked(w)
+	return id, nil
+}
+
+// syncLocked delivers the historical changes since the minRev of the
+// watcher, then the watcher is added to the watcher group to receive the
+// new changes. The historical changes are replayed with the mutex locked,
+// so there are no gaps or duplicates between them and the new ones. Note
+// this method should be invoked only if both the mutexes of the backend
+// and the stream are locked.
+func (ws *watchStream) syncLocked(w *streamWatcher) {
+	if events := ws.b.historyLocked(w); len(events) > 0 {
+		ws.enqueueLocked(w, backends.WatchResponse{
+			WatchID:  w.id,
+			Events:   events,
+			Revision: ws.b.currentRevision,
+		})
+	}
+	w.minRev = ws.b.currentRevision + 1
+	ws.b.streamWatchers.add(w)
+}
+
+// syncVictim catches the victim up with the history after its pending
+// responses drain, it's canceled if the history has been compacted.
+func (ws *watchStream) syncVictim(w *streamWatcher) {
+	ws.b.Lock()
+	defer ws.b.Unlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed || !w.victim || w.queued > 0 || ws.watchers[w.id] != w {
+		return
+	}
+	w.victim = false
+	if w.minRev < ws.b.compactRevision {
+		delete(ws.watchers, w.id)
+		ws.enqueueLocked(nil, backends.WatchResponse{
+			WatchID:         w.id,
+			Revision:        ws.b.currentRevision,
+			CompactRevision: ws.b.compactRevision,
+			Canceled:        true,
+			CancelReason:    backends.SlowWatcherCancelReason,
+		})
+		return
+	}
+	ws.syncLocked(w)
+}
+
+// historyLocked returns the events of the watcher since its minRev. Note
+// this method should be invoked only if the mutex is locked.
+func (b *btreeCache) historyLocked(w *streamWatcher) []*mvccpb.Event {
+	var events []*mvccpb.Event
+	b.tree.AscendGreaterOrEqual(&item{key: revision{main: w.minRev}}, func(i btree.Item) bool {
+		it := i.(*item)
+		if !w.contains(it.k) {
+			return true
+		}
+		ev := &mvccpb.Event{
+			Type: mvccpb.PUT,
+			Kv: &mvccpb.KeyValue{
+				Key:            it.k,
+				CreateRevision: it.createRev,
+				ModRevision:    it.key.main,
+				Version:        it.version,
+				Value:          it.value,
+				Lease:          it.lease,
+			},
+		}
+		if it.tombstone {
+			ev.Type = mvccpb.DELETE
+			ev.Kv = &mvccpb.KeyValue{
+				Key:         it.k,
+				ModRevision: it.key.main,
+			}
+		}
+		res, err := b.rangeLocked(it.k, nil, backends.RangeOptions{Revision: it.key.main - 1}, b.currentRevision)
+		if err == nil && len(res.KVs) > 0 {
+			ev.PrevKv = res.KVs[0]
+		}
+		if w.accepts(ev) {
+			events = append(events, ev)
+		}
+		return true
+	})
+	return events
+}
+
+func (ws *watchStream) Chan() <-chan backends.WatchResponse {
+	return ws.ch
+}
+
+func (ws *watchStream) RequestProgress(id int64) {
+	ws.b.RLock()
+	defer ws.b.RUnlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.watchers[id]
+	if !ok || w.victim {
+		return
+	}
+	// Changes deferred by Batch haven't been delivered yet, so the revision
+	// shouldn't cover them.
+	ws.enqueueLocked(w, backends.WatchResponse{
+		WatchID:  id,
+		Revision: ws.b.notifiedRevision,
+	})
+}
+
+func (ws *watchStream) RequestProgressAll() {
+	ws.b.RLock()
+	defer ws.b.RUnlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, w := range ws.watchers {
+		if w.victim {
+			// Not all the watchers have caught up.
+			return
+		}
+	}
+	ws.enqueueLocked(nil, backends.WatchResponse{
+		WatchID:  -1,
+		Revision: ws.b.notifiedRevision,
+	})
+}
+
+func (ws *watchStream) Cancel(id int64) error {
+	ws.b.Lock()
+	defer ws.b.Unlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.watchers[id]
+	if !ok {
+		return backends.ErrWatcherNotExist
+	}
+	delete(ws.watchers, id)
+	ws.b.streamWatchers.delete(w)
+	ws.enqueueLocked(nil, backends.WatchResponse{
+		WatchID:  id,
+		Revision: ws.b.currentRevision,
+		Canceled: true,
+	})
+	return nil
+}
+
+func (ws *watchStream) Close() {
+	ws.b.Lock()
+	defer ws.b.Unlock()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return
+	}
+	for id, w := range ws.watchers {
+		delete(ws.watchers, id)
+		ws.b.streamWatchers.delete(w)
+	}
+	ws.closed = true
+	ws.pending.Init()
+	close(ws.closec)
+}
+
+func (ws *watchStream) Watchers() []backends.WatcherState {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	states := make([]backends.WatcherState, 0, len(ws.watchers))
+	for _, w := range ws.watchers {
+		end := w.end
+		if end != nil && len(end) == 0 {
+			end = noPrefixEnd
+		}
+		states = append(states, backends.WatcherState{
+			ID:      w.id,
+			Key:     w.key,
+			End:     end,
+			Pending: w.queued,
+			Slow:    w.victim,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ID < states[j].ID
+	})
+	return states
+}
+
+// notify queues the response of the changes for the watcher, it never
+// blocks. It returns false if the watcher has too many pending responses,
+// then the watcher becomes a victim, and the changes since the response
+// will be delivered after it catches up.
+func (ws *watchStream) notify(w *streamWatcher, resp backends.WatchResponse) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return true
+	}
+	if w.queued >= ws.bufferSize {
+		w.victim = true
+		w.minRev = resp.Events[0].Kv.ModRevision
+		return false
+	}
+	ws.enqueueLocked(w, resp)
+	return true
+}
+
+func (ws *watchStream) enqueueLocked(w *streamWatcher, resp backends.WatchResponse) {
+	if ws.closed {
+		return
+	}
+	if w != nil {
+		w.queued++
+	}
+	ws.pending.PushBack(&pendingResponse{
+		w:    w,
+		resp: resp,
+	})
+	select {
+	case ws.notifyc <- struct{}{}:
+	default:
+	}
+}
+
+// run moves the queued responses to the channel until the stream is closed.
+func (ws *watchStream) run() {
+	for {
+		var (
+			pr   *pendingResponse
+			sync bool
+		)
+		ws.mu.Lock()
+		if e := ws.pending.Front(); e != nil {
+			pr = ws.pending.Remove(e).(*pendingResponse)
+			if pr.w != nil {
+				pr.w.queued--
+				sync = pr.w.victim && pr.w.queued == 0
+			}
+		}
+		ws.mu.Unlock()
+
+		if pr == nil {
+			select {
+			case <-ws.notifyc:
+				continue
+			case <-ws.closec:
+				return
+			}
+		}
+		select {
+		case ws.ch <- pr.resp:
+		case <-ws.closec:
+			return
+		}
+		if sync {
+			ws.syncVictim(pr.w)
+		}
+	}
+}
+
+func (b *btreeCache) Batch(fn func()) {
+	b.Lock()
+	b.batching++
+	b.Unlock()
+
+	defer func() {
+		b.Lock()
+		defer b.Unlock()
+		b.batching--
+		if b.batching == 0 && len(b.deferredEvents) > 0 {
+			b.notifyLocked(b.currentRevision, b.deferredEvents)
+			b.deferredEvents = nil
+		}
+	}()
+	fn()
+}
+
+// notifyLocked delivers the events to the stream watchers, events are
+// deferred if it's in a batch. Note this method should be invoked only if
+// the mutex is locked.
+func (b *btreeCache) notifyLocked(rev int64, events []*mvccpb.Event) {
+	if b.batching > 0 {
+		b.deferredEvents = append(b.deferredEvents, events...)
+		return
+	}
+
+	// The events are matched in chunks concurrently, and the chunks are
+	// merged in order, so the events of each watcher are still in order.
+	chunks := make([]watcherEvents, b.workersFor(len(events)))
+	parallelize(len(chunks), len(events), func(chunk, begin, end int) {
+		chunks[chunk] = b.matchLocked(events[begin:end])
+	})
+	matched := chunks[0]
+	for _, chunk := range chunks[1:] {
+		matched.merge(chunk)
+	}
+
+	// Each watcher gets exactly one response from one of the workers, and
+	// all of them are queued before the next change is notified.
+	victims := make([][]*streamWatcher, b.workersFor(len(matched.watchers)))
+	parallelize(len(victims), len(matched.watchers), func(worker, begin, end int) {
+		for _, w := range matched.watchers[begin:end] {
+			ok := w.ws.notify(w, backends.WatchResponse{
+				WatchID:  w.id,
+				Events:   matched.events[w],
+				Revision: rev,
+			})
+			if !ok {
+				victims[worker] = append(victims[worker], w)
+			}
+		}
+	})
+	for _, vs := range victims {
+		for _, w := range vs {
+			// The watcher is too slow, it stops receiving the new changes
+			// until it catches up.
+			b.streamWatchers.delete(w)
+		}
+	}
+	b.notifiedRevision = rev
+}
+
+// minParallelWork is the least number of the events or the watchers which
+// are worth being processed concurrently.
+const minParallelWork = 256
+
+// workersFor returns the number of the workers to process n events or
+// watchers.
+func (b *btreeCache) workersFor(n int) int {
+	workers := n / minParallelWork
+	if workers > b.notifyWorkers {
+		workers = b.notifyWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// parallelize splits [0, n) into chunks, and calls fn for each of them in
+// its own goroutine, then it waits for all of them. The first chunk is
+// processed in the current goroutine.
+func parallelize(chunks, n int, fn func(chunk, begin, end int)) {
+	if chunks <= 1 {
+		fn(0, 0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	size := (n + chunks - 1) / chunks
+	for chunk := 1; chunk < chunks; chunk++ {
+		begin := chunk * size
+		if begin >= n {
+			break
+		}
+		end := begin + size
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(chunk, begin, end int) {
+			defer wg.Done()
+			fn(chunk, begin, end)
+		}(chunk, begin, end)
+	}
+	end := size
+	if end > n {
+		end = n
+	}
+	fn(0, 0, end)
+	wg.Wait()
+}
+
+// watcherEvents are the events matched by the watchers, watchers are in the
+// order of their first events.
+type watcherEvents struct {
+	watchers []*streamWatcher
+	events   map[*streamWatcher][]*mvccpb.Event
+}
+
+// merge appends the events of other, which are later ones.
+func (we *watcherEvents) merge(other watcherEvents) {
+	for _, w := range other.watchers {
+		if _, ok := we.events[w]; !ok {
+			we.watchers = append(we.watchers, w)
+		}
+		we.events[w] = append(we.events[w], other.events[w]...)
+	}
+}
+
+// matchLocked finds the watchers of the events. Note this method should be
+// invoked only if the mutex is locked, it's safe to be invoked concurrently
+// since the watchers are not modified.
+func (b *btreeCache) matchLocked(events []*mvccpb.Event) watcherEvents {
+	matched := watcherEvents{
+		events: make(map[*streamWatcher][]*mvccpb.Event),
+	}
+	for _, ev := range events {
+		b.streamWatchers.watchersOf(ev.Kv.Key, func(w *streamWatcher) {
+			if ev.Kv.ModRevision < w.minRev || !w.accepts(ev) {
+				return
+			}
+			if _, ok := matched.events[w]; !ok {
+				matched.watchers = append(matched.watchers, w)
+			}
+			matched.events[w] = append(matched.events[w], ev)
+		})
+	}
+	return matched
+}
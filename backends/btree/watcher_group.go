@@ -0,0 +1,263 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package btree
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+// watcherGroup indexes the stream watchers by their ranges. Single key
+// watchers are indexed by a map, and the range watchers are indexed by an
+// interval tree, so that finding the watchers of a key doesn't need to
+// visit all the watchers.
+type watcherGroup struct {
+	keyWatchers map[string]map[*streamWatcher]struct{}
+	ranges      intervalTree
+	size        int
+}
+
+func newWatcherGroup() *watcherGroup {
+	return &watcherGroup{
+		keyWatchers: make(map[string]map[*streamWatcher]struct{}),
+	}
+}
+
+func (wg *watcherGroup) add(w *streamWatcher) {
+	wg.size++
+	if w.end == nil {
+		group, ok := wg.keyWatchers[string(w.key)]
+		if !ok {
+			group = make(map[*streamWatcher]struct{})
+			wg.keyWatchers[string(w.key)] = group
+		}
+		group[w] = struct{}{}
+		return
+	}
+	wg.ranges.insert(interval{begin: w.key, end: w.end}, w)
+}
+
+func (wg *watcherGroup) delete(w *streamWatcher) {
+	if w.end == nil {
+		group, ok := wg.keyWatchers[string(w.key)]
+		if !ok {
+			return
+		}
+		if _, ok := group[w]; !ok {
+			return
+		}
+		delete(group, w)
+		if len(group) == 0 {
+			delete(wg.keyWatchers, string(w.key))
+		}
+		wg.size--
+		return
+	}
+	if wg.ranges.delete(interval{begin: w.key, end: w.end}, w) {
+		wg.size--
+	}
+}
+
+// watchersOf calls fn for each watcher which contains the key.
+func (wg *watcherGroup) watchersOf(key []byte, fn func(w *streamWatcher)) {
+	for w := range wg.keyWatchers[string(key)] {
+		fn(w)
+	}
+	wg.ranges.stab(key, fn)
+}
+
+// interval is the range [begin, end), an empty end means infinity.
+type interval struct {
+	begin []byte
+	end   []byte
+}
+
+func (ivl interval) compare(other interval) int {
+	if c := bytes.Compare(ivl.begin, other.begin); c != 0 {
+		return c
+	}
+	return compareEnd(ivl.end, other.end)
+}
+
+// compareEnd compares two interval ends, an empty end is the greatest.
+func compareEnd(a, b []byte) int {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	default:
+		return bytes.Compare(a, b)
+	}
+}
+
+type intervalNode struct {
+	ivl interval
+	// max is the greatest end in the subtree.
+	max      []byte
+	priority int
+	left     *intervalNode
+	right    *intervalNode
+	watchers map[*streamWatcher]struct{}
+}
+
+func (n *intervalNode) update() {
+	n.max = n.ivl.end
+	if n.left != nil && compareEnd(n.left.max, n.max) > 0 {
+		n.max = n.left.max
+	}
+	if n.right != nil && compareEnd(n.right.max, n.max) > 0 {
+		n.max = n.right.max
+	}
+}
+
+// intervalTree is a treap ordered by the intervals, each node records the
+// greatest end in its subtree, so that the subtrees which cannot contain a
+// point are skipped.
+type intervalTree struct {
+	root *intervalNode
+}
+
+func (t *intervalTree) insert(ivl interval, w *streamWatcher) {
+	t.root = insertInterval(t.root, ivl, w)
+}
+
+// delete removes the watcher from the interval, it returns false if the
+// watcher is not found.
+func (t *intervalTree) delete(ivl interval, w *streamWatcher) bool {
+	var found bool
+	t.root = deleteInterval(t.root, ivl, w, &found)
+	return found
+}
+
+// stab calls fn for each watcher whose interval contains the point.
+func (t *intervalTree) stab(point []byte, fn func(w *streamWatcher)) {
+	stabInterval(t.root, point, fn)
+}
+
+func insertInterval(n *intervalNode, ivl interval, w *streamWatcher) *intervalNode {
+	if n == nil {
+		return &intervalNode{
+			ivl:      ivl,
+			max:      ivl.end,
+			priority: rand.Int(),
+			watchers: map[*streamWatcher]struct{}{
+				w: {},
+			},
+		}
+	}
+	switch c := ivl.compare(n.ivl); {
+	case c == 0:
+		n.watchers[w] = struct{}{}
+		return n
+	case c < 0:
+		n.left = insertInterval(n.left, ivl, w)
+		if n.left.priority > n.priority {
+			n = rotateRight(n)
+		}
+	default:
+		n.right = insertInterval(n.right, ivl, w)
+		if n.right.priority > n.priority {
+			n = rotateLeft(n)
+		}
+	}
+	n.update()
+	return n
+}
+
+func deleteInterval(n *intervalNode, ivl interval, w *streamWatcher, found *bool) *intervalNode {
+	if n == nil {
+		return nil
+	}
+	switch c := ivl.compare(n.ivl); {
+	case c == 0:
+		if _, ok := n.watchers[w]; !ok {
+			return n
+		}
+		*found = true
+		delete(n.watchers, w)
+		if len(n.watchers) > 0 {
+			return n
+		}
+		return mergeIntervals(n.left, n.right)
+	case c < 0:
+		n.left = deleteInterval(n.left, ivl, w, found)
+	default:
+		n.right = deleteInterval(n.right, ivl, w, found)
+	}
+	n.update()
+	return n
+}
+
+// mergeIntervals merges two treaps, all the intervals in left are less
+// than the ones in right.
+func mergeIntervals(left, right *intervalNode) *intervalNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.priority > right.priority {
+		left.right = mergeIntervals(left.right, right)
+		left.update()
+		return left
+	}
+	right.left = mergeIntervals(left, right.left)
+	right.update()
+	return right
+}
+
+func stabInterval(n *intervalNode, point []byte, fn func(w *streamWatcher)) {
+	if n == nil {
+		return
+	}
+	if len(n.max) > 0 && bytes.Compare(n.max, point) <= 0 {
+		// No interval in this subtree reaches the point.
+		return
+	}
+	stabInterval(n.left, point, fn)
+	if bytes.Compare(n.ivl.begin, point) > 0 {
+		// The intervals in the right subtree begin after the point.
+		return
+	}
+	if len(n.ivl.end) == 0 || bytes.Compare(point, n.ivl.end) < 0 {
+		for w := range n.watchers {
+			fn(w)
+		}
+	}
+	stabInterval(n.right, point, fn)
+}
+
+func rotateRight(n *intervalNode) *intervalNode {
+	left := n.left
+	n.left = left.right
+	n.update()
+	left.right = n
+	left.update()
+	return left
+}
+
+func rotateLeft(n *intervalNode) *intervalNode {
+	right := n.right
+	n.right = right.left
+	n.update()
+	right.left = n
+	right.update()
+	return right
+}
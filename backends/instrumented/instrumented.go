@@ -0,0 +1,193 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package instrumented wraps a backends.Backend with the Prometheus metrics
+// of its data and its operations, so that any backend gets them for free.
+package instrumented
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+var (
+	keysDesc = prometheus.NewDesc(
+		"etcd_adapter_cache_keys",
+		"The number of the keys in the backend.",
+		nil, nil,
+	)
+	bytesDesc = prometheus.NewDesc(
+		"etcd_adapter_cache_bytes",
+		"The number of bytes of the keys and the values in the backend, including the history.",
+		nil, nil,
+	)
+	historyRevisionsDesc = prometheus.NewDesc(
+		"etcd_adapter_cache_history_revisions",
+		"The number of the revisions retained in the history, since the compacted revision.",
+		nil, nil,
+	)
+	tombstonesDesc = prometheus.NewDesc(
+		"etcd_adapter_cache_tombstones",
+		"The number of the tombstones of the deleted keys retained in the history, only if the backend is a backends.TombstoneCounter.",
+		nil, nil,
+	)
+)
+
+// The values of the operation label.
+const (
+	opGet        = "get"
+	opCreate     = "create"
+	opUpdate     = "update"
+	opDelete     = "delete"
+	opList       = "list"
+	opCount      = "count"
+	opRange      = "range"
+	opTxn        = "txn"
+	opCompact    = "compact"
+	opKeyHistory = "key_history"
+)
+
+// Backend is a backends.Backend which observes the durations of the
+// operations, and it's a prometheus.Collector of the metrics. The etcd
+// adapter collects the metrics of its backend if it's a
+// prometheus.Collector, so no registration is needed if it's used as the
+// backend of the etcd adapter.
+type Backend struct {
+	backends.Backend
+	durations *prometheus.HistogramVec
+}
+
+// New wraps the backend.
+func New(b backends.Backend) *Backend {
+	return &Backend{
+		Backend: b,
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "etcd_adapter_cache_operation_duration_seconds",
+			Help:    "The durations of the operations of the backend, a txn lasts from the start to the end of the write transaction.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"operation"}),
+	}
+}
+
+func (b *Backend) observe(op string, start time.Time) {
+	b.durations.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (b *Backend) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
+	defer b.observe(opGet, time.Now())
+	return b.Backend.Get(ctx, key, revision)
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	defer b.observe(opCreate, time.Now())
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, atRev, lease int64) (int64, *server.KeyValue, bool, error) {
+	defer b.observe(opUpdate, time.Now())
+	return b.Backend.Update(ctx, key, value, atRev, lease)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, atRev int64) (int64, *server.KeyValue, bool, error) {
+	defer b.observe(opDelete, time.Now())
+	return b.Backend.Delete(ctx, key, atRev)
+}
+
+func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
+	defer b.observe(opList, time.Now())
+	return b.Backend.List(ctx, prefix, startKey, limit, revision)
+}
+
+func (b *Backend) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	defer b.observe(opCount, time.Now())
+	return b.Backend.Count(ctx, prefix)
+}
+
+func (b *Backend) Range(ctx context.Context, key, end []byte, opts backends.RangeOptions) (*backends.RangeResult, error) {
+	defer b.observe(opRange, time.Now())
+	return b.Backend.Range(ctx, key, end, opts)
+}
+
+func (b *Backend) GetAt(ctx context.Context, key []byte, revision int64) (*mvccpb.KeyValue, error) {
+	defer b.observe(opGet, time.Now())
+	return b.Backend.GetAt(ctx, key, revision)
+}
+
+func (b *Backend) RangeAt(ctx context.Context, key, end []byte, revision int64) (*backends.RangeResult, error) {
+	defer b.observe(opRange, time.Now())
+	return b.Backend.RangeAt(ctx, key, end, revision)
+}
+
+func (b *Backend) KeyHistory(ctx context.Context, key []byte, fromRev int64) ([]*backends.Change, error) {
+	defer b.observe(opKeyHistory, time.Now())
+	return b.Backend.KeyHistory(ctx, key, fromRev)
+}
+
+func (b *Backend) Write(ctx context.Context) backends.TxnWrite {
+	return &txnWrite{
+		TxnWrite: b.Backend.Write(ctx),
+		b:        b,
+		start:    time.Now(),
+	}
+}
+
+func (b *Backend) Compact(ctx context.Context, revision int64) (int64, error) {
+	defer b.observe(opCompact, time.Now())
+	return b.Backend.Compact(ctx, revision)
+}
+
+func (b *Backend) Describe(ch chan<- *prometheus.Desc) {
+	ch <- keysDesc
+	ch <- bytesDesc
+	ch <- historyRevisionsDesc
+	ch <- tombstonesDesc
+	b.durations.Describe(ch)
+}
+
+// Collect collects the metrics, the data is read from the wrapped backend
+// so that the scrapes are not observed as operations.
+func (b *Backend) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	if _, count, err := b.Backend.Count(ctx, ""); err == nil {
+		ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(count))
+	}
+	if size, err := b.Backend.DbSizeInUse(ctx); err == nil {
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(size))
+	}
+	ch <- prometheus.MustNewConstMetric(historyRevisionsDesc, prometheus.GaugeValue,
+		float64(b.Backend.CurrentRevision()-b.Backend.CompactRevision()))
+	if tc, ok := b.Backend.(backends.TombstoneCounter); ok {
+		ch <- prometheus.MustNewConstMetric(tombstonesDesc, prometheus.GaugeValue, float64(tc.Tombstones()))
+	}
+	b.durations.Collect(ch)
+}
+
+// txnWrite observes the duration of the transaction when it ends.
+type txnWrite struct {
+	backends.TxnWrite
+	b     *Backend
+	start time.Time
+}
+
+func (txn *txnWrite) End() {
+	txn.TxnWrite.End()
+	txn.b.observe(opTxn, txn.start)
+}
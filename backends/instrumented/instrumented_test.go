@@ -0,0 +1,102 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package instrumented
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+// gather returns the values of the gauges and the sample counts of the
+// histograms, keyed by the names and the operation labels.
+func gather(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	families, err := g.Gather()
+	assert.Nil(t, err, "checking error")
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += "/" + label.GetValue()
+			}
+			if m.GetHistogram() != nil {
+				values[name] = float64(m.GetHistogram().GetSampleCount())
+			} else {
+				values[name] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestInstrumentedBackend(t *testing.T) {
+	b := New(btree.NewBTreeCache(zap.NewExample()))
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(b), "checking error")
+
+	ctx := context.Background()
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes/3"} {
+		_, err := b.Create(ctx, key, []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	_, _, ok, err := b.Update(ctx, "/apisix/routes/1", []byte("v2"), 2, 0)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking update success flag")
+	_, _, ok, err = b.Delete(ctx, "/apisix/routes/3", 4)
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking delete success flag")
+	_, _, err = b.Get(ctx, "/apisix/routes/1", 0)
+	assert.Nil(t, err, "checking error")
+	_, err = b.Range(ctx, []byte("/apisix/routes/"), []byte("/apisix/routes0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	_, err = b.GetAt(ctx, []byte("/apisix/routes/1"), 2)
+	assert.Nil(t, err, "checking error")
+	_, err = b.KeyHistory(ctx, []byte("/apisix/routes/1"), 0)
+	assert.Nil(t, err, "checking error")
+	txn := b.Write(ctx)
+	txn.Put([]byte("/apisix/upstreams/1"), []byte("v1"), 0)
+	txn.End()
+	_, err = b.Compact(ctx, 5)
+	assert.Nil(t, err, "checking error")
+
+	values := gather(t, registry)
+	assert.Equal(t, float64(3), values["etcd_adapter_cache_keys"], "checking keys")
+	assert.Equal(t, float64(2), values["etcd_adapter_cache_history_revisions"], "checking history revisions")
+	assert.Equal(t, float64(1), values["etcd_adapter_cache_tombstones"], "checking tombstones")
+	assert.Greater(t, values["etcd_adapter_cache_bytes"], float64(0), "checking bytes")
+	for op, count := range map[string]float64{
+		opCreate:     3,
+		opUpdate:     1,
+		opDelete:     1,
+		opGet:        2,
+		opRange:      1,
+		opTxn:        1,
+		opCompact:    1,
+		opKeyHistory: 1,
+	} {
+		assert.Equal(t, count, values["etcd_adapter_cache_operation_duration_seconds/"+op], "checking "+op+" operations")
+	}
+	// The scrapes are not observed.
+	_, ok = gather(t, registry)["etcd_adapter_cache_operation_duration_seconds/"+opCount]
+	assert.False(t, ok, "checking count operations")
+}
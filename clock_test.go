@@ -0,0 +1,182 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock which only moves when it's advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	// changed is closed when a waiter is added or removed.
+	changed chan struct{}
+}
+
+// fakeWaiter is the fake Timer, and it's also the fake Ticker if it has a
+// period.
+type fakeWaiter struct {
+	clock    *fakeClock
+	c        chan time.Time
+	stopped  chan struct{}
+	deadline time.Time
+	// period is zero for the timers.
+	period time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Unix(0, 0),
+		changed: make(chan struct{}),
+	}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{fc.newWaiter(d, d)}
+}
+
+func (fc *fakeClock) NewTimer(d time.Duration) Timer {
+	return fc.newWaiter(d, 0)
+}
+
+func (fc *fakeClock) newWaiter(d, period time.Duration) *fakeWaiter {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	w := &fakeWaiter{
+		clock:    fc,
+		c:        make(chan time.Time, 1),
+		stopped:  make(chan struct{}),
+		deadline: fc.now.Add(d),
+		period:   period,
+	}
+	fc.waiters = append(fc.waiters, w)
+	fc.notifyLocked()
+	return w
+}
+
+func (fc *fakeClock) notifyLocked() {
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+// Advance moves the clock forward by d, and fires the tickers and timers
+// whose deadlines are reached. Unlike the real ones, it blocks until the
+// ticks are received or the tickers are stopped, so that no tick is dropped.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	fc.now = fc.now.Add(d)
+	now := fc.now
+	var fired []*fakeWaiter
+	waiters := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if !w.deadline.After(now) {
+			fired = append(fired, w)
+			if w.period == 0 {
+				continue
+			}
+			for !w.deadline.After(now) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+		}
+		waiters = append(waiters, w)
+	}
+	if len(waiters) != len(fc.waiters) {
+		fc.notifyLocked()
+	}
+	fc.waiters = waiters
+	fc.mu.Unlock()
+
+	for _, w := range fired {
+		select {
+		case w.c <- now:
+		case <-w.stopped:
+		}
+	}
+}
+
+// BlockUntil waits until there are n tickers and timers.
+func (fc *fakeClock) BlockUntil(n int) {
+	for {
+		fc.mu.Lock()
+		changed := fc.changed
+		if len(fc.waiters) == n {
+			fc.mu.Unlock()
+			return
+		}
+		fc.mu.Unlock()
+		<-changed
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) Stop() bool {
+	fc := w.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for i := range fc.waiters {
+		if fc.waiters[i] == w {
+			fc.waiters = append(fc.waiters[:i], fc.waiters[i+1:]...)
+			close(w.stopped)
+			fc.notifyLocked()
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
+
+func TestFakeClock(t *testing.T) {
+	fc := newFakeClock()
+	ticker := fc.NewTicker(time.Second)
+	timer := fc.NewTimer(2 * time.Second)
+	fc.BlockUntil(2)
+
+	fc.Advance(500 * time.Millisecond)
+	assert.Len(t, ticker.C(), 0, "checking ticks")
+	fc.Advance(500 * time.Millisecond)
+	assert.Equal(t, time.Unix(1, 0), <-ticker.C(), "checking tick")
+	assert.Len(t, timer.C(), 0, "checking timer")
+	fc.Advance(time.Second)
+	assert.Equal(t, time.Unix(2, 0), <-ticker.C(), "checking tick")
+	assert.Equal(t, time.Unix(2, 0), <-timer.C(), "checking timer")
+	// The fired timer is removed.
+	fc.BlockUntil(1)
+	assert.False(t, timer.Stop(), "checking stopping fired timer")
+	ticker.Stop()
+	fc.BlockUntil(0)
+}
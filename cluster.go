@@ -0,0 +1,107 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"net"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// clusterServer implements the etcdserverpb.ClusterServer, the adapter is
+// reported as the only member of the cluster, and the membership cannot be
+// changed.
+type clusterServer struct {
+	member *etcdserverpb.Member
+}
+
+// MemberList returns the adapter itself, the member id is same as the one in
+// the response headers.
+func (s *clusterServer) MemberList(ctx context.Context, r *etcdserverpb.MemberListRequest) (*etcdserverpb.MemberListResponse, error) {
+	return &etcdserverpb.MemberListResponse{
+		Header:  &etcdserverpb.ResponseHeader{},
+		Members: []*etcdserverpb.Member{s.member},
+	}, nil
+}
+
+// MemberAdd is not supported, the adapter cannot have any peers.
+func (s *clusterServer) MemberAdd(ctx context.Context, r *etcdserverpb.MemberAddRequest) (*etcdserverpb.MemberAddResponse, error) {
+	return nil, errGRPCMembershipNotSupported
+}
+
+// MemberRemove is not supported, the adapter cannot remove itself.
+func (s *clusterServer) MemberRemove(ctx context.Context, r *etcdserverpb.MemberRemoveRequest) (*etcdserverpb.MemberRemoveResponse, error) {
+	if r.ID != s.member.ID {
+		return nil, rpctypes.ErrGRPCMemberNotFound
+	}
+	return nil, errGRPCMembershipNotSupported
+}
+
+// MemberUpdate is not supported, the URLs of the adapter are only
+// configurable by the AdapterOptions.
+func (s *clusterServer) MemberUpdate(ctx context.Context, r *etcdserverpb.MemberUpdateRequest) (*etcdserverpb.MemberUpdateResponse, error) {
+	if r.ID != s.member.ID {
+		return nil, rpctypes.ErrGRPCMemberNotFound
+	}
+	return nil, errGRPCMembershipNotSupported
+}
+
+// MemberPromote fails like ETCD does for a voting member, as the adapter is
+// never a learner.
+func (s *clusterServer) MemberPromote(ctx context.Context, r *etcdserverpb.MemberPromoteRequest) (*etcdserverpb.MemberPromoteResponse, error) {
+	if r.ID != s.member.ID {
+		return nil, rpctypes.ErrGRPCMemberNotFound
+	}
+	return nil, rpctypes.ErrGRPCMemberNotLearner
+}
+
+// member returns the adapter as a cluster member.
+func (a *adapter) member() *etcdserverpb.Member {
+	return &etcdserverpb.Member{
+		ID:         a.memberID,
+		Name:       a.memberName,
+		PeerURLs:   a.peerURLs,
+		ClientURLs: a.clientURLs,
+	}
+}
+
+// listenerURLs returns the URLs of the listener address, the unspecified
+// host is replaced with localhost like the default URLs of ETCD. The scheme
+// is https if the listener is served over TLS, and it's unix or unixs for
+// the unix sockets.
+func listenerURLs(addr net.Addr, secure bool) []string {
+	scheme := "http://"
+	if addr.Network() == "unix" {
+		scheme = "unix://"
+		if secure {
+			scheme = "unixs://"
+		}
+		return []string{scheme + addr.String()}
+	}
+	if secure {
+		scheme = "https://"
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return []string{scheme + addr.String()}
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return []string{scheme + net.JoinHostPort(host, port)}
+}
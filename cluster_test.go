@@ -0,0 +1,243 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListenerURLs(t *testing.T) {
+	cases := []struct {
+		addr string
+		urls []string
+	}{
+		{
+			addr: "127.0.0.1:2379",
+			urls: []string{"http://127.0.0.1:2379"},
+		},
+		{
+			addr: "0.0.0.0:2379",
+			urls: []string{"http://localhost:2379"},
+		},
+		{
+			addr: "[::]:2379",
+			urls: []string{"http://localhost:2379"},
+		},
+		{
+			addr: "[::1]:2379",
+			urls: []string{"http://[::1]:2379"},
+		},
+	}
+	for _, c := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", c.addr)
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, c.urls, listenerURLs(addr, false), "checking urls of %s", c.addr)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:2379")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"https://127.0.0.1:2379"}, listenerURLs(addr, true), "checking urls of TLS")
+	unixAddr := &net.UnixAddr{Net: "unix", Name: "/tmp/etcd.sock"}
+	assert.Equal(t, []string{"unix:///tmp/etcd.sock"}, listenerURLs(unixAddr, false), "checking urls of unix socket")
+}
+
+func TestEtcdAdapterMemberList(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		MemberID:   100,
+		MemberName: "adapter-1",
+		PeerURLs:   []string{"http://10.0.0.1:2380"},
+		ClientURLs: []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"},
+	})
+	defer shutdown()
+
+	resp, err := client.MemberList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Members, 1, "checking members")
+	member := resp.Members[0]
+	assert.Equal(t, uint64(100), member.ID, "checking member id")
+	assert.Equal(t, "adapter-1", member.Name, "checking member name")
+	assert.Equal(t, []string{"http://10.0.0.1:2380"}, member.PeerURLs, "checking peer urls")
+	assert.Equal(t, []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"}, member.ClientURLs, "checking client urls")
+	assert.Equal(t, member.ID, resp.Header.MemberId, "checking member id")
+	status, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, member.ID, status.Leader, "checking leader")
+}
+
+func TestEtcdAdapterMemberListDefault(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	resp, err := client.MemberList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Members, 1, "checking members")
+	member := resp.Members[0]
+	assert.Equal(t, DefaultMemberID, member.ID, "checking member id")
+	assert.Equal(t, DefaultMemberName, member.Name, "checking member name")
+	urls := []string{"http://" + client.Endpoints()[0]}
+	assert.Equal(t, urls, member.ClientURLs, "checking client urls")
+	assert.Equal(t, urls, member.PeerURLs, "checking peer urls")
+
+	// The client can sync the endpoints from the member list.
+	assert.Nil(t, client.Sync(context.Background()), "checking error")
+	assert.Equal(t, urls, client.Endpoints(), "checking endpoints")
+}
+
+func TestEtcdAdapterMembershipChanges(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+	cluster := etcdserverpb.NewClusterClient(client.ActiveConnection())
+	maintenance := etcdserverpb.NewMaintenanceClient(client.ActiveConnection())
+
+	cases := []struct {
+		name string
+		call func(ctx context.Context) error
+		code codes.Code
+	}{
+		{
+			name: "MemberAdd",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberAdd(ctx, &etcdserverpb.MemberAddRequest{
+					PeerURLs: []string{"http://127.0.0.1:2380"},
+				})
+				return err
+			},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "MemberRemove",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberRemove(ctx, &etcdserverpb.MemberRemoveRequest{
+					ID: DefaultMemberID,
+				})
+				return err
+			},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "MemberRemove unknown member",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberRemove(ctx, &etcdserverpb.MemberRemoveRequest{
+					ID: 100,
+				})
+				return err
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "MemberUpdate",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberUpdate(ctx, &etcdserverpb.MemberUpdateRequest{
+					ID:       DefaultMemberID,
+					PeerURLs: []string{"http://127.0.0.1:2380"},
+				})
+				return err
+			},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "MemberUpdate unknown member",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberUpdate(ctx, &etcdserverpb.MemberUpdateRequest{
+					ID: 100,
+				})
+				return err
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "MemberPromote",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberPromote(ctx, &etcdserverpb.MemberPromoteRequest{
+					ID: DefaultMemberID,
+				})
+				return err
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "MemberPromote unknown member",
+			call: func(ctx context.Context) error {
+				_, err := cluster.MemberPromote(ctx, &etcdserverpb.MemberPromoteRequest{
+					ID: 100,
+				})
+				return err
+			},
+			code: codes.NotFound,
+		},
+		{
+			name: "MoveLeader",
+			call: func(ctx context.Context) error {
+				_, err := maintenance.MoveLeader(ctx, &etcdserverpb.MoveLeaderRequest{
+					TargetID: DefaultMemberID,
+				})
+				return err
+			},
+			code: codes.OK,
+		},
+		{
+			name: "MoveLeader unknown member",
+			call: func(ctx context.Context) error {
+				_, err := maintenance.MoveLeader(ctx, &etcdserverpb.MoveLeaderRequest{
+					TargetID: 100,
+				})
+				return err
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "Downgrade",
+			call: func(ctx context.Context) error {
+				_, err := maintenance.Downgrade(ctx, &etcdserverpb.DowngradeRequest{
+					Action:  etcdserverpb.DowngradeRequest_VALIDATE,
+					Version: "3.4.0",
+				})
+				return err
+			},
+			code: codes.Unimplemented,
+		},
+		{
+			name: "Hash",
+			call: func(ctx context.Context) error {
+				_, err := maintenance.Hash(ctx, &etcdserverpb.HashRequest{})
+				return err
+			},
+			code: codes.Unimplemented,
+		},
+	}
+	for _, c := range cases {
+		// The calls must not hang, so that the retry loops terminate.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := c.call(ctx)
+		cancel()
+		assert.Equal(t, c.code, status.Code(err), "checking status code of %s", c.name)
+	}
+
+	// The clientv3 errors are recognizable.
+	_, err := client.MemberPromote(context.Background(), DefaultMemberID)
+	assert.Equal(t, rpctypes.ErrMemberNotLearner, err, "checking error")
+	_, err = client.MoveLeader(context.Background(), 100)
+	assert.Equal(t, rpctypes.ErrBadLeaderTransferee, err, "checking error")
+}
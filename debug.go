@@ -0,0 +1,152 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+var errStateNotSupported = errors.New("etcd adapter: dumping the state is not supported by the backend")
+
+// registerDebugHandlers registers the debug endpoints under /debug/ to the
+// HTTP mux if they're enabled.
+func (a *adapter) registerDebugHandlers(mux *http.ServeMux) {
+	if !a.debug {
+		return
+	}
+	// The named profiles, e.g. /debug/pprof/heap, are served by the index.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/adapter/state", a.showState)
+}
+
+// State is the state of the adapter returned by Adapter.DumpState.
+type State struct {
+	// Revision is the current revision of the backend.
+	Revision int64 `json:"revision"`
+	// CompactRevision is the compacted revision of the backend.
+	CompactRevision int64 `json:"compact_revision"`
+	// Keys are the keys in the backend, sorted by the keys.
+	Keys []KeyState `json:"keys"`
+	// Watchers are the watchers of all the watch streams, sorted by the
+	// peers and then the ids.
+	Watchers []WatcherState `json:"watchers"`
+}
+
+// KeyState is the state of a key.
+type KeyState struct {
+	Key            string `json:"key"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Version        int64  `json:"version"`
+	Lease          int64  `json:"lease,omitempty"`
+	// Value is nil if the values are redacted.
+	Value []byte `json:"value,omitempty"`
+}
+
+// WatcherState is the state of a watcher.
+type WatcherState struct {
+	// ID is the id of the watcher in its stream.
+	ID int64 `json:"id"`
+	// Key and RangeEnd are the range of the watcher, like the ones of the
+	// WatchCreateRequest.
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+	// StartRevision is the start revision requested by the watcher, zero
+	// means the changes after it's created.
+	StartRevision int64 `json:"start_revision"`
+	// Pending is the number of the pending responses of the watcher.
+	Pending int `json:"pending"`
+	// Slow indicates the watcher stops receiving the new changes until its
+	// pending responses drain.
+	Slow bool `json:"slow"`
+	// Peer is the address of the client of the watch stream.
+	Peer string `json:"peer"`
+}
+
+func (a *adapter) DumpState(ctx context.Context, withValues bool) (*State, error) {
+	backend, ok := a.backend.(backends.Backend)
+	if !ok {
+		return nil, errStateNotSupported
+	}
+	// The compacted revision is read first, so that it's not greater than
+	// the revision of the keys.
+	compactRev := backend.CompactRevision()
+	rr, err := backend.Range(ctx, []byte{0}, []byte{0}, backends.RangeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	state := &State{
+		Revision:        rr.Revision,
+		CompactRevision: compactRev,
+		Keys:            make([]KeyState, 0, len(rr.KVs)),
+		Watchers:        []WatcherState{},
+	}
+	for _, kv := range rr.KVs {
+		ks := KeyState{
+			Key:            string(kv.Key),
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Version:        kv.Version,
+			Lease:          kv.Lease,
+		}
+		if withValues {
+			ks.Value = kv.Value
+		}
+		state.Keys = append(state.Keys, ks)
+	}
+	if a.watchServer != nil {
+		if watchers := a.watchServer.watcherStates(); watchers != nil {
+			state.Watchers = watchers
+		}
+	}
+	return state, nil
+}
+
+// showState serves the /debug/adapter/state endpoint, the values are
+// included if the "values" query parameter is true.
+func (a *adapter) showState(w http.ResponseWriter, r *http.Request) {
+	withValues, _ := strconv.ParseBool(r.URL.Query().Get("values"))
+	state, err := a.DumpState(r.Context(), withValues)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		a.logger.Warn("failed to send adapter state",
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdAdapterPprof(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	base := "http://" + client.Endpoints()[0]
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/adapter/state"} {
+		code, _ := getHealth(t, http.DefaultClient, base+path)
+		assert.Equal(t, http.StatusNotFound, code, "checking status code of %s", path)
+	}
+	shutdown()
+
+	_, client, shutdown = startTestAdapter(t, &AdapterOptions{
+		Debug: true,
+	})
+	defer shutdown()
+	base = "http://" + client.Endpoints()[0]
+	code, body := getHealth(t, http.DefaultClient, base+"/debug/pprof/")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Contains(t, body, "goroutine", "checking index")
+	code, body = getHealth(t, http.DefaultClient, base+"/debug/pprof/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Contains(t, body, "goroutine profile:", "checking goroutine profile")
+	code, body = getHealth(t, http.DefaultClient, base+"/debug/pprof/heap")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.NotEmpty(t, body, "checking heap profile")
+}
+
+func TestEtcdAdapterDumpState(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Debug: true,
+	})
+	defer shutdown()
+	base := "http://" + client.Endpoints()[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(2))
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	}
+	select {
+	case wresp := <-wch:
+		assert.Len(t, wresp.Events, 1, "checking events")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+
+	state, err := a.DumpState(context.Background(), false)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), state.Revision, "checking revision")
+	assert.Equal(t, int64(0), state.CompactRevision, "checking compact revision")
+	assert.Equal(t, []KeyState{
+		{
+			Key:            "/apisix/routes/1",
+			CreateRevision: 2,
+			ModRevision:    2,
+			Version:        1,
+		},
+	}, state.Keys, "checking keys")
+	assert.Len(t, state.Watchers, 1, "checking watchers")
+	assert.Equal(t, "/apisix/routes/", state.Watchers[0].Key, "checking watcher key")
+	assert.Equal(t, "/apisix/routes0", state.Watchers[0].RangeEnd, "checking watcher range end")
+	assert.Equal(t, int64(2), state.Watchers[0].StartRevision, "checking watcher start revision")
+	assert.NotEmpty(t, state.Watchers[0].Peer, "checking watcher peer")
+
+	code, body := getHealth(t, http.DefaultClient, base+"/debug/adapter/state?values=true")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	var dumped State
+	assert.Nil(t, json.Unmarshal([]byte(body), &dumped), "checking decoding error")
+	assert.Len(t, dumped.Keys, 1, "checking keys")
+	assert.Equal(t, []byte("v1"), dumped.Keys[0].Value, "checking value")
+	assert.Equal(t, state.Watchers, dumped.Watchers, "checking watchers")
+
+	code, body = getHealth(t, http.DefaultClient, base+"/debug/adapter/state")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.NotContains(t, body, `"value"`, "checking redacted values")
+}
@@ -0,0 +1,71 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"net"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// embeddedBufferSize is the buffer size of the in-memory connections of the
+// embedded clients.
+const embeddedBufferSize = 1 << 20
+
+func (a *adapter) NewEmbeddedClient(ctx context.Context) (*clientv3.Client, error) {
+	// The gRPC server is created by Serve.
+	select {
+	case <-a.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	l := bufconn.Listen(embeddedBufferSize)
+	go func() {
+		if err := a.grpcSrv.Serve(l); err != nil {
+			a.logger.Error("embedded grpc server serve failure",
+				zap.Error(err),
+			)
+		}
+	}()
+	client, err := clientv3.New(clientv3.Config{
+		// The endpoint is only a name, the connections are dialed in the
+		// memory.
+		Endpoints: []string{"bufconn"},
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return l.Dial()
+			}),
+		},
+	})
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = client.Close()
+		case <-client.Ctx().Done():
+		}
+		_ = l.Close()
+	}()
+	return client, nil
+}
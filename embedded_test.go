@@ -0,0 +1,75 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdAdapterEmbeddedClient(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	embedded, err := a.NewEmbeddedClient(ctx)
+	assert.Nil(t, err, "checking error")
+
+	// The embedded client shares the data with the network ones.
+	getResp, err := embedded.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	wch := embedded.Watch(ctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithRev(getResp.Header.Revision+1))
+	_, err = embedded.Put(context.Background(), "/apisix/routes/1", "1")
+	assert.Nil(t, err, "checking error")
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("2"),
+			Type:  EventAdd,
+		},
+	}
+	var events int
+	for events < 2 {
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking error")
+			events += len(wresp.Events)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+
+	// The client is closed with the context.
+	cancel()
+	select {
+	case <-embedded.Ctx().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the client to be closed")
+	}
+
+	// It waits until the adapter is serving.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = NewEtcdAdapter(nil).NewEmbeddedClient(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "checking error")
+}
@@ -0,0 +1,117 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"errors"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+var (
+	errGRPCReadOnly = status.New(codes.PermissionDenied, "etcd adapter is read-only").Err()
+	// errGRPCMembershipNotSupported is returned by the RPCs which change the
+	// cluster membership, as the adapter is always a single member cluster.
+	errGRPCMembershipNotSupported = status.New(codes.Unimplemented, "etcd adapter: changing the cluster membership is not supported").Err()
+	errGRPCDowngradeNotSupported  = status.New(codes.Unimplemented, "etcd adapter: downgrading the cluster is not supported").Err()
+	errGRPCHashNotSupported       = status.New(codes.Unimplemented, "etcd adapter: hashing the database is not supported, use HashKV instead").Err()
+	// errGRPCAuthVerifyOnly is returned by the Authenticate RPC if the JWTs
+	// can only be verified, as the private key is not configured.
+	errGRPCAuthVerifyOnly = status.New(codes.FailedPrecondition, "etcd adapter: issuing the tokens is not supported without the private key").Err()
+	// errGRPCRateLimited and errGRPCTooManyRequests are returned if the
+	// requests exceed the RateLimitOptions.
+	errGRPCRateLimited     = status.New(codes.ResourceExhausted, "etcd adapter: too many requests, rate limit exceeded").Err()
+	errGRPCTooManyRequests = status.New(codes.ResourceExhausted, "etcd adapter: too many concurrent requests").Err()
+	// errTooManyWatchers is the cancel reason of the watchers rejected by
+	// the MaxWatchers limit.
+	errTooManyWatchers = errors.New("etcd adapter: too many watchers")
+	// errReplaceNotSupported is returned by ReplaceAll if the backend is not
+	// a backends.Backend.
+	errReplaceNotSupported = errors.New("etcd adapter: replacing the keys is not supported by the backend")
+	// errPushEventsNotSupported is returned by the TypedAdapter if the
+	// backend is not a backends.Backend.
+	errPushEventsNotSupported = errors.New("etcd adapter: pushing the events together is not supported by the backend")
+	// errCompactNotSupported is returned by CompactTo if the backend is not
+	// a backends.Backend.
+	errCompactNotSupported = errors.New("etcd adapter: compacting the history is not supported by the backend")
+	// errSnapshotNotSupported is returned by SaveSnapshot if the backend is
+	// not a backends.Backend, and by the restoration if it's not a
+	// backends.Restorer.
+	errSnapshotNotSupported = errors.New("etcd adapter: saving or restoring snapshots is not supported by the backend")
+)
+
+var (
+	// ErrAlreadyServing is returned by Serve if the adapter is serving
+	// already, and by AddListener if it's called after Serve.
+	ErrAlreadyServing = errors.New("etcd adapter: already serving")
+	// ErrClosed is returned by Serve and AddListener after Shutdown or a
+	// failed Serve, as the adapter cannot be served again, and by Push once
+	// the events are no longer applied.
+	ErrClosed = errors.New("etcd adapter: closed")
+	// ErrKeyExists is returned by Push if the key of an add event exists.
+	ErrKeyExists = errors.New("etcd adapter: key already exists")
+	// ErrKeyNotFound is returned by Push if the key of an update or a
+	// delete event doesn't exist.
+	ErrKeyNotFound = errors.New("etcd adapter: key not found")
+	// ErrInvalidEventType is returned by Push if the event type is unknown.
+	ErrInvalidEventType = errors.New("etcd adapter: invalid event type")
+	// ErrKeyOutOfScope is returned by ReplaceAll if a desired key doesn't
+	// have the prefix.
+	ErrKeyOutOfScope = errors.New("etcd adapter: key out of the scope")
+	// ErrDuplicateKey is the error of the events sent together which have
+	// the same key, if AdapterOptions.AtomicEvents is set, and it's returned
+	// by ReplaceAll and the TypedAdapter if two objects have the same key.
+	ErrDuplicateKey = errors.New("etcd adapter: duplicate key in the events")
+	// ErrNoSpace is the error of the events and the objects of ReplaceAll
+	// which would exceed the quota, if AdapterOptions.RejectEventsOverQuota
+	// is set.
+	ErrNoSpace = errors.New("etcd adapter: database space exceeded")
+	// ErrNilObject is returned by the TypedAdapter if an object is nil, or
+	// the codec decodes a value into nil.
+	ErrNilObject = errors.New("etcd adapter: nil object")
+	// ErrInvalidSnapshot is wrapped by the error of restoring a snapshot
+	// which is corrupted, or whose format version is newer than the
+	// supported one.
+	ErrInvalidSnapshot = errors.New("etcd adapter: invalid snapshot")
+)
+
+// toGRPCError translates the errors to the ETCD gRPC errors, so that clients
+// can recognize them. Errors which are already gRPC status errors are kept.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch err {
+	case backends.ErrCompacted:
+		return rpctypes.ErrGRPCCompacted
+	case backends.ErrFutureRevision:
+		return rpctypes.ErrGRPCFutureRev
+	case context.Canceled:
+		return rpctypes.ErrGRPCCanceled
+	case context.DeadlineExceeded:
+		return rpctypes.ErrGRPCDeadlineExceeded
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+func TestToGRPCError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:     "compacted",
+			err:      backends.ErrCompacted,
+			expected: rpctypes.ErrGRPCCompacted,
+		},
+		{
+			name:     "future revision",
+			err:      backends.ErrFutureRevision,
+			expected: rpctypes.ErrGRPCFutureRev,
+		},
+		{
+			name:     "canceled",
+			err:      context.Canceled,
+			expected: rpctypes.ErrGRPCCanceled,
+		},
+		{
+			name:     "deadline exceeded",
+			err:      context.DeadlineExceeded,
+			expected: rpctypes.ErrGRPCDeadlineExceeded,
+		},
+		{
+			name:     "grpc error",
+			err:      rpctypes.ErrGRPCKeyNotFound,
+			expected: rpctypes.ErrGRPCKeyNotFound,
+		},
+		{
+			name:     "unknown error",
+			err:      errors.New("oops"),
+			expected: status.Error(codes.Unknown, "oops"),
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := toGRPCError(tc.err)
+			if tc.expected == nil {
+				assert.Nil(t, err, "checking error")
+				return
+			}
+			assert.Equal(t, status.Code(tc.expected), status.Code(err), "checking status code")
+			assert.Equal(t, tc.expected.Error(), err.Error(), "checking error message")
+		})
+	}
+}
+
+func TestEtcdAdapterErrors(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		_, err := client.Put(context.Background(), "/apisix/routes/1", value)
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := client.Compact(context.Background(), 3)
+	assert.Nil(t, err, "checking error")
+
+	nested := clientv3.OpTxn(nil, nil, nil)
+	for i := 0; i < 20; i++ {
+		nested = clientv3.OpTxn(nil, []clientv3.Op{nested}, nil)
+	}
+
+	cases := []struct {
+		name     string
+		call     func() error
+		expected error
+	}{
+		{
+			name: "compacted",
+			call: func() error {
+				_, err := client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(2))
+				return err
+			},
+			expected: rpctypes.ErrCompacted,
+		},
+		{
+			name: "future revision",
+			call: func() error {
+				_, err := client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(100))
+				return err
+			},
+			expected: rpctypes.ErrFutureRev,
+		},
+		{
+			name: "compact compacted",
+			call: func() error {
+				_, err := client.Compact(context.Background(), 2)
+				return err
+			},
+			expected: rpctypes.ErrCompacted,
+		},
+		{
+			name: "key not found",
+			call: func() error {
+				_, err := client.Put(context.Background(), "/apisix/routes/2", "", clientv3.WithIgnoreValue())
+				return err
+			},
+			expected: rpctypes.ErrKeyNotFound,
+		},
+		{
+			name: "value provided",
+			call: func() error {
+				_, err := client.Put(context.Background(), "/apisix/routes/1", "v4", clientv3.WithIgnoreValue())
+				return err
+			},
+			expected: rpctypes.ErrValueProvided,
+		},
+		{
+			name: "lease provided",
+			call: func() error {
+				_, err := client.Put(context.Background(), "/apisix/routes/1", "v4", clientv3.WithIgnoreLease(), clientv3.WithLease(1))
+				return err
+			},
+			expected: rpctypes.ErrLeaseProvided,
+		},
+		{
+			name: "too many ops",
+			call: func() error {
+				_, err := client.Do(context.Background(), nested)
+				return err
+			},
+			expected: rpctypes.ErrTooManyOps,
+		},
+		{
+			name: "in txn",
+			call: func() error {
+				_, err := client.Txn(context.Background()).Then(clientv3.OpGet("/apisix/routes/1", clientv3.WithRev(2))).Commit()
+				return err
+			},
+			expected: rpctypes.ErrCompacted,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			assert.Equal(t, tc.expected, rpctypes.Error(err), "checking error")
+		})
+	}
+}
@@ -1,17 +1,31 @@
 package etcdadapter
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdversion "go.etcd.io/etcd/api/v3/version"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 
+	"github.com/api7/etcd-adapter/backends"
 	"github.com/api7/etcd-adapter/backends/btree"
+	"github.com/api7/etcd-adapter/backends/instrumented"
 	"github.com/api7/etcd-adapter/backends/mysql"
 )
 
@@ -25,6 +39,31 @@ const (
 	EventUpdate
 	// EventDelete is the delete event
 	EventDelete
+	// EventUpsert is the event which puts the object no matter it exists
+	// or not, i.e. it's an add event if the object is absent, otherwise an
+	// update event.
+	EventUpsert
+)
+
+const (
+	// DefaultClusterID is the default cluster id, it's same as the cluster
+	// id of a single node ETCD cluster launched with the default settings.
+	DefaultClusterID = uint64(0xcdf818194e3a8c32)
+	// DefaultMemberID is the default member id, it's same as the member
+	// id of a single node ETCD cluster launched with the default settings.
+	DefaultMemberID = uint64(0x8e9e05c52164694d)
+	// DefaultMemberName is the default member name, it's same as the name
+	// of an ETCD member launched with the default settings.
+	DefaultMemberName = "default"
+	// DefaultWatchProgressNotifyInterval is the default interval of the
+	// watch progress notifications, it's same as ETCD.
+	DefaultWatchProgressNotifyInterval = 10 * time.Minute
+	// DefaultMaxWatchResponseBytes is the default max size of a watch
+	// response, it's same as the default max request bytes of ETCD.
+	DefaultMaxWatchResponseBytes = 1.5 * 1024 * 1024
+	// DefaultWatchBatchMaxEvents is the default max number of the events
+	// held for a watcher when the watch batching is enabled.
+	DefaultWatchBatchMaxEvents = 1000
 )
 
 // BackendKind is the type of backend.
@@ -35,45 +74,431 @@ const (
 	BackendBTree = BackendKind(iota)
 	// BackendMySQL indicates the mysql-based backend.
 	BackendMySQL
+	// BackendCustom indicates the backend provided by the application, see
+	// AdapterOptions.CustomBackend.
+	BackendCustom
 )
 
 // Event contains a bunch of entities and the type of event.
 type Event struct {
 	// Key is the object key.
 	Key string
-	// Value is the serialized data.
+	// Value is the serialized data. It's ignored by delete events, so they
+	// only need the Key.
 	Value []byte
 	// Type is the event type.
 	Type EventType
+	// Lease is the id of the lease which the key will be attached to, so
+	// that the key is deleted when the lease expires. The lease is granted
+	// with the TTL if it doesn't exist, and it's renewed every time the key
+	// is added or updated. It's only used by add, update and upsert events.
+	Lease int64
+	// TTL is the TTL of the lease in seconds. If Lease is zero but TTL is
+	// positive, the key keeps using its current lease, or a new lease is
+	// granted if it has none.
+	TTL int64
+	// Done receives the result of the event once it's applied and its
+	// changes are delivered to the watchers, it's optional. The result is
+	// dropped if the channel is not ready to receive, so it should be
+	// buffered, and it's never sent if the event is not applied, e.g. it's
+	// sent after Shutdown.
+	Done chan<- EventResult
+}
+
+// EventError is the error of an event which cannot be applied.
+type EventError struct {
+	// Event is the rejected event.
+	Event *Event
+	// Err is the reason why the event is rejected, e.g. ErrKeyNotFound.
+	Err error
+}
+
+func (e *EventError) Error() string {
+	return fmt.Sprintf("etcd adapter: failed to apply event (type %d) of %s: %s", e.Event.Type, e.Event.Key, e.Err)
+}
+
+func (e *EventError) Unwrap() error {
+	return e.Err
+}
+
+// EventResult is the result of an applied event.
+type EventResult struct {
+	// Event is the applied event.
+	Event *Event
+	// Revision is the revision of the change, it's zero if the event is
+	// failed to be applied.
+	Revision int64
+	// Err is the reason why the event is failed to be applied, e.g.
+	// ErrKeyNotFound.
+	Err error
 }
 
 type Adapter interface {
 	// EventCh returns a send-only channel to the users, so that users
-	// can feed events to Etcd Adapter. Note this is a non-buffered channel.
+	// can feed events to Etcd Adapter. Note this is a non-buffered channel
+	// unless AdapterOptions.EventChannelSize is set. The events sent before
+	// Shutdown are applied before it returns, while the ones sent after
+	// it are not.
 	EventCh() chan<- []*Event
+	// Push applies the event and returns the revision of the change, or
+	// ErrKeyExists, ErrKeyNotFound and ErrInvalidEventType if the event
+	// cannot be applied. It's applied in order with the events sent to
+	// EventCh, so the revisions are strictly increasing. It waits until
+	// the adapter is served, and returns ErrClosed once the events are no
+	// longer applied after Shutdown. The event might still be applied if
+	// ctx is done after it's accepted.
+	Push(ctx context.Context, ev *Event) (int64, error)
+	// ReplaceAll replaces the keys with the prefix by the desired objects,
+	// it puts the objects which are absent or changed, and deletes the keys
+	// which are not desired, in one transaction. So the changes share one
+	// revision, and the unchanged keys don't generate any events. An empty
+	// prefix means all the keys, and no desired objects means deleting all
+	// of them. The types of the desired events are ignored. It returns the
+	// revision after the changes, ErrKeyOutOfScope if a desired key doesn't
+	// have the prefix, ErrDuplicateKey if two desired objects have the same
+	// key, and ErrNoSpace if RejectEventsOverQuota is set and the desired
+	// objects would exceed the quota. It's serialized with the events in the
+	// same way as Push, and it's only supported by the btree backend.
+	ReplaceAll(ctx context.Context, prefix string, desired []*Event) (int64, error)
+	// CompactTo compacts the history before the revision in the same way as
+	// the Compact RPC, so that the ranges and the watchers at the compacted
+	// revisions fail as they do after the RPC. It returns
+	// backends.ErrFutureRevision if the revision is greater than the current
+	// revision, and backends.ErrCompacted if it's compacted already. It's
+	// only supported by the btree backend.
+	CompactTo(ctx context.Context, rev int64) error
 	// Serve accepts a net.Listener object and starts the Etcd V3 server.
+	// It blocks until the listener is closed, it returns nil if it's
+	// closed by Shutdown, otherwise the error of the listener, and Shutdown
+	// should still be called to stop the servers. It returns
+	// ErrAlreadyServing if it's serving already, and ErrClosed after
+	// Shutdown, as an adapter is only served once.
 	Serve(context.Context, net.Listener) error
-	// Shutdown shuts the etcd adapter down.
+	// Shutdown shuts the etcd adapter down. It drains the connections
+	// gracefully, but if the context is done before that, it closes them
+	// forcibly and returns an error wrapping the error of the context. It's
+	// a no-op before Serve or after Shutdown.
 	Shutdown(context.Context) error
+	// OutboundCh returns a receive-only channel to the users, changes
+	// made by the ETCD clients (e.g. by Put) will be delivered to it, so that
+	// users can learn about them. Note this is a buffered channel, changes
+	// will be dropped if the channel is full.
+	OutboundCh() <-chan *Event
+	// Errors returns a receive-only channel to the users, the events sent
+	// to the EventCh which cannot be applied, e.g. an update event on a
+	// missing key, are reported to it. Note this is a buffered channel, the
+	// errors will be dropped if the channel is full, and they're counted in
+	// Stats.DroppedEventErrors.
+	Errors() <-chan *EventError
+	// Stats returns the statistics of the etcd adapter.
+	Stats() Stats
+	// Leases returns the ids of the active leases in ascending order, it
+	// returns nil if the backend doesn't support leases.
+	Leases() []int64
+	// SetAllowlist replaces the allowlist, the new one takes effect for the
+	// subsequent requests and watchers. A nil one disables the allowlist.
+	SetAllowlist(*Allowlist)
+	// Ready returns a channel which is closed once Serve starts accepting
+	// the connections, i.e. after the services are registered. It's never
+	// closed if Serve fails before that.
+	Ready() <-chan struct{}
+	// AddListener adds a listener which is served together with the one
+	// passed to Serve, e.g. a unix socket for the local clients besides the
+	// TCP listener. It's served over the TLS of the options if they're not
+	// nil, regardless of AdapterOptions.TLS. It must be called before Serve,
+	// otherwise it returns ErrAlreadyServing or ErrClosed, and the listener
+	// is closed by Shutdown.
+	AddListener(net.Listener, *TLSOptions) error
+	// NewEmbeddedClient returns a client connected to the adapter in the
+	// memory, without the network. It waits until the adapter is serving,
+	// and the client is closed when the context is done.
+	NewEmbeddedClient(context.Context) (*clientv3.Client, error)
+	// DumpState returns the state of the adapter, i.e. the keys and the
+	// watchers, for debugging. The values of the keys are only included if
+	// withValues is true. It returns an error if the backend is not a
+	// backends.Backend.
+	DumpState(ctx context.Context, withValues bool) (*State, error)
+	// SetDataReady marks whether the data fed by the application is ready,
+	// it's checked by the /readyz and the /health endpoints if
+	// AdapterOptions.WaitForData is set.
+	SetDataReady(bool)
+	// SaveSnapshot writes the keyspace with its history since the compacted
+	// revision, and the leases, to w in a versioned and checksummed format,
+	// so that the adapter can be restored by AdapterOptions.RestoreSnapshot.
+	// It returns an error if the backend is not a backends.Backend.
+	SaveSnapshot(ctx context.Context, w io.Writer) error
 }
 
 type adapter struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	logger  *zap.Logger
-	grpcSrv *grpc.Server
-	httpSrv *http.Server
+	logger *zap.Logger
+	ready  chan struct{}
+	// drain is closed by Shutdown, so that the watch and the keepalive
+	// streams end.
+	drain     chan struct{}
+	drainOnce sync.Once
+	grpcSrv   *grpc.Server
+	httpSrv   *http.Server
+	health    *health.Server
+	// loops are the goroutines of the events and the leases, they're
+	// waited by Shutdown.
+	loops sync.WaitGroup
 
 	eventsCh chan []*Event
-	backend  server.Backend
-	bridge   *server.KVServerBridge
+	pushCh   chan *pushRequest
+	// eventsDone is closed once the events are no longer applied.
+	eventsDone chan struct{}
+	outboundCh chan *Event
+	errorsCh   chan *EventError
+	backend    server.Backend
+	bridge     *server.KVServerBridge
+	// lessor is nil if the backend is not a backends.Backend.
+	lessor    *lessor
+	readOnly  bool
+	clusterID uint64
+	memberID  uint64
+	// memberName, peerURLs and clientURLs describe the adapter as a
+	// cluster member, the URLs are derived from the listener address if
+	// they're not specified.
+	memberName string
+	peerURLs   []string
+	clientURLs []string
+
+	watchProgressNotifyInterval time.Duration
+	maxWatchResponseBytes       int
+	watcherBufferSize           int
+	maxWatchers                 int
+	watchBatchInterval          time.Duration
+	watchBatchMaxEvents         int
+	clock                       Clock
+	quotaBackendBytes           int64
+	rejectEventsOverQuota       bool
+	alarms                      *alarmStore
+	version                     *emulatedVersion
+	watchStats                  watchStats
+	allowlist                   *allowlist
+	auth                        *authStore
+	// tlsConfig is nil if the listener is served in plaintext.
+	tlsConfig         *tls.Config
+	grpcServerOptions []grpc.ServerOption
+	reflection        bool
+	// unaryInterceptors and streamInterceptors are the ones of the
+	// embedding application.
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	// rateLimiter is nil if there is no rate limit.
+	rateLimiter *rateLimiter
+	waitForData bool
+	// dataReady is set by SetDataReady, it should be accessed atomically.
+	dataReady  int32
+	eventStats eventStats
+	// metricsCollector is nil if the metrics of the adapter are not
+	// registered.
+	metricsRegisterer prometheus.Registerer
+	metricsGatherer   prometheus.Gatherer
+	metricsCollector  *metricsCollector
+	debug             bool
+	// watchServer is nil if the backend is not a backends.Backend.
+	watchServer *watchServer
+	// atomicEvents is false if the backend is not a backends.Backend.
+	atomicEvents         bool
+	skipUnchangedUpdates bool
+
+	// listenersMu guards the state and the listeners.
+	listenersMu sync.Mutex
+	state       serveState
+	// listeners are the ones added by AddListener before Serve, then the
+	// one passed to Serve is prepended.
+	listeners []*servedListener
 }
 
+// serveState is the lifecycle state of an adapter, which goes from new to
+// serving by Serve, then to closed by Shutdown or a failed Serve.
+type serveState int
+
+const (
+	stateNew = serveState(iota)
+	stateServing
+	stateClosed
+)
+
 type AdapterOptions struct {
 	Logger       *zap.Logger
 	Backend      BackendKind
 	MySQLOptions *mysql.Options
+	BTreeOptions *btree.Options
+	// CustomBackend is the backend used if Backend is BackendCustom. All
+	// the APIs are served if it's a backends.Backend, otherwise only the
+	// kine-compatible subset of them. Its methods are called concurrently
+	// by the events loop and the gRPC handlers, see backends.Backend for
+	// the guarantees required, and backendtest.Run to verify them.
+	CustomBackend server.Backend
+	// OutboundChannelSize is the buffer size of the outbound channel,
+	// default is 128.
+	OutboundChannelSize int
+	// EventChannelSize is the buffer size of the event channel, so that
+	// the producers can send a burst of events without waiting for each of
+	// them to be applied. Default is 0, i.e. a non-buffered channel.
+	EventChannelSize int
+	// ErrorChannelSize is the buffer size of the error channel, default is
+	// 128.
+	ErrorChannelSize int
+	// InitialEvents are applied by NewEtcdAdapter in the same way as the
+	// events sent to the EventCh together, so that the clients see the
+	// initial data as soon as the adapter is served.
+	InitialEvents []*Event
+	// RestoreSnapshot is a snapshot written by Adapter.SaveSnapshot, the
+	// backend is restored from it by NewEtcdAdapter before the
+	// InitialEvents are applied, and the leases are renewed with their
+	// TTLs. NewEtcdAdapter panics if it cannot be restored, e.g. the backend
+	// is not a backends.Restorer, or the snapshot is corrupted.
+	RestoreSnapshot io.Reader
+	// AtomicEvents indicates the events sent to the EventCh together are
+	// applied in one transaction, so that they share one revision and are
+	// delivered to the watchers in one response, and the clients see either
+	// none or all of them. The events can be of different types, but they
+	// are all rejected with ErrDuplicateKey if two of them have the same
+	// key. It's only supported by the btree backend.
+	AtomicEvents bool
+	// SkipUnchangedUpdates indicates the update and the upsert events which
+	// change neither the value nor the lease of the key are skipped, so that
+	// they don't bump the revision or wake up the watchers. The skipped ones
+	// are counted in Stats.SkippedUpdates.
+	SkipUnchangedUpdates bool
+	// ReadOnly indicates whether the adapter rejects the changes from the
+	// ETCD clients, events fed from the EventCh are still applied.
+	ReadOnly bool
+	// ClusterID is the cluster id in the response headers, default is
+	// DefaultClusterID.
+	ClusterID uint64
+	// MemberID is the member id in the response headers, default is
+	// DefaultMemberID.
+	MemberID uint64
+	// MemberName is the name of the adapter in the member list, default is
+	// DefaultMemberName.
+	MemberName string
+	// PeerURLs are the peer URLs of the adapter in the member list, they're
+	// same as the ClientURLs by default, as the adapter has no peers.
+	PeerURLs []string
+	// ClientURLs are the client URLs of the adapter in the member list,
+	// default is the URL of the listener address, with the unspecified
+	// host replaced by localhost.
+	ClientURLs []string
+	// WatchProgressNotifyInterval is the interval of the progress
+	// notifications for the watchers which require them, default is
+	// DefaultWatchProgressNotifyInterval.
+	WatchProgressNotifyInterval time.Duration
+	// MaxWatchResponseBytes is the max size of a watch response, larger
+	// ones are split into fragments if the watcher allows, default is
+	// DefaultMaxWatchResponseBytes.
+	MaxWatchResponseBytes int
+	// WatcherBufferSize is the max number of the pending responses of a
+	// watcher, a watcher stops receiving the new changes when its buffer is
+	// full, and it will catch up from the history after the buffer drains,
+	// or it will be canceled if the history has been compacted. It's the
+	// backend default if not specified.
+	WatcherBufferSize int
+	// MaxWatchers is the max number of the watchers in all the watch
+	// streams, new watchers are canceled once it's reached. Zero means no
+	// limit.
+	MaxWatchers int
+	// WatchBatchInterval is the max time the events of a watcher are held
+	// so that they're sent in one response, it's disabled by default so the
+	// events are sent at once.
+	WatchBatchInterval time.Duration
+	// WatchBatchMaxEvents is the max number of the events held for a
+	// watcher when batching is enabled, default is
+	// DefaultWatchBatchMaxEvents.
+	WatchBatchMaxEvents int
+	// QuotaBackendBytes is the max size of the backend, the NOSPACE alarm
+	// is raised once it's exceeded, and the changes from the ETCD clients
+	// are rejected until the alarm is disarmed. Zero means no quota.
+	QuotaBackendBytes int64
+	// RejectEventsOverQuota indicates the add, the update and the upsert
+	// events which would exceed the QuotaBackendBytes are rejected with
+	// ErrNoSpace, instead of being applied anyway. Unlike the changes from
+	// the ETCD clients, they're accepted again once the backend shrinks
+	// below the quota, regardless of the NOSPACE alarm.
+	RejectEventsOverQuota bool
+	// Clock is the source of time of the leases and the watchers, it's the
+	// wall clock by default. It's mainly used to control the time in tests.
+	Clock Clock
+	// EmulatedVersion is the ETCD version that etcd adapter claims, e.g.
+	// "3.4.32", only 3.4 and 3.5 are supported. It affects the versions
+	// reported to the clients and the behaviors which differ between the
+	// versions. Default is DefaultEmulatedVersion, and NewEtcdAdapter panics
+	// if the version is not supported.
+	EmulatedVersion string
+	// ClusterVersion is the cluster version reported by the /version
+	// endpoint, e.g. "3.4.9", default is the major and minor version of
+	// the EmulatedVersion, like "3.4.0". NewEtcdAdapter panics if it's not
+	// a valid semantic version.
+	ClusterVersion string
+	// Auth enables the authentication if it's not nil, then the KV, Watch,
+	// Lease and Auth requests must carry a token of a user, which is issued
+	// by the Authenticate RPC, and the keys are accessed as permitted by
+	// the roles of the user. Otherwise the authentication is disabled until
+	// a root user is added and it's enabled by the AuthEnable RPC, like
+	// ETCD. NewEtcdAdapter panics if the users or the roles are invalid.
+	Auth *AuthOptions
+	// Allowlist permits the clients to read and watch the keys with the
+	// prefixes, other requests are denied, it's independent of the Auth.
+	// It's updatable by the Adapter.SetAllowlist.
+	Allowlist *Allowlist
+	// TLS serves the listener over the TLS if it's not nil, otherwise it's
+	// served in plaintext. NewEtcdAdapter panics if the certificates cannot
+	// be loaded.
+	TLS *TLSOptions
+	// GRPCServerOptions tune the gRPC server, e.g. grpc.MaxRecvMsgSize for
+	// the large values, or grpc.KeepaliveParams which override the default
+	// keepalive settings. The adapter appends its own interceptors and
+	// credentials after them, so they must not set the interceptors or the
+	// credentials. NewEtcdAdapter panics if they set an interceptor by
+	// grpc.UnaryInterceptor or grpc.StreamInterceptor, use the
+	// UnaryInterceptors and the StreamInterceptors instead.
+	GRPCServerOptions []grpc.ServerOption
+	// Reflection registers the gRPC server reflection service, so that the
+	// tools like grpcurl can list and describe the services without the
+	// proto files. It's disabled by default. Like the health service, it
+	// doesn't require the authentication.
+	Reflection bool
+	// UnaryInterceptors and StreamInterceptors are chained before the
+	// interceptors of the adapter, so they observe all the requests of all
+	// the services, including the ones rejected by the authentication, and
+	// the errors already translated to the ETCD gRPC errors. They run in
+	// the given order.
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+	// RateLimit limits the rate and the concurrency of the unary requests
+	// if it's not nil, the rejected ones fail with ResourceExhausted.
+	// NewEtcdAdapter panics if the limits are negative.
+	RateLimit *RateLimitOptions
+	// WaitForData makes the /readyz and the /health endpoints report not
+	// ready until the data is marked ready by Adapter.SetDataReady, e.g.
+	// after the application feeds the initial events.
+	WaitForData bool
+	// MetricsRegisterer and MetricsGatherer are the Prometheus registry
+	// which the metrics are registered to and the /metrics endpoint
+	// gathers from, default are the global ones of Prometheus. The Go
+	// runtime and the process metrics are registered if they're not yet.
+	// A registerer collects only one serving adapter, so the adapters in
+	// the same process should use their own ones.
+	MetricsRegisterer prometheus.Registerer
+	MetricsGatherer   prometheus.Gatherer
+	// InstrumentBackend wraps the backend by instrumented.New, so that the
+	// durations of its operations are observed. It's ignored if the backend
+	// is not a backends.Backend. The metrics of a backend which is a
+	// prometheus.Collector are collected along with the adapter's.
+	InstrumentBackend bool
+	// Debug serves the debug endpoints on the HTTP endpoints, i.e. the
+	// profiles of net/http/pprof under /debug/pprof/, e.g.
+	// /debug/pprof/heap, and the state of the adapter at
+	// /debug/adapter/state. It's disabled by default, and the endpoints are
+	// served without the authentication, so only enable it if the listener
+	// is not exposed to the untrusted clients.
+	Debug bool
 }
 
 // NewEtcdAdapter new an etcd adapter instance.
@@ -83,69 +508,633 @@ func NewEtcdAdapter(opts *AdapterOptions) Adapter {
 		logger  *zap.Logger
 		backend server.Backend
 	)
-	if opts != nil && opts.Logger != nil {
+	if opts == nil {
+		opts = &AdapterOptions{}
+	}
+	if opts.Logger != nil {
 		logger = opts.Logger
 	} else {
 		logger = zap.NewExample()
 	}
+	emulatedVersion := opts.EmulatedVersion
+	if emulatedVersion == "" {
+		emulatedVersion = DefaultEmulatedVersion
+	}
+	version, err := parseEmulatedVersion(emulatedVersion, opts.ClusterVersion)
+	if err != nil {
+		panic(err.Error())
+	}
+	outboundChannelSize := opts.OutboundChannelSize
+	if outboundChannelSize <= 0 {
+		outboundChannelSize = 128
+	}
+	errorChannelSize := opts.ErrorChannelSize
+	if errorChannelSize <= 0 {
+		errorChannelSize = 128
+	}
+	eventChannelSize := opts.EventChannelSize
+	if eventChannelSize < 0 {
+		eventChannelSize = 0
+	}
 	switch opts.Backend {
 	case BackendBTree:
-		backend = btree.NewBTreeCache(logger)
+		backend, err = btree.OpenBTreeCache(logger, opts.BTreeOptions)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create btree backend: %s", err))
+		}
 	case BackendMySQL:
 		backend, err = mysql.NewMySQLCache(context.TODO(), opts.MySQLOptions)
 		if err != nil {
 			panic(fmt.Sprintf("failed to create mysql backend: %s", err))
 		}
+	case BackendCustom:
+		if opts.CustomBackend == nil {
+			panic("custom backend is not specified")
+		}
+		backend = opts.CustomBackend
 	default:
 		panic("unknown backend")
 	}
+	var snapshot *savedSnapshot
+	if opts.RestoreSnapshot != nil {
+		b, _ := backend.(backends.Backend)
+		if snapshot, err = restoreSnapshot(context.Background(), b, opts.RestoreSnapshot); err != nil {
+			panic(fmt.Sprintf("failed to restore snapshot: %s", err))
+		}
+	}
+	if b, ok := backend.(backends.Backend); ok && opts.InstrumentBackend {
+		backend = instrumented.New(b)
+	}
 
 	bridge := server.New(backend, "")
 	a := &adapter{
-		logger:   logger,
-		eventsCh: make(chan []*Event),
-		backend:  backend,
-		bridge:   bridge,
+		logger:     logger,
+		ready:      make(chan struct{}),
+		drain:      make(chan struct{}),
+		eventsCh:   make(chan []*Event, eventChannelSize),
+		pushCh:     make(chan *pushRequest),
+		eventsDone: make(chan struct{}),
+		outboundCh: make(chan *Event, outboundChannelSize),
+		errorsCh:   make(chan *EventError, errorChannelSize),
+		backend:    backend,
+		bridge:     bridge,
+		readOnly:   opts.ReadOnly,
+		clusterID:  opts.ClusterID,
+		memberID:   opts.MemberID,
+		memberName: opts.MemberName,
+		peerURLs:   opts.PeerURLs,
+		clientURLs: opts.ClientURLs,
+
+		watchProgressNotifyInterval: opts.WatchProgressNotifyInterval,
+		maxWatchResponseBytes:       opts.MaxWatchResponseBytes,
+		watcherBufferSize:           opts.WatcherBufferSize,
+		maxWatchers:                 opts.MaxWatchers,
+		watchBatchInterval:          opts.WatchBatchInterval,
+		watchBatchMaxEvents:         opts.WatchBatchMaxEvents,
+		clock:                       opts.Clock,
+		quotaBackendBytes:           opts.QuotaBackendBytes,
+		rejectEventsOverQuota:       opts.RejectEventsOverQuota,
+		alarms:                      newAlarmStore(),
+		version:                     version,
+		allowlist:                   newAllowlist(logger, opts.Allowlist),
+		grpcServerOptions:           opts.GRPCServerOptions,
+		reflection:                  opts.Reflection,
+		unaryInterceptors:           opts.UnaryInterceptors,
+		streamInterceptors:          opts.StreamInterceptors,
+		waitForData:                 opts.WaitForData,
+		metricsRegisterer:           opts.MetricsRegisterer,
+		metricsGatherer:             opts.MetricsGatherer,
+		debug:                       opts.Debug,
+		skipUnchangedUpdates:        opts.SkipUnchangedUpdates,
+	}
+	if a.clusterID == 0 {
+		a.clusterID = DefaultClusterID
+	}
+	if a.memberID == 0 {
+		a.memberID = DefaultMemberID
+	}
+	if a.memberName == "" {
+		a.memberName = DefaultMemberName
+	}
+	if a.watchProgressNotifyInterval <= 0 {
+		a.watchProgressNotifyInterval = DefaultWatchProgressNotifyInterval
+	}
+	if a.maxWatchResponseBytes <= 0 {
+		a.maxWatchResponseBytes = DefaultMaxWatchResponseBytes
+	}
+	if a.watchBatchMaxEvents <= 0 {
+		a.watchBatchMaxEvents = DefaultWatchBatchMaxEvents
+	}
+	if a.clock == nil {
+		a.clock = realClock{}
+	}
+	if a.metricsRegisterer == nil {
+		a.metricsRegisterer = prometheus.DefaultRegisterer
+	}
+	if a.metricsGatherer == nil {
+		a.metricsGatherer = prometheus.DefaultGatherer
+	}
+	if a.auth, err = newAuthStore(opts.Auth, a.clock); err != nil {
+		panic(fmt.Sprintf("invalid auth options: %s", err))
+	}
+	if opts.TLS != nil {
+		if a.tlsConfig, err = newTLSConfig(opts.TLS); err != nil {
+			panic(fmt.Sprintf("invalid TLS options: %s", err))
+		}
+	}
+	if a.rateLimiter, err = newRateLimiter(opts.RateLimit, a.clock); err != nil {
+		panic(fmt.Sprintf("invalid rate limit options: %s", err))
+	}
+	if err := validateServerOptions(a.grpcServerOptions); err != nil {
+		panic(fmt.Sprintf("invalid gRPC server options: %s", err))
+	}
+	if b, ok := backend.(backends.Backend); ok {
+		a.lessor = newLessor(b, logger, a.clock, a.sendOutboundEvent)
+		a.atomicEvents = opts.AtomicEvents
+	}
+	if snapshot != nil {
+		if err := a.restoreLeases(context.Background(), snapshot); err != nil {
+			panic(fmt.Sprintf("failed to restore leases: %s", err))
+		}
+	}
+	if len(opts.InitialEvents) > 0 {
+		a.handleEvents(context.Background(), opts.InitialEvents)
 	}
 	return a
 }
 
+func (a *adapter) Leases() []int64 {
+	if a.lessor == nil {
+		return nil
+	}
+	return a.lessor.list()
+}
+
 func (a *adapter) EventCh() chan<- []*Event {
 	return a.eventsCh
 }
 
+// pushRequest is an event pushed by Push, the events pushed together by the
+// TypedAdapter, or the objects replacing the keys by ReplaceAll, the result
+// is sent back once it's applied.
+type pushRequest struct {
+	ev *Event
+	// events are applied all or none, if they're pushed together.
+	events []*Event
+	// prefix and desired are set if the request is sent by ReplaceAll.
+	prefix  string
+	desired []*Event
+	// result is buffered, so that the events loop is never blocked.
+	result chan pushResult
+}
+
+type pushResult struct {
+	rev int64
+	err error
+}
+
+func (a *adapter) Push(ctx context.Context, ev *Event) (int64, error) {
+	return a.push(ctx, &pushRequest{
+		ev:     ev,
+		result: make(chan pushResult, 1),
+	})
+}
+
+func (a *adapter) ReplaceAll(ctx context.Context, prefix string, desired []*Event) (int64, error) {
+	if _, ok := a.backend.(backends.Backend); !ok {
+		return 0, errReplaceNotSupported
+	}
+	for _, ev := range desired {
+		if !strings.HasPrefix(ev.Key, prefix) {
+			return 0, ErrKeyOutOfScope
+		}
+	}
+	if _, ok := duplicateKey(desired); ok {
+		return 0, ErrDuplicateKey
+	}
+	return a.push(ctx, &pushRequest{
+		prefix:  prefix,
+		desired: desired,
+		result:  make(chan pushResult, 1),
+	})
+}
+
+func (a *adapter) CompactTo(ctx context.Context, rev int64) error {
+	b, ok := a.backend.(backends.Backend)
+	if !ok {
+		return errCompactNotSupported
+	}
+	if _, err := b.Compact(ctx, rev); err != nil {
+		return err
+	}
+	a.logger.Info("compacted history",
+		zap.Int64("revision", rev),
+	)
+	return nil
+}
+
+// pushEvents pushes the events in the same way as Push, but they're applied
+// in one transaction if all of them can be applied, otherwise none of them
+// is applied. It returns the revision of the last one, or the first error.
+func (a *adapter) pushEvents(ctx context.Context, events []*Event) (int64, error) {
+	if _, ok := a.backend.(backends.Backend); !ok {
+		return 0, errPushEventsNotSupported
+	}
+	return a.push(ctx, &pushRequest{
+		events: events,
+		result: make(chan pushResult, 1),
+	})
+}
+
+// push sends the request to the events loop, and waits for the result.
+func (a *adapter) push(ctx context.Context, req *pushRequest) (int64, error) {
+	// The channel is non-buffered, so the request is always handled once
+	// it's accepted by the events loop.
+	select {
+	case a.pushCh <- req:
+	case <-a.eventsDone:
+		return 0, ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.rev, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (a *adapter) Errors() <-chan *EventError {
+	return a.errorsCh
+}
+
+// sendEventError sends the error of the event to the error channel, it never
+// blocks so that the events loop won't be stuck if nobody is receiving.
+func (a *adapter) sendEventError(ev *Event, err error) {
+	select {
+	case a.errorsCh <- &EventError{Event: ev, Err: err}:
+	default:
+		atomic.AddInt64(&a.eventStats.droppedErrors, 1)
+	}
+}
+
+func (a *adapter) OutboundCh() <-chan *Event {
+	return a.outboundCh
+}
+
+// sendOutboundEvent sends the event to the outbound channel, it never blocks
+// so that the gRPC handlers won't be stuck by the slow consumers.
+func (a *adapter) sendOutboundEvent(ev *Event) {
+	select {
+	case a.outboundCh <- ev:
+	default:
+		a.logger.Warn("outbound channel is full, drop the event",
+			zap.String("key", ev.Key),
+		)
+	}
+}
+
+// watchEvents applies the events sent to the event channel and the ones
+// pushed by Push, it's the only place where the events are applied so that
+// they're applied in order.
 func (a *adapter) watchEvents(ctx context.Context) {
+	defer close(a.eventsDone)
 	for {
 		var events []*Event
 		select {
 		case <-ctx.Done():
+			a.drainEvents()
 			return
+		case req := <-a.pushCh:
+			a.handlePush(ctx, req)
+			continue
 		case events = <-a.eventsCh:
 			break
 		}
 		if len(events) > 0 {
+			a.handleEvents(ctx, events)
+		}
+	}
+}
+
+// drainEvents applies the events buffered in the channel, and the ones
+// being sent, when the adapter is shutting down. They're applied with a new
+// context, as the one of the adapter is canceled.
+func (a *adapter) drainEvents() {
+	for {
+		select {
+		case events := <-a.eventsCh:
+			if len(events) > 0 {
+				a.handleEvents(context.Background(), events)
+			}
+		case req := <-a.pushCh:
+			a.handlePush(context.Background(), req)
+		default:
+			return
+		}
+	}
+}
+
+// handleEvents applies the events in order. Changes from the same events
+// are delivered to the watchers together if the backend supports it.
+func (a *adapter) handleEvents(ctx context.Context, events []*Event) {
+	// results are only kept for the events with the Done channel.
+	var results []EventResult
+	record := func(ev *Event, rev int64, err error) {
+		if err != nil {
+			a.sendEventError(ev, err)
+		}
+		if ev.Done != nil {
+			results = append(results, EventResult{
+				Event:    ev,
+				Revision: rev,
+				Err:      err,
+			})
+		}
+	}
+	if a.atomicEvents {
+		a.applyEvents(ctx, events, false, record)
+	} else {
+		a.batch(func() {
 			for _, ev := range events {
 				// TODO we may use separate goroutines to handle events so that
 				// this main cycle won't be blocked, but the concurrency might cause
 				// the handling order is unpredictable, so this is a judgement call.
-				switch ev.Type {
-				case EventAdd:
-					a.handleAddEvent(ctx, ev)
-				case EventUpdate:
-					a.handleUpdateEvent(ctx, ev)
-				case EventDelete:
-					a.handleDeleteEvent(ctx, ev)
+				// The errors are logged by the handlers.
+				rev, err := a.handleEvent(ctx, ev)
+				record(ev, rev, err)
+			}
+		})
+	}
+	// The events are always applied, but the clients will be rejected if
+	// they exceed the quota.
+	a.checkQuota(ctx, 0)
+	for _, res := range results {
+		a.sendEventResult(res)
+	}
+}
+
+// handlePush applies the event pushed by Push, and sends back the result.
+func (a *adapter) handlePush(ctx context.Context, req *pushRequest) {
+	var res pushResult
+	if req.events != nil {
+		a.applyEvents(ctx, req.events, true, func(_ *Event, rev int64, err error) {
+			if res.err == nil {
+				res.rev, res.err = rev, err
+			}
+		})
+		a.checkQuota(ctx, 0)
+		req.result <- res
+		return
+	}
+	if req.ev == nil {
+		res.rev, res.err = a.replaceAll(ctx, req.prefix, req.desired)
+		a.checkQuota(ctx, 0)
+		req.result <- res
+		return
+	}
+	a.batch(func() {
+		res.rev, res.err = a.handleEvent(ctx, req.ev)
+	})
+	a.checkQuota(ctx, 0)
+	req.result <- res
+	if req.ev.Done != nil {
+		a.sendEventResult(EventResult{
+			Event:    req.ev,
+			Revision: res.rev,
+			Err:      res.err,
+		})
+	}
+}
+
+// replaceAll replaces the keys with the prefix by the desired objects in one
+// transaction, so that the clients never see the keys replaced partially.
+func (a *adapter) replaceAll(ctx context.Context, prefix string, desired []*Event) (int64, error) {
+	// The types of the desired events are ignored, they're all counted as
+	// the puts, and the quota is checked before the transaction, as the
+	// backend is locked until it ends.
+	upserts := make([]*Event, 0, len(desired))
+	for _, ev := range desired {
+		upserts = append(upserts, &Event{Key: ev.Key, Value: ev.Value, Type: EventUpsert})
+	}
+	if !a.checkEventsQuota(ctx, upserts...) {
+		return 0, ErrNoSpace
+	}
+	txn := a.backend.(backends.Backend).Write(ctx)
+	defer txn.End()
+
+	start, end := []byte(prefix), prefixEnd([]byte(prefix))
+	if len(start) == 0 {
+		start = []byte{0}
+	}
+	if end == nil {
+		end = []byte{0}
+	}
+	res, err := txn.Range(start, end, backends.RangeOptions{})
+	if err != nil {
+		a.logger.Error("failed to list objects (during replacing), ignore it",
+			zap.Error(err),
+			zap.String("prefix", prefix),
+		)
+		return 0, err
+	}
+
+	var puts, deletes int
+	wanted := make(map[string]struct{}, len(desired))
+	for _, ev := range desired {
+		key := []byte(ev.Key)
+		wanted[ev.Key] = struct{}{}
+		cur, err := txn.Range(key, nil, backends.RangeOptions{})
+		if err != nil {
+			return 0, err
+		}
+		var prevLease int64
+		if len(cur.KVs) > 0 {
+			prevLease = cur.KVs[0].Lease
+		}
+		lease := a.eventLease(ev, prevLease)
+		if len(cur.KVs) > 0 && bytes.Equal(cur.KVs[0].Value, ev.Value) && prevLease == lease {
+			continue
+		}
+		txn.Put(key, ev.Value, lease)
+		if a.lessor != nil && prevLease != 0 && prevLease != lease {
+			a.lessor.detach(prevLease, key)
+		}
+		puts++
+	}
+	for _, kv := range res.KVs {
+		if _, ok := wanted[string(kv.Key)]; ok {
+			continue
+		}
+		txn.DeleteRange(kv.Key, nil)
+		if a.lessor != nil && kv.Lease != 0 {
+			a.lessor.detach(kv.Lease, kv.Key)
+		}
+		deletes++
+	}
+	a.logger.Info("replaced objects",
+		zap.Int64("revision", txn.Rev()),
+		zap.String("prefix", prefix),
+		zap.Int("puts", puts),
+		zap.Int("deletes", deletes),
+	)
+	return txn.Rev(), nil
+}
+
+// duplicateKey returns the key shared by the events if there is one, like
+// ETCD rejects the transactions putting or deleting the same key twice.
+func duplicateKey(events []*Event) (string, bool) {
+	keys := make(map[string]struct{}, len(events))
+	for _, ev := range events {
+		if _, ok := keys[ev.Key]; ok {
+			return ev.Key, true
+		}
+		keys[ev.Key] = struct{}{}
+	}
+	return "", false
+}
+
+// sendEventResult sends the result to the Done channel of the event, it
+// never blocks so that the events loop won't be stuck by the slow receivers.
+func (a *adapter) sendEventResult(res EventResult) {
+	select {
+	case res.Event.Done <- res:
+	default:
+		a.logger.Warn("event done channel is not ready, drop the result",
+			zap.String("key", res.Event.Key),
+			zap.Int64("revision", res.Revision),
+		)
+	}
+}
+
+// batch calls fn, the changes made by it are delivered to the watchers
+// together if the backend supports it.
+func (a *adapter) batch(fn func()) {
+	if backend, ok := a.backend.(backends.Backend); ok {
+		backend.Batch(fn)
+	} else {
+		fn()
+	}
+}
+
+// applyEvents applies the events in one write transaction, so that they share
+// the same revision, the results are passed to record. If all is set, none of
+// them is applied if any of them fails, and all of them are recorded with the
+// error of the first failed one.
+func (a *adapter) applyEvents(ctx context.Context, events []*Event, all bool, record func(*Event, int64, error)) {
+	if key, ok := duplicateKey(events); ok {
+		a.logger.Error("duplicate key in the events, ignore them",
+			zap.String("key", key),
+			zap.Int("events", len(events)),
+		)
+		for _, ev := range events {
+			record(ev, 0, ErrDuplicateKey)
+		}
+		return
+	}
+	// The quota is checked before the transaction, as the backend is
+	// locked until it ends.
+	if !a.checkEventsQuota(ctx, events...) {
+		for _, ev := range events {
+			record(ev, 0, ErrNoSpace)
+		}
+		return
+	}
+	txn := a.backend.(backends.Backend).Write(ctx)
+	defer txn.End()
+	if all {
+		for _, ev := range events {
+			if _, err := a.checkEvent(txn, ev); err != nil {
+				for _, ev := range events {
+					record(ev, 0, err)
 				}
+				return
 			}
 		}
 	}
+	for _, ev := range events {
+		rev, err := a.applyEvent(txn, ev)
+		record(ev, rev, err)
+	}
 }
 
-func (a *adapter) handleAddEvent(ctx context.Context, ev *Event) {
-	rev, err := a.backend.Create(ctx, ev.Key, ev.Value, 0)
+// checkEvent checks the event against the key in the write transaction, it
+// returns the current key-value of the key, which is nil if it doesn't exist.
+func (a *adapter) checkEvent(txn backends.TxnWrite, ev *Event) (*mvccpb.KeyValue, error) {
+	res, err := txn.Range([]byte(ev.Key), nil, backends.RangeOptions{})
 	if err != nil {
-		a.logger.Error("failed to create object, ignore it",
+		a.logger.Error("failed to get object, ignore it",
 			zap.Error(err),
+			zap.String("key", ev.Key),
+		)
+		return nil, err
+	}
+	var prevKV *mvccpb.KeyValue
+	if len(res.KVs) > 0 {
+		prevKV = res.KVs[0]
+	}
+	switch ev.Type {
+	case EventAdd:
+		if prevKV != nil {
+			err = ErrKeyExists
+		}
+	case EventUpdate, EventDelete:
+		if prevKV == nil {
+			err = ErrKeyNotFound
+		}
+	case EventUpsert:
+	default:
+		err = ErrInvalidEventType
+	}
+	if err != nil {
+		a.logger.Error("failed to apply object, ignore it",
+			zap.Error(err),
+			zap.Int("type", int(ev.Type)),
+			zap.String("key", ev.Key),
+		)
+		return nil, err
+	}
+	return prevKV, nil
+}
+
+// applyEvent applies the event in the write transaction, so that it shares
+// the revision with the other changes in the transaction. The transaction
+// is applied partially if some events fail, like the events applied one by
+// one.
+func (a *adapter) applyEvent(txn backends.TxnWrite, ev *Event) (int64, error) {
+	defer a.eventStats.addApplied(ev.Type)
+	prevKV, err := a.checkEvent(txn, ev)
+	if err != nil {
+		return 0, err
+	}
+
+	key := []byte(ev.Key)
+	var prevLease, rev int64
+	if prevKV != nil {
+		prevLease = prevKV.Lease
+	}
+	if ev.Type == EventDelete {
+		_, rev = txn.DeleteRange(key, nil)
+		if a.lessor != nil && prevLease != 0 {
+			a.lessor.detach(prevLease, key)
+		}
+		a.logger.Info("deleted object",
+			zap.Int64("revision", rev),
+			zap.String("key", ev.Key),
+		)
+		return rev, nil
+	}
+	lease := a.eventLease(ev, prevLease)
+	if prevKV != nil && a.skipUpdate(ev, prevKV.Value, prevLease, lease) {
+		return prevKV.ModRevision, nil
+	}
+	rev = txn.Put(key, ev.Value, lease)
+	if a.lessor != nil && prevLease != 0 && prevLease != lease {
+		a.lessor.detach(prevLease, key)
+	}
+	if prevKV != nil {
+		a.logger.Info("updated object",
 			zap.Int64("revision", rev),
 			zap.String("key", ev.Key),
 		)
@@ -155,9 +1144,97 @@ func (a *adapter) handleAddEvent(ctx context.Context, ev *Event) {
 			zap.String("key", ev.Key),
 		)
 	}
+	return rev, nil
+}
+
+// skipUpdate reports whether the update or the upsert event should be skipped
+// as a no-op, i.e. neither the value nor the lease of the key is changed.
+func (a *adapter) skipUpdate(ev *Event, prevValue []byte, prevLease, lease int64) bool {
+	if !a.skipUnchangedUpdates || prevLease != lease || !bytes.Equal(prevValue, ev.Value) {
+		return false
+	}
+	atomic.AddInt64(&a.eventStats.skippedUpdates, 1)
+	a.logger.Debug("object is unchanged, skip the update",
+		zap.String("key", ev.Key),
+	)
+	return true
+}
+
+// handleEvent applies the event, and returns the revision of the change.
+func (a *adapter) handleEvent(ctx context.Context, ev *Event) (int64, error) {
+	if !a.checkEventsQuota(ctx, ev) {
+		return 0, ErrNoSpace
+	}
+	defer a.eventStats.addApplied(ev.Type)
+	switch ev.Type {
+	case EventAdd:
+		return a.handleAddEvent(ctx, ev)
+	case EventUpdate:
+		return a.handleUpdateEvent(ctx, ev)
+	case EventDelete:
+		return a.handleDeleteEvent(ctx, ev)
+	case EventUpsert:
+		return a.handleUpsertEvent(ctx, ev)
+	default:
+		a.logger.Error("unknown event type, ignore it",
+			zap.Int("type", int(ev.Type)),
+			zap.String("key", ev.Key),
+		)
+		return 0, ErrInvalidEventType
+	}
+}
+
+// eventLease returns the lease which the key of the event should be attached
+// to, prevLease is the lease that the key is using now.
+func (a *adapter) eventLease(ev *Event, prevLease int64) int64 {
+	if a.lessor == nil || (ev.Lease == 0 && ev.TTL <= 0) {
+		return 0
+	}
+	id := ev.Lease
+	if id == 0 {
+		id = prevLease
+	}
+	lease, err := a.lessor.keepAlive(id, ev.TTL, []byte(ev.Key))
+	if err != nil {
+		a.logger.Error("failed to attach object to lease, ignore the lease",
+			zap.Error(err),
+			zap.Int64("lease", id),
+			zap.String("key", ev.Key),
+		)
+		return 0
+	}
+	return lease
+}
+
+func (a *adapter) handleAddEvent(ctx context.Context, ev *Event) (int64, error) {
+	// The key is checked before the lease is granted or renewed, so that an
+	// existing key leaves no lease behind.
+	rev, kv, err := a.backend.Get(ctx, ev.Key, 0)
+	if err == nil && kv != nil {
+		err = server.ErrKeyExists
+	}
+	if err == nil {
+		rev, err = a.backend.Create(ctx, ev.Key, ev.Value, a.eventLease(ev, 0))
+	}
+	if err != nil {
+		a.logger.Error("failed to create object, ignore it",
+			zap.Error(err),
+			zap.Int64("revision", rev),
+			zap.String("key", ev.Key),
+		)
+		if err == server.ErrKeyExists {
+			err = ErrKeyExists
+		}
+		return 0, err
+	}
+	a.logger.Info("created object",
+		zap.Int64("revision", rev),
+		zap.String("key", ev.Key),
+	)
+	return rev, nil
 }
 
-func (a *adapter) handleUpdateEvent(ctx context.Context, ev *Event) {
+func (a *adapter) handleUpdateEvent(ctx context.Context, ev *Event) (int64, error) {
 	for {
 		rev, prevKV, err := a.backend.Get(ctx, ev.Key, 0)
 		if err != nil {
@@ -166,33 +1243,40 @@ func (a *adapter) handleUpdateEvent(ctx context.Context, ev *Event) {
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, err
 		}
 		if prevKV == nil {
 			a.logger.Error("object not found (during update event), ignore it",
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, ErrKeyNotFound
 		}
-		rev, prev, ok, err := a.backend.Update(ctx, ev.Key, ev.Value, prevKV.ModRevision, 0)
+		lease := a.eventLease(ev, prevKV.Lease)
+		if a.skipUpdate(ev, prevKV.Value, prevKV.Lease, lease) {
+			return prevKV.ModRevision, nil
+		}
+		rev, prev, ok, err := a.backend.Update(ctx, ev.Key, ev.Value, prevKV.ModRevision, lease)
 		if err != nil || prev == nil {
-			if prev == nil {
-				err = errors.New("object not found")
+			if err == nil {
+				err = ErrKeyNotFound
 			}
 			a.logger.Error("failed to update object, ignore it",
 				zap.Error(err),
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, err
 		}
 		if ok {
+			if a.lessor != nil && prevKV.Lease != 0 && prevKV.Lease != lease {
+				a.lessor.detach(prevKV.Lease, []byte(ev.Key))
+			}
 			a.logger.Info("updated object",
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return rev, nil
 		}
 		// Update was failed due to race conditions.
 		a.logger.Debug("object update was failed, retry it",
@@ -202,7 +1286,7 @@ func (a *adapter) handleUpdateEvent(ctx context.Context, ev *Event) {
 	}
 }
 
-func (a *adapter) handleDeleteEvent(ctx context.Context, ev *Event) {
+func (a *adapter) handleDeleteEvent(ctx context.Context, ev *Event) (int64, error) {
 	for {
 		rev, prevKV, err := a.backend.Get(ctx, ev.Key, 0)
 		if err != nil {
@@ -211,33 +1295,36 @@ func (a *adapter) handleDeleteEvent(ctx context.Context, ev *Event) {
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, err
 		}
 		if prevKV == nil {
 			a.logger.Error("object not found (during delete event), ignore it",
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, ErrKeyNotFound
 		}
 		rev, prev, ok, err := a.backend.Delete(ctx, ev.Key, prevKV.ModRevision)
 		if err != nil || prev == nil {
-			if prev == nil {
-				err = errors.New("object not found")
+			if err == nil {
+				err = ErrKeyNotFound
 			}
 			a.logger.Error("failed to delete object, ignore it",
 				zap.Error(err),
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return 0, err
 		}
 		if ok {
+			if a.lessor != nil && prevKV.Lease != 0 {
+				a.lessor.detach(prevKV.Lease, []byte(ev.Key))
+			}
 			a.logger.Info("deleted object",
 				zap.Int64("revision", rev),
 				zap.String("key", ev.Key),
 			)
-			return
+			return rev, nil
 		}
 		// Delete was failed due to race conditions.
 		a.logger.Debug("object delete was failed, retry it",
@@ -247,10 +1334,83 @@ func (a *adapter) handleDeleteEvent(ctx context.Context, ev *Event) {
 	}
 }
 
+func (a *adapter) handleUpsertEvent(ctx context.Context, ev *Event) (int64, error) {
+	for {
+		rev, prevKV, err := a.backend.Get(ctx, ev.Key, 0)
+		if err != nil {
+			a.logger.Error("failed to get object (during upsert event), ignore it",
+				zap.Error(err),
+				zap.Int64("revision", rev),
+				zap.String("key", ev.Key),
+			)
+			return 0, err
+		}
+		if prevKV == nil {
+			rev, err = a.backend.Create(ctx, ev.Key, ev.Value, a.eventLease(ev, 0))
+			if err == server.ErrKeyExists {
+				// Create was failed due to race conditions.
+				a.logger.Debug("object create was failed, retry it",
+					zap.Int64("revision", rev),
+					zap.String("key", ev.Key),
+				)
+				continue
+			}
+			if err != nil {
+				a.logger.Error("failed to create object, ignore it",
+					zap.Error(err),
+					zap.Int64("revision", rev),
+					zap.String("key", ev.Key),
+				)
+				return 0, err
+			}
+			a.logger.Info("created object",
+				zap.Int64("revision", rev),
+				zap.String("key", ev.Key),
+			)
+			return rev, nil
+		}
+		lease := a.eventLease(ev, prevKV.Lease)
+		if a.skipUpdate(ev, prevKV.Value, prevKV.Lease, lease) {
+			return prevKV.ModRevision, nil
+		}
+		rev, prev, ok, err := a.backend.Update(ctx, ev.Key, ev.Value, prevKV.ModRevision, lease)
+		if err != nil {
+			a.logger.Error("failed to update object, ignore it",
+				zap.Error(err),
+				zap.Int64("revision", rev),
+				zap.String("key", ev.Key),
+			)
+			return 0, err
+		}
+		if ok {
+			if a.lessor != nil && prevKV.Lease != 0 && prevKV.Lease != lease {
+				a.lessor.detach(prevKV.Lease, []byte(ev.Key))
+			}
+			a.logger.Info("updated object",
+				zap.Int64("revision", rev),
+				zap.String("key", ev.Key),
+			)
+			return rev, nil
+		}
+		// Update was failed due to race conditions, or the object was
+		// deleted meanwhile.
+		a.logger.Debug("object update was failed, retry it",
+			zap.Int64("revision", rev),
+			zap.Bool("deleted", prev == nil),
+			zap.String("key", ev.Key),
+		)
+	}
+}
+
 func (a *adapter) showVersion(w http.ResponseWriter, _ *http.Request) {
+	// Marshaling the strings never fails.
+	data, _ := json.Marshal(&etcdversion.Versions{
+		Server:  a.version.server,
+		Cluster: a.version.cluster,
+	})
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(`{"etcdserver":"3.5.0-pre","etcdcluster":"3.5.0"}`))
-	if err != nil {
+	if _, err := w.Write(data); err != nil {
 		a.logger.Warn("failed to send version info",
 			zap.Error(err),
 		)
@@ -17,14 +17,23 @@ package etcdadapter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
 	"golang.org/x/net/nettest"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/btree"
 )
 
 func TestShowVersion(t *testing.T) {
@@ -33,6 +42,7 @@ func TestShowVersion(t *testing.T) {
 	a.showVersion(w, nil)
 
 	assert.Equal(t, http.StatusOK, w.Code, "checking status code")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "checking content type")
 	assert.Equal(t, "{\"etcdserver\":\"3.5.0-pre\",\"etcdcluster\":\"3.5.0\"}", w.Body.String())
 }
 
@@ -47,6 +57,7 @@ func TestEtcdAdapter(t *testing.T) {
 		err := a.Serve(ctx, ln)
 		assert.Nil(t, err, "checking serve returning error")
 	}()
+	waitReady(t, a)
 
 	events := []*Event{
 		{
@@ -61,8 +72,7 @@ func TestEtcdAdapter(t *testing.T) {
 		},
 	}
 
-	a.EventCh() <- events
-	time.Sleep(500 * time.Millisecond)
+	sendEvents(t, a, events)
 
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: []string{ln.Addr().String()},
@@ -102,8 +112,7 @@ func TestEtcdAdapter(t *testing.T) {
 		},
 	}
 
-	a.EventCh() <- events
-	time.Sleep(500 * time.Millisecond)
+	sendEvents(t, a, events)
 
 	resp, err = client.Get(context.Background(), "/apisix/routes/1")
 	assert.Nil(t, err, "checking error")
@@ -144,13 +153,14 @@ func TestEtcdAdapterWatch(t *testing.T) {
 		err := a.Serve(ctx, ln)
 		assert.Nil(t, err, "checking serve returning error")
 	}()
+	waitReady(t, a)
 
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: []string{ln.Addr().String()},
 	})
 	assert.Nil(t, err, "creating etcd client")
 
-	ch := client.Watch(ctx, "/apisix/routes", clientv3.WithPrefix())
+	ch := client.Watch(ctx, "/apisix/routes", clientv3.WithPrefix(), clientv3.WithPrevKV())
 
 	a.EventCh() <- events
 
@@ -178,3 +188,955 @@ func TestEtcdAdapterWatch(t *testing.T) {
 
 	cancel()
 }
+
+// startTestAdapter starts an etcd adapter on a local listener, and returns
+// it together with a client connected to it. The returned function shuts
+// the adapter down.
+func startTestAdapter(t *testing.T, opts *AdapterOptions) (Adapter, *clientv3.Client, func()) {
+	a := NewEtcdAdapter(opts)
+
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+
+	return a, client, func() {
+		assert.Nil(t, client.Close(), "closing etcd client")
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+		cancel()
+	}
+}
+
+// waitReady waits until the adapter is serving.
+func waitReady(t *testing.T, a Adapter) {
+	select {
+	case <-a.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the adapter to be ready")
+	}
+}
+
+// sendEvents sends the events to the event channel, and waits until they're
+// applied by their Done channels.
+func sendEvents(t *testing.T, a Adapter, events []*Event) {
+	done := make(chan EventResult, len(events))
+	for _, ev := range events {
+		ev.Done = done
+	}
+	a.EventCh() <- events
+	timeout := time.After(5 * time.Second)
+	for range events {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("timed out waiting for the events to be applied")
+		}
+	}
+}
+
+// waitCreated waits for the created response of the watch, which is
+// requested by clientv3.WithCreatedNotify.
+func waitCreated(t *testing.T, wch clientv3.WatchChan) {
+	select {
+	case resp := <-wch:
+		assert.True(t, resp.Created, "checking created flag")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch to be created")
+	}
+}
+
+func TestEtcdAdapterOutboundChannelFull(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		OutboundChannelSize: 1,
+	})
+	defer shutdown()
+
+	// Nobody consumes the outbound channel, the handler shouldn't be blocked.
+	for i := 0; i < 10; i++ {
+		_, err := client.Put(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), "value")
+		assert.Nil(t, err, "checking error")
+	}
+	ev := <-a.OutboundCh()
+	assert.Equal(t, "/apisix/routes/0", ev.Key, "checking outbound event")
+	assert.Len(t, a.OutboundCh(), 0, "checking dropped events")
+}
+
+func TestEtcdAdapterEventChannelBuffered(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		EventChannelSize: 16,
+	})
+	// The events are buffered until the adapter is served.
+	for i := 0; i < 10; i++ {
+		a.EventCh() <- []*Event{
+			{
+				Key:   fmt.Sprintf("/apisix/routes/%d", i),
+				Value: []byte("v1"),
+				Type:  EventAdd,
+			},
+		}
+	}
+	assert.Equal(t, int64(10), a.Stats().QueuedEvents, "checking queued events")
+
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	for i := 10; i < 20; i++ {
+		a.EventCh() <- []*Event{
+			{
+				Key:   fmt.Sprintf("/apisix/routes/%d", i),
+				Value: []byte("v1"),
+				Type:  EventAdd,
+			},
+		}
+	}
+
+	// All the events sent before the shutdown are applied when it returns.
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	assert.Equal(t, int64(0), a.Stats().QueuedEvents, "checking queued events")
+	_, count, err := a.(*adapter).backend.Count(context.Background(), "/apisix/routes/")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(20), count, "checking applied events")
+}
+
+func TestEtcdAdapterPush(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	// Push waits until the adapter is served.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := a.Push(ctx, &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd})
+	assert.Equal(t, context.DeadlineExceeded, err, "checking error")
+
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	go func() {
+		err := a.Serve(context.Background(), ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	cases := []struct {
+		ev  *Event
+		rev int64
+		err error
+	}{
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd},
+			rev: 2,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd},
+			err: ErrKeyExists,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Value: []byte("v2"), Type: EventUpdate},
+			rev: 3,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/2", Value: []byte("v2"), Type: EventUpdate},
+			err: ErrKeyNotFound,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Type: EventDelete},
+			rev: 4,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Type: EventDelete},
+			err: ErrKeyNotFound,
+		},
+		{
+			ev:  &Event{Key: "/apisix/routes/1", Type: EventType(100)},
+			err: ErrInvalidEventType,
+		},
+	}
+	for _, tc := range cases {
+		rev, err := a.Push(context.Background(), tc.ev)
+		assert.Equal(t, tc.err, err, "checking error")
+		assert.Equal(t, tc.rev, rev, "checking revision")
+	}
+
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd})
+	assert.Equal(t, ErrClosed, err, "checking error")
+}
+
+func TestEtcdAdapterPushInterleaved(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	const events = 100
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			a.EventCh() <- []*Event{
+				{
+					Key:   fmt.Sprintf("/apisix/routes/ch/%d", i),
+					Value: []byte("v1"),
+					Type:  EventAdd,
+				},
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		var last int64
+		for i := 0; i < events; i++ {
+			rev, err := a.Push(context.Background(), &Event{
+				Key:   fmt.Sprintf("/apisix/routes/push/%d", i),
+				Value: []byte("v1"),
+				Type:  EventAdd,
+			})
+			assert.Nil(t, err, "checking error")
+			assert.Greater(t, rev, last, "checking revision")
+			last = rev
+		}
+	}()
+	wg.Wait()
+	// The events sent before are applied once the pushed one is applied.
+	rev, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/last", Value: []byte("v1"), Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2*events+2), rev, "checking revision")
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2*events+1, "checking keys")
+	for i, kv := range resp.Kvs {
+		assert.Equal(t, int64(i+2), kv.CreateRevision, "checking create revision of %s", kv.Key)
+	}
+}
+
+func TestEtcdAdapterInitialEvents(t *testing.T) {
+	const events = 100
+	var initial []*Event
+	for i := 0; i < events; i++ {
+		initial = append(initial, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%03d", i),
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		})
+	}
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		InitialEvents: initial,
+	})
+	defer shutdown()
+
+	// The first request sees the whole data.
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(events+1), resp.Header.Revision, "checking revision")
+	if assert.Len(t, resp.Kvs, events, "checking keys") {
+		for i, kv := range resp.Kvs {
+			assert.Equal(t, initial[i].Key, string(kv.Key), "checking key")
+			assert.Equal(t, int64(i+2), kv.CreateRevision, "checking create revision")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var keys []string
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(1))
+	for len(keys) < events {
+		select {
+		case wresp := <-wch:
+			for _, ev := range wresp.Events {
+				keys = append(keys, string(ev.Kv.Key))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch response")
+		}
+	}
+	for i, key := range keys {
+		assert.Equal(t, initial[i].Key, key, "checking key")
+	}
+}
+
+func TestEtcdAdapterCustomBackend(t *testing.T) {
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			Backend: BackendCustom,
+		})
+	}, "checking missing custom backend")
+
+	backend := btree.NewBTreeCache(zap.NewNop())
+	_, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Backend:       BackendCustom,
+		CustomBackend: backend,
+	})
+	defer shutdown()
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, resp.Kvs, 1, "checking kvs") {
+		assert.Equal(t, []byte("v1"), resp.Kvs[0].Value, "checking value")
+	}
+	_, err = a.Push(context.Background(), &Event{
+		Key:   "/apisix/routes/2",
+		Value: []byte("v1"),
+		Type:  EventAdd,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), backend.CurrentRevision(), "checking current revision")
+}
+
+func TestEtcdAdapterJournal(t *testing.T) {
+	opts := &AdapterOptions{
+		BTreeOptions: &btree.Options{
+			Journal: &btree.JournalOptions{
+				Dir: t.TempDir(),
+			},
+		},
+	}
+	a, client, shutdown := startTestAdapter(t, opts)
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	rev, err := a.Push(context.Background(), &Event{
+		Key:   "/apisix/routes/2",
+		Value: []byte("v1"),
+		Type:  EventAdd,
+	})
+	assert.Nil(t, err, "checking error")
+	shutdown()
+
+	// The changes of both the clients and the events are replayed.
+	_, client, shutdown = startTestAdapter(t, opts)
+	defer shutdown()
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, rev, resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Kvs, 2, "checking kvs")
+}
+
+func TestEtcdAdapterEventDone(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	done := make(chan EventResult, 4)
+	events := []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+			Done:  done,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+			Done:  done,
+		},
+		{
+			Key:   "/apisix/routes/3",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+			Done:  done,
+		},
+	}
+	a.EventCh() <- events
+
+	expected := []struct {
+		ev  *Event
+		rev int64
+		err error
+	}{
+		{ev: events[0], rev: 2},
+		{ev: events[2], rev: 4},
+		{ev: events[3], err: ErrKeyNotFound},
+	}
+	for _, exp := range expected {
+		var res EventResult
+		select {
+		case res = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the event result")
+		}
+		assert.Equal(t, exp.ev, res.Event, "checking event")
+		assert.Equal(t, exp.rev, res.Revision, "checking revision")
+		assert.Equal(t, exp.err, res.Err, "checking error")
+		if res.Err != nil {
+			continue
+		}
+		// The change is visible once it's acknowledged.
+		resp, err := client.Get(context.Background(), res.Event.Key)
+		assert.Nil(t, err, "checking error")
+		assert.GreaterOrEqual(t, resp.Header.Revision, res.Revision, "checking revision")
+		assert.Len(t, resp.Kvs, 1, "checking keys")
+	}
+
+	// The events loop is not blocked by the channels not ready to receive.
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/4",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+			Done:  make(chan EventResult),
+		},
+	}
+	rev, err := a.Push(context.Background(), &Event{
+		Key:   "/apisix/routes/5",
+		Value: []byte("v1"),
+		Type:  EventAdd,
+		Done:  done,
+	})
+	assert.Nil(t, err, "checking error")
+	res := <-done
+	assert.Equal(t, rev, res.Revision, "checking revision")
+}
+
+func TestEtcdAdapterUpsertEvent(t *testing.T) {
+	type step struct {
+		typ EventType
+		// createRev, modRev and version are the expected ones after the
+		// event, a zero modRev means the key is deleted.
+		createRev int64
+		modRev    int64
+		version   int64
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "add then upsert",
+			steps: []step{
+				{typ: EventAdd, createRev: 2, modRev: 2, version: 1},
+				{typ: EventUpsert, createRev: 2, modRev: 3, version: 2},
+			},
+		},
+		{
+			name: "upsert then upsert",
+			steps: []step{
+				{typ: EventUpsert, createRev: 2, modRev: 2, version: 1},
+				{typ: EventUpsert, createRev: 2, modRev: 3, version: 2},
+				{typ: EventUpdate, createRev: 2, modRev: 4, version: 3},
+			},
+		},
+		{
+			name: "delete then upsert",
+			steps: []step{
+				{typ: EventUpsert, createRev: 2, modRev: 2, version: 1},
+				{typ: EventDelete},
+				{typ: EventUpsert, createRev: 4, modRev: 4, version: 1},
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, client, shutdown := startTestAdapter(t, nil)
+			defer shutdown()
+
+			for i, st := range tc.steps {
+				ev := &Event{
+					Key:  "/apisix/routes/1",
+					Type: st.typ,
+				}
+				if st.typ != EventDelete {
+					ev.Value = []byte(fmt.Sprintf("v%d", i))
+				}
+				_, err := a.Push(context.Background(), ev)
+				assert.Nil(t, err, "checking error of step %d", i)
+
+				resp, err := client.Get(context.Background(), ev.Key)
+				assert.Nil(t, err, "checking error of step %d", i)
+				if st.modRev == 0 {
+					assert.Len(t, resp.Kvs, 0, "checking keys of step %d", i)
+					continue
+				}
+				if !assert.Len(t, resp.Kvs, 1, "checking keys of step %d", i) {
+					continue
+				}
+				kv := resp.Kvs[0]
+				assert.Equal(t, ev.Value, kv.Value, "checking value of step %d", i)
+				assert.Equal(t, st.createRev, kv.CreateRevision, "checking create revision of step %d", i)
+				assert.Equal(t, st.modRev, kv.ModRevision, "checking mod revision of step %d", i)
+				assert.Equal(t, st.version, kv.Version, "checking version of step %d", i)
+			}
+		})
+	}
+}
+
+func TestEtcdAdapterAtomicEvents(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		AtomicEvents: true,
+	})
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/0", "v1")
+	assert.Nil(t, err, "checking error")
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(3))
+
+	// The ranges see either none or all of the batch.
+	const batchSize = 100
+	stop := make(chan struct{})
+	ranged := make(chan struct{})
+	go func() {
+		defer close(ranged)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := client.Get(context.Background(), "/apisix/batch/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+			assert.Nil(t, err, "checking error")
+			if err == nil && resp.Count != 0 && resp.Count != batchSize {
+				t.Errorf("range sees %d keys of the batch", resp.Count)
+			}
+		}
+	}()
+	var batch []*Event
+	for i := 0; i < batchSize; i++ {
+		batch = append(batch, &Event{
+			Key:   fmt.Sprintf("/apisix/batch/%d", i),
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		})
+	}
+	sendEvents(t, a, batch)
+	close(stop)
+	<-ranged
+
+	done := make(chan EventResult, 1)
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/0",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+		{
+			Key:  "/apisix/routes/2",
+			Type: EventDelete,
+		},
+		{
+			Key:   "/apisix/routes/3",
+			Value: []byte("v1"),
+			Type:  EventUpsert,
+			Done:  done,
+		},
+	}
+	res := <-done
+	assert.Nil(t, res.Err, "checking error")
+	assert.Equal(t, int64(4), res.Revision, "checking revision")
+
+	// The changes of the batch are delivered in one response.
+	var resp clientv3.WatchResponse
+	select {
+	case resp = <-wch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+	if assert.Len(t, resp.Events, 3, "checking events") {
+		assert.Equal(t, "/apisix/routes/1", string(resp.Events[0].Kv.Key), "checking key")
+		assert.Equal(t, int64(1), resp.Events[0].Kv.Version, "checking version")
+		assert.Equal(t, "/apisix/routes/0", string(resp.Events[1].Kv.Key), "checking key")
+		assert.Equal(t, int64(2), resp.Events[1].Kv.Version, "checking version")
+		assert.Equal(t, "/apisix/routes/3", string(resp.Events[2].Kv.Key), "checking key")
+		assert.Equal(t, int64(1), resp.Events[2].Kv.Version, "checking version")
+		for _, ev := range resp.Events {
+			assert.Equal(t, int64(4), ev.Kv.ModRevision, "checking mod revision")
+		}
+	}
+
+	// The client changes are interleaved after the batch, and the history is
+	// replayed with the shared revision.
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "v1")
+	assert.Nil(t, err, "checking error")
+	var revs []int64
+	hctx, hcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer hcancel()
+	for resp := range client.Watch(hctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(1)) {
+		for _, ev := range resp.Events {
+			revs = append(revs, ev.Kv.ModRevision)
+		}
+		if len(revs) >= 5 {
+			break
+		}
+	}
+	assert.Equal(t, []int64{2, 4, 4, 4, 5}, revs, "checking revisions")
+}
+
+func TestEtcdAdapterAtomicMixedEvents(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		AtomicEvents: true,
+	})
+	defer shutdown()
+
+	_, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/3", Value: []byte("v1"), Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(3))
+
+	done := make(chan EventResult, 2)
+	a.EventCh() <- []*Event{
+		{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd},
+		{Key: "/apisix/routes/2", Value: []byte("v1"), Type: EventAdd},
+		{Key: "/apisix/routes/3", Type: EventDelete, Done: done},
+	}
+	res := <-done
+	assert.Nil(t, res.Err, "checking error")
+	assert.Equal(t, int64(3), res.Revision, "checking revision")
+	select {
+	case resp := <-wch:
+		var types []mvccpb.Event_EventType
+		for _, ev := range resp.Events {
+			types = append(types, ev.Type)
+			assert.Equal(t, int64(3), ev.Kv.ModRevision, "checking mod revision")
+		}
+		assert.Equal(t, []mvccpb.Event_EventType{mvccpb.PUT, mvccpb.PUT, mvccpb.DELETE}, types, "checking event types")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+
+	// The events with the same key are all rejected.
+	a.EventCh() <- []*Event{
+		{Key: "/apisix/routes/4", Value: []byte("v1"), Type: EventAdd},
+		{Key: "/apisix/routes/4", Type: EventDelete, Done: done},
+	}
+	res = <-done
+	assert.Equal(t, ErrDuplicateKey, res.Err, "checking error")
+	assert.Equal(t, int64(0), res.Revision, "checking revision")
+	assert.Len(t, a.Errors(), 2, "checking errors")
+	resp, err := client.Get(context.Background(), "/apisix/routes/4")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Kvs, 0, "checking keys")
+}
+
+func TestEtcdAdapterReplaceAll(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/2", "/apisix/routes/3", "/apisix/upstreams/1"} {
+		_, err := a.Push(context.Background(), &Event{Key: key, Value: []byte("v1"), Type: EventAdd})
+		assert.Nil(t, err, "checking error")
+	}
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithRev(6))
+
+	desired := []*Event{
+		{Key: "/apisix/routes/1", Value: []byte("v1")},
+		{Key: "/apisix/routes/2", Value: []byte("v2")},
+		{Key: "/apisix/routes/4", Value: []byte("v1")},
+	}
+	rev, err := a.ReplaceAll(context.Background(), "/apisix/routes/", desired)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(6), rev, "checking revision")
+	// Nothing is changed by the same objects.
+	rev, err = a.ReplaceAll(context.Background(), "/apisix/routes/", desired)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(6), rev, "checking revision")
+	// All the keys with the prefix are deleted.
+	rev, err = a.ReplaceAll(context.Background(), "/apisix/routes/", nil)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(7), rev, "checking revision")
+	_, err = a.ReplaceAll(context.Background(), "/apisix/routes/", []*Event{{Key: "/apisix/upstreams/2"}})
+	assert.Equal(t, ErrKeyOutOfScope, err, "checking error")
+	// Nothing is changed if two desired objects have the same key.
+	_, err = a.ReplaceAll(context.Background(), "/apisix/routes/", []*Event{
+		{Key: "/apisix/routes/1", Value: []byte("v1")},
+		{Key: "/apisix/routes/1", Value: []byte("v2")},
+	})
+	assert.Equal(t, ErrDuplicateKey, err, "checking error")
+
+	type change struct {
+		typ   mvccpb.Event_EventType
+		key   string
+		value string
+		rev   int64
+	}
+	expected := [][]change{
+		{
+			{typ: mvccpb.PUT, key: "/apisix/routes/2", value: "v2", rev: 6},
+			{typ: mvccpb.PUT, key: "/apisix/routes/4", value: "v1", rev: 6},
+			{typ: mvccpb.DELETE, key: "/apisix/routes/3", rev: 6},
+		},
+		{
+			{typ: mvccpb.DELETE, key: "/apisix/routes/1", rev: 7},
+			{typ: mvccpb.DELETE, key: "/apisix/routes/2", rev: 7},
+			{typ: mvccpb.DELETE, key: "/apisix/routes/4", rev: 7},
+		},
+	}
+	for _, exp := range expected {
+		var resp clientv3.WatchResponse
+		select {
+		case resp = <-wch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch response")
+		}
+		var changes []change
+		for _, ev := range resp.Events {
+			changes = append(changes, change{
+				typ:   ev.Type,
+				key:   string(ev.Kv.Key),
+				value: string(ev.Kv.Value),
+				rev:   ev.Kv.ModRevision,
+			})
+		}
+		assert.Equal(t, exp, changes, "checking changes")
+	}
+
+	resp, err := client.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(7), resp.Header.Revision, "checking revision")
+	if assert.Len(t, resp.Kvs, 1, "checking keys") {
+		assert.Equal(t, "/apisix/upstreams/1", string(resp.Kvs[0].Key), "checking key")
+	}
+}
+
+func TestEtcdAdapterEventErrors(t *testing.T) {
+	a, _, shutdown := startTestAdapter(t, &AdapterOptions{
+		ErrorChannelSize: 1,
+	})
+	defer shutdown()
+
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventUpdate,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:  "/apisix/routes/3",
+			Type: EventDelete,
+		},
+	}
+	// The events sent before are applied once the pushed one is applied.
+	_, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/4", Value: []byte("v1"), Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+
+	select {
+	case evErr := <-a.Errors():
+		assert.Equal(t, "/apisix/routes/1", evErr.Event.Key, "checking key")
+		assert.Equal(t, EventUpdate, evErr.Event.Type, "checking event type")
+		assert.True(t, errors.Is(evErr, ErrKeyNotFound), "checking error")
+	default:
+		t.Fatal("no event error reported")
+	}
+	// The error of the delete event is dropped, as the channel was full.
+	assert.Equal(t, int64(1), a.Stats().DroppedEventErrors, "checking dropped errors")
+
+	// The applied events never produce errors.
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+		{
+			Key:  "/apisix/routes/4",
+			Type: EventDelete,
+		},
+	}
+	_, err = a.Push(context.Background(), &Event{Key: "/apisix/routes/5", Value: []byte("v1"), Type: EventAdd})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, a.Errors(), 0, "checking errors")
+	assert.Equal(t, int64(1), a.Stats().DroppedEventErrors, "checking dropped errors")
+}
+
+func TestEtcdAdapterSkipUnchangedUpdates(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		SkipUnchangedUpdates: true,
+	})
+	defer shutdown()
+
+	push := func(typ EventType, value string) int64 {
+		rev, err := a.Push(context.Background(), &Event{
+			Key:   "/apisix/routes/1",
+			Value: []byte(value),
+			Type:  typ,
+		})
+		assert.Nil(t, err, "checking error")
+		return rev
+	}
+	assert.Equal(t, int64(2), push(EventAdd, "v1"), "checking revision")
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(3))
+
+	// The revision stays flat across the identical pushes.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, int64(2), push(EventUpdate, "v1"), "checking revision")
+		assert.Equal(t, int64(2), push(EventUpsert, "v1"), "checking revision")
+	}
+	assert.Equal(t, int64(6), a.Stats().SkippedUpdates, "checking skipped updates")
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	assert.Equal(t, int64(1), resp.Kvs[0].Version, "checking version")
+
+	// It still advances on the genuine changes.
+	assert.Equal(t, int64(3), push(EventUpdate, "v2"), "checking revision")
+	assert.Equal(t, int64(4), push(EventUpsert, "v3"), "checking revision")
+	assert.Equal(t, int64(6), a.Stats().SkippedUpdates, "checking skipped updates")
+	var revs []int64
+	for len(revs) < 2 {
+		select {
+		case resp := <-wch:
+			for _, ev := range resp.Events {
+				revs = append(revs, ev.Kv.ModRevision)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch response")
+		}
+	}
+	assert.Equal(t, []int64{3, 4}, revs, "checking revisions")
+
+	// The identical updates are applied without the option.
+	b, _, shutdownB := startTestAdapter(t, nil)
+	defer shutdownB()
+	for i := int64(0); i < 3; i++ {
+		typ := EventAdd
+		if i > 0 {
+			typ = EventUpdate
+		}
+		rev, err := b.Push(context.Background(), &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: typ})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, i+2, rev, "checking revision")
+	}
+	assert.Equal(t, int64(0), b.Stats().SkippedUpdates, "checking skipped updates")
+}
+
+// BenchmarkEtcdAdapterEventCh pushes single-item events to the event channel,
+// until all of them are applied.
+func BenchmarkEtcdAdapterEventCh(b *testing.B) {
+	cases := []struct {
+		name string
+		size int
+	}{
+		{
+			name: "unbuffered",
+		},
+		{
+			name: "1024",
+			size: 1024,
+		},
+	}
+	const events = 100000
+	batches := make([][]*Event, events)
+	for i := range batches {
+		batches[i] = []*Event{
+			{
+				Key:   fmt.Sprintf("/apisix/routes/%d", i),
+				Value: []byte("v1"),
+				Type:  EventAdd,
+			},
+		}
+	}
+	for _, bc := range cases {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				a := NewEtcdAdapter(&AdapterOptions{
+					Logger:           zap.NewNop(),
+					EventChannelSize: bc.size,
+				}).(*adapter)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					a.watchEvents(ctx)
+					close(done)
+				}()
+				for _, batch := range batches {
+					a.eventsCh <- batch
+				}
+				// The buffered events are drained once it's canceled.
+				cancel()
+				<-done
+			}
+			b.ReportMetric(float64(events), "events/op")
+		})
+	}
+}
+
+func TestEtcdAdapterCompactTo(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for i, value := range []string{"v1", "v2", "v3", "v4"} {
+		typ := EventUpdate
+		if i == 0 {
+			typ = EventAdd
+		}
+		_, err := a.Push(context.Background(), &Event{Key: "/apisix/routes/1", Value: []byte(value), Type: typ})
+		assert.Nil(t, err, "checking error")
+	}
+	// A watcher is watching since revision 3 before the compaction.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchEvents := func(wch clientv3.WatchChan, n int) {
+		for received := 0; received < n; {
+			select {
+			case wresp := <-wch:
+				assert.Nil(t, wresp.Err(), "checking watch error")
+				received += len(wresp.Events)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for watch response")
+			}
+		}
+	}
+	watchEvents(client.Watch(ctx, "/apisix/routes/1", clientv3.WithRev(3)), 3)
+
+	assert.Equal(t, backends.ErrFutureRevision, a.CompactTo(context.Background(), 6), "checking error")
+	assert.Nil(t, a.CompactTo(context.Background(), 4), "checking error")
+	assert.Equal(t, backends.ErrCompacted, a.CompactTo(context.Background(), 4), "checking error")
+	_, err := client.Compact(context.Background(), 4)
+	assert.Equal(t, rpctypes.ErrCompacted, err, "checking error")
+
+	_, err = client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(3))
+	assert.Equal(t, rpctypes.ErrCompacted, err, "checking error")
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(4))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v3", string(getResp.Kvs[0].Value), "checking value")
+
+	// The watcher resuming from a compacted revision fails, while the one
+	// resuming from the compacted revision succeeds.
+	wch := client.Watch(ctx, "/apisix/routes/1", clientv3.WithRev(3))
+	select {
+	case wresp := <-wch:
+		assert.Equal(t, rpctypes.ErrCompacted, wresp.Err(), "checking watch error")
+		assert.Equal(t, int64(4), wresp.CompactRevision, "checking compact revision")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch response")
+	}
+	watchEvents(client.Watch(ctx, "/apisix/routes/1", clientv3.WithRev(4)), 2)
+}
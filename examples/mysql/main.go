@@ -46,6 +46,8 @@ func main() {
 			panic(err)
 		}
 	}()
+	<-a.Ready()
+	opts.Logger.Info("etcd adapter is ready", zap.String("addr", ln.Addr().String()))
 	<-ctx.Done()
 	if err := a.Shutdown(context.TODO()); err != nil {
 		panic(err)
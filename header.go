@@ -0,0 +1,84 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"reflect"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// raftTerm is the raft term in the response headers, there is no raft in
+// etcd adapter, so it's always the first term.
+const raftTerm = 1
+
+// fillHeader fills the header of the response, so that all responses carry
+// the same cluster id and member id. The current revision is used if the
+// handler didn't give one.
+func (a *adapter) fillHeader(resp interface{}) {
+	v := reflect.ValueOf(resp)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	field := v.Elem().FieldByName("Header")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(&etcdserverpb.ResponseHeader{}) {
+		return
+	}
+	if field.IsNil() {
+		field.Set(reflect.ValueOf(&etcdserverpb.ResponseHeader{}))
+	}
+	header := field.Interface().(*etcdserverpb.ResponseHeader)
+	header.ClusterId = a.clusterID
+	header.MemberId = a.memberID
+	header.RaftTerm = raftTerm
+	if header.Revision == 0 {
+		if b, ok := a.backend.(backends.Backend); ok {
+			header.Revision = b.CurrentRevision()
+		}
+	}
+}
+
+func (a *adapter) headerUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	a.fillHeader(resp)
+	return resp, nil
+}
+
+func (a *adapter) headerStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &headerServerStream{
+		ServerStream: ss,
+		a:            a,
+	})
+}
+
+// headerServerStream fills the header of the messages before sending them.
+type headerServerStream struct {
+	grpc.ServerStream
+
+	a *adapter
+}
+
+func (ss *headerServerStream) SendMsg(m interface{}) error {
+	ss.a.fillHeader(m)
+	return ss.ServerStream.SendMsg(m)
+}
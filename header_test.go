@@ -0,0 +1,110 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+func TestFillHeader(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		MemberID: 123,
+	}).(*adapter)
+	b := a.backend.(backends.Backend)
+	txn := b.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/1"), []byte("v1"), 0)
+	txn.End()
+
+	resp := &etcdserverpb.PutResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: 1,
+		},
+	}
+	a.fillHeader(resp)
+	assert.Equal(t, &etcdserverpb.ResponseHeader{
+		ClusterId: DefaultClusterID,
+		MemberId:  123,
+		Revision:  1,
+		RaftTerm:  raftTerm,
+	}, resp.Header, "checking header")
+
+	// The current revision is used for absent headers.
+	statusResp := &etcdserverpb.StatusResponse{}
+	a.fillHeader(statusResp)
+	assert.Equal(t, &etcdserverpb.ResponseHeader{
+		ClusterId: DefaultClusterID,
+		MemberId:  123,
+		Revision:  2,
+		RaftTerm:  raftTerm,
+	}, statusResp.Header, "checking header")
+
+	// Messages without headers are ignored.
+	a.fillHeader(&etcdserverpb.PutRequest{})
+	a.fillHeader(nil)
+}
+
+func TestEtcdAdapterResponseHeader(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		ClusterID: 1000,
+		MemberID:  2000,
+	})
+	defer shutdown()
+
+	var headers []*etcdserverpb.ResponseHeader
+	putResp, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	headers = append(headers, putResp.Header)
+
+	getResp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	headers = append(headers, getResp.Header)
+
+	txnResp, err := client.Txn(context.Background()).Then(clientv3.OpPut("/apisix/routes/2", "v1")).Commit()
+	assert.Nil(t, err, "checking error")
+	headers = append(headers, txnResp.Header)
+
+	delResp, err := client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	headers = append(headers, delResp.Header)
+
+	statusResp, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	headers = append(headers, statusResp.Header)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	wresp := <-wch
+	assert.True(t, wresp.Created, "checking created")
+	headers = append(headers, &wresp.Header)
+
+	var lastRev int64
+	for _, header := range headers {
+		assert.Equal(t, uint64(1000), header.ClusterId, "checking cluster id")
+		assert.Equal(t, uint64(2000), header.MemberId, "checking member id")
+		assert.Equal(t, uint64(raftTerm), header.RaftTerm, "checking raft term")
+		assert.GreaterOrEqual(t, header.Revision, lastRev, "checking revision")
+		lastRev = header.Revision
+	}
+	assert.Equal(t, int64(4), lastRev, "checking the last revision")
+}
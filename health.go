@@ -0,0 +1,177 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	errNotServing   = errors.New("the gRPC services are not serving")
+	errDataNotReady = errors.New("the data is not ready")
+)
+
+// healthCheck is a named check of the /readyz and the /health endpoints, it
+// returns nil if it passes.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// readyChecks are the checks of the /readyz endpoint.
+func (a *adapter) readyChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "grpc", check: a.checkServing},
+	}
+	if a.waitForData {
+		checks = append(checks, healthCheck{name: "data", check: a.checkDataReady})
+	}
+	return checks
+}
+
+// checkServing checks whether the gRPC services are serving, they're not
+// before Serve is up, nor after Shutdown is called.
+func (a *adapter) checkServing() error {
+	resp, err := a.health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return errNotServing
+	}
+	return nil
+}
+
+func (a *adapter) checkDataReady() error {
+	if atomic.LoadInt32(&a.dataReady) == 0 {
+		return errDataNotReady
+	}
+	return nil
+}
+
+func (a *adapter) SetDataReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&a.dataReady, v)
+}
+
+// showLivez serves the /livez endpoint, the adapter is alive as long as it
+// serves the HTTP requests.
+func (a *adapter) showLivez(w http.ResponseWriter, r *http.Request) {
+	a.serveChecks(w, r, "livez", nil)
+}
+
+// showReadyz serves the /readyz endpoint.
+func (a *adapter) showReadyz(w http.ResponseWriter, r *http.Request) {
+	a.serveChecks(w, r, "readyz", a.readyChecks())
+}
+
+// serveChecks runs the checks like ETCD does, the ones named by the
+// "exclude" query parameters are skipped, and the result of every check is
+// shown if the "verbose" query parameter is present or any check fails.
+func (a *adapter) serveChecks(w http.ResponseWriter, r *http.Request, endpoint string, checks []healthCheck) {
+	excluded := make(map[string]struct{})
+	for _, name := range r.URL.Query()["exclude"] {
+		excluded[strings.TrimSpace(name)] = struct{}{}
+	}
+	_, verbose := r.URL.Query()["verbose"]
+
+	var (
+		b      bytes.Buffer
+		failed bool
+	)
+	for _, c := range checks {
+		if _, ok := excluded[c.name]; ok {
+			fmt.Fprintf(&b, "[+]%s excluded: ok\n", c.name)
+			continue
+		}
+		if err := c.check(); err != nil {
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", c.name, err)
+			failed = true
+		} else {
+			fmt.Fprintf(&b, "[+]%s ok\n", c.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		fmt.Fprintf(&b, "%s check failed\n", endpoint)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if !verbose {
+		b.Reset()
+		b.WriteString("ok")
+	} else {
+		fmt.Fprintf(&b, "%s check passed\n", endpoint)
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		a.logger.Warn("failed to send check result",
+			zap.String("endpoint", endpoint),
+			zap.Error(err),
+		)
+	}
+}
+
+// healthStatus is the response of the /health endpoint, it's same as the
+// one of ETCD.
+type healthStatus struct {
+	Health string `json:"health"`
+	Reason string `json:"reason"`
+}
+
+// showHealth serves the /health endpoint, the adapter is healthy if it's
+// ready and no alarm is activated.
+func (a *adapter) showHealth(w http.ResponseWriter, _ *http.Request) {
+	h := healthStatus{Health: "true"}
+	for _, c := range a.readyChecks() {
+		if err := c.check(); err != nil {
+			h = healthStatus{Health: "false", Reason: err.Error()}
+			break
+		}
+	}
+	if h.Health == "true" {
+		if alarms := a.alarms.list(etcdserverpb.AlarmType_NONE); len(alarms) > 0 {
+			h = healthStatus{Health: "false", Reason: "ALARM " + alarms[0].Alarm.String()}
+		}
+	}
+
+	// Marshaling the strings never fails.
+	data, _ := json.Marshal(&h)
+	w.Header().Set("Content-Type", "application/json")
+	if h.Health == "true" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(data); err != nil {
+		a.logger.Warn("failed to send health status",
+			zap.Error(err),
+		)
+	}
+}
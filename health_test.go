@@ -0,0 +1,231 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// getHealth requests the HTTP endpoint, and returns the status code and the
+// body.
+func getHealth(t *testing.T, client *http.Client, url string) (int, string) {
+	resp, err := client.Get(url)
+	assert.Nil(t, err, "checking error")
+	if err != nil {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "checking error")
+	return resp.StatusCode, string(body)
+}
+
+func TestEtcdAdapterHealthEndpoints(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		WaitForData: true,
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	base := "http://" + ln.Addr().String()
+	code, body := getHealth(t, http.DefaultClient, base+"/livez")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "ok", body, "checking body")
+
+	// The data is not ready yet.
+	code, body = getHealth(t, http.DefaultClient, base+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "checking status code")
+	assert.Equal(t, "[+]grpc ok\n[-]data failed: the data is not ready\nreadyz check failed\n", body, "checking body")
+	code, body = getHealth(t, http.DefaultClient, base+"/readyz?exclude=data")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "ok", body, "checking body")
+	code, body = getHealth(t, http.DefaultClient, base+"/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "checking status code")
+	assert.Equal(t, `{"health":"false","reason":"the data is not ready"}`, body, "checking body")
+
+	a.SetDataReady(true)
+	code, body = getHealth(t, http.DefaultClient, base+"/readyz")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "ok", body, "checking body")
+	code, body = getHealth(t, http.DefaultClient, base+"/readyz?verbose&exclude=grpc")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "[+]grpc excluded: ok\n[+]data ok\nreadyz check passed\n", body, "checking body")
+	code, body = getHealth(t, http.DefaultClient, base+"/health")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, `{"health":"true","reason":""}`, body, "checking body")
+
+	// The alarms make it unhealthy, but it's still ready.
+	a.(*adapter).alarms.activate(etcdserverpb.AlarmMember{
+		MemberID: DefaultMemberID,
+		Alarm:    etcdserverpb.AlarmType_NOSPACE,
+	})
+	code, body = getHealth(t, http.DefaultClient, base+"/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "checking status code")
+	assert.Equal(t, `{"health":"false","reason":"ALARM NOSPACE"}`, body, "checking body")
+	code, _ = getHealth(t, http.DefaultClient, base+"/readyz")
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+}
+
+func TestEtcdAdapterReadyzShutdown(t *testing.T) {
+	// The watch stream is held by the interceptor until it's canceled, so
+	// that the shutdown is draining meanwhile.
+	watching := make(chan struct{}, 1)
+	a := NewEtcdAdapter(&AdapterOptions{
+		StreamInterceptors: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if info.FullMethod != "/etcdserverpb.Watch/Watch" {
+					return handler(srv, ss)
+				}
+				watching <- struct{}{}
+				<-ss.Context().Done()
+				return ss.Context().Err()
+			},
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	// The listener stops accepting during the shutdown, so the endpoint is
+	// requested over the same connection.
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConns: 1}}
+	defer httpClient.CloseIdleConnections()
+	url := "http://" + ln.Addr().String() + "/readyz"
+	code, _ := getHealth(t, httpClient, url)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	defer client.Close()
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	_, err = etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(wctx)
+	assert.Nil(t, err, "checking error")
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch stream")
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- a.Shutdown(context.Background())
+	}()
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for code == http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		code, body = getHealth(t, httpClient, url)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, code, "checking status code")
+	assert.Equal(t, "[-]grpc failed: the gRPC services are not serving\nreadyz check failed\n", body, "checking body")
+
+	wcancel()
+	select {
+	case err := <-shutdownErr:
+		assert.Nil(t, err, "shutting down")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+}
+
+func TestEtcdAdapterHealth(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	defer client.Close()
+
+	hc := healthpb.NewHealthClient(client.ActiveConnection())
+	for _, name := range append([]string{""}, healthServiceNames...) {
+		resp, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{Service: name})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status, "checking status of %q", name)
+	}
+	_, err = hc.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "foo"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "checking error")
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	stream, err := hc.Watch(wctx, &healthpb.HealthCheckRequest{Service: "etcdserverpb.KV"})
+	assert.Nil(t, err, "checking error")
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status, "checking status")
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- a.Shutdown(context.Background())
+	}()
+	// The shutdown waits for the health watcher, which sees the update.
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "checking status")
+	wcancel()
+	select {
+	case err := <-shutdownErr:
+		assert.Nil(t, err, "shutting down")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+	for _, name := range append([]string{""}, healthServiceNames...) {
+		resp, err := a.(*adapter).health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: name})
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "checking status of %q", name)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// errorUnaryInterceptor translates the errors returned by the handlers
+// to the ETCD gRPC errors.
+func errorUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return resp, nil
+}
+
+// errorStreamInterceptor is the stream version of errorUnaryInterceptor.
+func errorStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return toGRPCError(handler(srv, ss))
+}
+
+// readOnlyUnaryInterceptor rejects all the requests which try to change the
+// keyspace, it's used when the adapter is in the read-only mode.
+func readOnlyUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	switch r := req.(type) {
+	case *etcdserverpb.PutRequest, *etcdserverpb.DeleteRangeRequest, *etcdserverpb.LeaseGrantRequest,
+		*etcdserverpb.LeaseRevokeRequest:
+		return nil, errGRPCReadOnly
+	case *etcdserverpb.TxnRequest:
+		if isMutationTxn(r) {
+			return nil, errGRPCReadOnly
+		}
+	}
+	return handler(ctx, req)
+}
+
+// isMutationTxn checks whether the transaction (and the nested ones)
+// contains any put or delete operations.
+func isMutationTxn(r *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch {
+			case op.GetRequestPut() != nil, op.GetRequestDeleteRange() != nil:
+				return true
+			case op.GetRequestTxn() != nil:
+				if isMutationTxn(op.GetRequestTxn()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEtcdAdapterReadOnly(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		ReadOnly: true,
+	})
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+
+	checkReadOnlyError := func(err error) {
+		assert.NotNil(t, err, "checking error")
+		st, ok := status.FromError(err)
+		assert.True(t, ok, "checking grpc status")
+		assert.Equal(t, codes.PermissionDenied, st.Code(), "checking status code")
+		assert.Equal(t, "etcd adapter is read-only", st.Message(), "checking status message")
+	}
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+	_, err := kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:   []byte("/apisix/routes/1"),
+		Value: []byte("v2"),
+	})
+	checkReadOnlyError(err)
+	_, err = kv.DeleteRange(context.Background(), &etcdserverpb.DeleteRangeRequest{
+		Key: []byte("/apisix/routes/1"),
+	})
+	checkReadOnlyError(err)
+	_, err = kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestTxn{
+					RequestTxn: &etcdserverpb.TxnRequest{
+						Failure: []*etcdserverpb.RequestOp{
+							{
+								Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+									RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{
+										Key: []byte("/apisix/routes/1"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	checkReadOnlyError(err)
+	lease := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+	_, err = lease.LeaseGrant(context.Background(), &etcdserverpb.LeaseGrantRequest{
+		TTL: 10,
+	})
+	checkReadOnlyError(err)
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking number of kvs")
+	assert.Equal(t, "v1", string(resp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	assert.Len(t, a.OutboundCh(), 0, "checking outbound events")
+
+	// Events are still applied.
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+	})
+	resp, err = client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v2", string(resp.Kvs[0].Value), "checking value")
+}
+
+func TestEtcdAdapterInterceptors(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		unary   = make(map[string]int)
+		streams = make(map[string]int)
+	)
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		UnaryInterceptors: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				mu.Lock()
+				unary[info.FullMethod]++
+				mu.Unlock()
+				return handler(ctx, req)
+			},
+		},
+		StreamInterceptors: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				mu.Lock()
+				streams[info.FullMethod]++
+				mu.Unlock()
+				return handler(srv, ss)
+			},
+		},
+	})
+	defer shutdown()
+
+	_, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/1")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	select {
+	case wresp := <-wch:
+		assert.Len(t, wresp.Events, 1, "checking events")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+
+	lease, err := client.Grant(context.Background(), 60)
+	assert.Nil(t, err, "checking error")
+	_, err = client.KeepAliveOnce(context.Background(), lease.ID)
+	assert.Nil(t, err, "checking error")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, unary["/etcdserverpb.KV/Range"], "checking range requests")
+	assert.Equal(t, 1, unary["/etcdserverpb.KV/Put"], "checking put requests")
+	assert.Equal(t, 1, streams["/etcdserverpb.Watch/Watch"], "checking watch streams")
+	assert.Equal(t, 1, streams["/etcdserverpb.Lease/LeaseKeepAlive"], "checking keepalive streams")
+}
@@ -0,0 +1,744 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// maxTxnNestingDepth is the maximum depth of the nested transactions.
+const maxTxnNestingDepth = 16
+
+// kvServer implements the etcdserverpb.KVServer. It serves requests with the
+// extended backend abilities if the backend supports, or it falls back to
+// the kine bridge.
+type kvServer struct {
+	*server.KVServerBridge
+
+	backend server.Backend
+	// lessor manages the leases of the keys, it's nil if the backend is not
+	// a backends.Backend.
+	lessor *lessor
+	// notify is called when the clients make changes.
+	notify func(*Event)
+	// auth checks the permissions of the users if the authentication is
+	// enabled.
+	auth      *authStore
+	allowlist *allowlist
+}
+
+// rangeFunc ranges the keys in the backend or in a transaction.
+type rangeFunc func(key, end []byte, opts backends.RangeOptions) (*backends.RangeResult, error)
+
+func (s *kvServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	if err := s.auth.checkPermission(ctx, r.Key, r.RangeEnd, authpb.READ); err != nil {
+		return nil, err
+	}
+	if err := s.allowlist.checkRead(ctx, "Range", r.Key, r.RangeEnd); err != nil {
+		return nil, err
+	}
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.KVServerBridge.Range(ctx, r)
+	}
+	return s.rangeKeys(func(key, end []byte, opts backends.RangeOptions) (*backends.RangeResult, error) {
+		return b.Range(ctx, key, end, opts)
+	}, r)
+}
+
+// rangeKeys applies the range request with the given range function.
+func (s *kvServer) rangeKeys(rangeFn rangeFunc, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	sortOrder := r.SortOrder
+	if r.SortTarget != etcdserverpb.RangeRequest_KEY && sortOrder == etcdserverpb.RangeRequest_NONE {
+		// Key-values are returned in the key ascending order by the
+		// backend, so only sort them in the ascending order by default
+		// when the target is not the key.
+		sortOrder = etcdserverpb.RangeRequest_ASCEND
+	}
+	filtered := r.MinModRevision > 0 || r.MaxModRevision > 0 ||
+		r.MinCreateRevision > 0 || r.MaxCreateRevision > 0
+	limit := r.Limit
+	if sortOrder != etcdserverpb.RangeRequest_NONE || filtered {
+		// All key-values are required to sort or filter them before
+		// applying the limit.
+		limit = 0
+	}
+
+	res, err := rangeFn(r.Key, r.RangeEnd, backends.RangeOptions{
+		Revision:  r.Revision,
+		Limit:     limit,
+		CountOnly: r.CountOnly && !filtered,
+	})
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	kvs := res.KVs
+	count := res.Count
+	if filtered {
+		kvs = filterKeyValues(kvs, r)
+		count = int64(len(kvs))
+	}
+	if r.CountOnly {
+		kvs = nil
+	}
+	sortKeyValues(kvs, r.SortTarget, sortOrder)
+	if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+		kvs = kvs[:r.Limit]
+	}
+	resp := &etcdserverpb.RangeResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: res.Revision,
+		},
+		Kvs:   kvs,
+		Count: count,
+	}
+	if !r.CountOnly {
+		resp.More = count > int64(len(kvs))
+	}
+	if r.KeysOnly {
+		for _, kv := range kvs {
+			kv.Value = nil
+		}
+	}
+	return resp, nil
+}
+
+func (s *kvServer) Put(ctx context.Context, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	if err := s.checkPutPermission(ctx, r); err != nil {
+		return nil, err
+	}
+	if err := s.allowlist.checkWrite(ctx, "Put", r.Key, nil); err != nil {
+		return nil, err
+	}
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.KVServerBridge.Put(ctx, r)
+	}
+
+	txn := b.Write(ctx)
+	defer txn.End()
+	return s.put(txn, r)
+}
+
+// put applies the put request in the write transaction.
+func (s *kvServer) put(txn backends.TxnWrite, r *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	if r.IgnoreValue && len(r.Value) > 0 {
+		return nil, rpctypes.ErrGRPCValueProvided
+	}
+	if r.IgnoreLease && r.Lease != 0 {
+		return nil, rpctypes.ErrGRPCLeaseProvided
+	}
+	res, err := txn.Range(r.Key, nil, backends.RangeOptions{})
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	typ := EventAdd
+	if len(res.KVs) > 0 {
+		typ = EventUpdate
+	}
+
+	value, lease := r.Value, r.Lease
+	if r.IgnoreValue || r.IgnoreLease {
+		if len(res.KVs) == 0 {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if r.IgnoreValue {
+			value = res.KVs[0].Value
+		}
+		if r.IgnoreLease {
+			lease = res.KVs[0].Lease
+		}
+	}
+	if lease != 0 && !s.lessor.attach(lease, r.Key) {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	if len(res.KVs) > 0 && res.KVs[0].Lease != 0 && res.KVs[0].Lease != lease {
+		s.lessor.detach(res.KVs[0].Lease, r.Key)
+	}
+
+	rev := txn.Put(r.Key, value, lease)
+	s.notify(&Event{
+		Key:   string(r.Key),
+		Value: value,
+		Type:  typ,
+	})
+	resp := &etcdserverpb.PutResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+	}
+	if r.PrevKv && len(res.KVs) > 0 {
+		resp.PrevKv = res.KVs[0]
+	}
+	return resp, nil
+}
+
+func (s *kvServer) DeleteRange(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
+	if err := s.checkDeleteRangePermission(ctx, r); err != nil {
+		return nil, err
+	}
+	if err := s.allowlist.checkWrite(ctx, "DeleteRange", r.Key, r.RangeEnd); err != nil {
+		return nil, err
+	}
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.KVServerBridge.DeleteRange(ctx, r)
+	}
+
+	txn := b.Write(ctx)
+	defer txn.End()
+	return s.deleteRange(txn, r)
+}
+
+// deleteRange applies the delete range request in the write transaction.
+func (s *kvServer) deleteRange(txn backends.TxnWrite, r *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
+	// The transaction holds the backend exclusively, so the key-values got
+	// here are exactly the deleted ones, even if events are being applied
+	// concurrently.
+	res, err := txn.Range(r.Key, r.RangeEnd, backends.RangeOptions{})
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	deleted, rev := txn.DeleteRange(r.Key, r.RangeEnd)
+	for _, kv := range res.KVs {
+		if kv.Lease != 0 {
+			s.lessor.detach(kv.Lease, kv.Key)
+		}
+		s.notify(&Event{
+			Key:  string(kv.Key),
+			Type: EventDelete,
+		})
+	}
+	resp := &etcdserverpb.DeleteRangeResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+		Deleted: deleted,
+	}
+	if r.PrevKv {
+		resp.PrevKvs = res.KVs
+	}
+	return resp, nil
+}
+
+func (s *kvServer) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if err := s.checkTxnPermission(ctx, r); err != nil {
+		return nil, err
+	}
+	if err := s.allowlist.checkTxn(ctx, r); err != nil {
+		return nil, err
+	}
+	if err := checkTxnDuplicates(r); err != nil {
+		return nil, err
+	}
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.KVServerBridge.Txn(ctx, r)
+	}
+
+	txn := b.Write(ctx)
+	defer txn.End()
+
+	// The branches are chosen before applying any operation, then they are
+	// checked, so that the transaction won't be applied partially.
+	path := newTxnPath(txn, r)
+	checkPath := path
+	if err := s.checkTxn(txn, r, &checkPath); err != nil {
+		return nil, err
+	}
+	return s.txn(txn, r, &path)
+}
+
+// txnPath is the branches chosen by the compares of a transaction and the
+// nested ones, in the order they are applied, true means the success one.
+type txnPath []bool
+
+// newTxnPath evaluates the compares of the transaction and the nested ones
+// in the chosen branches. Like ETCD, they are all evaluated against the state
+// before the transaction, so the nested compares don't see the changes of
+// the operations before them.
+func newTxnPath(txn backends.TxnWrite, r *etcdserverpb.TxnRequest) txnPath {
+	path := txnPath{applyCompares(txn, r.Compare)}
+	ops := r.Success
+	if !path[0] {
+		ops = r.Failure
+	}
+	for _, op := range ops {
+		if tv, ok := op.Request.(*etcdserverpb.RequestOp_RequestTxn); ok {
+			path = append(path, newTxnPath(txn, tv.RequestTxn)...)
+		}
+	}
+	return path
+}
+
+// next pops the branch of the next transaction.
+func (p *txnPath) next() bool {
+	succeeded := (*p)[0]
+	*p = (*p)[1:]
+	return succeeded
+}
+
+// txn applies the transaction request (and the nested ones) in the write
+// transaction along the path, so that all the changes share the same
+// revision.
+func (s *kvServer) txn(txn backends.TxnWrite, r *etcdserverpb.TxnRequest, path *txnPath) (*etcdserverpb.TxnResponse, error) {
+	succeeded := path.next()
+	ops := r.Success
+	if !succeeded {
+		ops = r.Failure
+	}
+	resp := &etcdserverpb.TxnResponse{
+		Succeeded: succeeded,
+		Responses: make([]*etcdserverpb.ResponseOp, 0, len(ops)),
+	}
+	for _, op := range ops {
+		var respOp *etcdserverpb.ResponseOp
+		switch tv := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			rangeResp, err := s.rangeKeys(txn.Range, tv.RequestRange)
+			if err != nil {
+				return nil, err
+			}
+			respOp = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseRange{
+					ResponseRange: rangeResp,
+				},
+			}
+		case *etcdserverpb.RequestOp_RequestPut:
+			putResp, err := s.put(txn, tv.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			respOp = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponsePut{
+					ResponsePut: putResp,
+				},
+			}
+		case *etcdserverpb.RequestOp_RequestDeleteRange:
+			deleteResp, err := s.deleteRange(txn, tv.RequestDeleteRange)
+			if err != nil {
+				return nil, err
+			}
+			respOp = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{
+					ResponseDeleteRange: deleteResp,
+				},
+			}
+		case *etcdserverpb.RequestOp_RequestTxn:
+			txnResp, err := s.txn(txn, tv.RequestTxn, path)
+			if err != nil {
+				return nil, err
+			}
+			respOp = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseTxn{
+					ResponseTxn: txnResp,
+				},
+			}
+		default:
+			return nil, status.Errorf(codes.Unimplemented, "unsupported transaction operation %T", op.Request)
+		}
+		resp.Responses = append(resp.Responses, respOp)
+	}
+	resp.Header = &etcdserverpb.ResponseHeader{
+		Revision: txn.Rev(),
+	}
+	return resp, nil
+}
+
+func (s *kvServer) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	if err := s.allowlist.checkWrite(ctx, "Compact", nil, nil); err != nil {
+		return nil, err
+	}
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.KVServerBridge.Compact(ctx, r)
+	}
+
+	rev, err := b.Compact(ctx, r.Revision)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &etcdserverpb.CompactionResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+	}, nil
+}
+
+// checkPutPermission checks whether the user is permitted to put the key,
+// reading the previous key-value is also required if it's returned.
+func (s *kvServer) checkPutPermission(ctx context.Context, r *etcdserverpb.PutRequest) error {
+	if err := s.auth.checkPermission(ctx, r.Key, nil, authpb.WRITE); err != nil {
+		return err
+	}
+	if r.PrevKv {
+		return s.auth.checkPermission(ctx, r.Key, nil, authpb.READ)
+	}
+	return nil
+}
+
+// checkDeleteRangePermission is same as checkPutPermission, but for the
+// delete range request.
+func (s *kvServer) checkDeleteRangePermission(ctx context.Context, r *etcdserverpb.DeleteRangeRequest) error {
+	if err := s.auth.checkPermission(ctx, r.Key, r.RangeEnd, authpb.WRITE); err != nil {
+		return err
+	}
+	if r.PrevKv {
+		return s.auth.checkPermission(ctx, r.Key, r.RangeEnd, authpb.READ)
+	}
+	return nil
+}
+
+// checkTxnPermission checks the permissions of the compares, which count as
+// reads, and of the operations in both branches, including the nested
+// transactions, so that the result doesn't depend on the compares.
+func (s *kvServer) checkTxnPermission(ctx context.Context, r *etcdserverpb.TxnRequest) error {
+	if !s.auth.isEnabled() {
+		return nil
+	}
+	for _, c := range r.Compare {
+		if err := s.auth.checkPermission(ctx, c.Key, c.RangeEnd, authpb.READ); err != nil {
+			return err
+		}
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			var err error
+			switch tv := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestRange:
+				err = s.auth.checkPermission(ctx, tv.RequestRange.Key, tv.RequestRange.RangeEnd, authpb.READ)
+			case *etcdserverpb.RequestOp_RequestPut:
+				err = s.checkPutPermission(ctx, tv.RequestPut)
+			case *etcdserverpb.RequestOp_RequestDeleteRange:
+				err = s.checkDeleteRangePermission(ctx, tv.RequestDeleteRange)
+			case *etcdserverpb.RequestOp_RequestTxn:
+				err = s.checkTxnPermission(ctx, tv.RequestTxn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTxnDuplicates checks that no key is written more than once in either
+// branch of the transaction, including the nested transactions, like ETCD,
+// as the result would depend on the order of the operations.
+func checkTxnDuplicates(r *etcdserverpb.TxnRequest) error {
+	for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+		if _, _, err := checkOpsDuplicates(ops, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOpsDuplicates checks the operations of a branch, it returns the keys
+// put and the ranges deleted by them. A key can be deleted by several
+// operations, but it can't be both put and deleted, or be put twice, except
+// in the different branches of a nested transaction.
+func checkOpsDuplicates(ops []*etcdserverpb.RequestOp, depth int) (map[string]struct{}, []keyRange, error) {
+	var dels []keyRange
+	for _, op := range ops {
+		if tv, ok := op.Request.(*etcdserverpb.RequestOp_RequestDeleteRange); ok && tv.RequestDeleteRange != nil {
+			dels = append(dels, newKeyRange(tv.RequestDeleteRange.Key, tv.RequestDeleteRange.RangeEnd))
+		}
+	}
+	deleted := func(key string) bool {
+		for _, r := range dels {
+			if r.containsKey([]byte(key)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	puts := make(map[string]struct{})
+	for _, op := range ops {
+		tv, ok := op.Request.(*etcdserverpb.RequestOp_RequestTxn)
+		if !ok || tv.RequestTxn == nil {
+			continue
+		}
+		if depth+1 >= maxTxnNestingDepth {
+			return nil, nil, rpctypes.ErrGRPCTooManyOps
+		}
+		putsThen, delsThen, err := checkOpsDuplicates(tv.RequestTxn.Success, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		putsElse, delsElse, err := checkOpsDuplicates(tv.RequestTxn.Failure, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key := range putsThen {
+			if _, ok := puts[key]; ok || deleted(key) {
+				return nil, nil, rpctypes.ErrGRPCDuplicateKey
+			}
+			puts[key] = struct{}{}
+		}
+		for key := range putsElse {
+			// Only one of the branches is applied, so they can put the
+			// same key.
+			if _, ok := puts[key]; ok {
+				if _, ok := putsThen[key]; !ok {
+					return nil, nil, rpctypes.ErrGRPCDuplicateKey
+				}
+			}
+			if deleted(key) {
+				return nil, nil, rpctypes.ErrGRPCDuplicateKey
+			}
+			puts[key] = struct{}{}
+		}
+		dels = append(dels, delsThen...)
+		dels = append(dels, delsElse...)
+	}
+
+	for _, op := range ops {
+		tv, ok := op.Request.(*etcdserverpb.RequestOp_RequestPut)
+		if !ok || tv.RequestPut == nil {
+			continue
+		}
+		key := string(tv.RequestPut.Key)
+		if _, ok := puts[key]; ok || deleted(key) {
+			return nil, nil, rpctypes.ErrGRPCDuplicateKey
+		}
+		puts[key] = struct{}{}
+	}
+	return puts, dels, nil
+}
+
+// keyRange is the range [start, end) of the keys, a nil end means there is
+// no upper bound.
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// newKeyRange returns the range of the key and the range end, they're
+// interpreted in the same way as the RangeRequest.
+func newKeyRange(key, end []byte) keyRange {
+	switch {
+	case len(end) == 0:
+		return keyRange{
+			start: key,
+			end:   append(append(make([]byte, 0, len(key)+1), key...), 0),
+		}
+	case len(end) == 1 && end[0] == 0:
+		return keyRange{start: key}
+	default:
+		return keyRange{
+			start: key,
+			end:   end,
+		}
+	}
+}
+
+// containsKey checks whether the key is in the range.
+func (r keyRange) containsKey(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && (r.end == nil || bytes.Compare(key, r.end) < 0)
+}
+
+// checkTxn checks whether the operations of the transaction along the path
+// can be applied. As no key is written twice, the state before the
+// transaction is the one seen by each operation.
+func (s *kvServer) checkTxn(txn backends.TxnWrite, r *etcdserverpb.TxnRequest, path *txnPath) error {
+	ops := r.Success
+	if !path.next() {
+		ops = r.Failure
+	}
+	for _, op := range ops {
+		switch tv := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			// Make sure the revision can be read.
+			_, err := txn.Range(tv.RequestRange.Key, nil, backends.RangeOptions{
+				Revision:  tv.RequestRange.Revision,
+				CountOnly: true,
+			})
+			if err != nil {
+				return toGRPCError(err)
+			}
+		case *etcdserverpb.RequestOp_RequestPut:
+			r := tv.RequestPut
+			if r.IgnoreValue && len(r.Value) > 0 {
+				return rpctypes.ErrGRPCValueProvided
+			}
+			if r.IgnoreLease && r.Lease != 0 {
+				return rpctypes.ErrGRPCLeaseProvided
+			}
+			if r.Lease != 0 && !s.lessor.exists(r.Lease) {
+				return rpctypes.ErrGRPCLeaseNotFound
+			}
+			if r.IgnoreValue || r.IgnoreLease {
+				res, err := txn.Range(r.Key, nil, backends.RangeOptions{CountOnly: true})
+				if err != nil {
+					return toGRPCError(err)
+				}
+				if res.Count == 0 {
+					return rpctypes.ErrGRPCKeyNotFound
+				}
+			}
+		case *etcdserverpb.RequestOp_RequestTxn:
+			if err := s.checkTxn(txn, tv.RequestTxn, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyCompares checks whether all the compares are satisfied.
+func applyCompares(txn backends.TxnWrite, compares []*etcdserverpb.Compare) bool {
+	for _, c := range compares {
+		if !applyCompare(txn, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyCompare checks whether the compare is satisfied by all the keys in
+// its range.
+func applyCompare(txn backends.TxnWrite, c *etcdserverpb.Compare) bool {
+	res, err := txn.Range(c.Key, c.RangeEnd, backends.RangeOptions{})
+	if err != nil {
+		return false
+	}
+	if len(res.KVs) == 0 {
+		if c.Target == etcdserverpb.Compare_VALUE {
+			// Always fail if comparing the value of a key that doesn't exist.
+			return false
+		}
+		return compareKeyValue(c, &mvccpb.KeyValue{})
+	}
+	for _, kv := range res.KVs {
+		if !compareKeyValue(c, kv) {
+			return false
+		}
+	}
+	return true
+}
+
+func compareKeyValue(c *etcdserverpb.Compare, kv *mvccpb.KeyValue) bool {
+	var result int
+	switch c.Target {
+	case etcdserverpb.Compare_VALUE:
+		result = bytes.Compare(kv.Value, c.GetValue())
+	case etcdserverpb.Compare_CREATE:
+		result = compareInt64(kv.CreateRevision, c.GetCreateRevision())
+	case etcdserverpb.Compare_MOD:
+		result = compareInt64(kv.ModRevision, c.GetModRevision())
+	case etcdserverpb.Compare_VERSION:
+		result = compareInt64(kv.Version, c.GetVersion())
+	case etcdserverpb.Compare_LEASE:
+		result = compareInt64(kv.Lease, c.GetLease())
+	}
+	switch c.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return result == 0
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return result != 0
+	case etcdserverpb.Compare_GREATER:
+		return result > 0
+	case etcdserverpb.Compare_LESS:
+		return result < 0
+	}
+	return true
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// filterKeyValues filters out the key-values which don't satisfy the
+// revision conditions of the range request.
+func filterKeyValues(kvs []*mvccpb.KeyValue, r *etcdserverpb.RangeRequest) []*mvccpb.KeyValue {
+	filtered := kvs[:0]
+	for _, kv := range kvs {
+		if r.MinModRevision > 0 && kv.ModRevision < r.MinModRevision {
+			continue
+		}
+		if r.MaxModRevision > 0 && kv.ModRevision > r.MaxModRevision {
+			continue
+		}
+		if r.MinCreateRevision > 0 && kv.CreateRevision < r.MinCreateRevision {
+			continue
+		}
+		if r.MaxCreateRevision > 0 && kv.CreateRevision > r.MaxCreateRevision {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+// kvSorter sorts key-values with the given less function.
+type kvSorter struct {
+	kvs  []*mvccpb.KeyValue
+	less func(a, b *mvccpb.KeyValue) bool
+}
+
+func (s *kvSorter) Len() int           { return len(s.kvs) }
+func (s *kvSorter) Swap(i, j int)      { s.kvs[i], s.kvs[j] = s.kvs[j], s.kvs[i] }
+func (s *kvSorter) Less(i, j int) bool { return s.less(s.kvs[i], s.kvs[j]) }
+
+// sortKeyValues sorts the key-values by the target in the given order, the
+// order of key-values which have the same target keeps unchanged.
+func sortKeyValues(kvs []*mvccpb.KeyValue, target etcdserverpb.RangeRequest_SortTarget, order etcdserverpb.RangeRequest_SortOrder) {
+	if order == etcdserverpb.RangeRequest_NONE {
+		return
+	}
+	sorter := &kvSorter{kvs: kvs}
+	switch target {
+	case etcdserverpb.RangeRequest_KEY:
+		sorter.less = func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Key, b.Key) < 0 }
+	case etcdserverpb.RangeRequest_VERSION:
+		sorter.less = func(a, b *mvccpb.KeyValue) bool { return a.Version < b.Version }
+	case etcdserverpb.RangeRequest_CREATE:
+		sorter.less = func(a, b *mvccpb.KeyValue) bool { return a.CreateRevision < b.CreateRevision }
+	case etcdserverpb.RangeRequest_MOD:
+		sorter.less = func(a, b *mvccpb.KeyValue) bool { return a.ModRevision < b.ModRevision }
+	case etcdserverpb.RangeRequest_VALUE:
+		sorter.less = func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Value, b.Value) < 0 }
+	default:
+		return
+	}
+	if order == etcdserverpb.RangeRequest_DESCEND {
+		sort.Stable(sort.Reverse(sorter))
+	} else {
+		sort.Stable(sorter)
+	}
+}
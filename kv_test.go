@@ -0,0 +1,1097 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdAdapterRangePrefix(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes2",
+			Value: []byte("2"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/upstreams/1",
+			Value: []byte("3"),
+			Type:  EventAdd,
+		},
+	})
+
+	// The prefix doesn't have to be path-like.
+	resp, err := client.Get(context.Background(), "/apisix/route", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "/apisix/routes/1", string(resp.Kvs[0].Key))
+	assert.Equal(t, int64(2), resp.Kvs[0].CreateRevision)
+	assert.Equal(t, int64(2), resp.Kvs[0].ModRevision)
+	assert.Equal(t, "/apisix/routes2", string(resp.Kvs[1].Key))
+	assert.Equal(t, int64(3), resp.Kvs[1].CreateRevision)
+	assert.Equal(t, int64(3), resp.Kvs[1].ModRevision)
+
+	resp, err = client.Get(context.Background(), "/apisix/routes2", clientv3.WithFromKey())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "/apisix/routes2", string(resp.Kvs[0].Key))
+	assert.Equal(t, "/apisix/upstreams/1", string(resp.Kvs[1].Key))
+}
+
+func TestEtcdAdapterRangeLimit(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	var events []*Event
+	for i := 0; i < 3000; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%04d", i),
+			Value: []byte("value"),
+			Type:  EventAdd,
+		})
+	}
+	sendEvents(t, a, events)
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithLimit(1))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking number of kvs")
+	assert.True(t, resp.More, "checking more")
+	assert.Equal(t, int64(3000), resp.Count, "checking count")
+
+	seen := make(map[string]struct{})
+	key := "/apisix/routes/"
+	end := clientv3.GetPrefixRangeEnd(key)
+	for {
+		resp, err := client.Get(context.Background(), key, clientv3.WithRange(end), clientv3.WithLimit(100))
+		assert.Nil(t, err, "checking error")
+		assert.LessOrEqual(t, len(resp.Kvs), 100, "checking number of kvs")
+		for _, kv := range resp.Kvs {
+			_, ok := seen[string(kv.Key)]
+			assert.False(t, ok, "checking duplicated key")
+			seen[string(kv.Key)] = struct{}{}
+		}
+		if !resp.More {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	assert.Len(t, seen, 3000, "checking number of keys")
+}
+
+func TestEtcdAdapterRangeKeysOnlyAndCountOnly(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("route 1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("route 2"),
+			Type:  EventAdd,
+		},
+	})
+
+	resp, err := client.Get(context.Background(), "/apisix", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, int64(2), resp.Count, "checking count")
+	for i, kv := range resp.Kvs {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i+1), string(kv.Key), "checking key")
+		assert.Empty(t, kv.Value, "checking value")
+		assert.Equal(t, int64(i+2), kv.ModRevision, "checking mod revision")
+		assert.Equal(t, int64(i+2), kv.CreateRevision, "checking create revision")
+	}
+
+	resp, err = client.Get(context.Background(), "/apisix", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 0, "checking number of kvs")
+	assert.Equal(t, int64(2), resp.Count, "checking count")
+	assert.False(t, resp.More, "checking more")
+}
+
+func TestEtcdAdapterRangeSort(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	var events []*Event
+	for i := 0; i < 20; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%02d", i),
+			Value: []byte(fmt.Sprintf("%02d", 20-i)),
+			Type:  EventAdd,
+		})
+	}
+	sendEvents(t, a, events)
+	// Touch the first route so that it's the most recently modified one.
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/00",
+			Value: []byte("21"),
+			Type:  EventUpdate,
+		},
+	})
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend), clientv3.WithLimit(3))
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.More, "checking more")
+	assert.Equal(t, int64(20), resp.Count, "checking count")
+	var keys []string
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	assert.Equal(t, []string{"/apisix/routes/00", "/apisix/routes/19", "/apisix/routes/18"}, keys, "checking keys")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByValue, clientv3.SortAscend), clientv3.WithLimit(2))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "/apisix/routes/19", string(resp.Kvs[0].Key), "checking key")
+	assert.Equal(t, "/apisix/routes/18", string(resp.Kvs[1].Key), "checking key")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(2))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "/apisix/routes/19", string(resp.Kvs[0].Key), "checking key")
+	assert.Equal(t, "/apisix/routes/18", string(resp.Kvs[1].Key), "checking key")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByVersion, clientv3.SortDescend), clientv3.WithLimit(1))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "/apisix/routes/00", string(resp.Kvs[0].Key), "checking key")
+	assert.Equal(t, int64(2), resp.Kvs[0].Version, "checking version")
+}
+
+func TestEtcdAdapterRangeRevisionFilters(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	// Revisions 2 to 11 are for the creation.
+	var events []*Event
+	for i := 0; i < 10; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%d", i),
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		})
+	}
+	sendEvents(t, a, events)
+
+	// Revisions 12 to 16 are for the update.
+	events = nil
+	for i := 5; i < 10; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%d", i),
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		})
+	}
+	sendEvents(t, a, events)
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithMinModRev(12))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(5), resp.Count, "checking count")
+	for i, kv := range resp.Kvs {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i+5), string(kv.Key), "checking key")
+		assert.Equal(t, "v2", string(kv.Value), "checking value")
+	}
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithMinModRev(12), clientv3.WithLimit(2))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, int64(5), resp.Count, "checking count")
+	assert.True(t, resp.More, "checking more")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithMaxCreateRev(4), clientv3.WithCountOnly())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 0, "checking number of kvs")
+	assert.Equal(t, int64(3), resp.Count, "checking count")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(),
+		clientv3.WithMinCreateRev(5), clientv3.WithMaxModRev(11))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Count, "checking count")
+	assert.Equal(t, "/apisix/routes/3", string(resp.Kvs[0].Key), "checking key")
+	assert.Equal(t, "/apisix/routes/4", string(resp.Kvs[1].Key), "checking key")
+}
+
+func TestEtcdAdapterRangeRevision(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(2))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Kvs, 1, "checking number of kvs")
+	assert.Equal(t, "v1", string(resp.Kvs[0].Value), "checking value")
+
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(4))
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "v2", string(resp.Kvs[0].Value), "checking value")
+
+	_, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(5))
+	assert.Equal(t, rpctypes.ErrFutureRev, err, "checking error")
+}
+
+func TestEtcdAdapterRangeFromKey(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	var events []*Event
+	for _, kind := range []string{"routes", "services", "upstreams"} {
+		for i := 0; i < 50; i++ {
+			events = append(events, &Event{
+				Key:   fmt.Sprintf("/apisix/%s/%02d", kind, i),
+				Value: []byte("value"),
+				Type:  EventAdd,
+			})
+		}
+	}
+	sendEvents(t, a, events)
+
+	resp, err := client.Get(context.Background(), "", clientv3.WithFromKey(), clientv3.WithCountOnly())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(150), resp.Count, "checking count")
+
+	resp, err = client.Get(context.Background(), "/apisix/services/", clientv3.WithFromKey(), clientv3.WithCountOnly())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(100), resp.Count, "checking count")
+
+	// Walk through the whole keyspace in pages.
+	var keys []string
+	key := ""
+	for {
+		resp, err := client.Get(context.Background(), key, clientv3.WithFromKey(), clientv3.WithLimit(7))
+		assert.Nil(t, err, "checking error")
+		for _, kv := range resp.Kvs {
+			keys = append(keys, string(kv.Key))
+		}
+		if !resp.More {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	assert.Len(t, keys, 150, "checking number of keys")
+	for i, ev := range events {
+		assert.Equal(t, ev.Key, keys[i], "checking key")
+	}
+}
+
+func TestEtcdAdapterPut(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	resp, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 1, "checking number of kvs")
+	assert.Equal(t, "v2", string(getResp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(2), getResp.Kvs[0].CreateRevision, "checking create revision")
+	assert.Equal(t, int64(3), getResp.Kvs[0].ModRevision, "checking mod revision")
+	assert.Equal(t, int64(2), getResp.Kvs[0].Version, "checking version")
+
+	var values []string
+	for len(values) < 2 {
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			for _, ev := range wresp.Events {
+				assert.Equal(t, clientv3.EventTypePut, ev.Type, "checking event type")
+				values = append(values, string(ev.Kv.Value))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+	assert.Equal(t, []string{"v1", "v2"}, values, "checking watched values")
+
+	ev := <-a.OutboundCh()
+	assert.Equal(t, &Event{Key: "/apisix/routes/1", Value: []byte("v1"), Type: EventAdd}, ev, "checking outbound event")
+	ev = <-a.OutboundCh()
+	assert.Equal(t, &Event{Key: "/apisix/routes/1", Value: []byte("v2"), Type: EventUpdate}, ev, "checking outbound event")
+}
+
+func TestEtcdAdapterPutPrevKV(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	resp, err := client.Put(context.Background(), "/apisix/routes/1", "v1", clientv3.WithPrevKV())
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, resp.PrevKv, "checking prev kv")
+
+	resp, err = client.Put(context.Background(), "/apisix/routes/1", "v2", clientv3.WithPrevKV())
+	assert.Nil(t, err, "checking error")
+	assert.NotNil(t, resp.PrevKv, "checking prev kv")
+	assert.Equal(t, "/apisix/routes/1", string(resp.PrevKv.Key), "checking prev key")
+	assert.Equal(t, "v1", string(resp.PrevKv.Value), "checking prev value")
+	assert.Equal(t, int64(2), resp.PrevKv.CreateRevision, "checking prev create revision")
+	assert.Equal(t, int64(2), resp.PrevKv.ModRevision, "checking prev mod revision")
+	assert.Equal(t, int64(1), resp.PrevKv.Version, "checking prev version")
+
+	resp, err = client.Put(context.Background(), "/apisix/routes/1", "v3")
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, resp.PrevKv, "checking prev kv without asking")
+
+	resp, err = client.Put(context.Background(), "/apisix/routes/2", "v1", clientv3.WithPrevKV())
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, resp.PrevKv, "checking prev kv of the missing key")
+}
+
+func TestEtcdAdapterPutIgnoreValueAndLease(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+
+	_, err := kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:         []byte("/apisix/routes/1"),
+		IgnoreValue: true,
+	})
+	assert.Equal(t, rpctypes.ErrGRPCKeyNotFound.Error(), err.Error(), "checking error")
+	_, err = kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:         []byte("/apisix/routes/1"),
+		IgnoreLease: true,
+	})
+	assert.Equal(t, rpctypes.ErrGRPCKeyNotFound.Error(), err.Error(), "checking error")
+
+	lease := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+	for _, id := range []int64{100, 200} {
+		_, err = lease.LeaseGrant(context.Background(), &etcdserverpb.LeaseGrantRequest{
+			ID:  id,
+			TTL: 60,
+		})
+		assert.Nil(t, err, "checking error")
+	}
+	_, err = kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:   []byte("/apisix/routes/1"),
+		Value: []byte("v1"),
+		Lease: 100,
+	})
+	assert.Nil(t, err, "checking error")
+
+	resp, err := kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:         []byte("/apisix/routes/1"),
+		Lease:       200,
+		IgnoreValue: true,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v1", string(getResp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(200), getResp.Kvs[0].Lease, "checking lease")
+	assert.Equal(t, int64(3), getResp.Kvs[0].ModRevision, "checking mod revision")
+
+	_, err = kv.Put(context.Background(), &etcdserverpb.PutRequest{
+		Key:         []byte("/apisix/routes/1"),
+		Value:       []byte("v2"),
+		IgnoreLease: true,
+	})
+	assert.Nil(t, err, "checking error")
+
+	getResp, err = client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v2", string(getResp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(200), getResp.Kvs[0].Lease, "checking lease")
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "", clientv3.WithIgnoreValue(), clientv3.WithIgnoreLease())
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "", clientv3.WithIgnoreValue())
+	assert.Equal(t, rpctypes.ErrKeyNotFound, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v3", clientv3.WithIgnoreValue())
+	assert.Equal(t, rpctypes.ErrValueProvided, err, "checking error")
+}
+
+func TestEtcdAdapterDeleteRange(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/consumers/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/consumers/2",
+			Value: []byte("2"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/consumers/", clientv3.WithPrefix(), clientv3.WithRev(5), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	resp, err := client.Delete(context.Background(), "/apisix/consumers/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Deleted, "checking deleted")
+	assert.Equal(t, int64(5), resp.Header.Revision, "checking revision")
+
+	getResp, err := client.Get(context.Background(), "/apisix/consumers/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 0, "checking number of kvs")
+	getResp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 1, "checking number of kvs")
+
+	var deleted []string
+	for len(deleted) < 2 {
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			for _, ev := range wresp.Events {
+				assert.Equal(t, clientv3.EventTypeDelete, ev.Type, "checking event type")
+				deleted = append(deleted, string(ev.Kv.Key))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+	assert.Equal(t, []string{"/apisix/consumers/1", "/apisix/consumers/2"}, deleted, "checking deleted keys")
+
+	assert.Equal(t, &Event{Key: "/apisix/consumers/1", Type: EventDelete}, <-a.OutboundCh(), "checking outbound event")
+	assert.Equal(t, &Event{Key: "/apisix/consumers/2", Type: EventDelete}, <-a.OutboundCh(), "checking outbound event")
+
+	resp, err = client.Delete(context.Background(), "/apisix/consumers/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), resp.Deleted, "checking deleted")
+	assert.Equal(t, int64(5), resp.Header.Revision, "checking revision")
+
+	resp, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), resp.Deleted, "checking deleted")
+	assert.Equal(t, int64(6), resp.Header.Revision, "checking revision")
+}
+
+func TestEtcdAdapterDeleteRangePrevKVs(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for _, key := range []string{"/apisix/consumers/2", "/apisix/consumers/1", "/apisix/routes/1"} {
+		_, err := client.Put(context.Background(), key, "v1")
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := client.Put(context.Background(), "/apisix/consumers/2", "v2")
+	assert.Nil(t, err, "checking error")
+
+	resp, err := client.Delete(context.Background(), "/apisix/consumers/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Deleted, "checking deleted")
+	assert.Len(t, resp.PrevKvs, 2, "checking number of prev kvs")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/consumers/1"),
+		CreateRevision: 3,
+		ModRevision:    3,
+		Version:        1,
+		Value:          []byte("v1"),
+	}, resp.PrevKvs[0], "checking prev kv")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/consumers/2"),
+		CreateRevision: 2,
+		ModRevision:    5,
+		Version:        2,
+		Value:          []byte("v2"),
+	}, resp.PrevKvs[1], "checking prev kv")
+
+	resp, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.PrevKvs, 0, "checking prev kvs without asking")
+}
+
+func TestEtcdAdapterTxn(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	key := "/apisix/routes/1"
+	createIfNotExists := func(value string) *clientv3.TxnResponse {
+		resp, err := client.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value)).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		assert.Nil(t, err, "checking error")
+		return resp
+	}
+
+	resp := createIfNotExists("v1")
+	assert.True(t, resp.Succeeded, "checking succeeded")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Responses, 1, "checking responses")
+	assert.Equal(t, int64(2), resp.Responses[0].GetResponsePut().Header.Revision, "checking put revision")
+
+	resp = createIfNotExists("v2")
+	assert.False(t, resp.Succeeded, "checking succeeded")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	rangeResp := resp.Responses[0].GetResponseRange()
+	assert.Len(t, rangeResp.Kvs, 1, "checking number of kvs")
+	assert.Equal(t, "v1", string(rangeResp.Kvs[0].Value), "checking value")
+
+	// Optimistic concurrency with the mod revision.
+	resp, err := client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", 2)).
+		Then(clientv3.OpPut(key, "v2"), clientv3.OpPut("/apisix/routes/2", "v1"), clientv3.OpDelete("/apisix/routes/3")).
+		Commit()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Succeeded, "checking succeeded")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Responses, 3, "checking responses")
+	assert.Equal(t, int64(0), resp.Responses[2].GetResponseDeleteRange().Deleted, "checking deleted")
+
+	resp, err = client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", 2)).
+		Then(clientv3.OpPut(key, "v3")).
+		Commit()
+	assert.Nil(t, err, "checking error")
+	assert.False(t, resp.Succeeded, "checking succeeded")
+	assert.Len(t, resp.Responses, 0, "checking responses")
+
+	cases := []struct {
+		name      string
+		cmp       clientv3.Cmp
+		succeeded bool
+	}{
+		{
+			name:      "value equal",
+			cmp:       clientv3.Compare(clientv3.Value(key), "=", "v2"),
+			succeeded: true,
+		},
+		{
+			name:      "value not equal",
+			cmp:       clientv3.Compare(clientv3.Value(key), "!=", "v2"),
+			succeeded: false,
+		},
+		{
+			name:      "value of missing key",
+			cmp:       clientv3.Compare(clientv3.Value("/apisix/routes/3"), "!=", "v2"),
+			succeeded: false,
+		},
+		{
+			name:      "version greater",
+			cmp:       clientv3.Compare(clientv3.Version(key), ">", 1),
+			succeeded: true,
+		},
+		{
+			name:      "create revision less",
+			cmp:       clientv3.Compare(clientv3.CreateRevision(key), "<", 2),
+			succeeded: false,
+		},
+		{
+			name:      "lease equal",
+			cmp:       clientv3.Compare(clientv3.LeaseValue(key), "=", clientv3.NoLease),
+			succeeded: true,
+		},
+		{
+			name:      "mod revision of prefix",
+			cmp:       clientv3.Compare(clientv3.ModRevision("/apisix/routes/"), "=", 3).WithPrefix(),
+			succeeded: true,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Txn(context.Background()).If(tc.cmp).Commit()
+			assert.Nil(t, err, "checking error")
+			assert.Equal(t, tc.succeeded, resp.Succeeded, "checking succeeded")
+		})
+	}
+
+	getResp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), getResp.Header.Revision, "checking revision")
+	assert.Len(t, getResp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "v2", string(getResp.Kvs[0].Value), "checking value")
+
+	// The transaction isn't applied if any operation is invalid.
+	_, err = client.Txn(context.Background()).
+		Then(clientv3.OpPut("/apisix/routes/3", "v1"), clientv3.OpPut("/apisix/routes/4", "", clientv3.WithIgnoreValue())).
+		Commit()
+	assert.Equal(t, rpctypes.ErrKeyNotFound, err, "checking error")
+	getResp, err = client.Get(context.Background(), "/apisix/routes/3")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 0, "checking number of kvs")
+	assert.Equal(t, int64(3), getResp.Header.Revision, "checking revision")
+}
+
+func TestEtcdAdapterNestedTxn(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+
+	// The outer compare succeeds, but the inner one fails.
+	resp, err := kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{
+			{
+				Key:         []byte("/apisix/routes/1"),
+				Target:      etcdserverpb.Compare_VALUE,
+				Result:      etcdserverpb.Compare_EQUAL,
+				TargetUnion: &etcdserverpb.Compare_Value{Value: []byte("v1")},
+			},
+		},
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestPut{
+					RequestPut: &etcdserverpb.PutRequest{
+						Key:   []byte("/apisix/routes/1"),
+						Value: []byte("v2"),
+					},
+				},
+			},
+			{
+				Request: &etcdserverpb.RequestOp_RequestTxn{
+					RequestTxn: &etcdserverpb.TxnRequest{
+						Compare: []*etcdserverpb.Compare{
+							{
+								Key:         []byte("/apisix/routes/2"),
+								Target:      etcdserverpb.Compare_VERSION,
+								Result:      etcdserverpb.Compare_GREATER,
+								TargetUnion: &etcdserverpb.Compare_Version{Version: 0},
+							},
+						},
+						Success: []*etcdserverpb.RequestOp{
+							{
+								Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+									RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{
+										Key: []byte("/apisix/routes/3"),
+									},
+								},
+							},
+						},
+						Failure: []*etcdserverpb.RequestOp{
+							{
+								Request: &etcdserverpb.RequestOp_RequestPut{
+									RequestPut: &etcdserverpb.PutRequest{
+										Key:   []byte("/apisix/routes/2"),
+										Value: []byte("v1"),
+									},
+								},
+							},
+							{
+								Request: &etcdserverpb.RequestOp_RequestRange{
+									RequestRange: &etcdserverpb.RangeRequest{
+										Key:      []byte("/apisix/routes/"),
+										RangeEnd: []byte("/apisix/routes0"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Succeeded, "checking succeeded")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+	assert.Len(t, resp.Responses, 2, "checking responses")
+	inner := resp.Responses[1].GetResponseTxn()
+	assert.NotNil(t, inner, "checking nested txn response")
+	assert.False(t, inner.Succeeded, "checking nested succeeded")
+	assert.Equal(t, int64(3), inner.Header.Revision, "checking nested revision")
+	assert.Len(t, inner.Responses, 2, "checking nested responses")
+	rangeResp := inner.Responses[1].GetResponseRange()
+	assert.Len(t, rangeResp.Kvs, 2, "checking number of kvs")
+	assert.Equal(t, "v2", string(rangeResp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(3), rangeResp.Kvs[0].ModRevision, "checking mod revision")
+	assert.Equal(t, int64(3), rangeResp.Kvs[1].ModRevision, "checking mod revision")
+
+	// Too deep nested transactions are rejected.
+	txn := &etcdserverpb.TxnRequest{}
+	for i := 0; i < 20; i++ {
+		txn = &etcdserverpb.TxnRequest{
+			Success: []*etcdserverpb.RequestOp{
+				{
+					Request: &etcdserverpb.RequestOp_RequestTxn{
+						RequestTxn: txn,
+					},
+				},
+			},
+		}
+	}
+	_, err = kv.Txn(context.Background(), txn)
+	assert.Equal(t, rpctypes.ErrGRPCTooManyOps.Error(), err.Error(), "checking error")
+
+	// The nested compares see the state before the transaction, not the
+	// changes made by the operations before them.
+	resp, err = kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestPut{
+					RequestPut: &etcdserverpb.PutRequest{
+						Key:   []byte("/apisix/routes/1"),
+						Value: []byte("v3"),
+					},
+				},
+			},
+			{
+				Request: &etcdserverpb.RequestOp_RequestTxn{
+					RequestTxn: &etcdserverpb.TxnRequest{
+						Compare: []*etcdserverpb.Compare{
+							{
+								Key:         []byte("/apisix/routes/1"),
+								Target:      etcdserverpb.Compare_VALUE,
+								Result:      etcdserverpb.Compare_EQUAL,
+								TargetUnion: &etcdserverpb.Compare_Value{Value: []byte("v2")},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Responses[1].GetResponseTxn().Succeeded, "checking nested succeeded")
+
+	// The nested put ignoring the value of the key deleted before it is
+	// rejected before anything is applied.
+	_, err = kv.Txn(context.Background(), &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{
+			{
+				Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+					RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{
+						Key: []byte("/apisix/routes/1"),
+					},
+				},
+			},
+			{
+				Request: &etcdserverpb.RequestOp_RequestTxn{
+					RequestTxn: &etcdserverpb.TxnRequest{
+						Success: []*etcdserverpb.RequestOp{
+							{
+								Request: &etcdserverpb.RequestOp_RequestPut{
+									RequestPut: &etcdserverpb.PutRequest{
+										Key:         []byte("/apisix/routes/1"),
+										IgnoreValue: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.Equal(t, rpctypes.ErrGRPCDuplicateKey.Error(), err.Error(), "checking error")
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), getResp.Header.Revision, "checking revision")
+	if assert.Len(t, getResp.Kvs, 1, "checking kvs") {
+		assert.Equal(t, "v3", string(getResp.Kvs[0].Value), "checking value")
+	}
+}
+
+func TestEtcdAdapterTxnDuplicateKey(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+
+	put := func(key string) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{
+			Request: &etcdserverpb.RequestOp_RequestPut{
+				RequestPut: &etcdserverpb.PutRequest{
+					Key:   []byte(key),
+					Value: []byte("v1"),
+				},
+			},
+		}
+	}
+	del := func(key, end string) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{
+			Request: &etcdserverpb.RequestOp_RequestDeleteRange{
+				RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{
+					Key:      []byte(key),
+					RangeEnd: []byte(end),
+				},
+			},
+		}
+	}
+	nested := func(success, failure []*etcdserverpb.RequestOp) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{
+			Request: &etcdserverpb.RequestOp_RequestTxn{
+				RequestTxn: &etcdserverpb.TxnRequest{
+					Success: success,
+					Failure: failure,
+				},
+			},
+		}
+	}
+	cases := []struct {
+		name      string
+		ops       []*etcdserverpb.RequestOp
+		duplicate bool
+	}{
+		{
+			name:      "put twice",
+			ops:       []*etcdserverpb.RequestOp{put("/apisix/routes/1"), put("/apisix/routes/1")},
+			duplicate: true,
+		},
+		{
+			name:      "put and delete",
+			ops:       []*etcdserverpb.RequestOp{put("/apisix/routes/1"), del("/apisix/routes/", "/apisix/routes0")},
+			duplicate: true,
+		},
+		{
+			name:      "delete and nested put",
+			ops:       []*etcdserverpb.RequestOp{del("/apisix/routes/1", ""), nested([]*etcdserverpb.RequestOp{put("/apisix/routes/1")}, nil)},
+			duplicate: true,
+		},
+		{
+			name: "put in nested txns",
+			ops: []*etcdserverpb.RequestOp{
+				nested([]*etcdserverpb.RequestOp{put("/apisix/routes/1")}, nil),
+				nested(nil, []*etcdserverpb.RequestOp{put("/apisix/routes/1")}),
+			},
+			duplicate: true,
+		},
+		{
+			name: "delete twice",
+			ops:  []*etcdserverpb.RequestOp{del("/apisix/routes/1", ""), del("/apisix/routes/", "\x00")},
+		},
+		{
+			name: "put in both branches",
+			ops: []*etcdserverpb.RequestOp{
+				nested([]*etcdserverpb.RequestOp{put("/apisix/routes/1")}, []*etcdserverpb.RequestOp{put("/apisix/routes/1")}),
+			},
+		},
+	}
+	for _, tc := range cases {
+		// The request is rejected even if the branch is not chosen.
+		for _, failure := range []bool{false, true} {
+			r := &etcdserverpb.TxnRequest{Success: tc.ops}
+			if failure {
+				r = &etcdserverpb.TxnRequest{Failure: tc.ops}
+			}
+			_, err := kv.Txn(context.Background(), r)
+			if tc.duplicate {
+				assert.Equal(t, rpctypes.ErrGRPCDuplicateKey.Error(), err.Error(), "checking %s error", tc.name)
+			} else {
+				assert.Nil(t, err, "checking %s error", tc.name)
+			}
+		}
+	}
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+}
+
+func TestEtcdAdapterTxnWatch(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/3", "v1")
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(3), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	resp, err := client.Txn(context.Background()).
+		Then(
+			clientv3.OpPut("/apisix/routes/1", "v1"),
+			clientv3.OpPut("/apisix/routes/2", "v1"),
+			clientv3.OpDelete("/apisix/routes/3"),
+		).
+		Commit()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+
+	select {
+	case wresp := <-wch:
+		assert.Nil(t, wresp.Err(), "checking watch error")
+		assert.Equal(t, int64(3), wresp.Header.Revision, "checking header revision")
+		assert.Len(t, wresp.Events, 3, "checking number of events")
+		for _, ev := range wresp.Events {
+			assert.Equal(t, int64(3), ev.Kv.ModRevision, "checking event revision")
+		}
+		assert.Equal(t, clientv3.EventTypeDelete, wresp.Events[2].Type, "checking event type")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch events")
+	}
+
+	select {
+	case wresp := <-wch:
+		t.Fatalf("unexpected watch response: %v", wresp)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestEtcdAdapterCompact(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for _, value := range []string{"v1", "v2", "v3", "v4"} {
+		_, err := client.Put(context.Background(), "/apisix/routes/1", value)
+		assert.Nil(t, err, "checking error")
+	}
+
+	_, err := client.Compact(context.Background(), 6)
+	assert.Equal(t, rpctypes.ErrFutureRev, err, "checking error")
+
+	resp, err := client.Compact(context.Background(), 4)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(5), resp.Header.Revision, "checking revision")
+
+	_, err = client.Compact(context.Background(), 4)
+	assert.Equal(t, rpctypes.ErrCompacted, err, "checking error")
+
+	_, err = client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(3))
+	assert.Equal(t, rpctypes.ErrCompacted, err, "checking error")
+
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1", clientv3.WithRev(4))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v3", string(getResp.Kvs[0].Value), "checking value")
+
+	getResp, err = client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v4", string(getResp.Kvs[0].Value), "checking value")
+	assert.Equal(t, int64(4), getResp.Kvs[0].Version, "checking version")
+}
+
+func TestEtcdAdapterVersion(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	key := "/apisix/routes/1"
+	checkVersion := func(version int64) {
+		resp, err := client.Get(context.Background(), key)
+		assert.Nil(t, err, "checking error")
+		if version == 0 {
+			assert.Len(t, resp.Kvs, 0, "checking number of kvs")
+			return
+		}
+		assert.Len(t, resp.Kvs, 1, "checking number of kvs")
+		assert.Equal(t, version, resp.Kvs[0].Version, "checking version")
+	}
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   key,
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+	checkVersion(1)
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   key,
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+		{
+			Key:   key,
+			Value: []byte("v3"),
+			Type:  EventUpdate,
+		},
+	})
+	checkVersion(3)
+
+	putResp, err := client.Put(context.Background(), key, "v4", clientv3.WithPrevKV())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), putResp.PrevKv.Version, "checking prev version")
+	checkVersion(4)
+
+	txnResp, err := client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.Version(key), "=", 4)).
+		Then(clientv3.OpPut(key, "v5")).
+		Commit()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, txnResp.Succeeded, "checking succeeded")
+	checkVersion(5)
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:  key,
+			Type: EventDelete,
+		},
+	})
+	checkVersion(0)
+
+	// The version is reset when the key is created again.
+	sendEvents(t, a, []*Event{
+		{
+			Key:   key,
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+	checkVersion(1)
+}
@@ -0,0 +1,130 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"io"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// leaseServer implements the etcdserverpb.LeaseServer with the lessor, the
+// RPCs which are not supported yet are served by the kine bridge.
+type leaseServer struct {
+	etcdserverpb.LeaseServer
+
+	lessor *lessor
+	// drain is closed when the adapter is shutting down.
+	drain <-chan struct{}
+}
+
+func (s *leaseServer) LeaseGrant(ctx context.Context, r *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
+	id, ttl, err := s.lessor.grant(r.ID, r.TTL)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.LeaseGrantResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: s.lessor.backend.CurrentRevision(),
+		},
+		ID:  id,
+		TTL: ttl,
+	}, nil
+}
+
+func (s *leaseServer) LeaseRevoke(ctx context.Context, r *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
+	rev, err := s.lessor.revoke(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.LeaseRevokeResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+	}, nil
+}
+
+// LeaseKeepAlive renews the leases requested over the stream, the unknown or
+// expired leases get a response with zero TTL. The leases aren't revoked when
+// the stream goes away, they just expire if no one keeps them alive. The
+// stream ends when the adapter is shutting down, so that the client turns to
+// the other endpoints.
+func (s *leaseServer) LeaseKeepAlive(stream etcdserverpb.Lease_LeaseKeepAliveServer) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.keepAlive(stream)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-s.drain:
+		return rpctypes.ErrGRPCStopped
+	}
+}
+
+func (s *leaseServer) keepAlive(stream etcdserverpb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp := &etcdserverpb.LeaseKeepAliveResponse{
+			Header: &etcdserverpb.ResponseHeader{
+				Revision: s.lessor.backend.CurrentRevision(),
+			},
+			ID:  req.ID,
+			TTL: s.lessor.renew(req.ID),
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *leaseServer) LeaseTimeToLive(ctx context.Context, r *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	granted, ttl, keys, err := s.lessor.timeToLive(ctx, r.ID, r.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.LeaseTimeToLiveResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: s.lessor.backend.CurrentRevision(),
+		},
+		ID:         r.ID,
+		TTL:        ttl,
+		GrantedTTL: granted,
+		Keys:       keys,
+	}, nil
+}
+
+func (s *leaseServer) LeaseLeases(ctx context.Context, r *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
+	ids := s.lessor.list()
+	leases := make([]*etcdserverpb.LeaseStatus, 0, len(ids))
+	for _, id := range ids {
+		leases = append(leases, &etcdserverpb.LeaseStatus{ID: id})
+	}
+	return &etcdserverpb.LeaseLeasesResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: s.lessor.backend.CurrentRevision(),
+		},
+		Leases: leases,
+	}, nil
+}
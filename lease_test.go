@@ -0,0 +1,219 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// advanceLeases moves the fake clock forward, and waits until the expired
+// leases are revoked, as the next tick is received after that.
+func advanceLeases(clock *fakeClock, d time.Duration) {
+	clock.Advance(d)
+	clock.Advance(leaseExpiryCheckInterval)
+}
+
+func TestEtcdAdapterLeaseExpiry(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	lease, err := client.Grant(context.Background(), 1)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), lease.TTL, "checking ttl")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1", clientv3.WithLease(lease.ID))
+	assert.Nil(t, err, "checking error")
+
+	var events []*clientv3.Event
+	for len(events) < 2 {
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			events = append(events, wresp.Events...)
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for the lease expiry")
+		}
+	}
+	assert.Equal(t, clientv3.EventTypePut, events[0].Type, "checking event type")
+	assert.Equal(t, int64(lease.ID), events[0].Kv.Lease, "checking lease")
+	assert.Equal(t, clientv3.EventTypeDelete, events[1].Type, "checking event type")
+	assert.Equal(t, int64(3), events[1].Kv.ModRevision, "checking revision")
+
+	_, err = client.Revoke(context.Background(), lease.ID)
+	assert.Equal(t, rpctypes.ErrLeaseNotFound, err, "checking error")
+}
+
+func TestEtcdAdapterLeaseRevoke(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1", clientv3.WithLease(100))
+	assert.Equal(t, rpctypes.ErrLeaseNotFound, err, "checking error")
+
+	lease, err := client.Grant(context.Background(), 60)
+	assert.Nil(t, err, "checking error")
+	for _, key := range []string{"/apisix/routes/1", "/apisix/upstreams/1"} {
+		_, err = client.Put(context.Background(), key, "v1", clientv3.WithLease(lease.ID))
+		assert.Nil(t, err, "checking error")
+	}
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "v1")
+	assert.Nil(t, err, "checking error")
+
+	resp, err := client.Revoke(context.Background(), lease.ID)
+	assert.Nil(t, err, "checking error")
+	// All the keys are deleted in one revision.
+	assert.Equal(t, int64(5), resp.Header.Revision, "checking revision")
+	getResp, err := client.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 1, "checking key-values")
+	assert.Equal(t, "/apisix/routes/2", string(getResp.Kvs[0].Key), "checking key")
+
+	// The lease id chosen by the client is respected.
+	grantResp, err := etcdserverpb.NewLeaseClient(client.ActiveConnection()).LeaseGrant(context.Background(), &etcdserverpb.LeaseGrantRequest{
+		ID:  100,
+		TTL: 60,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(100), grantResp.ID, "checking lease id")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1", clientv3.WithLease(100))
+	assert.Nil(t, err, "checking error")
+}
+
+func TestEtcdAdapterLeaseKeepAlive(t *testing.T) {
+	clock := newFakeClock()
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+	})
+	defer shutdown()
+	clock.BlockUntil(1)
+
+	lease, err := client.Grant(context.Background(), 2)
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1", clientv3.WithLease(lease.ID))
+	assert.Nil(t, err, "checking error")
+
+	// The lease outlives its TTL as long as it's kept alive.
+	for i := 0; i < 3; i++ {
+		advanceLeases(clock, time.Second)
+		resp, err := client.KeepAliveOnce(context.Background(), lease.ID)
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, int64(2), resp.TTL, "checking ttl")
+	}
+	getResp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 1, "checking key-values")
+
+	// The streaming keepalive responds with the TTL of the lease.
+	streamed, err := client.Grant(context.Background(), 2)
+	assert.Nil(t, err, "checking error")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := client.KeepAlive(ctx, streamed.ID)
+	assert.Nil(t, err, "checking error")
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-ch:
+			assert.NotNil(t, resp, "checking keepalive response")
+			assert.Equal(t, int64(2), resp.TTL, "checking ttl")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the keepalive response")
+		}
+	}
+	cancel()
+
+	// The lease expires after the client stops keeping it alive.
+	advanceLeases(clock, 3*time.Second)
+	getResp, err = client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 0, "checking key-values")
+
+	// The lease not found is kept alive with a zero TTL like ETCD, which the
+	// client reports as ErrLeaseNotFound.
+	resp, err := client.KeepAliveOnce(context.Background(), 100)
+	assert.Equal(t, rpctypes.ErrLeaseNotFound, err, "checking error")
+	assert.Equal(t, int64(0), resp.TTL, "checking ttl")
+}
+
+func TestEtcdAdapterLeaseTimeToLive(t *testing.T) {
+	clock := newFakeClock()
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+	})
+	defer shutdown()
+	clock.BlockUntil(1)
+
+	lease, err := client.Grant(context.Background(), 1)
+	assert.Nil(t, err, "checking error")
+	resp, err := client.TimeToLive(context.Background(), lease.ID, clientv3.WithAttachedKeys())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), resp.GrantedTTL, "checking granted ttl")
+	assert.Len(t, resp.Keys, 0, "checking keys")
+
+	for _, key := range []string{"/apisix/routes/1", "/apisix/upstreams/1"} {
+		_, err = client.Put(context.Background(), key, "v1", clientv3.WithLease(lease.ID))
+		assert.Nil(t, err, "checking error")
+	}
+	resp, err = client.TimeToLive(context.Background(), lease.ID, clientv3.WithAttachedKeys())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, [][]byte{[]byte("/apisix/routes/1"), []byte("/apisix/upstreams/1")}, resp.Keys, "checking keys")
+
+	advanceLeases(clock, 2*time.Second)
+	resp, err = client.TimeToLive(context.Background(), lease.ID, clientv3.WithAttachedKeys())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(-1), resp.TTL, "checking ttl")
+	assert.Len(t, resp.Keys, 0, "checking keys")
+}
+
+func TestEtcdAdapterLeaseLeases(t *testing.T) {
+	clock := newFakeClock()
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+	})
+	defer shutdown()
+	clock.BlockUntil(1)
+
+	resp, err := client.Leases(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Leases, 0, "checking leases")
+
+	var ids []int64
+	for _, ttl := range []int64{60, 1} {
+		lease, err := client.Grant(context.Background(), ttl)
+		assert.Nil(t, err, "checking error")
+		ids = append(ids, int64(lease.ID))
+	}
+	resp, err = client.Leases(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Leases, 2, "checking leases")
+	assert.Len(t, a.Leases(), 2, "checking leases")
+
+	advanceLeases(clock, 2*time.Second)
+	resp, err = client.Leases(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Leases, 1, "checking leases")
+	assert.Equal(t, ids[0], int64(resp.Leases[0].ID), "checking lease id")
+	assert.Equal(t, []int64{ids[0]}, a.Leases(), "checking leases")
+}
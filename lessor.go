@@ -0,0 +1,338 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+const (
+	// maxLeaseTTL is the max TTL of a lease in seconds, it's same as ETCD.
+	maxLeaseTTL = 9000000000
+	// leaseExpiryCheckInterval is the interval to look for the expired
+	// leases.
+	leaseExpiryCheckInterval = 500 * time.Millisecond
+)
+
+// lease is a lease granted by the lessor, keys are the ones attached to it.
+type lease struct {
+	id     int64
+	ttl    int64
+	expiry time.Time
+	keys   map[string]struct{}
+}
+
+// lessor manages the leases, the keys attached to a lease are deleted when
+// the lease is revoked or expired, just like they're deleted by the clients.
+type lessor struct {
+	backend backends.Backend
+	logger  *zap.Logger
+	clock   Clock
+	// notify is called when the keys are deleted.
+	notify func(*Event)
+
+	mu     sync.Mutex
+	leases map[int64]*lease
+}
+
+func newLessor(backend backends.Backend, logger *zap.Logger, clock Clock, notify func(*Event)) *lessor {
+	return &lessor{
+		backend: backend,
+		logger:  logger,
+		clock:   clock,
+		notify:  notify,
+		leases:  make(map[int64]*lease),
+	}
+}
+
+// grant grants a lease with the TTL in seconds, an id is chosen if it's
+// zero. It returns the id and the TTL of the lease.
+func (le *lessor) grant(id, ttl int64) (int64, int64, error) {
+	if ttl > maxLeaseTTL {
+		return 0, 0, rpctypes.ErrGRPCLeaseTTLTooLarge
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if _, ok := le.leases[id]; ok {
+		return 0, 0, rpctypes.ErrGRPCLeaseExist
+	}
+	return le.grantLocked(id, ttl).id, ttl, nil
+}
+
+func (le *lessor) grantLocked(id, ttl int64) *lease {
+	for id == 0 || le.leases[id] != nil {
+		id = rand.Int63()
+	}
+	l := &lease{
+		id:     id,
+		ttl:    ttl,
+		expiry: le.clock.Now().Add(time.Duration(ttl) * time.Second),
+		keys:   make(map[string]struct{}),
+	}
+	le.leases[id] = l
+	return l
+}
+
+// keepAlive attaches the key to the lease and renews the lease, it's granted
+// with the TTL if it doesn't exist, a zero id means a new lease is wanted.
+// It returns the id of the lease.
+func (le *lessor) keepAlive(id, ttl int64, key []byte) (int64, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	l, ok := le.leases[id]
+	if ok {
+		l.expiry = le.clock.Now().Add(time.Duration(l.ttl) * time.Second)
+	} else {
+		if ttl < 1 {
+			return 0, rpctypes.ErrGRPCLeaseNotFound
+		}
+		if ttl > maxLeaseTTL {
+			return 0, rpctypes.ErrGRPCLeaseTTLTooLarge
+		}
+		l = le.grantLocked(id, ttl)
+	}
+	l.keys[string(key)] = struct{}{}
+	return l.id, nil
+}
+
+// revoke revokes the lease and deletes the keys attached to it in one
+// transaction. It returns the revision after the deletion.
+func (le *lessor) revoke(ctx context.Context, id int64) (int64, error) {
+	le.mu.Lock()
+	l, ok := le.leases[id]
+	if !ok {
+		le.mu.Unlock()
+		return 0, rpctypes.ErrGRPCLeaseNotFound
+	}
+	delete(le.leases, id)
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	le.mu.Unlock()
+
+	sort.Strings(keys)
+	txn := le.backend.Write(ctx)
+	defer txn.End()
+	for _, key := range keys {
+		res, err := txn.Range([]byte(key), nil, backends.RangeOptions{})
+		if err != nil {
+			return 0, err
+		}
+		// The key might have been overwritten without the lease, e.g. by
+		// the events fed from the EventCh.
+		if len(res.KVs) == 0 || res.KVs[0].Lease != id {
+			continue
+		}
+		txn.DeleteRange([]byte(key), nil)
+		le.notify(&Event{
+			Key:  key,
+			Type: EventDelete,
+		})
+	}
+	return txn.Rev(), nil
+}
+
+// renew refreshes the expiry of the lease, it returns the TTL of the lease,
+// or zero if the lease doesn't exist or is expired.
+func (le *lessor) renew(id int64) int64 {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	l, ok := le.leases[id]
+	if !ok {
+		return 0
+	}
+	now := le.clock.Now()
+	// The expired lease is going to be revoked, don't bring it back.
+	if !now.Before(l.expiry) {
+		return 0
+	}
+	l.expiry = now.Add(time.Duration(l.ttl) * time.Second)
+	return l.ttl
+}
+
+// timeToLive returns the granted TTL and the remaining TTL of the lease, the
+// remaining TTL is -1 if the lease doesn't exist or is expired. The keys
+// attached to the lease are also returned if withKeys is true.
+func (le *lessor) timeToLive(ctx context.Context, id int64, withKeys bool) (int64, int64, [][]byte, error) {
+	le.mu.Lock()
+	l, ok := le.leases[id]
+	if !ok {
+		le.mu.Unlock()
+		return 0, -1, nil, nil
+	}
+	granted := l.ttl
+	remaining := l.expiry.Sub(le.clock.Now())
+	var keys []string
+	if withKeys {
+		keys = make([]string, 0, len(l.keys))
+		for key := range l.keys {
+			keys = append(keys, key)
+		}
+	}
+	le.mu.Unlock()
+
+	ttl := int64(remaining.Seconds())
+	if remaining <= 0 {
+		ttl = -1
+	}
+	if !withKeys {
+		return granted, ttl, nil, nil
+	}
+	sort.Strings(keys)
+	attached := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		res, err := le.backend.Range(ctx, []byte(key), nil, backends.RangeOptions{})
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		// Same as revoke, the key might not be attached anymore.
+		if len(res.KVs) == 0 || res.KVs[0].Lease != id {
+			continue
+		}
+		attached = append(attached, []byte(key))
+	}
+	return granted, ttl, attached, nil
+}
+
+// list returns the ids of the leases which aren't expired, sorted.
+func (le *lessor) list() []int64 {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	now := le.clock.Now()
+	ids := make([]int64, 0, len(le.leases))
+	for id, l := range le.leases {
+		if now.Before(l.expiry) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// snapshot returns the copies of the leases without the keys, sorted by the
+// ids.
+func (le *lessor) snapshot() []*lease {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	leases := make([]*lease, 0, len(le.leases))
+	for _, l := range le.leases {
+		leases = append(leases, &lease{
+			id:     l.id,
+			ttl:    l.ttl,
+			expiry: l.expiry,
+		})
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].id < leases[j].id
+	})
+	return leases
+}
+
+// restore grants the leases of a snapshot, they're renewed as if they're
+// just granted, and attaches the keys to them.
+func (le *lessor) restore(leases []*lease, kvs []*mvccpb.KeyValue) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	for _, l := range leases {
+		le.grantLocked(l.id, l.ttl)
+	}
+	for _, kv := range kvs {
+		if l, ok := le.leases[kv.Lease]; ok {
+			l.keys[string(kv.Key)] = struct{}{}
+		}
+	}
+}
+
+// exists checks whether the lease exists.
+func (le *lessor) exists(id int64) bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	_, ok := le.leases[id]
+	return ok
+}
+
+// attach attaches the key to the lease, it returns false if the lease
+// doesn't exist.
+func (le *lessor) attach(id int64, key []byte) bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	l, ok := le.leases[id]
+	if !ok {
+		return false
+	}
+	l.keys[string(key)] = struct{}{}
+	return true
+}
+
+// detach detaches the key from the lease.
+func (le *lessor) detach(id int64, key []byte) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if l, ok := le.leases[id]; ok {
+		delete(l.keys, string(key))
+	}
+}
+
+// run revokes the expired leases until the context is done.
+func (le *lessor) run(ctx context.Context) {
+	ticker := le.clock.NewTicker(leaseExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		for _, id := range le.expired(le.clock.Now()) {
+			if _, err := le.revoke(ctx, id); err != nil && err != rpctypes.ErrGRPCLeaseNotFound {
+				le.logger.Error("failed to revoke expired lease",
+					zap.Int64("lease", id),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// expired returns the ids of the leases which are expired at now.
+func (le *lessor) expired(now time.Time) []int64 {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	var ids []int64
+	for id, l := range le.leases {
+		if !now.Before(l.expiry) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
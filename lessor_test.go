@@ -0,0 +1,355 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+func TestLessorGrantAndRevoke(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	var events []*Event
+	le := newLessor(backend, zap.NewNop(), newFakeClock(), func(ev *Event) {
+		events = append(events, ev)
+	})
+
+	id, ttl, err := le.grant(100, 10)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(100), id, "checking lease id")
+	assert.Equal(t, int64(10), ttl, "checking ttl")
+	_, _, err = le.grant(100, 10)
+	assert.Equal(t, rpctypes.ErrGRPCLeaseExist, err, "checking error")
+	_, _, err = le.grant(0, maxLeaseTTL+1)
+	assert.Equal(t, rpctypes.ErrGRPCLeaseTTLTooLarge, err, "checking error")
+	id, _, err = le.grant(0, 10)
+	assert.Nil(t, err, "checking error")
+	assert.NotEqual(t, int64(0), id, "checking lease id")
+
+	txn := backend.Write(context.Background())
+	for _, key := range []string{"/apisix/routes/1", "/apisix/upstreams/1", "/apisix/routes/2"} {
+		assert.True(t, le.attach(100, []byte(key)), "checking attaching result")
+		txn.Put([]byte(key), []byte("v1"), 100)
+	}
+	assert.False(t, le.attach(200, []byte("/apisix/routes/1")), "checking attaching result")
+	txn.End()
+	// The key is overwritten without the lease.
+	txn = backend.Write(context.Background())
+	txn.Put([]byte("/apisix/routes/2"), []byte("v2"), 0)
+	txn.End()
+
+	rev, err := le.revoke(context.Background(), 100)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), rev, "checking revision")
+	_, err = le.revoke(context.Background(), 100)
+	assert.Equal(t, rpctypes.ErrGRPCLeaseNotFound, err, "checking error")
+
+	res, err := backend.Range(context.Background(), []byte("/apisix/"), []byte("/apisix0"), backends.RangeOptions{})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, res.KVs, 1, "checking key-values")
+	assert.Equal(t, "/apisix/routes/2", string(res.KVs[0].Key), "checking key")
+	assert.Equal(t, []*Event{
+		{
+			Key:  "/apisix/routes/1",
+			Type: EventDelete,
+		},
+		{
+			Key:  "/apisix/upstreams/1",
+			Type: EventDelete,
+		},
+	}, events, "checking events")
+}
+
+func TestLessorExpiry(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	clock := newFakeClock()
+	le := newLessor(backend, zap.NewNop(), clock, func(*Event) {})
+	ws := backend.NewWatchStream(backends.WatchStreamOptions{})
+	defer ws.Close()
+
+	_, err := ws.Watch(backends.AutoWatchID, []byte("/apisix/routes/1"), nil, 0)
+	assert.Nil(t, err, "checking error")
+	id, _, err := le.grant(0, 1)
+	assert.Nil(t, err, "checking error")
+	txn := backend.Write(context.Background())
+	assert.True(t, le.attach(id, []byte("/apisix/routes/1")), "checking attaching result")
+	txn.Put([]byte("/apisix/routes/1"), []byte("v1"), id)
+	txn.End()
+	<-ws.Chan()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go le.run(ctx)
+	clock.BlockUntil(1)
+
+	// The lease isn't expired in the first check.
+	clock.Advance(leaseExpiryCheckInterval)
+	assert.True(t, le.exists(id), "checking lease existence")
+	clock.Advance(leaseExpiryCheckInterval)
+	resp := <-ws.Chan()
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.DELETE, resp.Events[0].Type, "checking event type")
+	assert.False(t, le.exists(id), "checking lease existence")
+}
+
+func TestLessorRenew(t *testing.T) {
+	clock := newFakeClock()
+	le := newLessor(btree.NewBTreeCache(zap.NewNop()), zap.NewNop(), clock, func(*Event) {})
+
+	assert.Equal(t, int64(0), le.renew(100), "checking unknown lease")
+	id, _, err := le.grant(100, 60)
+	assert.Nil(t, err, "checking error")
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, int64(60), le.renew(id), "checking ttl")
+	clock.Advance(59 * time.Second)
+	assert.Len(t, le.expired(clock.Now()), 0, "checking expired leases")
+
+	clock.Advance(time.Second)
+	assert.Equal(t, int64(0), le.renew(id), "checking expired lease")
+	assert.Equal(t, []int64{id}, le.expired(clock.Now()), "checking expired leases")
+}
+
+func TestLessorTimeToLive(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	clock := newFakeClock()
+	le := newLessor(backend, zap.NewNop(), clock, func(*Event) {})
+
+	_, ttl, keys, err := le.timeToLive(context.Background(), 100, true)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(-1), ttl, "checking unknown lease")
+	assert.Nil(t, keys, "checking keys")
+
+	id, _, err := le.grant(100, 60)
+	assert.Nil(t, err, "checking error")
+	granted, ttl, keys, err := le.timeToLive(context.Background(), id, true)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(60), granted, "checking granted ttl")
+	assert.Equal(t, int64(60), ttl, "checking ttl")
+	assert.Len(t, keys, 0, "checking keys")
+
+	txn := backend.Write(context.Background())
+	for _, key := range []string{"/apisix/upstreams/1", "/apisix/routes/1", "/apisix/routes/2"} {
+		assert.True(t, le.attach(id, []byte(key)), "checking attaching result")
+		txn.Put([]byte(key), []byte("v1"), id)
+	}
+	// The key is overwritten without the lease.
+	txn.Put([]byte("/apisix/routes/2"), []byte("v2"), 0)
+	txn.End()
+	_, _, keys, err = le.timeToLive(context.Background(), id, true)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, [][]byte{[]byte("/apisix/routes/1"), []byte("/apisix/upstreams/1")}, keys, "checking keys")
+	_, _, keys, err = le.timeToLive(context.Background(), id, false)
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, keys, "checking keys")
+
+	clock.Advance(30 * time.Second)
+	_, ttl, _, err = le.timeToLive(context.Background(), id, false)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(30), ttl, "checking ttl")
+	clock.Advance(30 * time.Second)
+	granted, ttl, _, err = le.timeToLive(context.Background(), id, true)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(60), granted, "checking granted ttl")
+	assert.Equal(t, int64(-1), ttl, "checking expired lease")
+}
+
+func TestLessorList(t *testing.T) {
+	clock := newFakeClock()
+	le := newLessor(btree.NewBTreeCache(zap.NewNop()), zap.NewNop(), clock, func(*Event) {})
+	assert.Len(t, le.list(), 0, "checking leases")
+
+	for _, id := range []int64{300, 100, 200} {
+		_, _, err := le.grant(id, 60)
+		assert.Nil(t, err, "checking error")
+	}
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, int64(60), le.renew(100), "checking ttl")
+	assert.Equal(t, int64(60), le.renew(300), "checking ttl")
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, []int64{100, 300}, le.list(), "checking leases")
+}
+
+func TestLessorKeepAlive(t *testing.T) {
+	clock := newFakeClock()
+	le := newLessor(btree.NewBTreeCache(zap.NewNop()), zap.NewNop(), clock, func(*Event) {})
+
+	_, err := le.keepAlive(100, 0, []byte("/apisix/routes/1"))
+	assert.Equal(t, rpctypes.ErrGRPCLeaseNotFound, err, "checking error")
+	id, err := le.keepAlive(100, 60, []byte("/apisix/routes/1"))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(100), id, "checking lease id")
+
+	clock.Advance(time.Minute)
+	// The existing lease is renewed with its own TTL.
+	id, err = le.keepAlive(id, 1, []byte("/apisix/routes/2"))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(100), id, "checking lease id")
+	assert.Equal(t, int64(60), le.leases[id].ttl, "checking ttl")
+	assert.Len(t, le.expired(clock.Now()), 0, "checking expired leases")
+	assert.Len(t, le.leases[id].keys, 2, "checking keys")
+
+	id, err = le.keepAlive(0, 1, []byte("/apisix/routes/3"))
+	assert.Nil(t, err, "checking error")
+	assert.NotEqual(t, int64(0), id, "checking lease id")
+	assert.NotEqual(t, int64(100), id, "checking lease id")
+}
+
+func TestEtcdAdapterEventLease(t *testing.T) {
+	clock := newFakeClock()
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+	})
+	defer shutdown()
+	// Wait for the ticker checking the expired leases.
+	clock.BlockUntil(1)
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+			TTL:   2,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+			Lease: 100,
+			TTL:   2,
+		},
+		{
+			Key:   "/apisix/routes/3",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	})
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 3, "checking key-values")
+	lease := resp.Kvs[0].Lease
+	assert.NotEqual(t, int64(0), lease, "checking lease")
+	assert.Equal(t, int64(100), resp.Kvs[1].Lease, "checking lease")
+	assert.Equal(t, int64(0), resp.Kvs[2].Lease, "checking lease")
+
+	// Re-pushing the key refreshes its lease.
+	advanceLeases(clock, time.Second)
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+			TTL:   2,
+		},
+	})
+	advanceLeases(clock, time.Second)
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 2, "checking key-values")
+	assert.Equal(t, "/apisix/routes/1", string(resp.Kvs[0].Key), "checking key")
+	assert.Equal(t, lease, resp.Kvs[0].Lease, "checking lease")
+
+	advanceLeases(clock, time.Second)
+	resp, err = client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	assert.Equal(t, "/apisix/routes/3", string(resp.Kvs[0].Key), "checking key")
+}
+
+func TestEtcdAdapterEventLeaseExistingKey(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	lease, err := client.Grant(context.Background(), 60)
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventAdd,
+			TTL:   60,
+		},
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventAdd,
+			Lease: int64(lease.ID),
+		},
+	})
+
+	// The add events of the existing key neither grant a lease nor attach
+	// the key to one.
+	leases, err := client.Leases(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, leases.Leases, 1, "checking leases")
+	ttl, err := client.TimeToLive(context.Background(), lease.ID, clientv3.WithAttachedKeys())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, ttl.Keys, 0, "checking attached keys")
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	if assert.Len(t, resp.Kvs, 1, "checking key-values") {
+		assert.Equal(t, "v1", string(resp.Kvs[0].Value), "checking value")
+		assert.Equal(t, int64(0), resp.Kvs[0].Lease, "checking lease")
+	}
+}
+
+func TestEtcdAdapterEventTTLExpiry(t *testing.T) {
+	clock := newFakeClock()
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		Clock: clock,
+	})
+	defer shutdown()
+	// Wait for the ticker checking the expired leases.
+	clock.BlockUntil(1)
+
+	push := func(typ EventType, value string) {
+		_, err := a.Push(context.Background(), &Event{
+			Key:   "/apisix/routes/1",
+			Value: []byte(value),
+			Type:  typ,
+			TTL:   10,
+		})
+		assert.Nil(t, err, "checking error")
+	}
+	get := func() *clientv3.GetResponse {
+		resp, err := client.Get(context.Background(), "/apisix/routes/1")
+		assert.Nil(t, err, "checking error")
+		return resp
+	}
+
+	push(EventAdd, "v1")
+	advanceLeases(clock, 5*time.Second)
+	// Re-pushing the key resets its TTL.
+	push(EventUpdate, "v2")
+	advanceLeases(clock, 6*time.Second)
+	assert.Len(t, get().Kvs, 1, "checking keys")
+
+	advanceLeases(clock, 4*time.Second)
+	resp := get()
+	assert.Len(t, resp.Kvs, 0, "checking keys")
+	assert.Equal(t, int64(4), resp.Header.Revision, "checking revision")
+}
@@ -0,0 +1,78 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/soheilhy/cmux"
+)
+
+// servedListener is a listener multiplexed to the gRPC and the HTTP servers.
+type servedListener struct {
+	addr   net.Addr
+	secure bool
+	mux    cmux.CMux
+	grpcl  net.Listener
+	httpl  net.Listener
+}
+
+func newServedListener(l net.Listener, tlsConfig *tls.Config) *servedListener {
+	addr := l.Addr()
+	// The connections are handshaked before they're multiplexed, so both the
+	// gRPC and the HTTP servers are served over the TLS.
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	// Like ETCD, the gRPC services and the HTTP endpoints share the port.
+	// The gRPC requests are matched by the content type rather than the
+	// HTTP/2 preface, as the HTTP endpoints can be requested over HTTP/2
+	// too, e.g. by curl over TLS. The settings are sent while matching, for
+	// the clients which wait for them before sending the headers, e.g.
+	// grpc-java.
+	m := cmux.New(l)
+	return &servedListener{
+		addr:   addr,
+		secure: tlsConfig != nil,
+		mux:    m,
+		grpcl:  m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc")),
+		httpl:  m.Match(cmux.Any()),
+	}
+}
+
+func (a *adapter) AddListener(l net.Listener, opts *TLSOptions) error {
+	var (
+		tlsConfig *tls.Config
+		err       error
+	)
+	if opts != nil {
+		if tlsConfig, err = newTLSConfig(opts); err != nil {
+			return err
+		}
+	}
+
+	a.listenersMu.Lock()
+	defer a.listenersMu.Unlock()
+	switch a.state {
+	case stateServing:
+		return ErrAlreadyServing
+	case stateClosed:
+		return ErrClosed
+	}
+	a.listeners = append(a.listeners, newServedListener(l, tlsConfig))
+	return nil
+}
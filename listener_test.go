@@ -0,0 +1,113 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+)
+
+func TestEtcdAdapterMultipleListeners(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeTestCertFiles(t, dir, "server", ca.issue(t, "localhost", true))
+	a := NewEtcdAdapter(&AdapterOptions{
+		TLS: &TLSOptions{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	sock := filepath.Join(dir, "etcd.sock")
+	unixLn, err := net.Listen("unix", sock)
+	assert.Nil(t, err, "checking listener creating error")
+	assert.Nil(t, a.AddListener(unixLn, nil), "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	assert.Equal(t, ErrAlreadyServing, a.AddListener(unixLn, nil), "checking error")
+
+	tcpClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+		TLS:       &tls.Config{RootCAs: ca.pool},
+	})
+	assert.Nil(t, err, "checking error")
+	defer tcpClient.Close()
+	unixClient, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{"unix://" + sock},
+	})
+	assert.Nil(t, err, "checking error")
+	defer unixClient.Close()
+
+	members, err := unixClient.MemberList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"https://" + ln.Addr().String(), "unix://" + sock}, members.Members[0].ClientURLs, "checking client urls")
+
+	// Both the clients see the changes made through the other one.
+	getResp, err := tcpClient.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	rev := getResp.Header.Revision + 1
+	tcpWatch := tcpClient.Watch(ctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+	unixWatch := unixClient.Watch(ctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+	var wg sync.WaitGroup
+	for i, client := range []*clientv3.Client{tcpClient, unixClient} {
+		wg.Add(1)
+		go func(i int, client *clientv3.Client) {
+			defer wg.Done()
+			_, err := client.Put(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), "v")
+			assert.Nil(t, err, "checking error")
+		}(i, client)
+	}
+	wg.Wait()
+	for _, client := range []*clientv3.Client{tcpClient, unixClient} {
+		resp, err := client.Get(context.Background(), "/apisix/", clientv3.WithPrefix())
+		assert.Nil(t, err, "checking error")
+		assert.Len(t, resp.Kvs, 2, "checking key-values")
+	}
+	for _, wch := range []clientv3.WatchChan{tcpWatch, unixWatch} {
+		var events int
+		for events < 2 {
+			select {
+			case resp := <-wch:
+				assert.Nil(t, resp.Err(), "checking error")
+				events += len(resp.Events)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for watch events")
+			}
+		}
+	}
+
+	// Shutdown closes all the listeners.
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	_, err = net.Dial("unix", sock)
+	assert.NotNil(t, err, "checking error")
+}
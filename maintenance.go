@@ -0,0 +1,258 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// maintenanceServer implements the etcdserverpb.MaintenanceServer, the RPCs
+// which are not supported yet are served by the kine bridge.
+type maintenanceServer struct {
+	etcdserverpb.MaintenanceServer
+
+	backend  server.Backend
+	lessor   *lessor
+	alarms   *alarmStore
+	memberID uint64
+	version  *emulatedVersion
+}
+
+// Status reports the adapter as the leader of a single member cluster, the
+// raft index follows the current revision, as each revision is a change
+// applied to the store.
+func (s *maintenanceServer) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
+	size, err := s.backend.DbSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rev int64
+	inUse := size
+	if b, ok := s.backend.(backends.Backend); ok {
+		rev = b.CurrentRevision()
+		if inUse, err = b.DbSizeInUse(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var errs []string
+	for _, alarm := range s.alarms.list(etcdserverpb.AlarmType_NONE) {
+		errs = append(errs, alarmString(alarm))
+	}
+	return &etcdserverpb.StatusResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+		Version:          s.version.server,
+		DbSize:           size,
+		DbSizeInUse:      inUse,
+		Leader:           s.memberID,
+		RaftIndex:        uint64(rev),
+		RaftTerm:         raftTerm,
+		RaftAppliedIndex: uint64(rev),
+		Errors:           errs,
+	}, nil
+}
+
+// Alarm gets, activates or deactivates the alarms, note the alarms are not
+// persisted.
+func (s *maintenanceServer) Alarm(ctx context.Context, r *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
+	resp := &etcdserverpb.AlarmResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}
+	alarm := etcdserverpb.AlarmMember{
+		MemberID: r.MemberID,
+		Alarm:    r.Alarm,
+	}
+	switch r.Action {
+	case etcdserverpb.AlarmRequest_GET:
+		resp.Alarms = s.alarms.list(r.Alarm)
+	case etcdserverpb.AlarmRequest_ACTIVATE:
+		if r.Alarm == etcdserverpb.AlarmType_NONE {
+			break
+		}
+		if s.alarms.activate(alarm) {
+			resp.Alarms = append(resp.Alarms, &alarm)
+		}
+	case etcdserverpb.AlarmRequest_DEACTIVATE:
+		if s.alarms.deactivate(alarm) {
+			resp.Alarms = append(resp.Alarms, &alarm)
+		}
+	}
+	return resp, nil
+}
+
+// Defragment releases the space freed by the compactions, the reduced size
+// is reported by the following Status responses.
+func (s *maintenanceServer) Defragment(ctx context.Context, r *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.MaintenanceServer.Defragment(ctx, r)
+	}
+	if err := b.Defragment(ctx); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.DefragmentResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}, nil
+}
+
+// Hash is not supported, as there is no database file to hash. HashKV should
+// be used to check the consistency instead.
+func (s *maintenanceServer) Hash(ctx context.Context, r *etcdserverpb.HashRequest) (*etcdserverpb.HashResponse, error) {
+	return nil, errGRPCHashNotSupported
+}
+
+// MoveLeader succeeds if the transferee is the adapter itself, as it's
+// always the leader, other transferees are not members of the cluster.
+func (s *maintenanceServer) MoveLeader(ctx context.Context, r *etcdserverpb.MoveLeaderRequest) (*etcdserverpb.MoveLeaderResponse, error) {
+	if r.TargetID != s.memberID {
+		return nil, rpctypes.ErrGRPCBadLeaderTransferee
+	}
+	return &etcdserverpb.MoveLeaderResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}, nil
+}
+
+// Downgrade is not supported, the version of the adapter is fixed. The RPC
+// is unknown to ETCD 3.4, so it's rejected like an unknown method when 3.4
+// is emulated.
+func (s *maintenanceServer) Downgrade(ctx context.Context, r *etcdserverpb.DowngradeRequest) (*etcdserverpb.DowngradeResponse, error) {
+	if !s.version.atLeast(3, 5) {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method Downgrade for service etcdserverpb.Maintenance")
+	}
+	return nil, errGRPCDowngradeNotSupported
+}
+
+// HashKV hashes the key-values like ETCD, note the revision in the header is
+// the one that the key-values are hashed at, as there is no other place for
+// it in the response.
+func (s *maintenanceServer) HashKV(ctx context.Context, r *etcdserverpb.HashKVRequest) (*etcdserverpb.HashKVResponse, error) {
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.MaintenanceServer.HashKV(ctx, r)
+	}
+	res, err := b.HashKV(ctx, r.Revision)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.HashKVResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: res.Revision,
+		},
+		Hash:            res.Hash,
+		CompactRevision: res.CompactRevision,
+	}, nil
+}
+
+// Snapshot streams the snapshot in the file format of ETCD, the SHA-256 of
+// the file is sent at last like ETCD, so that it can be verified when it's
+// restored.
+func (s *maintenanceServer) Snapshot(r *etcdserverpb.SnapshotRequest, stream etcdserverpb.Maintenance_SnapshotServer) error {
+	b, ok := s.backend.(backends.Backend)
+	if !ok {
+		return s.MaintenanceServer.Snapshot(r, stream)
+	}
+	history, err := b.History(stream.Context())
+	if err != nil {
+		return err
+	}
+	var leases []*lease
+	if s.lessor != nil {
+		leases = s.lessor.snapshot()
+	}
+	snapshot, err := newETCDSnapshot(history, leases)
+	if err != nil {
+		return err
+	}
+
+	w := &snapshotWriter{
+		stream:    stream,
+		revision:  history.Revision,
+		remaining: uint64(snapshot.Size()),
+		hash:      sha256.New(),
+	}
+	if _, err := snapshot.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return stream.Send(&etcdserverpb.SnapshotResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: history.Revision,
+		},
+		Blob: w.hash.Sum(nil),
+	})
+}
+
+// snapshotChunkSize is the max size of the blob in a snapshot response, it's
+// same as ETCD.
+const snapshotChunkSize = 32 * 1024
+
+// snapshotWriter sends the written bytes in chunks.
+type snapshotWriter struct {
+	stream    etcdserverpb.Maintenance_SnapshotServer
+	revision  int64
+	remaining uint64
+	hash      hash.Hash
+	buf       []byte
+}
+
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	_, _ = w.hash.Write(p)
+	written := 0
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, snapshotChunkSize)
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *snapshotWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.remaining -= uint64(len(w.buf))
+	err := w.stream.Send(&etcdserverpb.SnapshotResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: w.revision,
+		},
+		RemainingBytes: w.remaining,
+		Blob:           w.buf,
+	})
+	w.buf = w.buf[:0]
+	return err
+}
@@ -0,0 +1,138 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdAdapterMaintenanceStatus(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Put(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), "v1")
+		assert.Nil(t, err, "checking error")
+	}
+	resp, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, DefaultEmulatedVersion, resp.Version, "checking version")
+	assert.Equal(t, int64(3*(16+2)), resp.DbSize, "checking db size")
+	assert.Equal(t, DefaultMemberID, resp.Leader, "checking leader")
+	assert.Equal(t, DefaultMemberID, resp.Header.MemberId, "checking member id")
+	assert.Equal(t, DefaultClusterID, resp.Header.ClusterId, "checking cluster id")
+	assert.Equal(t, int64(4), resp.Header.Revision, "checking revision")
+	assert.Equal(t, uint64(4), resp.RaftIndex, "checking raft index")
+	assert.Equal(t, uint64(raftTerm), resp.RaftTerm, "checking raft term")
+	assert.Equal(t, resp.Header.RaftTerm, resp.RaftTerm, "checking raft term")
+	assert.Len(t, resp.Errors, 0, "checking errors")
+}
+
+func TestEtcdAdapterMaintenanceHashKV(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	endpoint := client.Endpoints()[0]
+	resp, err := client.HashKV(context.Background(), endpoint, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	again, err := client.HashKV(context.Background(), endpoint, 0)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, resp.Hash, again.Hash, "checking hash")
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	again, err = client.HashKV(context.Background(), endpoint, 0)
+	assert.Nil(t, err, "checking error")
+	assert.NotEqual(t, resp.Hash, again.Hash, "checking hash")
+
+	_, err = client.HashKV(context.Background(), endpoint, 100)
+	assert.Equal(t, rpctypes.ErrFutureRev, err, "checking error")
+}
+
+func TestEtcdAdapterMaintenanceSnapshot(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	lease, err := client.Grant(context.Background(), 60)
+	assert.Nil(t, err, "checking error")
+	for i := 0; i < 1000; i++ {
+		_, err := client.Put(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), strings.Repeat("v", 100), clientv3.WithLease(lease.ID))
+		assert.Nil(t, err, "checking error")
+	}
+	rc, err := client.Snapshot(context.Background())
+	assert.Nil(t, err, "checking error")
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err, "checking error")
+
+	// The SHA-256 of the file is appended.
+	file, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	expected := sha256.Sum256(file)
+	assert.Equal(t, expected[:], sum, "checking hash")
+	buckets := readBoltFile(t, file)
+	assert.Len(t, buckets["key"], 1000, "checking keys")
+	assert.Len(t, buckets["lease"], 1, "checking leases")
+	assert.Equal(t, etcdRevisionBytes(1001, 0, false), buckets["key"][999].key, "checking revision")
+}
+
+func TestEtcdAdapterDefragment(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Put(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), "v1")
+		assert.Nil(t, err, "checking error")
+	}
+	var rev int64
+	for i := 0; i < 10; i += 2 {
+		resp, err := client.Delete(context.Background(), fmt.Sprintf("/apisix/routes/%d", i))
+		assert.Nil(t, err, "checking error")
+		rev = resp.Header.Revision
+	}
+	_, err := client.Compact(context.Background(), rev)
+	assert.Nil(t, err, "checking error")
+	before, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	// The live keys and the tombstone at the compacted revision.
+	assert.Equal(t, int64(5*(16+2)+16), before.DbSizeInUse, "checking db size in use")
+	assert.Greater(t, before.DbSize, before.DbSizeInUse, "checking db size")
+
+	_, err = client.Defragment(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	after, err := client.Status(context.Background(), client.Endpoints()[0])
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, before.DbSizeInUse, after.DbSize, "checking db size")
+	assert.Equal(t, before.DbSizeInUse, after.DbSizeInUse, "checking db size in use")
+
+	resp, err := client.Get(context.Background(), "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 5, "checking key-values")
+	for i, kv := range resp.Kvs {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", 2*i+1), string(kv.Key), "checking key")
+	}
+}
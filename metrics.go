@@ -0,0 +1,161 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	currentRevisionDesc = prometheus.NewDesc(
+		"etcd_adapter_current_revision",
+		"The current revision of the backend.",
+		nil, nil,
+	)
+	keysDesc = prometheus.NewDesc(
+		"etcd_adapter_keys",
+		"The number of the keys in the backend.",
+		nil, nil,
+	)
+	dbSizeDesc = prometheus.NewDesc(
+		"etcd_adapter_db_size_bytes",
+		"The number of bytes allocated by the backend, which the quota is checked against.",
+		nil, nil,
+	)
+	quotaBackendBytesDesc = prometheus.NewDesc(
+		"etcd_adapter_quota_backend_bytes",
+		"The quota of the backend size, zero means no quota.",
+		nil, nil,
+	)
+	activeWatchersDesc = prometheus.NewDesc(
+		"etcd_adapter_active_watchers",
+		"The number of the watchers in all the watch streams.",
+		nil, nil,
+	)
+	eventsAppliedDesc = prometheus.NewDesc(
+		"etcd_adapter_events_applied_total",
+		"The number of the events fed by the application which are applied, by the event type.",
+		[]string{"type"}, nil,
+	)
+)
+
+// eventTypeNames are the values of the type label, indexed by the event
+// types minus one.
+var eventTypeNames = [...]string{"add", "update", "delete", "upsert"}
+
+// eventStats are the statistics of the events fed by the application, the
+// fields should be accessed atomically.
+type eventStats struct {
+	// applied are indexed by the event types minus one.
+	applied [len(eventTypeNames)]int64
+	// droppedErrors is the number of the event errors dropped as the error
+	// channel is full.
+	droppedErrors int64
+	// skippedUpdates is the number of the no-op updates skipped.
+	skippedUpdates int64
+}
+
+func (es *eventStats) addApplied(typ EventType) {
+	if typ >= EventAdd && int(typ) <= len(eventTypeNames) {
+		atomic.AddInt64(&es.applied[typ-1], 1)
+	}
+}
+
+// metricsCollector collects the metrics of an adapter when it's scraped.
+type metricsCollector struct {
+	a *adapter
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- currentRevisionDesc
+	ch <- keysDesc
+	ch <- dbSizeDesc
+	ch <- quotaBackendBytesDesc
+	ch <- activeWatchersDesc
+	ch <- eventsAppliedDesc
+	if backend, ok := c.a.backend.(prometheus.Collector); ok {
+		backend.Describe(ch)
+	}
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	rev, count, err := c.a.backend.Count(context.Background(), "")
+	if err != nil {
+		c.a.logger.Warn("failed to count keys for metrics",
+			zap.Error(err),
+		)
+	} else {
+		ch <- prometheus.MustNewConstMetric(currentRevisionDesc, prometheus.GaugeValue, float64(rev))
+		ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(count))
+	}
+	if size, err := c.a.backend.DbSize(context.Background()); err != nil {
+		c.a.logger.Warn("failed to get db size for metrics",
+			zap.Error(err),
+		)
+	} else {
+		ch <- prometheus.MustNewConstMetric(dbSizeDesc, prometheus.GaugeValue, float64(size))
+	}
+	ch <- prometheus.MustNewConstMetric(quotaBackendBytesDesc, prometheus.GaugeValue, float64(c.a.quotaBackendBytes))
+	ch <- prometheus.MustNewConstMetric(activeWatchersDesc, prometheus.GaugeValue,
+		float64(atomic.LoadInt64(&c.a.watchStats.activeWatchers)))
+	for i, name := range eventTypeNames {
+		ch <- prometheus.MustNewConstMetric(eventsAppliedDesc, prometheus.CounterValue,
+			float64(atomic.LoadInt64(&c.a.eventStats.applied[i])), name)
+	}
+	if backend, ok := c.a.backend.(prometheus.Collector); ok {
+		backend.Collect(ch)
+	}
+}
+
+// registerMetrics registers the Go runtime and the process collectors, which
+// are shared by the adapters, and the collector of the adapter. Only one
+// adapter is collected by a registerer at a time, the others are skipped
+// with a warning until it's unregistered by Shutdown.
+func (a *adapter) registerMetrics() {
+	for _, c := range []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		if err := a.metricsRegisterer.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				a.logger.Warn("failed to register metrics collector",
+					zap.Error(err),
+				)
+			}
+		}
+	}
+	c := &metricsCollector{a: a}
+	if err := a.metricsRegisterer.Register(c); err != nil {
+		a.logger.Warn("failed to register etcd adapter metrics, use a separate registerer for each adapter",
+			zap.Error(err),
+		)
+		return
+	}
+	a.metricsCollector = c
+}
+
+// unregisterMetrics unregisters the collector of the adapter, so that it's
+// not referenced by the registerer after Shutdown.
+func (a *adapter) unregisterMetrics() {
+	if a.metricsCollector != nil {
+		a.metricsRegisterer.Unregister(a.metricsCollector)
+		a.metricsCollector = nil
+	}
+}
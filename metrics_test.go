@@ -0,0 +1,142 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+)
+
+// scrapeMetrics scrapes the /metrics endpoint of the address.
+func scrapeMetrics(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	assert.Nil(t, err, "checking error")
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "checking status code")
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "checking error")
+	return string(body)
+}
+
+func TestEtcdAdapterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	a := NewEtcdAdapter(&AdapterOptions{
+		MetricsRegisterer: registry,
+		MetricsGatherer:   registry,
+		InstrumentBackend: true,
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	defer client.Close()
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix())
+
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v2"),
+			Type:  EventUpdate,
+		},
+	}
+	select {
+	case <-wch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+
+	metrics := scrapeMetrics(t, ln.Addr().String())
+	assert.Contains(t, metrics, "\netcd_adapter_keys 2\n", "checking keys")
+	assert.Contains(t, metrics, "\netcd_adapter_current_revision ", "checking current revision")
+	assert.Contains(t, metrics, "\netcd_adapter_db_size_bytes ", "checking db size")
+	assert.Contains(t, metrics, "\netcd_adapter_quota_backend_bytes 0\n", "checking quota")
+	assert.Contains(t, metrics, "\netcd_adapter_active_watchers 1\n", "checking active watchers")
+	assert.Contains(t, metrics, "\netcd_adapter_events_applied_total{type=\"add\"} 2\n", "checking applied add events")
+	assert.Contains(t, metrics, "\netcd_adapter_events_applied_total{type=\"update\"} 1\n", "checking applied update events")
+	assert.Contains(t, metrics, "\netcd_adapter_events_applied_total{type=\"delete\"} 0\n", "checking applied delete events")
+	assert.Contains(t, metrics, "\netcd_adapter_cache_keys 2\n", "checking backend keys")
+	assert.Contains(t, metrics, "\netcd_adapter_cache_operation_duration_seconds_count{operation=\"create\"} 2\n", "checking backend operations")
+	assert.Contains(t, metrics, "\ngo_goroutines ", "checking Go runtime metrics")
+
+	// Another adapter with the same registerer is served without its
+	// metrics, and the metrics of the former one are unregistered by the
+	// shutdown.
+	other := NewEtcdAdapter(&AdapterOptions{
+		MetricsRegisterer: registry,
+		MetricsGatherer:   registry,
+	})
+	otherLn, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	go func() {
+		err := other.Serve(ctx, otherLn)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, other)
+	defer func() {
+		assert.Nil(t, other.Shutdown(context.Background()), "shutting down")
+	}()
+	assert.Contains(t, scrapeMetrics(t, otherLn.Addr().String()), "\netcd_adapter_keys 2\n", "checking keys")
+
+	wcancel()
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	assert.Equal(t, 0, countMetrics(t, registry, "etcd_adapter_keys"), "checking unregistered metrics")
+}
+
+// countMetrics returns the number of the metrics of the name gathered from
+// the registry.
+func countMetrics(t *testing.T, g prometheus.Gatherer, name string) int {
+	families, err := g.Gather()
+	assert.Nil(t, err, "checking error")
+	for _, family := range families {
+		if family.GetName() == name {
+			return len(family.GetMetric())
+		}
+	}
+	return 0
+}
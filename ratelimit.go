@@ -0,0 +1,266 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// RetryAfterTrailer is the gRPC trailer of the requests rejected by the
+// rate limit or the concurrency cap, it's the number of milliseconds after
+// which the client should retry.
+const RetryAfterTrailer = "retry-after-ms"
+
+// concurrencyRetryAfter is the hint of the requests rejected by the
+// concurrency cap, as there is no way to predict when a slot is released.
+const concurrencyRetryAfter = 100 * time.Millisecond
+
+// peerBucketsSweepInterval is the interval of removing the per-peer buckets
+// which are full, i.e. the ones of the idle peers.
+const peerBucketsSweepInterval = time.Minute
+
+// RateLimitOptions protect the adapter from the clients sending too many
+// unary requests, e.g. a client hot-looping the Range requests. The Watch
+// streams are limited by the MaxWatchers instead. The zero values mean no
+// limit.
+type RateLimitOptions struct {
+	// RequestsPerSecond is the rate of the token bucket shared by all the
+	// clients, and Burst is its size, which is at least one.
+	RequestsPerSecond float64
+	Burst             int
+	// PerPeerRequestsPerSecond and PerPeerBurst are the token bucket of
+	// each client host, the clients on the same host share it.
+	PerPeerRequestsPerSecond float64
+	PerPeerBurst             int
+	// MaxConcurrentRequests caps the requests being processed at the same
+	// time.
+	MaxConcurrentRequests int
+}
+
+func (opts *RateLimitOptions) validate() error {
+	if opts.RequestsPerSecond < 0 || opts.Burst < 0 || opts.PerPeerRequestsPerSecond < 0 || opts.PerPeerBurst < 0 {
+		return errors.New("the rates and the bursts must not be negative")
+	}
+	if opts.MaxConcurrentRequests < 0 {
+		return errors.New("max concurrent requests must not be negative")
+	}
+	return nil
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second, the
+// tokens are refilled lazily when they're taken.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take takes a token, it returns the time to wait for the next token if
+// there is none.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full checks whether the bucket is refilled to the burst, then it makes
+// no difference to drop it.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// rateLimiter limits the rate and the concurrency of the unary requests.
+type rateLimiter struct {
+	opts  RateLimitOptions
+	clock Clock
+
+	mu        sync.Mutex
+	global    *tokenBucket
+	peers     map[string]*tokenBucket
+	lastSweep time.Time
+
+	// concurrent is the number of the requests being processed, and
+	// rejected is the number of the rejected requests, they should be
+	// accessed atomically.
+	concurrent int64
+	rejected   int64
+}
+
+// newRateLimiter returns nil if opts is nil, which doesn't limit anything.
+func newRateLimiter(opts *RateLimitOptions, clock Clock) (*rateLimiter, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	rl := &rateLimiter{
+		opts:      *opts,
+		clock:     clock,
+		peers:     make(map[string]*tokenBucket),
+		lastSweep: now,
+	}
+	if opts.RequestsPerSecond > 0 {
+		rl.global = newTokenBucket(opts.RequestsPerSecond, opts.Burst, now)
+	}
+	return rl, nil
+}
+
+// allow checks the rate limits of the request from the peer.
+func (rl *rateLimiter) allow(peer string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.clock.Now()
+	if now.Sub(rl.lastSweep) >= peerBucketsSweepInterval {
+		for p, b := range rl.peers {
+			if b.full(now) {
+				delete(rl.peers, p)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	var pb *tokenBucket
+	if rl.opts.PerPeerRequestsPerSecond > 0 {
+		pb = rl.peers[peer]
+		if pb == nil {
+			pb = newTokenBucket(rl.opts.PerPeerRequestsPerSecond, rl.opts.PerPeerBurst, now)
+			rl.peers[peer] = pb
+		}
+		// Check the peer first, so that a greedy peer doesn't take the
+		// tokens of the others.
+		if ok, wait := pb.take(now); !ok {
+			return false, wait
+		}
+	}
+	if rl.global != nil {
+		if ok, wait := rl.global.take(now); !ok {
+			if pb != nil {
+				// Give back the token of the peer.
+				pb.tokens++
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// acquire takes a slot of the concurrent requests.
+func (rl *rateLimiter) acquire() bool {
+	max := int64(rl.opts.MaxConcurrentRequests)
+	for {
+		n := atomic.LoadInt64(&rl.concurrent)
+		if max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&rl.concurrent, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (rl *rateLimiter) release() {
+	atomic.AddInt64(&rl.concurrent, -1)
+}
+
+// rejectedRequests is nil-safe, so that it can be reported without limits.
+func (rl *rateLimiter) rejectedRequests() int64 {
+	if rl == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&rl.rejected)
+}
+
+// reject records the rejected request and tells the client when to retry.
+func (rl *rateLimiter) reject(ctx context.Context, retryAfter time.Duration, err error) error {
+	atomic.AddInt64(&rl.rejected, 1)
+	ms := (retryAfter + time.Millisecond - 1) / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	}
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterTrailer, strconv.FormatInt(int64(ms), 10)))
+	return err
+}
+
+// peerHost returns the host of the client, the port is dropped so that the
+// connections of the same host share the limit.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rateLimitUnaryInterceptor rejects the requests of the ETCD services which
+// exceed the rate limits or the concurrency cap. The other services, e.g.
+// the health checks of the load balancers, are not limited.
+func (a *adapter) rateLimitUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	rl := a.rateLimiter
+	if !strings.HasPrefix(info.FullMethod, "/etcdserverpb.") {
+		return handler(ctx, req)
+	}
+	if ok, wait := rl.allow(peerHost(ctx)); !ok {
+		return nil, rl.reject(ctx, wait, errGRPCRateLimited)
+	}
+	if !rl.acquire() {
+		return nil, rl.reject(ctx, concurrencyRetryAfter, errGRPCTooManyRequests)
+	}
+	defer rl.release()
+	return handler(ctx, req)
+}
@@ -0,0 +1,249 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiterGlobal(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := newRateLimiter(&RateLimitOptions{
+		RequestsPerSecond: 10,
+		Burst:             2,
+	}, clock)
+	assert.Nil(t, err, "checking error")
+
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.allow("10.0.0.1")
+		assert.True(t, ok, "checking burst")
+	}
+	ok, wait := rl.allow("10.0.0.2")
+	assert.False(t, ok, "checking exceeded rate")
+	assert.Equal(t, 100*time.Millisecond, wait, "checking wait")
+
+	clock.Advance(50 * time.Millisecond)
+	ok, wait = rl.allow("10.0.0.2")
+	assert.False(t, ok, "checking exceeded rate")
+	assert.Equal(t, 50*time.Millisecond, wait, "checking wait")
+	clock.Advance(50 * time.Millisecond)
+	ok, _ = rl.allow("10.0.0.2")
+	assert.True(t, ok, "checking refilled token")
+
+	// The bucket is never refilled beyond the burst.
+	clock.Advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.allow("10.0.0.1")
+		assert.True(t, ok, "checking burst")
+	}
+	ok, _ = rl.allow("10.0.0.1")
+	assert.False(t, ok, "checking exceeded rate")
+}
+
+func TestRateLimiterPerPeer(t *testing.T) {
+	clock := newFakeClock()
+	rl, err := newRateLimiter(&RateLimitOptions{
+		RequestsPerSecond:        10,
+		Burst:                    3,
+		PerPeerRequestsPerSecond: 1,
+		PerPeerBurst:             2,
+	}, clock)
+	assert.Nil(t, err, "checking error")
+
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.allow("10.0.0.1")
+		assert.True(t, ok, "checking burst of the peer")
+	}
+	ok, wait := rl.allow("10.0.0.1")
+	assert.False(t, ok, "checking exceeded rate of the peer")
+	assert.Equal(t, time.Second, wait, "checking wait")
+
+	// The rejected requests of a peer don't take the global tokens.
+	ok, _ = rl.allow("10.0.0.2")
+	assert.True(t, ok, "checking the other peer")
+	ok, wait = rl.allow("10.0.0.3")
+	assert.False(t, ok, "checking exceeded global rate")
+	assert.Equal(t, 100*time.Millisecond, wait, "checking wait")
+	// While the ones rejected by the global limit give back the tokens of
+	// the peer.
+	clock.Advance(100 * time.Millisecond)
+	ok, _ = rl.allow("10.0.0.3")
+	assert.True(t, ok, "checking the token of the peer")
+
+	// The buckets of the idle peers are dropped.
+	clock.Advance(peerBucketsSweepInterval)
+	ok, _ = rl.allow("10.0.0.1")
+	assert.True(t, ok, "checking refilled token")
+	assert.Len(t, rl.peers, 1, "checking buckets of the peers")
+}
+
+func TestRateLimiterOptions(t *testing.T) {
+	rl, err := newRateLimiter(nil, newFakeClock())
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, rl, "checking rate limiter")
+	assert.Equal(t, int64(0), rl.rejectedRequests(), "checking rejected requests")
+
+	for _, opts := range []*RateLimitOptions{
+		{RequestsPerSecond: -1},
+		{Burst: -1},
+		{PerPeerRequestsPerSecond: -1},
+		{MaxConcurrentRequests: -1},
+	} {
+		_, err := newRateLimiter(opts, newFakeClock())
+		assert.NotNil(t, err, "checking error of %+v", opts)
+	}
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			RateLimit: &RateLimitOptions{RequestsPerSecond: -1},
+		})
+	}, "checking invalid options")
+}
+
+func TestRateLimitUnaryInterceptor(t *testing.T) {
+	clock := newFakeClock()
+	a := NewEtcdAdapter(&AdapterOptions{
+		Clock: clock,
+		RateLimit: &RateLimitOptions{
+			PerPeerRequestsPerSecond: 1,
+			PerPeerBurst:             1,
+			MaxConcurrentRequests:    1,
+		},
+	}).(*adapter)
+	peerContext := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 2379},
+		})
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &etcdserverpb.RangeResponse{}, nil
+	}
+	rangeInfo := &grpc.UnaryServerInfo{FullMethod: "/etcdserverpb.KV/Range"}
+
+	_, err := a.rateLimitUnaryInterceptor(peerContext("10.0.0.1"), &etcdserverpb.RangeRequest{}, rangeInfo, handler)
+	assert.Nil(t, err, "checking error")
+	_, err = a.rateLimitUnaryInterceptor(peerContext("10.0.0.1"), &etcdserverpb.RangeRequest{}, rangeInfo, handler)
+	assert.Equal(t, errGRPCRateLimited, err, "checking error")
+	// The health checks are not limited.
+	_, err = a.rateLimitUnaryInterceptor(peerContext("10.0.0.1"), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+	assert.Nil(t, err, "checking error")
+
+	// A request is being processed by the other peer.
+	blocked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := a.rateLimitUnaryInterceptor(peerContext("10.0.0.2"), &etcdserverpb.RangeRequest{}, rangeInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			<-blocked
+			return nil, nil
+		})
+		assert.Nil(t, err, "checking error")
+	}()
+	// The requests are sent by different peers, so that they're not
+	// limited by the rate.
+	i := 0
+	assert.Eventually(t, func() bool {
+		i++
+		_, err := a.rateLimitUnaryInterceptor(peerContext(fmt.Sprintf("10.0.1.%d", i)), &etcdserverpb.RangeRequest{}, rangeInfo, handler)
+		return err == errGRPCTooManyRequests
+	}, 5*time.Second, 10*time.Millisecond, "checking concurrency cap")
+	close(blocked)
+	<-done
+
+	_, err = a.rateLimitUnaryInterceptor(peerContext("10.0.0.3"), &etcdserverpb.RangeRequest{}, rangeInfo, handler)
+	assert.Nil(t, err, "checking error")
+	assert.GreaterOrEqual(t, a.Stats().RejectedRequests, int64(2), "checking rejected requests")
+}
+
+func TestEtcdAdapterRateLimit(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		RateLimit: &RateLimitOptions{
+			RequestsPerSecond: 50,
+			Burst:             10,
+		},
+	})
+	defer shutdown()
+
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+	var trailer metadata.MD
+	var err error
+	for i := 0; i < 100; i++ {
+		_, err = kv.Range(context.Background(), &etcdserverpb.RangeRequest{Key: []byte("/apisix/routes/1")}, grpc.Trailer(&trailer))
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "checking error")
+	assert.NotEmpty(t, trailer.Get(RetryAfterTrailer), "checking retry after")
+
+	// Hot-loop the requests, which are mostly rejected, while measuring the
+	// latency of applying the events.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				_, _ = kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/apisix/routes/1")})
+			}
+		}()
+	}
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	wch := client.Watch(wctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+	var maxLatency time.Duration
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		a.EventCh() <- []*Event{
+			{
+				Key:   fmt.Sprintf("/apisix/routes/%d", i),
+				Value: []byte("v1"),
+				Type:  EventAdd,
+			},
+		}
+		select {
+		case wresp := <-wch:
+			assert.Len(t, wresp.Events, 1, "checking events")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch response")
+		}
+		if latency := time.Since(start); latency > maxLatency {
+			maxLatency = latency
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	t.Logf("max latency of applying the events: %s", maxLatency)
+	assert.Less(t, int64(maxLatency), int64(500*time.Millisecond), "checking latency of applying the events")
+	assert.Greater(t, a.Stats().RejectedRequests, int64(0), "checking rejected requests")
+}
@@ -17,29 +17,95 @@ package etcdadapter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	gatewayruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/soheilhy/cmux"
 	"github.com/tmc/grpc-websocket-proxy/wsproxy"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	etcdservergw "go.etcd.io/etcd/api/v3/etcdserverpb/gw"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/api7/etcd-adapter/backends"
 )
 
+// healthServiceNames are the service names reported by the health service,
+// besides the overall server.
+var healthServiceNames = []string{
+	"etcdserverpb.KV",
+	"etcdserverpb.Watch",
+	"etcdserverpb.Lease",
+	"etcdserverpb.Cluster",
+	"etcdserverpb.Maintenance",
+	"etcdserverpb.Auth",
+}
+
 func (a *adapter) Serve(ctx context.Context, l net.Listener) error {
-	a.ctx, a.cancel = context.WithCancel(ctx)
+	a.listenersMu.Lock()
+	switch a.state {
+	case stateServing:
+		a.listenersMu.Unlock()
+		return ErrAlreadyServing
+	case stateClosed:
+		a.listenersMu.Unlock()
+		return ErrClosed
+	}
+	// Shutdown waits for the servers to be created, as it's locked out
+	// until then.
+	a.state = stateServing
+	listeners, err := a.start(ctx, l)
+	if err != nil {
+		// The services might be registered partially, so the adapter
+		// cannot be served again.
+		a.state = stateClosed
+		a.cancel()
+		// The events loop is not started, so Push returns.
+		close(a.eventsDone)
+	}
+	a.listenersMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := listeners[0].mux.Serve(); err != nil && !a.closed() {
+		return err
+	}
+	return nil
+}
 
-	m := cmux.New(l)
-	grpcl := m.Match(cmux.HTTP2())
-	httpl := m.Match(cmux.HTTP1Fast())
+// closed reports whether the adapter is shut down.
+func (a *adapter) closed() bool {
+	a.listenersMu.Lock()
+	defer a.listenersMu.Unlock()
+	return a.state == stateClosed
+}
+
+// start creates and starts the servers on the listener and the ones added
+// by AddListener, which are returned with the former one first. It's called
+// with the listenersMu locked.
+func (a *adapter) start(ctx context.Context, l net.Listener) ([]*servedListener, error) {
+	a.ctx, a.cancel = context.WithCancel(ctx)
+	listeners := append([]*servedListener{newServedListener(l, a.tlsConfig)}, a.listeners...)
+	a.listeners = listeners
 
 	if err := a.backend.Start(a.ctx); err != nil {
-		return err
+		return nil, err
 	}
 
 	kep := keepalive.EnforcementPolicy{
@@ -50,15 +116,51 @@ func (a *adapter) Serve(ctx context.Context, l net.Listener) error {
 		Timeout:           10 * time.Second,
 	}
 
-	grpcSrv := grpc.NewServer(
+	// The interceptors of the embedding application are the outermost ones.
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	unaryInterceptors = append(unaryInterceptors, a.unaryInterceptors...)
+	unaryInterceptors = append(unaryInterceptors, errorUnaryInterceptor)
+	if a.rateLimiter != nil {
+		// Reject the requests before they take any resources, e.g. the
+		// password hashing of the authentication.
+		unaryInterceptors = append(unaryInterceptors, a.rateLimitUnaryInterceptor)
+	}
+	unaryInterceptors = append(unaryInterceptors, a.headerUnaryInterceptor, a.authUnaryInterceptor)
+	var streamInterceptors []grpc.StreamServerInterceptor
+	streamInterceptors = append(streamInterceptors, a.streamInterceptors...)
+	streamInterceptors = append(streamInterceptors, errorStreamInterceptor, a.headerStreamInterceptor, a.authStreamInterceptor)
+	if a.readOnly {
+		unaryInterceptors = append(unaryInterceptors, readOnlyUnaryInterceptor)
+	}
+	unaryInterceptors = append(unaryInterceptors, a.quotaUnaryInterceptor)
+
+	// The latter options win, so the keepalive settings can be overridden,
+	// while the interceptors and the credentials cannot.
+	serverOpts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(kep),
 		grpc.KeepaliveParams(kp),
+	}
+	serverOpts = append(serverOpts, a.grpcServerOptions...)
+	serverOpts = append(serverOpts,
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		// Expose the client certificates to the auth and the allowlist.
+		grpc.Creds(tlsConnCredentials{}),
 	)
+	grpcSrv := grpc.NewServer(serverOpts...)
 	a.grpcSrv = grpcSrv
-	a.bridge.Register(grpcSrv)
+	if len(a.clientURLs) == 0 {
+		for _, sl := range listeners {
+			a.clientURLs = append(a.clientURLs, listenerURLs(sl.addr, sl.secure)...)
+		}
+	}
+	if len(a.peerURLs) == 0 {
+		a.peerURLs = a.clientURLs
+	}
+	a.registerServices(grpcSrv)
 
-	if gwmux, err := a.registerGateway(l.Addr().String()); err != nil {
-		return err
+	if gwmux, err := a.registerGateway(l.Addr()); err != nil {
+		return nil, err
 	} else {
 		mux := http.NewServeMux()
 		mux.Handle(
@@ -74,62 +176,260 @@ func (a *adapter) Serve(ctx context.Context, l net.Listener) error {
 			),
 		)
 		mux.HandleFunc("/version", a.showVersion)
+		mux.HandleFunc("/health", a.showHealth)
+		mux.HandleFunc("/livez", a.showLivez)
+		mux.HandleFunc("/readyz", a.showReadyz)
+		mux.Handle("/metrics", promhttp.HandlerFor(a.metricsGatherer, promhttp.HandlerOpts{}))
+		a.registerDebugHandlers(mux)
 		a.httpSrv = &http.Server{
-			Handler: mux,
+			// Serve the HTTP/2 requests which are not gRPC, both the
+			// cleartext ones and the ones negotiated over TLS.
+			Handler: h2c.NewHandler(mux, &http2.Server{}),
 		}
 	}
 
-	go a.watchEvents(a.ctx)
-
+	a.loops.Add(1)
 	go func() {
-		if err := a.httpSrv.Serve(httpl); err != nil && !strings.Contains(err.Error(), "mux: listener closed") {
-			a.logger.Error("http server serve failure",
-				zap.Error(err),
-			)
-		}
+		defer a.loops.Done()
+		a.watchEvents(a.ctx)
 	}()
+	if a.lessor != nil {
+		a.loops.Add(1)
+		go func() {
+			defer a.loops.Done()
+			a.lessor.run(a.ctx)
+		}()
+	}
 
-	go func() {
-		if err := grpcSrv.Serve(grpcl); err != nil {
-			a.logger.Error("grpc server serve failure",
-				zap.Error(err),
-			)
-		}
-	}()
+	for _, sl := range listeners {
+		sl := sl
+		go func() {
+			if err := a.httpSrv.Serve(sl.httpl); err != nil && !strings.Contains(err.Error(), "mux: listener closed") {
+				a.logger.Error("http server serve failure",
+					zap.Error(err),
+				)
+			}
+		}()
 
-	if err := m.Serve(); err != nil && !reasonableFailure(err) {
-		return err
+		go func() {
+			if err := grpcSrv.Serve(sl.grpcl); err != nil {
+				a.logger.Error("grpc server serve failure",
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+	// Serve returns the error of the listener passed to it, the ones added
+	// by AddListener are only logged. Both are ignored after Shutdown.
+	for _, sl := range listeners[1:] {
+		sl := sl
+		go func() {
+			if err := sl.mux.Serve(); err != nil && !reasonableFailure(err) {
+				a.logger.Error("listener serve failure",
+					zap.String("addr", sl.addr.String()),
+					zap.Error(err),
+				)
+			}
+		}()
 	}
 
-	return nil
+	a.registerMetrics()
+	// The listeners are listening already, so the connections are queued
+	// until they're accepted by the muxes.
+	a.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+	close(a.ready)
+	return listeners, nil
+}
+
+func (a *adapter) Ready() <-chan struct{} {
+	return a.ready
 }
 
 func (a *adapter) Shutdown(ctx context.Context) error {
-	a.grpcSrv.Stop()
+	a.listenersMu.Lock()
+	if a.state != stateServing {
+		// There is nothing to shut down before Serve, and the adapter is
+		// shut down already after Shutdown or a failed Serve.
+		a.listenersMu.Unlock()
+		return nil
+	}
+	a.state = stateClosed
 
-	if err := a.httpSrv.Shutdown(ctx); err != nil {
-		return err
+	// Report NOT_SERVING before the connections are closed, so that the
+	// load balancers watching the health service stop routing to us.
+	a.health.Shutdown()
+
+	// Close the listeners first, so that Serve returns.
+	for _, sl := range a.listeners {
+		sl.mux.Close()
+	}
+	a.listenersMu.Unlock()
+
+	// The watch and the keepalive streams never end by themselves, so they
+	// are ended with a retriable error, then the in-flight requests are
+	// waited. The streams not drained, e.g. the ones of the kine bridge, are
+	// killed once the context is done, and so are the HTTP connections.
+	a.drainOnce.Do(func() {
+		close(a.drain)
+	})
+	var err error
+	stopped := make(chan struct{})
+	go func() {
+		a.grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		a.grpcSrv.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+	if err == nil {
+		// The listeners of the HTTP server are closed by the muxes already.
+		if err = a.httpSrv.Shutdown(ctx); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
+	if err != nil {
+		if cerr := a.httpSrv.Close(); cerr != nil {
+			a.logger.Warn("failed to close http server",
+				zap.Error(cerr),
+			)
+		}
 	}
+
+	// Wait for the loops, so that no event is applied after Shutdown.
 	a.cancel()
+	a.loops.Wait()
+	a.unregisterMetrics()
+	if err != nil {
+		return fmt.Errorf("etcd adapter: forced to shut down: %w", err)
+	}
 	return nil
 }
 
+// registerServices registers the ETCD V3 gRPC services to the gRPC server.
+// The KV, Watch, Lease, Cluster and Maintenance services are overridden so that more
+// features can be supported, and the Auth service is implemented by the adapter.
+func (a *adapter) registerServices(srv *grpc.Server) {
+	etcdserverpb.RegisterKVServer(srv, &kvServer{
+		KVServerBridge: a.bridge,
+		backend:        a.backend,
+		lessor:         a.lessor,
+		notify:         a.sendOutboundEvent,
+		auth:           a.auth,
+		allowlist:      a.allowlist,
+	})
+	if backend, ok := a.backend.(backends.Backend); ok {
+		a.watchServer = &watchServer{
+			backend:                backend,
+			logger:                 a.logger,
+			progressNotifyInterval: a.watchProgressNotifyInterval,
+			maxResponseBytes:       a.maxWatchResponseBytes,
+			watcherBufferSize:      a.watcherBufferSize,
+			maxWatchers:            a.maxWatchers,
+			batchInterval:          a.watchBatchInterval,
+			batchMaxEvents:         a.watchBatchMaxEvents,
+			stats:                  &a.watchStats,
+			clock:                  a.clock,
+			auth:                   a.auth,
+			allowlist:              a.allowlist,
+			drain:                  a.drain,
+		}
+		etcdserverpb.RegisterWatchServer(srv, a.watchServer)
+		etcdserverpb.RegisterLeaseServer(srv, &leaseServer{
+			LeaseServer: a.bridge,
+			lessor:      a.lessor,
+			drain:       a.drain,
+		})
+	} else {
+		etcdserverpb.RegisterWatchServer(srv, a.bridge)
+		etcdserverpb.RegisterLeaseServer(srv, a.bridge)
+	}
+	etcdserverpb.RegisterClusterServer(srv, &clusterServer{
+		member: a.member(),
+	})
+	etcdserverpb.RegisterMaintenanceServer(srv, &maintenanceServer{
+		MaintenanceServer: a.bridge,
+		backend:           a.backend,
+		lessor:            a.lessor,
+		alarms:            a.alarms,
+		memberID:          a.memberID,
+		version:           a.version,
+	})
+
+	etcdserverpb.RegisterAuthServer(srv, &authServer{
+		store: a.auth,
+	})
+
+	// The services are NOT_SERVING until Serve is up.
+	a.health = health.NewServer()
+	a.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, a.health)
+
+	if a.reflection {
+		reflection.Register(srv)
+	}
+}
+
+// setServingStatus sets the health status of the overall server and the
+// ETCD V3 services.
+func (a *adapter) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	a.health.SetServingStatus("", status)
+	for _, name := range healthServiceNames {
+		a.health.SetServingStatus(name, status)
+	}
+}
+
 // registerGateway registers a gRPC gateway server for etcd adapter, as some components
 // might not support gRPC protocol, it's better to support the HTTP Restful protocol.
-func (a *adapter) registerGateway(addr string) (*gatewayruntime.ServeMux, error) {
+func (a *adapter) registerGateway(addr net.Addr) (*gatewayruntime.ServeMux, error) {
 	a.logger.Info("register grpc gateway")
-	grpcConn, err := grpc.DialContext(a.ctx, addr,
-		grpc.WithInsecure(),
+	// Dial the address by its network, so that the unix sockets work.
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, addr.Network(), addr.String())
+	}
+	creds := grpc.WithInsecure()
+	if a.tlsConfig != nil {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(gatewayTLSConfig(a.tlsConfig)))
+	}
+	grpcConn, err := grpc.DialContext(a.ctx, addr.String(), creds,
+		grpc.WithContextDialer(dialer),
+		// Like ETCD, the responses of the gateway are not limited, the
+		// server limits them already.
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)),
 	)
 	if err != nil {
 		return nil, err
 	}
-	gwmux := gatewayruntime.NewServeMux()
-	if err := etcdservergw.RegisterKVHandler(a.ctx, gwmux, grpcConn); err != nil {
-		return nil, err
-	}
-	if err := etcdservergw.RegisterWatchHandler(a.ctx, gwmux, grpcConn); err != nil {
-		return nil, err
+	// Like ETCD, the fields are named as the proto ones, e.g. "range_end",
+	// and the errors are in the {"error", "code", "message"} form of the
+	// gateway.
+	gwmux := gatewayruntime.NewServeMux(
+		gatewayruntime.WithMarshalerOption(gatewayruntime.MIMEWildcard, &gatewayruntime.JSONPb{OrigName: true}),
+		// The gateway only passes the Accept header as the
+		// grpcgateway-accept metadata, which marks the proxied requests, so
+		// it's set for the requests without the header too.
+		gatewayruntime.WithMetadata(func(_ context.Context, req *http.Request) metadata.MD {
+			if req.Header.Get("Accept") != "" {
+				return nil
+			}
+			return metadata.Pairs(gatewayAcceptMetadata, "*/*")
+		}),
+	)
+	for _, register := range []func(context.Context, *gatewayruntime.ServeMux, *grpc.ClientConn) error{
+		etcdservergw.RegisterKVHandler,
+		etcdservergw.RegisterWatchHandler,
+		etcdservergw.RegisterLeaseHandler,
+		etcdservergw.RegisterClusterHandler,
+		etcdservergw.RegisterMaintenanceHandler,
+		etcdservergw.RegisterAuthHandler,
+	} {
+		if err := register(a.ctx, gwmux, grpcConn); err != nil {
+			return nil, err
+		}
 	}
 	go func() {
 		<-a.ctx.Done()
@@ -146,7 +446,7 @@ func reasonableFailure(err error) bool {
 	if err == http.ErrServerClosed {
 		return true
 	}
-	if strings.Contains(err.Error(), "mux: listener closed") {
+	if err == cmux.ErrServerClosed || strings.Contains(err.Error(), "mux: listener closed") {
 		return true
 	}
 	if strings.Contains(err.Error(), "use of closed network connection") {
@@ -154,3 +454,29 @@ func reasonableFailure(err error) bool {
 	}
 	return false
 }
+
+// validateServerOptions rejects the gRPC server options which set an
+// interceptor, as there is no way to inspect the options, it relies on
+// grpc.NewServer panicking when an interceptor is set twice.
+func validateServerOptions(opts []grpc.ServerOption) (err error) {
+	if len(opts) == 0 {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the interceptors are installed by etcd adapter: %v", r)
+		}
+	}()
+	probe := make([]grpc.ServerOption, 0, len(opts)+2)
+	probe = append(probe, opts...)
+	probe = append(probe,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, ss)
+		}),
+	)
+	grpc.NewServer(probe...).Stop()
+	return nil
+}
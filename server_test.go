@@ -0,0 +1,529 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/goleak"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/nettest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+func TestEtcdAdapterReady(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	select {
+	case <-a.Ready():
+		t.Fatal("ready before serving")
+	default:
+	}
+
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	// The requests succeed right after it's ready.
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{ln.Addr().String()},
+		DialTimeout: time.Second,
+	})
+	assert.Nil(t, err, "checking error")
+	defer client.Close()
+	_, err = client.Get(context.Background(), "/x")
+	assert.Nil(t, err, "checking error")
+}
+
+func TestEtcdAdapterGRPCServerOptions(t *testing.T) {
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			GRPCServerOptions: []grpc.ServerOption{
+				grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+					return handler(ctx, req)
+				}),
+			},
+		})
+	}, "checking interceptor option")
+
+	value := strings.Repeat("x", 6<<20)
+	for _, raised := range []bool{false, true} {
+		opts := &AdapterOptions{}
+		if raised {
+			opts.GRPCServerOptions = []grpc.ServerOption{
+				grpc.MaxRecvMsgSize(16 << 20),
+				grpc.MaxSendMsgSize(16 << 20),
+			}
+		}
+		_, client, shutdown := startTestAdapter(t, opts)
+		// The client limits the requests to 2 MiB by default.
+		large, err := clientv3.New(clientv3.Config{
+			Endpoints:          client.Endpoints(),
+			MaxCallSendMsgSize: 16 << 20,
+			MaxCallRecvMsgSize: 16 << 20,
+		})
+		assert.Nil(t, err, "checking error")
+
+		_, err = large.Put(context.Background(), "/apisix/routes/1", value)
+		if !raised {
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err), "checking error of default limit")
+		} else {
+			assert.Nil(t, err, "checking error")
+			resp, err := large.Get(context.Background(), "/apisix/routes/1")
+			assert.Nil(t, err, "checking error")
+			assert.Equal(t, len(value), len(resp.Kvs[0].Value), "checking value")
+		}
+		assert.Nil(t, large.Close(), "checking error")
+		shutdown()
+	}
+}
+
+func TestEtcdAdapterGateway(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/routes/2",
+			Value: []byte("2"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/upstreams/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+	})
+
+	post := func(path, body string) (int, map[string]interface{}) {
+		resp, err := http.Post("http://"+client.Endpoints()[0]+path, "application/json", strings.NewReader(body))
+		assert.Nil(t, err, "checking error")
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result), "checking error")
+		return resp.StatusCode, result
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	code, result := post("/v3/kv/range", `{"key":"`+b64("/apisix/routes/")+`","range_end":"`+b64("/apisix/routes0")+`"}`)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	kvs, _ := result["kvs"].([]interface{})
+	assert.Len(t, kvs, 2, "checking key-values")
+	for i, kv := range kvs {
+		key := kv.(map[string]interface{})["key"]
+		assert.Equal(t, b64(fmt.Sprintf("/apisix/routes/%d", i+1)), key, "checking key")
+	}
+
+	code, _ = post("/v3/kv/put", `{"key":"`+b64("/x")+`","value":"`+b64("v1")+`"}`)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	resp, err := client.Get(context.Background(), "/x")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "v1", string(resp.Kvs[0].Value), "checking value")
+	code, result = post("/v3/kv/deleterange", `{"key":"`+b64("/x")+`"}`)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "1", result["deleted"], "checking deleted")
+
+	code, result = post("/v3/lease/grant", `{"TTL":60}`)
+	assert.Equal(t, http.StatusOK, code, "checking status code")
+	assert.Equal(t, "60", result["TTL"], "checking TTL")
+
+	// The errors are in the same form as ETCD.
+	code, result = post("/v3/lease/revoke", `{"ID":1}`)
+	assert.Equal(t, http.StatusNotFound, code, "checking status code")
+	assert.Equal(t, "etcdserver: requested lease not found", result["error"], "checking error")
+	assert.Equal(t, float64(codes.NotFound), result["code"], "checking error code")
+}
+
+// listReflectedServices lists the services by the gRPC server reflection.
+func listReflectedServices(t *testing.T, client *clientv3.Client) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(client.ActiveConnection()).ServerReflectionInfo(context.Background())
+	assert.Nil(t, err, "checking error")
+	defer stream.CloseSend()
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		services = append(services, service.Name)
+	}
+	return services, nil
+}
+
+func TestEtcdAdapterReflection(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	_, err := listReflectedServices(t, client)
+	assert.Equal(t, codes.Unimplemented, status.Code(err), "checking disabled reflection")
+	shutdown()
+
+	// The reflection doesn't require the authentication.
+	_, client, shutdown = startTestAdapter(t, &AdapterOptions{
+		Auth: &AuthOptions{
+			Users: []User{newTestUser(t, "foo", "bar", RootRole)},
+		},
+		Reflection: true,
+	})
+	defer shutdown()
+
+	services, err := listReflectedServices(t, client)
+	assert.Nil(t, err, "checking error")
+	for _, name := range healthServiceNames {
+		assert.Contains(t, services, name, "checking services")
+	}
+
+	stream, err := reflectionpb.NewServerReflectionClient(client.ActiveConnection()).ServerReflectionInfo(context.Background())
+	assert.Nil(t, err, "checking error")
+	defer stream.CloseSend()
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "etcdserverpb.KV"},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, resp.GetErrorResponse(), "checking error response")
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto(), "checking file descriptors")
+
+	// While the ETCD services still do.
+	_, err = client.Get(context.Background(), "/x")
+	assert.Equal(t, rpctypes.ErrUserEmpty, err, "checking error")
+}
+
+func TestEtcdAdapterGracefulShutdown(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	defer client.Close()
+
+	var wchs []clientv3.WatchChan
+	for i := 0; i < 50; i++ {
+		wch := client.Watch(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), clientv3.WithCreatedNotify())
+		waitCreated(t, wch)
+		wchs = append(wchs, wch)
+	}
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(context.Background())
+	assert.Nil(t, err, "checking error")
+	err = stream.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+			CreateRequest: &etcdserverpb.WatchCreateRequest{
+				Key: []byte("/apisix/routes/1"),
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	wresp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, wresp.Created, "checking created flag")
+
+	lease, err := client.Grant(context.Background(), 60)
+	assert.Nil(t, err, "checking error")
+	kch, err := client.KeepAlive(context.Background(), lease.ID)
+	assert.Nil(t, err, "checking error")
+	<-kch
+	keepAlive, err := etcdserverpb.NewLeaseClient(client.ActiveConnection()).LeaseKeepAlive(context.Background())
+	assert.Nil(t, err, "checking error")
+	err = keepAlive.Send(&etcdserverpb.LeaseKeepAliveRequest{ID: int64(lease.ID)})
+	assert.Nil(t, err, "checking error")
+	_, err = keepAlive.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(51), a.Stats().ActiveWatchers, "checking active watchers")
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- a.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdownErr:
+		assert.Nil(t, err, "shutting down")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+
+	// The watchers are canceled with the reason, then the stream ends with
+	// a retriable error.
+	wresp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, wresp.Canceled, "checking canceled flag")
+	assert.Equal(t, wresp.WatchId, int64(0), "checking watch id")
+	assert.Equal(t, rpctypes.ErrStopped.Error(), wresp.CancelReason, "checking cancel reason")
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "checking error")
+	_, err = keepAlive.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "checking error")
+
+	timeout := time.After(5 * time.Second)
+	for i, wch := range wchs {
+		for closed := false; !closed; {
+			select {
+			case _, ok := <-wch:
+				closed = !ok
+			case <-timeout:
+				t.Fatalf("timed out waiting for the watcher %d to close", i)
+			}
+		}
+	}
+	assert.Equal(t, int64(0), a.Stats().ActiveWatchers, "checking active watchers")
+}
+
+func TestEtcdAdapterShutdownDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// The watch streams are held by the interceptor, so they cannot be
+	// drained, like the ones of the kine bridge.
+	watching := make(chan struct{}, 1)
+	a := NewEtcdAdapter(&AdapterOptions{
+		StreamInterceptors: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if info.FullMethod != "/etcdserverpb.Watch/Watch" {
+					return handler(srv, ss)
+				}
+				watching <- struct{}{}
+				<-ss.Context().Done()
+				return ss.Context().Err()
+			},
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.Serve(ctx, ln)
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	wctx, wcancel := context.WithCancel(context.Background())
+	defer wcancel()
+	_, err = etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(wctx)
+	assert.Nil(t, err, "checking error")
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch stream")
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer scancel()
+	start := time.Now()
+	err = a.Shutdown(sctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "checking error")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "checking shutdown duration")
+
+	select {
+	case err := <-serveErr:
+		assert.Nil(t, err, "checking serve returning error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for serve to return")
+	}
+	wcancel()
+	assert.Nil(t, client.Close(), "closing etcd client")
+}
+
+func TestEtcdAdapterShutdownGraceful(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	a := NewEtcdAdapter(nil)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.Serve(ctx, ln)
+	}()
+	waitReady(t, a)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	wch := client.Watch(context.Background(), "/apisix/routes/1")
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	select {
+	case wresp := <-wch:
+		assert.Len(t, wresp.Events, 1, "checking events")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer scancel()
+	assert.Nil(t, a.Shutdown(sctx), "shutting down")
+	select {
+	case err := <-serveErr:
+		assert.Nil(t, err, "checking serve returning error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for serve to return")
+	}
+	assert.Nil(t, client.Close(), "closing etcd client")
+}
+
+func TestEtcdAdapterLifecycle(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	// Shutdown is a no-op before Serve.
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down before serving")
+
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.Serve(ctx, ln)
+	}()
+	waitReady(t, a)
+
+	ln2, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	defer ln2.Close()
+	assert.Equal(t, ErrAlreadyServing, a.Serve(ctx, ln2), "checking serving twice")
+
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	select {
+	case err := <-serveErr:
+		assert.Nil(t, err, "checking serve returning error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for serve to return")
+	}
+
+	assert.Equal(t, ErrClosed, a.Serve(ctx, ln2), "checking serving after shutdown")
+	assert.Equal(t, ErrClosed, a.AddListener(ln2, nil), "checking adding listener after shutdown")
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down twice")
+}
+
+func TestEtcdAdapterListenerClosed(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.Serve(ctx, ln)
+	}()
+	waitReady(t, a)
+
+	// Serve fails if the listener is closed by others.
+	assert.Nil(t, ln.Close(), "closing listener")
+	select {
+	case err := <-serveErr:
+		assert.NotNil(t, err, "checking serve returning error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for serve to return")
+	}
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+}
+
+func TestEtcdAdapterSinglePort(t *testing.T) {
+	a := NewEtcdAdapter(nil)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(context.Background(), ln)
+	}()
+	waitReady(t, a)
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "checking error")
+	defer client.Close()
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "1")
+	assert.Nil(t, err, "checking error")
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+
+	// The HTTP endpoints are served on the same port, over both HTTP/1.1
+	// and the cleartext HTTP/2.
+	h2c := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	for _, httpClient := range []*http.Client{http.DefaultClient, h2c} {
+		httpResp, err := httpClient.Get("http://" + ln.Addr().String() + "/version")
+		assert.Nil(t, err, "checking error")
+		assert.Nil(t, httpResp.Body.Close(), "checking error")
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode, "checking status code")
+	}
+
+	// Serve returns once both the servers are shut down.
+	assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	select {
+	case err := <-served:
+		assert.Nil(t, err, "checking serve returning error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after shutdown")
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// The constants of the bolt file format, which is the format of the ETCD
+// snapshots. See go.etcd.io/bbolt for the details.
+const (
+	boltPageSize         = 4096
+	boltPageHeaderSize   = 16
+	boltElementSize      = 16
+	boltBucketHeaderSize = 16
+	boltMagic            = 0xED0CDAED
+	boltVersion          = 2
+
+	boltBranchPageFlag   = 0x01
+	boltLeafPageFlag     = 0x02
+	boltMetaPageFlag     = 0x04
+	boltFreelistPageFlag = 0x10
+	boltBucketLeafFlag   = 0x01
+
+	// The first two pages are the meta pages, and the third one is the
+	// (empty) freelist, the root bucket follows them.
+	boltFreelistPage = 2
+	boltRootPage     = 3
+)
+
+// errBoltEntriesChanged means the entries of a bucket are different from the
+// ones which the pages were laid out with.
+var errBoltEntriesChanged = errors.New("etcd adapter: snapshot entries changed")
+
+// boltEntry is a key-value in a leaf page.
+type boltEntry struct {
+	flags uint32
+	key   []byte
+	value []byte
+}
+
+// boltEntries calls fn with the entries of a bucket in the order of their
+// keys. It's called twice, first to lay out the pages, then to write them, so
+// the entries must be the same in both calls.
+type boltEntries func(fn func(boltEntry) error) error
+
+// boltNode is a page of the b+tree of a bucket, it spans more than one page
+// if it overflows.
+type boltNode struct {
+	pgid     uint64
+	pages    uint64
+	count    int
+	firstKey []byte
+	// children are the child nodes of a branch page.
+	children []*boltNode
+}
+
+// boltBucket is a bucket of the bolt file.
+type boltBucket struct {
+	name    []byte
+	entries boltEntries
+
+	leaves   []*boltNode
+	branches []*boltNode
+	root     *boltNode
+}
+
+// boltSnapshot writes the buckets as a bolt file, the pages are laid out
+// before writing, so that the file can be written in one pass without
+// holding it in memory.
+type boltSnapshot struct {
+	buckets []*boltBucket
+	// pages is the number of pages in the file.
+	pages uint64
+}
+
+// newBoltSnapshot lays out the buckets, which must be sorted by their names.
+func newBoltSnapshot(buckets []*boltBucket) (*boltSnapshot, error) {
+	s := &boltSnapshot{
+		buckets: buckets,
+		pages:   boltRootPage + 1,
+	}
+	for _, b := range buckets {
+		if err := s.layout(b); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// layout splits the entries into the leaf pages, and builds the branch pages
+// upon them until there is only one root page.
+func (s *boltSnapshot) layout(b *boltBucket) error {
+	var (
+		leaf *boltNode
+		size int
+	)
+	err := b.entries(func(e boltEntry) error {
+		esize := boltElementSize + len(e.key) + len(e.value)
+		if leaf == nil || (leaf.count > 0 && size+esize > boltPageSize) {
+			if leaf != nil {
+				leaf.pages = boltPages(size)
+			}
+			leaf = &boltNode{
+				firstKey: append([]byte(nil), e.key...),
+			}
+			b.leaves = append(b.leaves, leaf)
+			size = boltPageHeaderSize
+		}
+		leaf.count++
+		size += esize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		// The empty bucket still needs a root page.
+		leaf = &boltNode{}
+		b.leaves = append(b.leaves, leaf)
+		size = boltPageHeaderSize
+	}
+	leaf.pages = boltPages(size)
+	for _, n := range b.leaves {
+		n.pgid = s.pages
+		s.pages += n.pages
+	}
+
+	nodes := b.leaves
+	for len(nodes) > 1 {
+		var (
+			parents []*boltNode
+			parent  *boltNode
+		)
+		for _, n := range nodes {
+			esize := boltElementSize + len(n.firstKey)
+			if parent == nil || size+esize > boltPageSize {
+				if parent != nil {
+					parent.pages = boltPages(size)
+				}
+				parent = &boltNode{
+					firstKey: n.firstKey,
+				}
+				parents = append(parents, parent)
+				size = boltPageHeaderSize
+			}
+			parent.children = append(parent.children, n)
+			parent.count++
+			size += esize
+		}
+		parent.pages = boltPages(size)
+		for _, n := range parents {
+			n.pgid = s.pages
+			s.pages += n.pages
+		}
+		b.branches = append(b.branches, parents...)
+		nodes = parents
+	}
+	b.root = nodes[0]
+	return nil
+}
+
+// Size returns the size of the bolt file.
+func (s *boltSnapshot) Size() int64 {
+	return int64(s.pages * boltPageSize)
+}
+
+// WriteTo writes the bolt file to w.
+func (s *boltSnapshot) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	write := func(page []byte) error {
+		n, err := w.Write(page)
+		written += int64(n)
+		return err
+	}
+
+	for id := uint64(0); id < boltFreelistPage; id++ {
+		if err := write(s.metaPage(id)); err != nil {
+			return written, err
+		}
+	}
+	freelist := make([]byte, boltPageSize)
+	putBoltPageHeader(freelist, boltFreelistPage, boltFreelistPageFlag, 0, 0)
+	if err := write(freelist); err != nil {
+		return written, err
+	}
+	root := make([]boltEntry, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		value := make([]byte, boltBucketHeaderSize)
+		binary.LittleEndian.PutUint64(value, b.root.pgid)
+		root = append(root, boltEntry{
+			flags: boltBucketLeafFlag,
+			key:   b.name,
+			value: value,
+		})
+	}
+	rootNode := &boltNode{
+		pgid:  boltRootPage,
+		pages: 1,
+	}
+	if err := write(boltLeafPage(rootNode, root)); err != nil {
+		return written, err
+	}
+
+	for _, b := range s.buckets {
+		var (
+			i       int
+			entries []boltEntry
+		)
+		err := b.entries(func(e boltEntry) error {
+			if i >= len(b.leaves) {
+				return errBoltEntriesChanged
+			}
+			entries = append(entries, e)
+			if len(entries) < b.leaves[i].count {
+				return nil
+			}
+			if err := write(boltLeafPage(b.leaves[i], entries)); err != nil {
+				return err
+			}
+			i++
+			entries = entries[:0]
+			return nil
+		})
+		if err != nil {
+			return written, err
+		}
+		if len(entries) > 0 {
+			return written, errBoltEntriesChanged
+		}
+		if i < len(b.leaves) {
+			if b.leaves[i].count > 0 {
+				return written, errBoltEntriesChanged
+			}
+			// It's the empty bucket.
+			if err := write(boltLeafPage(b.leaves[i], nil)); err != nil {
+				return written, err
+			}
+		}
+		for _, n := range b.branches {
+			if err := write(boltBranchPage(n)); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// metaPage returns the meta page, both meta pages point to the same root
+// bucket, and the second one has a greater transaction id.
+func (s *boltSnapshot) metaPage(id uint64) []byte {
+	page := make([]byte, boltPageSize)
+	putBoltPageHeader(page, id, boltMetaPageFlag, 0, 0)
+	m := page[boltPageHeaderSize:]
+	binary.LittleEndian.PutUint32(m[0:], boltMagic)
+	binary.LittleEndian.PutUint32(m[4:], boltVersion)
+	binary.LittleEndian.PutUint32(m[8:], boltPageSize)
+	// The root bucket.
+	binary.LittleEndian.PutUint64(m[16:], boltRootPage)
+	binary.LittleEndian.PutUint64(m[32:], boltFreelistPage)
+	binary.LittleEndian.PutUint64(m[40:], s.pages)
+	// The transaction id.
+	binary.LittleEndian.PutUint64(m[48:], id)
+	h := fnv.New64a()
+	_, _ = h.Write(m[:56])
+	binary.LittleEndian.PutUint64(m[56:], h.Sum64())
+	return page
+}
+
+func boltLeafPage(n *boltNode, entries []boltEntry) []byte {
+	page := make([]byte, n.pages*boltPageSize)
+	putBoltPageHeader(page, n.pgid, boltLeafPageFlag, len(entries), n.pages-1)
+	off := boltPageHeaderSize + boltElementSize*len(entries)
+	for i, e := range entries {
+		elem := page[boltPageHeaderSize+boltElementSize*i:]
+		pos := off - boltPageHeaderSize - boltElementSize*i
+		binary.LittleEndian.PutUint32(elem[0:], e.flags)
+		binary.LittleEndian.PutUint32(elem[4:], uint32(pos))
+		binary.LittleEndian.PutUint32(elem[8:], uint32(len(e.key)))
+		binary.LittleEndian.PutUint32(elem[12:], uint32(len(e.value)))
+		off += copy(page[off:], e.key)
+		off += copy(page[off:], e.value)
+	}
+	return page
+}
+
+func boltBranchPage(n *boltNode) []byte {
+	page := make([]byte, n.pages*boltPageSize)
+	putBoltPageHeader(page, n.pgid, boltBranchPageFlag, len(n.children), n.pages-1)
+	off := boltPageHeaderSize + boltElementSize*len(n.children)
+	for i, child := range n.children {
+		elem := page[boltPageHeaderSize+boltElementSize*i:]
+		pos := off - boltPageHeaderSize - boltElementSize*i
+		binary.LittleEndian.PutUint32(elem[0:], uint32(pos))
+		binary.LittleEndian.PutUint32(elem[4:], uint32(len(child.firstKey)))
+		binary.LittleEndian.PutUint64(elem[8:], child.pgid)
+		off += copy(page[off:], child.firstKey)
+	}
+	return page
+}
+
+func putBoltPageHeader(page []byte, id uint64, flags uint16, count int, overflow uint64) {
+	binary.LittleEndian.PutUint64(page[0:], id)
+	binary.LittleEndian.PutUint16(page[8:], flags)
+	binary.LittleEndian.PutUint16(page[10:], uint16(count))
+	binary.LittleEndian.PutUint32(page[12:], uint32(overflow))
+}
+
+// boltPages returns the number of pages needed by size bytes.
+func boltPages(size int) uint64 {
+	return uint64((size + boltPageSize - 1) / boltPageSize)
+}
+
+// boltEntrySlice returns the boltEntries of the entries, which are already
+// sorted by their keys.
+func boltEntrySlice(entries []boltEntry) boltEntries {
+	return func(fn func(boltEntry) error) error {
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// newETCDSnapshot lays out the history and the leases in the buckets of the
+// ETCD backend, only the buckets needed to restore the key-values and the
+// leases are written, the others are created by ETCD when it's restored.
+func newETCDSnapshot(history *backends.HistoryResult, leases []*lease) (*boltSnapshot, error) {
+	keys := func(fn func(boltEntry) error) error {
+		for _, c := range history.Changes {
+			value, err := c.KV.Marshal()
+			if err != nil {
+				return err
+			}
+			err = fn(boltEntry{
+				key:   etcdRevisionBytes(c.Revision, c.Sub, c.Tombstone),
+				value: value,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	leaseEntries := make([]boltEntry, 0, len(leases))
+	for _, l := range leases {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(l.id))
+		leaseEntries = append(leaseEntries, boltEntry{
+			key:   key,
+			value: marshalETCDLease(l.id, l.ttl),
+		})
+	}
+
+	index := make([]byte, 8)
+	binary.BigEndian.PutUint64(index, uint64(history.Revision))
+	term := make([]byte, 8)
+	binary.BigEndian.PutUint64(term, raftTerm)
+	meta := []boltEntry{
+		{key: []byte("consistent_index"), value: index},
+	}
+	if history.CompactRevision > 0 {
+		compacted := etcdRevisionBytes(history.CompactRevision, 0, false)
+		meta = append(meta,
+			boltEntry{key: []byte("finishedCompactRev"), value: compacted},
+			boltEntry{key: []byte("scheduledCompactRev"), value: compacted},
+		)
+	}
+	meta = append(meta, boltEntry{key: []byte("term"), value: term})
+
+	return newBoltSnapshot([]*boltBucket{
+		{
+			name:    []byte("key"),
+			entries: keys,
+		},
+		{
+			name:    []byte("lease"),
+			entries: boltEntrySlice(leaseEntries),
+		},
+		{
+			name:    []byte("meta"),
+			entries: boltEntrySlice(meta),
+		},
+	})
+}
+
+// etcdRevisionBytes returns the revision in the format of the keys of the
+// key bucket, the tombstones are marked with a trailing 't'.
+func etcdRevisionBytes(main, sub int64, tombstone bool) []byte {
+	b := make([]byte, 17, 18)
+	binary.BigEndian.PutUint64(b, uint64(main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(sub))
+	if tombstone {
+		b = append(b, 't')
+	}
+	return b
+}
+
+// marshalETCDLease marshals the lease as the leasepb.Lease of ETCD, whose ID
+// and TTL are the first two varint fields.
+func marshalETCDLease(id, ttl int64) []byte {
+	b := make([]byte, 0, 2*(1+binary.MaxVarintLen64))
+	var buf [binary.MaxVarintLen64]byte
+	for i, v := range []int64{id, ttl} {
+		if v == 0 {
+			continue
+		}
+		b = append(b, byte((i+1)<<3))
+		n := binary.PutUvarint(buf[:], uint64(v))
+		b = append(b, buf[:n]...)
+	}
+	return b
+}
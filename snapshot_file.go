@@ -0,0 +1,213 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// The snapshot file starts with the magic and the format version, which is a
+// big-endian uint32, then the gob encoded savedSnapshot follows, and it ends
+// with the CRC-32C checksum of all the bytes before it.
+const (
+	snapshotMagic   = "EADSNAP\x00"
+	snapshotVersion = 1
+
+	snapshotHeaderSize   = len(snapshotMagic) + 4
+	snapshotChecksumSize = 4
+)
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// savedSnapshot is the state of the adapter in the snapshot file, the
+// changes are the history of the backend, so the revisions and the versions
+// are kept.
+type savedSnapshot struct {
+	Revision        int64
+	CompactRevision int64
+	Changes         []savedChange
+	Leases          []savedLease
+}
+
+type savedChange struct {
+	Revision       int64
+	Sub            int64
+	Tombstone      bool
+	Key            []byte
+	Value          []byte
+	CreateRevision int64
+	Version        int64
+	Lease          int64
+}
+
+type savedLease struct {
+	ID  int64
+	TTL int64
+}
+
+func (a *adapter) SaveSnapshot(ctx context.Context, w io.Writer) error {
+	b, ok := a.backend.(backends.Backend)
+	if !ok {
+		return errSnapshotNotSupported
+	}
+	history, err := b.History(ctx)
+	if err != nil {
+		return err
+	}
+	snapshot := &savedSnapshot{
+		Revision:        history.Revision,
+		CompactRevision: history.CompactRevision,
+		Changes:         make([]savedChange, 0, len(history.Changes)),
+	}
+	for _, c := range history.Changes {
+		snapshot.Changes = append(snapshot.Changes, savedChange{
+			Revision:       c.Revision,
+			Sub:            c.Sub,
+			Tombstone:      c.Tombstone,
+			Key:            c.KV.Key,
+			Value:          c.KV.Value,
+			CreateRevision: c.KV.CreateRevision,
+			Version:        c.KV.Version,
+			Lease:          c.KV.Lease,
+		})
+	}
+	if a.lessor != nil {
+		for _, l := range a.lessor.snapshot() {
+			snapshot.Leases = append(snapshot.Leases, savedLease{
+				ID:  l.id,
+				TTL: l.ttl,
+			})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	h := crc32.New(snapshotCRCTable)
+	mw := io.MultiWriter(bw, h)
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotMagic):], snapshotVersion)
+	if _, err := mw.Write(header); err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(mw).Encode(snapshot); err != nil {
+		return err
+	}
+	checksum := make([]byte, snapshotChecksumSize)
+	binary.BigEndian.PutUint32(checksum, h.Sum32())
+	if _, err := bw.Write(checksum); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readSnapshot reads and verifies the snapshot file, the whole file is read
+// before it's decoded, so that a corrupted one is never partially restored.
+func readSnapshot(r io.Reader) (*savedSnapshot, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < snapshotHeaderSize+snapshotChecksumSize || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a snapshot of the etcd adapter", ErrInvalidSnapshot)
+	}
+	version := binary.BigEndian.Uint32(data[len(snapshotMagic):])
+	if version > snapshotVersion {
+		return nil, fmt.Errorf("%w: format version %d is newer than the supported version %d", ErrInvalidSnapshot, version, snapshotVersion)
+	}
+	body := data[:len(data)-snapshotChecksumSize]
+	expected := binary.BigEndian.Uint32(data[len(body):])
+	if actual := crc32.Checksum(body, snapshotCRCTable); actual != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch, expected %08x, got %08x", ErrInvalidSnapshot, expected, actual)
+	}
+	snapshot := &savedSnapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(body[snapshotHeaderSize:])).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	return snapshot, nil
+}
+
+// restoreSnapshot restores the backend from the snapshot file, the leases
+// are restored by restoreLeases once the lessor is created.
+func restoreSnapshot(ctx context.Context, backend backends.Backend, r io.Reader) (*savedSnapshot, error) {
+	restorer, ok := backend.(backends.Restorer)
+	if !ok {
+		return nil, errSnapshotNotSupported
+	}
+	snapshot, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	history := &backends.HistoryResult{
+		Revision:        snapshot.Revision,
+		CompactRevision: snapshot.CompactRevision,
+		Changes:         make([]*backends.Change, 0, len(snapshot.Changes)),
+	}
+	for _, c := range snapshot.Changes {
+		change := &backends.Change{
+			Revision:  c.Revision,
+			Sub:       c.Sub,
+			Tombstone: c.Tombstone,
+			KV: &mvccpb.KeyValue{
+				Key: c.Key,
+			},
+		}
+		if !c.Tombstone {
+			change.KV.CreateRevision = c.CreateRevision
+			change.KV.ModRevision = c.Revision
+			change.KV.Version = c.Version
+			change.KV.Value = c.Value
+			change.KV.Lease = c.Lease
+		}
+		history.Changes = append(history.Changes, change)
+	}
+	if err := restorer.Restore(ctx, history); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// restoreLeases grants the leases of the snapshot and attaches the restored
+// keys to them.
+func (a *adapter) restoreLeases(ctx context.Context, snapshot *savedSnapshot) error {
+	if a.lessor == nil || len(snapshot.Leases) == 0 {
+		return nil
+	}
+	res, err := a.lessor.backend.Range(ctx, []byte{}, []byte{0}, backends.RangeOptions{})
+	if err != nil {
+		return err
+	}
+	leases := make([]*lease, 0, len(snapshot.Leases))
+	for _, l := range snapshot.Leases {
+		leases = append(leases, &lease{
+			id:  l.ID,
+			ttl: l.TTL,
+		})
+	}
+	a.lessor.restore(leases, res.KVs)
+	return nil
+}
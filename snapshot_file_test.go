@@ -0,0 +1,160 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdAdapterSnapshotRoundTrip(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	ctx := context.Background()
+	_, err := client.Put(ctx, "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(ctx, "/apisix/routes/2", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(ctx, "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	// The key is deleted and then recreated, so its create revision and
+	// version start over.
+	_, err = client.Delete(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(ctx, "/apisix/routes/1", "v3")
+	assert.Nil(t, err, "checking error")
+	compactResp, err := client.Put(ctx, "/apisix/routes/1", "v4")
+	assert.Nil(t, err, "checking error")
+	lease, err := client.Grant(ctx, 60)
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(ctx, "/apisix/routes/3", "v1", clientv3.WithLease(lease.ID))
+	assert.Nil(t, err, "checking error")
+	_, err = client.Delete(ctx, "/apisix/routes/2")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(ctx, "/apisix/routes/2", "v2")
+	assert.Nil(t, err, "checking error")
+	compactRev := compactResp.Header.Revision
+	_, err = client.Compact(ctx, compactRev)
+	assert.Nil(t, err, "checking error")
+
+	resp, err := client.Get(ctx, "/apisix/routes/", clientv3.WithPrefix())
+	assert.Nil(t, err, "checking error")
+	rev := resp.Header.Revision
+	expected := make(map[int64]*clientv3.GetResponse)
+	for r := compactRev; r <= rev; r++ {
+		expected[r], err = client.Get(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(r))
+		assert.Nil(t, err, "checking error")
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, a.SaveSnapshot(ctx, &buf), "checking error")
+	shutdown()
+
+	a, client, shutdown = startTestAdapter(t, &AdapterOptions{
+		RestoreSnapshot: bytes.NewReader(buf.Bytes()),
+	})
+	defer shutdown()
+	for r := compactRev; r <= rev; r++ {
+		resp, err := client.Get(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(r))
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, rev, resp.Header.Revision, "checking revision")
+		assert.Equal(t, expected[r].Kvs, resp.Kvs, "checking kvs at revision %d", r)
+	}
+	_, err = client.Get(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(compactRev-1))
+	assert.Equal(t, rpctypes.ErrCompacted, err, "checking compacted error")
+
+	// The leases are restored with the keys attached.
+	assert.Equal(t, []int64{int64(lease.ID)}, a.Leases(), "checking leases")
+	ttl, err := client.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, [][]byte{[]byte("/apisix/routes/3")}, ttl.Keys, "checking lease keys")
+	_, err = client.Revoke(ctx, lease.ID)
+	assert.Nil(t, err, "checking error")
+	getResp, err := client.Get(ctx, "/apisix/routes/3")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, getResp.Kvs, 0, "checking kvs")
+
+	// The revisions continue after the restored ones.
+	putResp, err := client.Put(ctx, "/apisix/routes/1", "v5")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, rev+2, putResp.Header.Revision, "checking revision")
+	getResp, err = client.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), getResp.Kvs[0].Version, "checking version")
+}
+
+func TestReadSnapshotInvalid(t *testing.T) {
+	a, _, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+	_, err := a.Push(context.Background(), &Event{
+		Key:   "/apisix/routes/1",
+		Value: []byte("v1"),
+		Type:  EventAdd,
+	})
+	assert.Nil(t, err, "checking error")
+	var buf bytes.Buffer
+	assert.Nil(t, a.SaveSnapshot(context.Background(), &buf), "checking error")
+	snapshot, err := readSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), snapshot.Revision, "checking revision")
+
+	newer := append([]byte(nil), buf.Bytes()...)
+	binary.BigEndian.PutUint32(newer[len(snapshotMagic):], snapshotVersion+1)
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	cases := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{
+			name:   "not a snapshot",
+			data:   []byte("not a snapshot"),
+			reason: "not a snapshot of the etcd adapter",
+		},
+		{
+			name:   "newer version",
+			data:   newer,
+			reason: "format version 2 is newer than the supported version 1",
+		},
+		{
+			name:   "corrupted",
+			data:   corrupted,
+			reason: "checksum mismatch",
+		},
+		{
+			name:   "truncated",
+			data:   buf.Bytes()[:buf.Len()-1],
+			reason: "checksum mismatch",
+		},
+	}
+	for _, tc := range cases {
+		_, err := readSnapshot(bytes.NewReader(tc.data))
+		assert.True(t, errors.Is(err, ErrInvalidSnapshot), "checking %s error", tc.name)
+		assert.Contains(t, err.Error(), tc.reason, "checking %s error", tc.name)
+	}
+
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			RestoreSnapshot: bytes.NewReader(corrupted),
+		})
+	}, "checking panic")
+}
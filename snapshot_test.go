@@ -0,0 +1,213 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+// readBoltFile reads all the buckets of the bolt file, it checks the file in
+// the same way as bolt reads it.
+func readBoltFile(t *testing.T, file []byte) map[string][]boltEntry {
+	assert.Equal(t, 0, len(file)%boltPageSize, "checking file size")
+	page := func(id uint64) []byte {
+		assert.True(t, int(id+1)*boltPageSize <= len(file), "checking page id %d", id)
+		p := file[id*boltPageSize:]
+		assert.Equal(t, id, binary.LittleEndian.Uint64(p), "checking page id")
+		return p
+	}
+	var root uint64
+	for id := uint64(0); id < 2; id++ {
+		p := page(id)
+		assert.Equal(t, uint16(boltMetaPageFlag), binary.LittleEndian.Uint16(p[8:]), "checking page flags")
+		m := p[boltPageHeaderSize:]
+		assert.Equal(t, uint32(boltMagic), binary.LittleEndian.Uint32(m[0:]), "checking magic")
+		assert.Equal(t, uint32(boltVersion), binary.LittleEndian.Uint32(m[4:]), "checking version")
+		assert.Equal(t, uint32(boltPageSize), binary.LittleEndian.Uint32(m[8:]), "checking page size")
+		assert.Equal(t, uint64(len(file)/boltPageSize), binary.LittleEndian.Uint64(m[40:]), "checking high water mark")
+		h := fnv.New64a()
+		_, _ = h.Write(m[:56])
+		assert.Equal(t, h.Sum64(), binary.LittleEndian.Uint64(m[56:]), "checking checksum")
+		root = binary.LittleEndian.Uint64(m[16:])
+		freelist := page(binary.LittleEndian.Uint64(m[32:]))
+		assert.Equal(t, uint16(boltFreelistPageFlag), binary.LittleEndian.Uint16(freelist[8:]), "checking page flags")
+	}
+
+	// walk returns the entries of the tree rooted at the page.
+	var walk func(id uint64) []boltEntry
+	walk = func(id uint64) []boltEntry {
+		p := page(id)
+		flags := binary.LittleEndian.Uint16(p[8:])
+		count := int(binary.LittleEndian.Uint16(p[10:]))
+		overflow := binary.LittleEndian.Uint32(p[12:])
+		p = p[:(uint64(overflow)+1)*boltPageSize]
+		var entries []boltEntry
+		for i := 0; i < count; i++ {
+			elem := p[boltPageHeaderSize+boltElementSize*i:]
+			switch flags {
+			case boltLeafPageFlag:
+				pos := binary.LittleEndian.Uint32(elem[4:])
+				ksize := binary.LittleEndian.Uint32(elem[8:])
+				vsize := binary.LittleEndian.Uint32(elem[12:])
+				data := elem[pos:]
+				entries = append(entries, boltEntry{
+					flags: binary.LittleEndian.Uint32(elem[0:]),
+					key:   data[:ksize],
+					value: data[ksize : ksize+vsize],
+				})
+			case boltBranchPageFlag:
+				pos := binary.LittleEndian.Uint32(elem[0:])
+				ksize := binary.LittleEndian.Uint32(elem[4:])
+				children := walk(binary.LittleEndian.Uint64(elem[8:]))
+				assert.Equal(t, elem[pos:pos+ksize], children[0].key, "checking branch key")
+				entries = append(entries, children...)
+			default:
+				t.Fatalf("unexpected page flags %d", flags)
+			}
+		}
+		for i := 1; i < len(entries); i++ {
+			assert.True(t, bytes.Compare(entries[i-1].key, entries[i].key) < 0, "checking key order")
+		}
+		return entries
+	}
+
+	buckets := make(map[string][]boltEntry)
+	for _, b := range walk(root) {
+		assert.Equal(t, uint32(boltBucketLeafFlag), b.flags, "checking bucket flags")
+		assert.Len(t, b.value, boltBucketHeaderSize, "checking bucket header")
+		buckets[string(b.key)] = walk(binary.LittleEndian.Uint64(b.value))
+	}
+	return buckets
+}
+
+func TestBoltSnapshot(t *testing.T) {
+	var large []boltEntry
+	for i := 0; i < 10000; i++ {
+		large = append(large, boltEntry{
+			key:   []byte(fmt.Sprintf("key-%05d", i)),
+			value: []byte(strings.Repeat("v", i%200)),
+		})
+	}
+	// The entry which overflows a page.
+	large[5000].value = []byte(strings.Repeat("v", 3*boltPageSize))
+	snapshot, err := newBoltSnapshot([]*boltBucket{
+		{
+			name:    []byte("empty"),
+			entries: boltEntrySlice(nil),
+		},
+		{
+			name:    []byte("large"),
+			entries: boltEntrySlice(large),
+		},
+		{
+			name: []byte("small"),
+			entries: boltEntrySlice([]boltEntry{
+				{key: []byte("k1"), value: []byte("v1")},
+				{key: []byte("k2")},
+			}),
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	assert.True(t, len(snapshot.buckets[1].branches) > 1, "checking branch pages")
+
+	var buf bytes.Buffer
+	n, err := snapshot.WriteTo(&buf)
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, snapshot.Size(), n, "checking written size")
+	assert.Equal(t, snapshot.Size(), int64(buf.Len()), "checking file size")
+
+	buckets := readBoltFile(t, buf.Bytes())
+	assert.Len(t, buckets, 3, "checking buckets")
+	assert.Len(t, buckets["empty"], 0, "checking empty bucket")
+	assert.Equal(t, len(large), len(buckets["large"]), "checking large bucket")
+	for i, e := range buckets["large"] {
+		assert.Equal(t, large[i].key, e.key, "checking key")
+		assert.Equal(t, large[i].value, e.value, "checking value")
+	}
+	assert.Len(t, buckets["small"], 2, "checking small bucket")
+
+	// The entries must be same as the ones laid out with.
+	snapshot.buckets[2].entries = boltEntrySlice([]boltEntry{{key: []byte("k1")}})
+	_, err = snapshot.WriteTo(&bytes.Buffer{})
+	assert.Equal(t, errBoltEntriesChanged, err, "checking error")
+}
+
+func TestETCDSnapshot(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	le := newLessor(backend, zap.NewNop(), newFakeClock(), func(*Event) {})
+	id, _, err := le.grant(100, 60)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), id)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Create(context.Background(), "/apisix/routes/2", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	_, _, _, err = backend.Delete(context.Background(), "/apisix/routes/2", 3)
+	assert.Nil(t, err, "checking error")
+	_, err = backend.Compact(context.Background(), 3)
+	assert.Nil(t, err, "checking error")
+
+	history, err := backend.History(context.Background())
+	assert.Nil(t, err, "checking error")
+	snapshot, err := newETCDSnapshot(history, le.snapshot())
+	assert.Nil(t, err, "checking error")
+	var buf bytes.Buffer
+	_, err = snapshot.WriteTo(&buf)
+	assert.Nil(t, err, "checking error")
+
+	buckets := readBoltFile(t, buf.Bytes())
+	keys := buckets["key"]
+	assert.Len(t, keys, 3, "checking keys")
+	assert.Equal(t, etcdRevisionBytes(2, 0, false), keys[0].key, "checking revision")
+	assert.Equal(t, etcdRevisionBytes(4, 0, true), keys[2].key, "checking revision")
+	kv := &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    2,
+		Version:        1,
+		Value:          []byte("v1"),
+		Lease:          100,
+	}
+	data, err := kv.Marshal()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, data, keys[0].value, "checking key-value")
+	assert.Equal(t, []boltEntry{
+		{
+			key:   []byte{0, 0, 0, 0, 0, 0, 0, 100},
+			value: []byte{1<<3 | 0, 100, 2<<3 | 0, 60},
+		},
+	}, buckets["lease"], "checking leases")
+
+	meta := make(map[string][]byte)
+	for _, e := range buckets["meta"] {
+		meta[string(e.key)] = e.value
+	}
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 4}, meta["consistent_index"], "checking consistent index")
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, raftTerm}, meta["term"], "checking term")
+	assert.Equal(t, etcdRevisionBytes(3, 0, false), meta["finishedCompactRev"], "checking compact revision")
+	assert.Equal(t, etcdRevisionBytes(3, 0, false), meta["scheduledCompactRev"], "checking compact revision")
+}
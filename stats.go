@@ -0,0 +1,92 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Stats are the statistics of the etcd adapter.
+type Stats struct {
+	// SlowWatchersCanceled is the number of the watchers canceled because
+	// they were too slow to catch up before the history was compacted.
+	SlowWatchersCanceled int64
+	// ActiveWatchers is the number of the watchers in all the streams.
+	ActiveWatchers int64
+	// RejectedRequests is the number of the requests rejected by the rate
+	// limit or the concurrency cap.
+	RejectedRequests int64
+	// QueuedEvents is the number of the event batches buffered in the
+	// event channel, it reaching AdapterOptions.EventChannelSize means the
+	// producers are waiting for the events to be applied.
+	QueuedEvents int64
+	// DroppedEventErrors is the number of the event errors dropped as the
+	// channel returned by Adapter.Errors is full.
+	DroppedEventErrors int64
+	// SkippedUpdates is the number of the update and the upsert events
+	// skipped as no-ops, see AdapterOptions.SkipUnchangedUpdates.
+	SkippedUpdates int64
+	// DbSize is the number of bytes allocated by the backend, which
+	// AdapterOptions.QuotaBackendBytes is checked against. It's zero if
+	// the size cannot be got from the backend.
+	DbSize int64
+}
+
+// watchStats are the statistics of the watch service, the fields should be
+// accessed atomically.
+type watchStats struct {
+	slowWatchersCanceled int64
+	activeWatchers       int64
+}
+
+// acquireWatcher takes a slot for a new watcher, it returns false if there
+// are already max active watchers. A non-positive max means no limit.
+func (ws *watchStats) acquireWatcher(max int) bool {
+	for {
+		n := atomic.LoadInt64(&ws.activeWatchers)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&ws.activeWatchers, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (ws *watchStats) releaseWatcher() {
+	atomic.AddInt64(&ws.activeWatchers, -1)
+}
+
+func (a *adapter) Stats() Stats {
+	size, err := a.backend.DbSize(context.Background())
+	if err != nil {
+		a.logger.Warn("failed to get db size for stats",
+			zap.Error(err),
+		)
+	}
+	return Stats{
+		SlowWatchersCanceled: atomic.LoadInt64(&a.watchStats.slowWatchersCanceled),
+		ActiveWatchers:       atomic.LoadInt64(&a.watchStats.activeWatchers),
+		RejectedRequests:     a.rateLimiter.rejectedRequests(),
+		QueuedEvents:         int64(len(a.eventsCh)),
+		DroppedEventErrors:   atomic.LoadInt64(&a.eventStats.droppedErrors),
+		SkippedUpdates:       atomic.LoadInt64(&a.eventStats.skippedUpdates),
+		DbSize:               size,
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions contains the TLS settings of the listener passed to Serve, like
+// the --cert-file, --key-file and --trusted-ca-file of ETCD. Both the gRPC
+// services and the HTTP endpoints are served over the TLS.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM encoded certificate and private key
+	// of the server.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM encoded CA certificates to verify the client
+	// certificates. If it's set, the clients must present a certificate
+	// issued by one of the CAs, i.e. the mutual TLS.
+	ClientCAFile string
+	// Config is used instead of the files if it's not nil, e.g. to reload
+	// the certificates by the GetCertificate.
+	Config *tls.Config
+}
+
+// newTLSConfig returns the server TLS config of the options.
+func newTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	var cfg *tls.Config
+	if opts.Config != nil {
+		cfg = opts.Config.Clone()
+	} else {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("both the cert file and the key file are required")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if opts.ClientCAFile != "" {
+			data, err := ioutil.ReadFile(opts.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %s", opts.ClientCAFile)
+			}
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	// The gRPC clients negotiate h2, while the HTTP ones use HTTP/1.1.
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return cfg, nil
+}
+
+// gatewayTLSConfig returns the TLS config of the gRPC gateway, which dials
+// the adapter itself. Like ETCD, the server certificate is also presented as
+// the client certificate, and the server is trusted without verification.
+func gatewayTLSConfig(cfg *tls.Config) *tls.Config {
+	dtls := cfg.Clone()
+	dtls.InsecureSkipVerify = true
+	dtls.NextProtos = nil
+	return dtls
+}
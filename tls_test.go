@@ -0,0 +1,180 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+)
+
+// writeTestCertFiles writes the PEM encoded certificate and key files of
+// the certificate to the directory.
+func writeTestCertFiles(t testing.TB, dir, name string, cert tls.Certificate) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600), "checking error")
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err, "checking error")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600), "checking error")
+	return certFile, keyFile
+}
+
+// writeFile writes the CA certificate file.
+func (ca *testCA) writeFile(t testing.TB, dir string) string {
+	file := filepath.Join(dir, "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	assert.Nil(t, ioutil.WriteFile(file, data, 0600), "checking error")
+	return file
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeTestCertFiles(t, dir, "server", ca.issue(t, "localhost", true))
+	caFile := ca.writeFile(t, dir)
+	invalidFile := filepath.Join(dir, "invalid")
+	assert.Nil(t, ioutil.WriteFile(invalidFile, []byte("invalid"), 0600), "checking error")
+
+	cfg, err := newTLSConfig(&TLSOptions{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, cfg.Certificates, 1, "checking certificates")
+	assert.Equal(t, tls.NoClientCert, cfg.ClientAuth, "checking client auth")
+	assert.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos, "checking next protos")
+
+	cfg, err = newTLSConfig(&TLSOptions{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+	})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth, "checking client auth")
+	assert.NotNil(t, cfg.ClientCAs, "checking client CAs")
+
+	// The config is cloned, so it's not modified.
+	orig := &tls.Config{}
+	cfg, err = newTLSConfig(&TLSOptions{Config: orig})
+	assert.Nil(t, err, "checking error")
+	assert.Empty(t, orig.NextProtos, "checking next protos")
+	assert.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos, "checking next protos")
+
+	cases := []struct {
+		name string
+		opts *TLSOptions
+	}{
+		{
+			name: "no key file",
+			opts: &TLSOptions{CertFile: certFile},
+		},
+		{
+			name: "invalid cert file",
+			opts: &TLSOptions{CertFile: invalidFile, KeyFile: keyFile},
+		},
+		{
+			name: "missing client CA file",
+			opts: &TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing")},
+		},
+		{
+			name: "invalid client CA file",
+			opts: &TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: invalidFile},
+		},
+	}
+	for _, c := range cases {
+		_, err := newTLSConfig(c.opts)
+		assert.NotNil(t, err, "checking error of %s", c.name)
+	}
+}
+
+func TestEtcdAdapterTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeTestCertFiles(t, dir, "server", ca.issue(t, "localhost", true))
+	a := NewEtcdAdapter(&AdapterOptions{
+		TLS: &TLSOptions{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: ca.writeFile(t, dir),
+		},
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	tlsConfig := &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "client", false)},
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+		TLS:       tlsConfig,
+	})
+	assert.Nil(t, err, "checking error")
+	defer client.Close()
+
+	sendEvents(t, a, []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("1"),
+			Type:  EventAdd,
+		},
+	})
+	resp, err := client.Get(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Kvs, 1, "checking key-values")
+	members, err := client.MemberList(context.Background())
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, []string{"https://" + ln.Addr().String()}, members.Members[0].ClientURLs, "checking client urls")
+
+	// The HTTP endpoints are served over the TLS too.
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	httpResp, err := httpClient.Get("https://" + ln.Addr().String() + "/version")
+	assert.Nil(t, err, "checking error")
+	assert.Nil(t, httpResp.Body.Close(), "checking error")
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode, "checking status code")
+
+	// The clients without the certificates are rejected.
+	_, err = http.Get("http://" + ln.Addr().String() + "/version")
+	assert.NotNil(t, err, "checking error")
+	_, err = (&http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}},
+	}).Get("https://" + ln.Addr().String() + "/version")
+	assert.NotNil(t, err, "checking error")
+}
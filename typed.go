@@ -0,0 +1,223 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Object is an object of the application, it's stored as the value of its
+// key.
+type Object interface {
+	// Key returns the key of the object, e.g. "/apisix/routes/1".
+	Key() string
+}
+
+// Codec encodes the objects into the values of their keys, and decodes the
+// values back. Decode returns the concrete type of the application, e.g. a
+// *Route, which the users assert the Object to.
+type Codec interface {
+	Encode(obj Object) ([]byte, error)
+	Decode(key string, value []byte) (Object, error)
+}
+
+// JSONCodec returns a Codec which encodes the objects in JSON, newObject
+// returns the object which a value is decoded into, e.g. a new(Route).
+func JSONCodec(newObject func() Object) Codec {
+	return jsonCodec{newObject: newObject}
+}
+
+type jsonCodec struct {
+	newObject func() Object
+}
+
+func (c jsonCodec) Encode(obj Object) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (c jsonCodec) Decode(_ string, value []byte) (Object, error) {
+	obj := c.newObject()
+	if err := json.Unmarshal(value, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ObjectEvent is a change made by the ETCD clients, with its value decoded.
+type ObjectEvent struct {
+	// Key is the object key.
+	Key string
+	// Type is the event type.
+	Type EventType
+	// Object is the decoded object, it's nil for the delete events, and if
+	// the value cannot be decoded.
+	Object Object
+	// Err is the error of decoding the value.
+	Err error
+}
+
+// TypedAdapter is a facade of the Adapter for the applications which work
+// with the objects of one type rather than the serialized values. The
+// objects are encoded and decoded by the Codec, while the gRPC services are
+// same as the Adapter, which is embedded to serve and shut it down. Get
+// returns the Object interface rather than the type of the application, as
+// Go 1.16 has no generics.
+type TypedAdapter struct {
+	Adapter
+
+	adapter *adapter
+	codec   Codec
+}
+
+// NewTypedAdapter creates the Adapter by the options, and the TypedAdapter
+// over it. It panics if the codec is nil.
+func NewTypedAdapter(opts *AdapterOptions, codec Codec) *TypedAdapter {
+	if codec == nil {
+		panic("codec of the typed adapter is nil")
+	}
+	a := NewEtcdAdapter(opts)
+	return &TypedAdapter{
+		Adapter: a,
+		adapter: a.(*adapter),
+		codec:   codec,
+	}
+}
+
+// PushAdd adds the objects in order with the events, it returns the revision
+// of the objects. They're applied in one transaction, so they share one
+// revision and are delivered to the watchers in one response, and none of
+// them is applied if any of them fails, e.g. with ErrKeyExists, or with
+// ErrDuplicateKey if two objects have the same key. It returns ErrNilObject
+// if an object is nil, including a nil pointer in the interface. It's only
+// supported by the btree backend.
+func (ta *TypedAdapter) PushAdd(ctx context.Context, objs ...Object) (int64, error) {
+	return ta.pushObjects(ctx, EventAdd, objs)
+}
+
+// PushUpdate is same as PushAdd, but updates the objects.
+func (ta *TypedAdapter) PushUpdate(ctx context.Context, objs ...Object) (int64, error) {
+	return ta.pushObjects(ctx, EventUpdate, objs)
+}
+
+// PushDelete is same as PushAdd, but deletes the keys.
+func (ta *TypedAdapter) PushDelete(ctx context.Context, keys ...string) (int64, error) {
+	events := make([]*Event, 0, len(keys))
+	for _, key := range keys {
+		events = append(events, &Event{
+			Key:  key,
+			Type: EventDelete,
+		})
+	}
+	return ta.push(ctx, events)
+}
+
+func (ta *TypedAdapter) pushObjects(ctx context.Context, typ EventType, objs []Object) (int64, error) {
+	events := make([]*Event, 0, len(objs))
+	for _, obj := range objs {
+		if isNilObject(obj) {
+			return 0, ErrNilObject
+		}
+		value, err := ta.codec.Encode(obj)
+		if err != nil {
+			return 0, fmt.Errorf("etcd adapter: failed to encode %s: %w", obj.Key(), err)
+		}
+		events = append(events, &Event{
+			Key:   obj.Key(),
+			Value: value,
+			Type:  typ,
+		})
+	}
+	return ta.push(ctx, events)
+}
+
+func (ta *TypedAdapter) push(ctx context.Context, events []*Event) (int64, error) {
+	return ta.adapter.pushEvents(ctx, events)
+}
+
+// Get returns the decoded object of the key, or false if the key doesn't
+// exist.
+func (ta *TypedAdapter) Get(ctx context.Context, key string) (Object, bool, error) {
+	_, kv, err := ta.adapter.backend.Get(ctx, key, 0)
+	if err != nil || kv == nil {
+		return nil, false, err
+	}
+	obj, err := ta.decode(key, kv.Value)
+	if err != nil {
+		return nil, false, err
+	}
+	return obj, true, nil
+}
+
+// Outbound decodes the changes delivered to the OutboundCh of the Adapter,
+// and sends them to the returned channel until ctx is done, then it's
+// closed. It consumes the OutboundCh, so call it once.
+func (ta *TypedAdapter) Outbound(ctx context.Context) <-chan *ObjectEvent {
+	ch := make(chan *ObjectEvent)
+	go func() {
+		defer close(ch)
+		for {
+			var ev *Event
+			select {
+			case ev = <-ta.OutboundCh():
+			case <-ctx.Done():
+				return
+			}
+			oe := &ObjectEvent{
+				Key:  ev.Key,
+				Type: ev.Type,
+			}
+			if ev.Type != EventDelete {
+				oe.Object, oe.Err = ta.decode(ev.Key, ev.Value)
+			}
+			select {
+			case ch <- oe:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// decode decodes the value by the codec, a nil object is an error, so that
+// the users never get a nil pointer in the interface.
+func (ta *TypedAdapter) decode(key string, value []byte) (Object, error) {
+	obj, err := ta.codec.Decode(key, value)
+	if err != nil {
+		return nil, fmt.Errorf("etcd adapter: failed to decode %s: %w", key, err)
+	}
+	if isNilObject(obj) {
+		return nil, fmt.Errorf("etcd adapter: failed to decode %s: %w", key, ErrNilObject)
+	}
+	return obj, nil
+}
+
+// isNilObject checks whether the object is nil, or a nil pointer (map,
+// slice, etc.) in the interface.
+func isNilObject(obj Object) bool {
+	if obj == nil {
+		return true
+	}
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
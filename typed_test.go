@@ -0,0 +1,203 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/nettest"
+)
+
+type testRoute struct {
+	ID  string `json:"id"`
+	URI string `json:"uri,omitempty"`
+}
+
+func (r *testRoute) Key() string {
+	return "/apisix/routes/" + r.ID
+}
+
+// nilCodec decodes every value into a nil *testRoute.
+type nilCodec struct {
+	Codec
+}
+
+func (nilCodec) Decode(string, []byte) (Object, error) {
+	var r *testRoute
+	return r, nil
+}
+
+func startTestTypedAdapter(t *testing.T, codec Codec) (*TypedAdapter, *clientv3.Client, func()) {
+	ta := NewTypedAdapter(nil, codec)
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		err := ta.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, ta)
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{ln.Addr().String()},
+	})
+	assert.Nil(t, err, "creating etcd client")
+	return ta, client, func() {
+		assert.Nil(t, client.Close(), "closing etcd client")
+		assert.Nil(t, ta.Shutdown(context.Background()), "shutting down")
+		cancel()
+	}
+}
+
+func TestTypedAdapter(t *testing.T) {
+	ta, client, shutdown := startTestTypedAdapter(t, JSONCodec(func() Object {
+		return new(testRoute)
+	}))
+	defer shutdown()
+	ctx := context.Background()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix())
+
+	// The objects pushed together share one revision, and they're delivered
+	// to the watchers in one response.
+	rev, err := ta.PushAdd(ctx, &testRoute{ID: "1", URI: "/a"}, &testRoute{ID: "2"})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(2), rev, "checking revision")
+	select {
+	case wresp := <-wch:
+		assert.Len(t, wresp.Events, 2, "checking events")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch response")
+	}
+	resp, err := client.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, `{"id":"1","uri":"/a"}`, string(resp.Kvs[0].Value), "checking value")
+
+	obj, ok, err := ta.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking existence")
+	assert.Equal(t, &testRoute{ID: "1", URI: "/a"}, obj, "checking object")
+	// The zero fields are kept as they are.
+	obj, ok, err = ta.Get(ctx, "/apisix/routes/2")
+	assert.Nil(t, err, "checking error")
+	assert.True(t, ok, "checking existence")
+	assert.Equal(t, &testRoute{ID: "2"}, obj, "checking object")
+
+	// None of the objects is pushed if any of them fails.
+	_, err = ta.PushAdd(ctx, &testRoute{ID: "3"}, &testRoute{ID: "1"})
+	assert.Equal(t, ErrKeyExists, err, "checking error")
+	_, err = ta.PushAdd(ctx, &testRoute{ID: "3"}, &testRoute{ID: "3", URI: "/c"})
+	assert.Equal(t, ErrDuplicateKey, err, "checking error")
+	_, ok, err = ta.Get(ctx, "/apisix/routes/3")
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking existence")
+
+	rev, err = ta.PushUpdate(ctx, &testRoute{ID: "1", URI: "/b"})
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(3), rev, "checking revision")
+	obj, _, err = ta.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "/b", obj.(*testRoute).URI, "checking uri")
+	_, err = ta.PushUpdate(ctx, &testRoute{ID: "3"})
+	assert.Equal(t, ErrKeyNotFound, err, "checking error")
+
+	rev, err = ta.PushDelete(ctx, "/apisix/routes/1", "/apisix/routes/2")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(4), rev, "checking revision")
+	obj, ok, err = ta.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking existence")
+	assert.Nil(t, obj, "checking object")
+
+	// Neither a nil interface nor a nil pointer in it is pushed, and nothing
+	// is pushed if any object is nil.
+	var nilRoute *testRoute
+	for _, objs := range [][]Object{{nil}, {nilRoute}, {&testRoute{ID: "1"}, nilRoute}} {
+		_, err = ta.PushAdd(ctx, objs...)
+		assert.Equal(t, ErrNilObject, err, "checking error")
+	}
+	_, ok, err = ta.Get(ctx, "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+	assert.False(t, ok, "checking existence")
+}
+
+func TestTypedAdapterDecodeNil(t *testing.T) {
+	ta, _, shutdown := startTestTypedAdapter(t, nilCodec{Codec: JSONCodec(func() Object {
+		return new(testRoute)
+	})})
+	defer shutdown()
+
+	_, err := ta.PushAdd(context.Background(), &testRoute{ID: "1"})
+	assert.Nil(t, err, "checking error")
+	obj, ok, err := ta.Get(context.Background(), "/apisix/routes/1")
+	assert.True(t, errors.Is(err, ErrNilObject), "checking error")
+	assert.False(t, ok, "checking existence")
+	assert.True(t, obj == nil, "checking object")
+}
+
+func TestTypedAdapterOutbound(t *testing.T) {
+	ta, client, shutdown := startTestTypedAdapter(t, JSONCodec(func() Object {
+		return new(testRoute)
+	}))
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ta.Outbound(ctx)
+	_, err := client.Put(context.Background(), "/apisix/routes/1", `{"id":"1","uri":"/a"}`)
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "not json")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+
+	var events []*ObjectEvent
+	for len(events) < 3 {
+		select {
+		case ev := <-ch:
+			events = append(events, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the outbound events")
+		}
+	}
+	assert.Equal(t, &ObjectEvent{
+		Key:    "/apisix/routes/1",
+		Type:   EventAdd,
+		Object: &testRoute{ID: "1", URI: "/a"},
+	}, events[0], "checking event")
+	assert.Equal(t, "/apisix/routes/2", events[1].Key, "checking key")
+	assert.NotNil(t, events[1].Err, "checking error")
+	assert.True(t, events[1].Object == nil, "checking object")
+	assert.Equal(t, &ObjectEvent{
+		Key:  "/apisix/routes/1",
+		Type: EventDelete,
+	}, events[2], "checking event")
+
+	// The channel is closed once the context is done.
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok, "checking channel closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the channel to close")
+	}
+
+	assert.Panics(t, func() {
+		NewTypedAdapter(nil, nil)
+	}, "checking panic")
+}
@@ -0,0 +1,70 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// DefaultEmulatedVersion is the ETCD version that etcd adapter claims by
+// default.
+const DefaultEmulatedVersion = "3.5.0-pre"
+
+var versionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)(-[0-9A-Za-z.-]+)?$`)
+
+// emulatedVersion is the ETCD version that etcd adapter claims, it's
+// reported by the /version endpoint and the Status RPC, and the behaviors
+// which differ between the versions follow it.
+type emulatedVersion struct {
+	major int
+	minor int
+	// server is the version of the server, cluster is the major and minor
+	// version of it, like the cluster version of ETCD.
+	server  string
+	cluster string
+}
+
+// parseEmulatedVersion parses the version, only 3.4 and 3.5 are supported.
+// The cluster version is derived from it if it's empty.
+func parseEmulatedVersion(v, cluster string) (*emulatedVersion, error) {
+	m := versionRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return nil, fmt.Errorf("invalid emulated version %q", v)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	if major != 3 || (minor != 4 && minor != 5) {
+		return nil, fmt.Errorf("unsupported emulated version %q, only 3.4 and 3.5 are supported", v)
+	}
+	if cluster == "" {
+		cluster = fmt.Sprintf("%d.%d.0", major, minor)
+	} else if !versionRegexp.MatchString(cluster) {
+		return nil, fmt.Errorf("invalid cluster version %q", cluster)
+	}
+	return &emulatedVersion{
+		major:   major,
+		minor:   minor,
+		server:  v,
+		cluster: cluster,
+	}, nil
+}
+
+// atLeast checks whether the version is at least major.minor.
+func (v *emulatedVersion) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
@@ -0,0 +1,181 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"golang.org/x/net/nettest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseEmulatedVersion(t *testing.T) {
+	cases := []struct {
+		version string
+		cluster string
+	}{
+		{
+			version: "3.4.32",
+			cluster: "3.4.0",
+		},
+		{
+			version: "3.5.0-pre",
+			cluster: "3.5.0",
+		},
+		{
+			version: "3.5.9",
+			cluster: "3.5.0",
+		},
+	}
+	for _, c := range cases {
+		v, err := parseEmulatedVersion(c.version, "")
+		assert.Nil(t, err, "checking error of %s", c.version)
+		assert.Equal(t, c.version, v.server, "checking server version")
+		assert.Equal(t, c.cluster, v.cluster, "checking cluster version")
+	}
+
+	for _, version := range []string{"", "3.4", "v3.4.32", "3.4.x", "3.3.25", "3.6.0", "2.3.8", "garbage"} {
+		_, err := parseEmulatedVersion(version, "")
+		assert.NotNil(t, err, "checking error of %s", version)
+	}
+}
+
+func TestParseEmulatedVersionCluster(t *testing.T) {
+	v, err := parseEmulatedVersion("3.4.9", "3.4.9")
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, "3.4.9", v.server, "checking server version")
+	assert.Equal(t, "3.4.9", v.cluster, "checking cluster version")
+
+	for _, cluster := range []string{"3.4", "v3.4.0", "garbage"} {
+		_, err := parseEmulatedVersion("3.4.9", cluster)
+		assert.NotNil(t, err, "checking error of %s", cluster)
+	}
+}
+
+func TestEmulatedVersionAtLeast(t *testing.T) {
+	v, err := parseEmulatedVersion("3.4.32", "")
+	assert.Nil(t, err, "checking error")
+	assert.True(t, v.atLeast(3, 4), "checking 3.4")
+	assert.False(t, v.atLeast(3, 5), "checking 3.5")
+	assert.False(t, v.atLeast(4, 0), "checking 4.0")
+}
+
+func TestShowEmulatedVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	a := NewEtcdAdapter(&AdapterOptions{
+		EmulatedVersion: "3.4.32",
+	}).(*adapter)
+	a.showVersion(w, nil)
+
+	assert.Equal(t, http.StatusOK, w.Code, "checking status code")
+	assert.Equal(t, "{\"etcdserver\":\"3.4.32\",\"etcdcluster\":\"3.4.0\"}", w.Body.String())
+
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			EmulatedVersion: "3.6.0",
+		})
+	}, "checking unsupported version")
+	assert.Panics(t, func() {
+		NewEtcdAdapter(&AdapterOptions{
+			EmulatedVersion: "3.4.9",
+			ClusterVersion:  "3.4",
+		})
+	}, "checking invalid cluster version")
+}
+
+func TestEtcdAdapterVersionEndpoint(t *testing.T) {
+	a := NewEtcdAdapter(&AdapterOptions{
+		EmulatedVersion: "3.4.9",
+		ClusterVersion:  "3.4.9",
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	assert.Nil(t, err, "checking listener creating error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := a.Serve(ctx, ln)
+		assert.Nil(t, err, "checking serve returning error")
+	}()
+	waitReady(t, a)
+	defer func() {
+		assert.Nil(t, a.Shutdown(context.Background()), "shutting down")
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/version")
+	assert.Nil(t, err, "checking error")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "checking status code")
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"), "checking content type")
+	var versions struct {
+		Server  string `json:"etcdserver"`
+		Cluster string `json:"etcdcluster"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&versions), "checking decoding error")
+	assert.Equal(t, "3.4.9", versions.Server, "checking server version")
+	assert.Equal(t, "3.4.9", versions.Cluster, "checking cluster version")
+}
+
+func TestEtcdAdapterEmulatedVersion(t *testing.T) {
+	cases := []struct {
+		version string
+		cluster string
+		// downgradeError is the error of the Downgrade RPC, which is unknown
+		// to ETCD 3.4.
+		downgradeError error
+	}{
+		{
+			version:        "3.4.32",
+			cluster:        "3.4.0",
+			downgradeError: status.Error(codes.Unimplemented, "unknown method Downgrade for service etcdserverpb.Maintenance"),
+		},
+		{
+			version:        "3.5.0",
+			cluster:        "3.5.0",
+			downgradeError: errGRPCDowngradeNotSupported,
+		},
+	}
+	for _, c := range cases {
+		_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+			EmulatedVersion: c.version,
+		})
+
+		resp, err := http.Get("http://" + client.Endpoints()[0] + "/version")
+		assert.Nil(t, err, "checking error")
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err, "checking error")
+		assert.Nil(t, resp.Body.Close(), "checking error")
+		assert.Equal(t, `{"etcdserver":"`+c.version+`","etcdcluster":"`+c.cluster+`"}`, string(body), "checking version")
+
+		statusResp, err := client.Status(context.Background(), client.Endpoints()[0])
+		assert.Nil(t, err, "checking error")
+		assert.Equal(t, c.version, statusResp.Version, "checking version")
+
+		maintenance := etcdserverpb.NewMaintenanceClient(client.ActiveConnection())
+		_, err = maintenance.Downgrade(context.Background(), &etcdserverpb.DowngradeRequest{
+			Version: "3.4.0",
+		})
+		assert.Equal(t, c.downgradeError.Error(), err.Error(), "checking error")
+		shutdown()
+	}
+}
@@ -0,0 +1,673 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+const (
+	// ctrlStreamBufLen is the buffer size of the control responses (e.g.
+	// the created responses) of a watch stream.
+	ctrlStreamBufLen = 16
+	// invalidWatchID is the watch id in the response of a watch which
+	// failed to be created, or of a progress notification for all the
+	// watchers in the stream.
+	invalidWatchID = -1
+)
+
+// watchServer implements the etcdserverpb.WatchServer interface on top of
+// the backends.Backend, so that the watchers are able to watch any range.
+type watchServer struct {
+	backend                backends.Backend
+	logger                 *zap.Logger
+	progressNotifyInterval time.Duration
+	maxResponseBytes       int
+	watcherBufferSize      int
+	maxWatchers            int
+	batchInterval          time.Duration
+	batchMaxEvents         int
+	stats                  *watchStats
+	clock                  Clock
+	// auth checks the permissions of the users if the authentication is
+	// enabled.
+	auth      *authStore
+	allowlist *allowlist
+	// drain is closed when the adapter is shutting down.
+	drain <-chan struct{}
+
+	// streams are the active gRPC watch streams, they're listed by the
+	// state dump.
+	streamsMu sync.Mutex
+	streams   map[*serverWatchStream]struct{}
+}
+
+// serverWatchStream is a gRPC watch stream, all the watchers created on it
+// share the same backends.WatchStream.
+type serverWatchStream struct {
+	backend     backends.Backend
+	logger      *zap.Logger
+	stats       *watchStats
+	clock       Clock
+	auth        *authStore
+	allowlist   *allowlist
+	watchStream backends.WatchStream
+	gRPCStream  etcdserverpb.Watch_WatchServer
+	drain       <-chan struct{}
+	// peer is the address of the client.
+	peer string
+
+	// ctrlStream carries the responses which are not generated by the
+	// backend, e.g. the created responses.
+	ctrlStream chan *etcdserverpb.WatchResponse
+	// batcher merges the event responses, it's nil if the batching is
+	// disabled.
+	batcher *watchBatcher
+
+	progressNotifyInterval time.Duration
+	maxResponseBytes       int
+	maxWatchers            int
+
+	mu     sync.Mutex
+	closed bool
+	// active are the watchers which take the slots of MaxWatchers.
+	active map[int64]struct{}
+	// progress are the watchers which require the progress notifications,
+	// the value indicates whether a notification is needed in the current
+	// interval, it's false if there are events sent in the interval.
+	progress map[int64]bool
+	// prevKV are the watchers which require the previous key-values.
+	prevKV map[int64]struct{}
+	// fragment are the watchers which allow the responses to be split.
+	fragment map[int64]struct{}
+	// canceling are the watchers whose canceled responses haven't been
+	// sent, their ids cannot be reused until then.
+	canceling map[int64]struct{}
+	// startRevs are the start revisions requested by the watchers.
+	startRevs map[int64]int64
+
+	wg     sync.WaitGroup
+	closec chan struct{}
+}
+
+func (ws *watchServer) Watch(stream etcdserverpb.Watch_WatchServer) error {
+	sws := &serverWatchStream{
+		backend:   ws.backend,
+		logger:    ws.logger,
+		stats:     ws.stats,
+		clock:     ws.clock,
+		auth:      ws.auth,
+		allowlist: ws.allowlist,
+		watchStream: ws.backend.NewWatchStream(backends.WatchStreamOptions{
+			BufferSize: ws.watcherBufferSize,
+		}),
+		gRPCStream: stream,
+		drain:      ws.drain,
+		ctrlStream: make(chan *etcdserverpb.WatchResponse, ctrlStreamBufLen),
+		closec:     make(chan struct{}),
+
+		progressNotifyInterval: ws.progressNotifyInterval,
+		progress:               make(map[int64]bool),
+		prevKV:                 make(map[int64]struct{}),
+		fragment:               make(map[int64]struct{}),
+		canceling:              make(map[int64]struct{}),
+		startRevs:              make(map[int64]int64),
+		active:                 make(map[int64]struct{}),
+		maxResponseBytes:       ws.maxResponseBytes,
+		maxWatchers:            ws.maxWatchers,
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		sws.peer = p.Addr.String()
+	}
+	ws.addStream(sws)
+	defer ws.removeStream(sws)
+
+	sws.wg.Add(1)
+	if ws.batchInterval > 0 {
+		sws.batcher = newWatchBatcher(ws.clock, ws.batchInterval, ws.batchMaxEvents)
+	}
+	sendDone := make(chan struct{})
+	go func() {
+		defer sws.wg.Done()
+		defer close(sendDone)
+		sws.sendLoop()
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		if err := sws.recvLoop(); err != nil {
+			errc <- err
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-stream.Context().Done():
+		err = stream.Context().Err()
+	case <-ws.drain:
+		// The send loop cancels all the watchers, then the stream ends
+		// with a retriable error.
+		select {
+		case <-sendDone:
+		case <-stream.Context().Done():
+		}
+		err = rpctypes.ErrGRPCStopped
+	}
+	sws.close()
+	return err
+}
+
+func (ws *watchServer) addStream(sws *serverWatchStream) {
+	ws.streamsMu.Lock()
+	defer ws.streamsMu.Unlock()
+	if ws.streams == nil {
+		ws.streams = make(map[*serverWatchStream]struct{})
+	}
+	ws.streams[sws] = struct{}{}
+}
+
+func (ws *watchServer) removeStream(sws *serverWatchStream) {
+	ws.streamsMu.Lock()
+	defer ws.streamsMu.Unlock()
+	delete(ws.streams, sws)
+}
+
+// watcherStates returns the states of the watchers in all the streams,
+// sorted by the peers and then the ids.
+func (ws *watchServer) watcherStates() []WatcherState {
+	ws.streamsMu.Lock()
+	streams := make([]*serverWatchStream, 0, len(ws.streams))
+	for sws := range ws.streams {
+		streams = append(streams, sws)
+	}
+	ws.streamsMu.Unlock()
+
+	var states []WatcherState
+	for _, sws := range streams {
+		for _, w := range sws.watchStream.Watchers() {
+			sws.mu.Lock()
+			startRev := sws.startRevs[w.ID]
+			sws.mu.Unlock()
+			states = append(states, WatcherState{
+				ID:            w.ID,
+				Key:           string(w.Key),
+				RangeEnd:      string(w.End),
+				StartRevision: startRev,
+				Pending:       w.Pending,
+				Slow:          w.Slow,
+				Peer:          sws.peer,
+			})
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		if states[i].Peer != states[j].Peer {
+			return states[i].Peer < states[j].Peer
+		}
+		return states[i].ID < states[j].ID
+	})
+	return states
+}
+
+func (sws *serverWatchStream) recvLoop() error {
+	for {
+		req, err := sws.gRPCStream.Recv()
+		if err == io.EOF {
+			// The client closes the send direction, but it still can
+			// receive the responses.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch uv := req.RequestUnion.(type) {
+		case *etcdserverpb.WatchRequest_CreateRequest:
+			if uv.CreateRequest == nil {
+				continue
+			}
+			if !sws.createWatch(uv.CreateRequest) {
+				return nil
+			}
+		case *etcdserverpb.WatchRequest_CancelRequest:
+			if uv.CancelRequest == nil {
+				continue
+			}
+			sws.cancelWatch(uv.CancelRequest.WatchId)
+		case *etcdserverpb.WatchRequest_ProgressRequest:
+			if uv.ProgressRequest == nil {
+				continue
+			}
+			sws.watchStream.RequestProgressAll()
+		default:
+			// Unknown requests are ignored, like what ETCD does.
+		}
+	}
+}
+
+// createWatch creates a watcher and sends the created response, it returns
+// false if the stream is closed.
+func (sws *serverWatchStream) createWatch(creq *etcdserverpb.WatchCreateRequest) bool {
+	var (
+		id  int64
+		err error
+	)
+	rev := sws.backend.CurrentRevision()
+	// The permission is only checked on creation, like ETCD.
+	ctx := sws.gRPCStream.Context()
+	permErr := sws.auth.checkPermission(ctx, creq.Key, creq.RangeEnd, authpb.READ)
+	if permErr == nil {
+		permErr = sws.allowlist.checkRead(ctx, "Watch", creq.Key, creq.RangeEnd)
+	}
+	sws.mu.Lock()
+	// The assigned ids are increasing, so only the ones specified by the
+	// client are checked.
+	_, canceling := sws.canceling[creq.WatchId]
+	sws.mu.Unlock()
+	if canceling && creq.WatchId != backends.AutoWatchID {
+		// The canceled response of the previous watcher is still on the
+		// way, reusing the id would mix up the responses of them.
+		err = backends.ErrWatcherDuplicateID
+	} else if permErr != nil {
+		err = permErr
+	} else if !sws.stats.acquireWatcher(sws.maxWatchers) {
+		err = errTooManyWatchers
+	} else {
+		// The WatchId is AutoWatchID unless the client specifies one.
+		id, err = sws.watchStream.Watch(creq.WatchId, creq.Key, creq.RangeEnd, creq.StartRevision, filtersFromRequest(creq)...)
+		if err != nil {
+			sws.stats.releaseWatcher()
+		}
+	}
+	wr := &etcdserverpb.WatchResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: rev,
+		},
+		WatchId:  id,
+		Created:  true,
+		Canceled: err != nil,
+	}
+	if err != nil {
+		wr.WatchId = invalidWatchID
+		wr.CancelReason = err.Error()
+	} else {
+		sws.mu.Lock()
+		if sws.closed {
+			// The watcher has been canceled by the closing.
+			sws.stats.releaseWatcher()
+		} else {
+			sws.active[id] = struct{}{}
+		}
+		if creq.ProgressNotify {
+			sws.progress[id] = true
+		}
+		if creq.PrevKv {
+			sws.prevKV[id] = struct{}{}
+		}
+		if creq.Fragment {
+			sws.fragment[id] = struct{}{}
+		}
+		sws.startRevs[id] = creq.StartRevision
+		sws.mu.Unlock()
+	}
+	select {
+	case sws.ctrlStream <- wr:
+		return true
+	case <-sws.closec:
+		return false
+	}
+}
+
+// cancelWatch cancels the watcher, the canceled response will be delivered
+// by the backend after all the pending events of the watcher, so it's the
+// last one.
+func (sws *serverWatchStream) cancelWatch(id int64) {
+	sws.mu.Lock()
+	defer sws.mu.Unlock()
+	if err := sws.watchStream.Cancel(id); err != nil {
+		sws.logger.Debug("failed to cancel watcher",
+			zap.Int64("watch_id", id),
+			zap.Error(err),
+		)
+		return
+	}
+	sws.canceling[id] = struct{}{}
+	// The slot is freed without waiting for the canceled response.
+	sws.releaseWatchLocked(id)
+}
+
+// releaseWatchLocked frees the slot of the watcher, note the mutex should be
+// locked.
+func (sws *serverWatchStream) releaseWatchLocked(id int64) {
+	if _, ok := sws.active[id]; ok {
+		delete(sws.active, id)
+		sws.stats.releaseWatcher()
+	}
+}
+
+func (sws *serverWatchStream) sendLoop() {
+	// ids are the watchers whose created responses have been sent.
+	ids := make(map[int64]struct{})
+	// pending are the responses of the watchers whose created responses
+	// haven't been sent yet.
+	pending := make(map[int64][]backends.WatchResponse)
+
+	progressTicker := sws.clock.NewTicker(sws.progressNotifyInterval)
+	defer progressTicker.Stop()
+
+	for {
+		select {
+		case wresp := <-sws.watchStream.Chan():
+			if wresp.WatchID == invalidWatchID {
+				// It's the progress notification of the whole stream, so the
+				// merged events should be sent first.
+				if !sws.flushBatches(ids) || !sws.send(sws.toWatchResponse(wresp)) {
+					return
+				}
+				continue
+			}
+			if _, ok := ids[wresp.WatchID]; !ok {
+				pending[wresp.WatchID] = append(pending[wresp.WatchID], wresp)
+				continue
+			}
+			if !sws.deliver(wresp, ids) {
+				return
+			}
+		case c := <-sws.ctrlStream:
+			if !sws.send(c) {
+				return
+			}
+			if !c.Created || c.Canceled {
+				continue
+			}
+			ids[c.WatchId] = struct{}{}
+			for _, wresp := range pending[c.WatchId] {
+				if !sws.deliver(wresp, ids) {
+					return
+				}
+			}
+			delete(pending, c.WatchId)
+		case <-sws.batchC():
+			if !sws.flushBatches(ids) {
+				return
+			}
+		case <-progressTicker.C():
+			sws.mu.Lock()
+			for id, needed := range sws.progress {
+				if needed {
+					sws.watchStream.RequestProgress(id)
+				}
+				sws.progress[id] = true
+			}
+			sws.mu.Unlock()
+		case <-sws.drain:
+			sws.cancelAll(ids)
+			return
+		case <-sws.closec:
+			return
+		}
+	}
+}
+
+// cancelAll sends the canceled responses to all the watchers when the
+// adapter is shutting down, after the merged events and the created
+// responses on the way.
+func (sws *serverWatchStream) cancelAll(ids map[int64]struct{}) {
+	if !sws.flushBatches(ids) {
+		return
+	}
+	// The send loop is the only receiver of the ctrlStream.
+	for len(sws.ctrlStream) > 0 {
+		c := <-sws.ctrlStream
+		if !sws.send(c) {
+			return
+		}
+		if c.Created && !c.Canceled {
+			ids[c.WatchId] = struct{}{}
+		}
+	}
+	rev := sws.backend.CurrentRevision()
+	for id := range ids {
+		wr := &etcdserverpb.WatchResponse{
+			Header: &etcdserverpb.ResponseHeader{
+				Revision: rev,
+			},
+			WatchId:      id,
+			Canceled:     true,
+			CancelReason: rpctypes.ErrStopped.Error(),
+		}
+		if !sws.send(wr) {
+			return
+		}
+	}
+}
+
+// deliver sends the response generated by the backend. If the batching is
+// enabled, the event responses are merged, and they're sent before the other
+// responses of the same watcher.
+func (sws *serverWatchStream) deliver(wresp backends.WatchResponse, ids map[int64]struct{}) bool {
+	if sws.batcher == nil {
+		return sws.sendWatchResponse(wresp, ids)
+	}
+	if len(wresp.Events) > 0 && !wresp.Canceled {
+		if sws.batcher.add(wresp) {
+			return sws.flushBatch(wresp.WatchID, ids)
+		}
+		return true
+	}
+	return sws.flushBatch(wresp.WatchID, ids) && sws.sendWatchResponse(wresp, ids)
+}
+
+// flushBatch sends the merged events of the watcher.
+func (sws *serverWatchStream) flushBatch(id int64, ids map[int64]struct{}) bool {
+	if merged, ok := sws.batcher.take(id); ok {
+		return sws.sendWatchResponse(merged, ids)
+	}
+	return true
+}
+
+// flushBatches sends the merged events of all the watchers.
+func (sws *serverWatchStream) flushBatches(ids map[int64]struct{}) bool {
+	if sws.batcher == nil {
+		return true
+	}
+	for _, merged := range sws.batcher.takeAll() {
+		if !sws.sendWatchResponse(merged, ids) {
+			return false
+		}
+	}
+	return true
+}
+
+// batchC returns the channel which fires when the merged events should be
+// sent, it's nil if the batching is disabled.
+func (sws *serverWatchStream) batchC() <-chan time.Time {
+	if sws.batcher == nil {
+		return nil
+	}
+	return sws.batcher.C()
+}
+
+// sendWatchResponse sends the response generated by the backend, and it
+// updates the states of the watcher.
+func (sws *serverWatchStream) sendWatchResponse(wresp backends.WatchResponse, ids map[int64]struct{}) bool {
+	wr := sws.toWatchResponse(wresp)
+	sws.mu.Lock()
+	_, fragment := sws.fragment[wr.WatchId]
+	sws.mu.Unlock()
+
+	if fragment {
+		if !sendFragments(wr, sws.maxResponseBytes, sws.send) {
+			return false
+		}
+	} else {
+		if size := wr.Size(); size > sws.maxResponseBytes {
+			sws.logger.Warn("watch response is too large, consider fragmenting it",
+				zap.Int64("watch_id", wr.WatchId),
+				zap.Int("size", size),
+				zap.Int("max_size", sws.maxResponseBytes),
+			)
+		}
+		if !sws.send(wr) {
+			return false
+		}
+	}
+
+	if wresp.CancelReason == backends.SlowWatcherCancelReason {
+		atomic.AddInt64(&sws.stats.slowWatchersCanceled, 1)
+	}
+
+	sws.mu.Lock()
+	defer sws.mu.Unlock()
+	if wr.Canceled {
+		delete(ids, wr.WatchId)
+		delete(sws.progress, wr.WatchId)
+		delete(sws.prevKV, wr.WatchId)
+		delete(sws.fragment, wr.WatchId)
+		delete(sws.canceling, wr.WatchId)
+		delete(sws.startRevs, wr.WatchId)
+		sws.releaseWatchLocked(wr.WatchId)
+	} else if len(wr.Events) > 0 {
+		if _, ok := sws.progress[wr.WatchId]; ok {
+			sws.progress[wr.WatchId] = false
+		}
+	}
+	return true
+}
+
+// sendFragments splits the response into fragments whose sizes are at
+// most maxBytes, unless one event is already larger than it. All the
+// fragments have the Fragment flag except the last one.
+func sendFragments(wr *etcdserverpb.WatchResponse, maxBytes int, send func(*etcdserverpb.WatchResponse) bool) bool {
+	if len(wr.Events) < 2 || wr.Size() <= maxBytes {
+		return send(wr)
+	}
+
+	var idx int
+	for idx < len(wr.Events) {
+		cur := &etcdserverpb.WatchResponse{
+			Header:   wr.Header,
+			WatchId:  wr.WatchId,
+			Fragment: true,
+		}
+		for _, ev := range wr.Events[idx:] {
+			cur.Events = append(cur.Events, ev)
+			if len(cur.Events) > 1 && cur.Size() > maxBytes {
+				cur.Events = cur.Events[:len(cur.Events)-1]
+				break
+			}
+			idx++
+		}
+		if idx == len(wr.Events) {
+			cur.Fragment = false
+		}
+		if !send(cur) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sws *serverWatchStream) send(wr *etcdserverpb.WatchResponse) bool {
+	if err := sws.gRPCStream.Send(wr); err != nil {
+		sws.logger.Debug("failed to send watch response",
+			zap.Int64("watch_id", wr.WatchId),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// close closes the watch stream, all the watchers on it are canceled.
+func (sws *serverWatchStream) close() {
+	sws.watchStream.Close()
+	sws.mu.Lock()
+	sws.closed = true
+	for id := range sws.active {
+		sws.releaseWatchLocked(id)
+	}
+	sws.mu.Unlock()
+	close(sws.closec)
+	sws.wg.Wait()
+}
+
+func (sws *serverWatchStream) toWatchResponse(wresp backends.WatchResponse) *etcdserverpb.WatchResponse {
+	sws.mu.Lock()
+	_, prevKV := sws.prevKV[wresp.WatchID]
+	sws.mu.Unlock()
+
+	events := wresp.Events
+	if !prevKV && len(events) > 0 {
+		// The events are shared among watchers, so copy them.
+		events = make([]*mvccpb.Event, 0, len(wresp.Events))
+		for _, ev := range wresp.Events {
+			events = append(events, &mvccpb.Event{
+				Type: ev.Type,
+				Kv:   ev.Kv,
+			})
+		}
+	}
+	cancelReason := wresp.CancelReason
+	if wresp.Canceled && wresp.CompactRevision != 0 && cancelReason == "" {
+		// It's the reason which ETCD uses for the compacted watchers.
+		cancelReason = rpctypes.ErrCompacted.Error()
+	}
+	return &etcdserverpb.WatchResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: wresp.Revision,
+		},
+		WatchId:         wresp.WatchID,
+		Events:          events,
+		CompactRevision: wresp.CompactRevision,
+		Canceled:        wresp.Canceled,
+		CancelReason:    cancelReason,
+	}
+}
+
+func filtersFromRequest(creq *etcdserverpb.WatchCreateRequest) []backends.FilterFunc {
+	filters := make([]backends.FilterFunc, 0, len(creq.Filters))
+	for _, ft := range creq.Filters {
+		switch ft {
+		case etcdserverpb.WatchCreateRequest_NOPUT:
+			filters = append(filters, filterNoPut)
+		case etcdserverpb.WatchCreateRequest_NODELETE:
+			filters = append(filters, filterNoDelete)
+		}
+	}
+	return filters
+}
+
+func filterNoPut(ev *mvccpb.Event) bool {
+	return ev.Type == mvccpb.PUT
+}
+
+func filterNoDelete(ev *mvccpb.Event) bool {
+	return ev.Type == mvccpb.DELETE
+}
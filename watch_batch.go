@@ -0,0 +1,119 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/api7/etcd-adapter/backends"
+)
+
+// watchBatcher merges the event responses of each watcher, until there are
+// maxEvents events or the interval elapses since the first one is added.
+// It's used by the send loop only, so it's not thread-safe.
+type watchBatcher struct {
+	clock     Clock
+	interval  time.Duration
+	maxEvents int
+
+	// ids are the watchers with merged responses, in the order of their
+	// first responses.
+	ids     []int64
+	batched map[int64]*backends.WatchResponse
+	timer   Timer
+	timerc  <-chan time.Time
+}
+
+func newWatchBatcher(clock Clock, interval time.Duration, maxEvents int) *watchBatcher {
+	return &watchBatcher{
+		clock:     clock,
+		interval:  interval,
+		maxEvents: maxEvents,
+		batched:   make(map[int64]*backends.WatchResponse),
+	}
+}
+
+// add merges the response with the previous ones of the watcher. It returns
+// true if the merged response should be flushed as it's full.
+func (wb *watchBatcher) add(wresp backends.WatchResponse) bool {
+	merged, ok := wb.batched[wresp.WatchID]
+	if !ok {
+		merged = &backends.WatchResponse{
+			WatchID: wresp.WatchID,
+			// The events are shared among watchers, so don't append to
+			// the original slice.
+			Events: append([]*mvccpb.Event(nil), wresp.Events...),
+		}
+		wb.ids = append(wb.ids, wresp.WatchID)
+		wb.batched[wresp.WatchID] = merged
+		if wb.timer == nil {
+			wb.timer = wb.clock.NewTimer(wb.interval)
+			wb.timerc = wb.timer.C()
+		}
+	} else {
+		merged.Events = append(merged.Events, wresp.Events...)
+	}
+	merged.Revision = wresp.Revision
+	return len(merged.Events) >= wb.maxEvents
+}
+
+// take removes the merged response of the watcher.
+func (wb *watchBatcher) take(id int64) (backends.WatchResponse, bool) {
+	merged, ok := wb.batched[id]
+	if !ok {
+		return backends.WatchResponse{}, false
+	}
+	delete(wb.batched, id)
+	for i := range wb.ids {
+		if wb.ids[i] == id {
+			wb.ids = append(wb.ids[:i], wb.ids[i+1:]...)
+			break
+		}
+	}
+	if len(wb.ids) == 0 {
+		wb.stopTimer()
+	}
+	return *merged, true
+}
+
+// takeAll removes all the merged responses.
+func (wb *watchBatcher) takeAll() []backends.WatchResponse {
+	wresps := make([]backends.WatchResponse, 0, len(wb.ids))
+	for _, id := range wb.ids {
+		wresps = append(wresps, *wb.batched[id])
+		delete(wb.batched, id)
+	}
+	wb.ids = wb.ids[:0]
+	wb.stopTimer()
+	return wresps
+}
+
+// C returns the channel which fires when the interval elapses, it's nil if
+// there are no merged responses.
+func (wb *watchBatcher) C() <-chan time.Time {
+	return wb.timerc
+}
+
+func (wb *watchBatcher) stopTimer() {
+	if wb.timer == nil {
+		return
+	}
+	wb.timer.Stop()
+	wb.timer = nil
+	wb.timerc = nil
+}
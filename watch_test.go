@@ -0,0 +1,1149 @@
+// Copyright api7.ai
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package etcdadapter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"github.com/api7/etcd-adapter/backends"
+	"github.com/api7/etcd-adapter/backends/btree"
+)
+
+func TestSendFragments(t *testing.T) {
+	wr := &etcdserverpb.WatchResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: 2,
+		},
+		WatchId: 1,
+	}
+	for i := 0; i < 100; i++ {
+		wr.Events = append(wr.Events, &mvccpb.Event{
+			Type: mvccpb.PUT,
+			Kv: &mvccpb.KeyValue{
+				Key:   []byte(fmt.Sprintf("/apisix/routes/%d", i)),
+				Value: make([]byte, 100),
+			},
+		})
+	}
+
+	var fragments []*etcdserverpb.WatchResponse
+	send := func(wr *etcdserverpb.WatchResponse) bool {
+		fragments = append(fragments, wr)
+		return true
+	}
+	assert.True(t, sendFragments(wr, 1024, send), "checking sending result")
+	assert.Greater(t, len(fragments), 1, "checking the number of fragments")
+
+	var events []*mvccpb.Event
+	for i, fragment := range fragments {
+		assert.LessOrEqual(t, fragment.Size(), 1024, "checking fragment size")
+		assert.Equal(t, i != len(fragments)-1, fragment.Fragment, "checking fragment flag")
+		assert.Equal(t, int64(1), fragment.WatchId, "checking watch id")
+		events = append(events, fragment.Events...)
+	}
+	assert.Equal(t, wr.Events, events, "checking events")
+
+	// Small responses and single event ones are not split.
+	fragments = nil
+	assert.True(t, sendFragments(wr, wr.Size(), send), "checking sending result")
+	assert.True(t, sendFragments(&etcdserverpb.WatchResponse{
+		Events: wr.Events[:1],
+	}, 1, send), "checking sending result")
+	assert.Len(t, fragments, 2, "checking the number of fragments")
+	assert.False(t, fragments[0].Fragment, "checking fragment flag")
+	assert.Len(t, fragments[0].Events, 100, "checking events")
+}
+
+// fakeWatchStream is an in-memory etcdserverpb.Watch_WatchServer.
+type fakeWatchStream struct {
+	grpc.ServerStream
+
+	ctx   context.Context
+	reqc  chan *etcdserverpb.WatchRequest
+	respc chan *etcdserverpb.WatchResponse
+}
+
+func (s *fakeWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeWatchStream) Recv() (*etcdserverpb.WatchRequest, error) {
+	select {
+	case req := <-s.reqc:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *fakeWatchStream) Send(wr *etcdserverpb.WatchResponse) error {
+	select {
+	case s.respc <- wr:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// startTestWatchStream serves a fake watch stream with a prefix watcher on
+// "/apisix/routes/", the returned function closes the stream.
+func startTestWatchStream(t testing.TB, ws *watchServer) (*fakeWatchStream, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeWatchStream{
+		ctx:   ctx,
+		reqc:  make(chan *etcdserverpb.WatchRequest),
+		respc: make(chan *etcdserverpb.WatchResponse, 1024),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = ws.Watch(stream)
+	}()
+	stream.reqc <- &etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+			CreateRequest: &etcdserverpb.WatchCreateRequest{
+				Key:      []byte("/apisix/routes/"),
+				RangeEnd: []byte("/apisix/routes0"),
+			},
+		},
+	}
+	resp := <-stream.respc
+	assert.True(t, resp.Created, "checking created flag")
+	return stream, func() {
+		cancel()
+		<-done
+	}
+}
+
+func newTestWatchServer(backend backends.Backend, batchInterval time.Duration, batchMaxEvents int) *watchServer {
+	return &watchServer{
+		backend:                backend,
+		logger:                 zap.NewNop(),
+		progressNotifyInterval: DefaultWatchProgressNotifyInterval,
+		maxResponseBytes:       DefaultMaxWatchResponseBytes,
+		batchInterval:          batchInterval,
+		batchMaxEvents:         batchMaxEvents,
+		stats:                  &watchStats{},
+		clock:                  realClock{},
+		allowlist:              newAllowlist(zap.NewNop(), nil),
+	}
+}
+
+func TestWatchServerBatching(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	stream, closeStream := startTestWatchStream(t, newTestWatchServer(backend, 100*time.Millisecond, 3))
+	defer closeStream()
+
+	for i := 0; i < 2; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	// The events are held until the interval elapses.
+	select {
+	case <-stream.respc:
+		t.Fatal("events are sent before the interval elapses")
+	case <-time.After(50 * time.Millisecond):
+	}
+	resp := <-stream.respc
+	assert.Len(t, resp.Events, 2, "checking events")
+	assert.Equal(t, int64(3), resp.Header.Revision, "checking revision")
+
+	// The events are sent once there are enough of them.
+	for i := 2; i < 5; i++ {
+		_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+		assert.Nil(t, err, "checking error")
+	}
+	select {
+	case resp = <-stream.respc:
+		assert.Len(t, resp.Events, 3, "checking events")
+		for i, ev := range resp.Events {
+			assert.Equal(t, int64(i+4), ev.Kv.ModRevision, "checking revision")
+		}
+		assert.Equal(t, int64(6), resp.Header.Revision, "checking revision")
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("timed out waiting for watch response")
+	}
+
+	// The merged events are sent before the progress notification.
+	_, err := backend.Create(context.Background(), "/apisix/routes/5", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	stream.reqc <- &etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_ProgressRequest{
+			ProgressRequest: &etcdserverpb.WatchProgressRequest{},
+		},
+	}
+	resp = <-stream.respc
+	assert.Len(t, resp.Events, 1, "checking events")
+	resp = <-stream.respc
+	assert.Equal(t, int64(invalidWatchID), resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 0, "checking events")
+}
+
+func BenchmarkWatchServerBatching(b *testing.B) {
+	cases := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:     "10ms",
+			interval: 10 * time.Millisecond,
+		},
+	}
+	const events = 500
+	for _, bc := range cases {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var sends int
+			for n := 0; n < b.N; n++ {
+				backend := btree.NewBTreeCache(zap.NewNop())
+				stream, closeStream := startTestWatchStream(b, newTestWatchServer(backend, bc.interval, DefaultWatchBatchMaxEvents))
+
+				// The events are applied at a fixed rate.
+				go func() {
+					ticker := time.NewTicker(200 * time.Microsecond)
+					defer ticker.Stop()
+					for i := 0; i < events; i++ {
+						<-ticker.C
+						_, err := backend.Create(context.Background(), fmt.Sprintf("/apisix/routes/%d", i), []byte("v1"), 0)
+						assert.Nil(b, err, "checking create error")
+					}
+				}()
+				for received := 0; received < events; sends++ {
+					received += len((<-stream.respc).Events)
+				}
+				closeStream()
+			}
+			b.ReportMetric(float64(sends)/float64(b.N), "sends/op")
+		})
+	}
+}
+
+func TestWatchServerDrain(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	ws := newTestWatchServer(backend, time.Hour, 100)
+	drain := make(chan struct{})
+	ws.drain = drain
+	stream, closeStream := startTestWatchStream(t, ws)
+	defer closeStream()
+
+	_, err := backend.Create(context.Background(), "/apisix/routes/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	time.Sleep(50 * time.Millisecond)
+	close(drain)
+
+	// The merged events are sent before the canceled response.
+	select {
+	case resp := <-stream.respc:
+		assert.Len(t, resp.Events, 1, "checking events")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch response")
+	}
+	select {
+	case resp := <-stream.respc:
+		assert.True(t, resp.Canceled, "checking canceled flag")
+		assert.Equal(t, rpctypes.ErrStopped.Error(), resp.CancelReason, "checking cancel reason")
+		assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch response")
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&ws.stats.activeWatchers) == 0
+	}, time.Second, 10*time.Millisecond, "checking active watchers")
+}
+
+func TestWatchServerProgressNotify(t *testing.T) {
+	backend := btree.NewBTreeCache(zap.NewNop())
+	ws := newTestWatchServer(backend, 0, 0)
+	clock := newFakeClock()
+	ws.clock = clock
+	stream, closeStream := startTestWatchStream(t, ws)
+	defer closeStream()
+	clock.BlockUntil(1)
+
+	stream.reqc <- &etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+			CreateRequest: &etcdserverpb.WatchCreateRequest{
+				Key:            []byte("/apisix/upstreams/"),
+				RangeEnd:       []byte("/apisix/upstreams0"),
+				ProgressNotify: true,
+			},
+		},
+	}
+	resp := <-stream.respc
+	assert.True(t, resp.Created, "checking created flag")
+	id := resp.WatchId
+
+	clock.Advance(DefaultWatchProgressNotifyInterval)
+	resp = <-stream.respc
+	assert.Equal(t, id, resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 0, "checking events")
+	assert.Equal(t, int64(1), resp.Header.Revision, "checking revision")
+
+	// The watcher which has received events in the interval doesn't need
+	// the notification.
+	_, err := backend.Create(context.Background(), "/apisix/upstreams/1", []byte("v1"), 0)
+	assert.Nil(t, err, "checking error")
+	resp = <-stream.respc
+	assert.Len(t, resp.Events, 1, "checking events")
+	clock.Advance(DefaultWatchProgressNotifyInterval)
+	clock.Advance(DefaultWatchProgressNotifyInterval)
+	resp = <-stream.respc
+	assert.Equal(t, id, resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 0, "checking events")
+	assert.Equal(t, int64(2), resp.Header.Revision, "checking revision")
+	select {
+	case resp = <-stream.respc:
+		t.Fatalf("unexpected watch response: %v", resp)
+	default:
+	}
+}
+
+func TestEtcdAdapterWatchCreateAndCancel(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+	assert.Nil(t, err, "checking error")
+
+	for _, key := range []string{"/apisix/routes/1", "/apisix/routes/2"} {
+		err = stream.Send(&etcdserverpb.WatchRequest{
+			RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+				CreateRequest: &etcdserverpb.WatchCreateRequest{
+					Key: []byte(key),
+				},
+			},
+		})
+		assert.Nil(t, err, "checking error")
+	}
+	for _, id := range []int64{0, 1} {
+		resp, err := stream.Recv()
+		assert.Nil(t, err, "checking error")
+		assert.True(t, resp.Created, "checking created flag")
+		assert.Equal(t, id, resp.WatchId, "checking watch id")
+	}
+
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	}
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(0), resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, mvccpb.PUT, resp.Events[0].Type, "checking event type")
+	assert.Equal(t, int64(2), resp.Events[0].Kv.ModRevision, "checking revision")
+	assert.Equal(t, int64(1), resp.Events[0].Kv.Version, "checking version")
+
+	err = stream.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CancelRequest{
+			CancelRequest: &etcdserverpb.WatchCancelRequest{
+				WatchId: 0,
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(0), resp.WatchId, "checking watch id")
+
+	// Changes made by the clients are watched too.
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Put(context.Background(), "/apisix/routes/2", "v1")
+	assert.Nil(t, err, "checking error")
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, "/apisix/routes/2", string(resp.Events[0].Kv.Key), "checking key")
+	assert.Equal(t, int64(4), resp.Header.Revision, "checking revision")
+}
+
+func TestEtcdAdapterWatchClientCancel(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wch := client.Watch(ctx, "/apisix/routes/1", clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+
+	var events []*clientv3.Event
+	for len(events) < 2 {
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			events = append(events, wresp.Events...)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+	assert.Equal(t, clientv3.EventTypePut, events[0].Type, "checking event type")
+	assert.Equal(t, "v1", string(events[0].Kv.Value), "checking value")
+	assert.Equal(t, clientv3.EventTypeDelete, events[1].Type, "checking event type")
+	assert.Equal(t, int64(3), events[1].Kv.ModRevision, "checking revision")
+
+	cancel()
+	select {
+	case _, ok := <-wch:
+		assert.False(t, ok, "checking watch channel closed")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch channel closed")
+	}
+}
+
+func TestEtcdAdapterWatchOverlappingPrefixes(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch1 := client.Watch(ctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	wch2 := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch1)
+	waitCreated(t, wch2)
+
+	a.EventCh() <- []*Event{
+		{
+			Key:   "/apisix/routes/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+		{
+			Key:   "/apisix/upstreams/1",
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		},
+	}
+
+	for _, tc := range []struct {
+		ch   clientv3.WatchChan
+		keys []string
+	}{
+		{
+			ch:   wch1,
+			keys: []string{"/apisix/routes/1", "/apisix/upstreams/1"},
+		},
+		{
+			ch:   wch2,
+			keys: []string{"/apisix/routes/1"},
+		},
+	} {
+		select {
+		case wresp := <-tc.ch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			var keys []string
+			for _, ev := range wresp.Events {
+				keys = append(keys, string(ev.Kv.Key))
+			}
+			assert.Equal(t, tc.keys, keys, "checking keys")
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+}
+
+func TestEtcdAdapterWatchResume(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	feed := func(from, to int) {
+		for i := from; i < to; i++ {
+			a.EventCh() <- []*Event{
+				{
+					Key:   fmt.Sprintf("/apisix/routes/%d", i),
+					Value: []byte("v1"),
+					Type:  EventAdd,
+				},
+			}
+		}
+	}
+	receive := func(wch clientv3.WatchChan, n int) []*clientv3.Event {
+		var events []*clientv3.Event
+		for len(events) < n {
+			select {
+			case wresp := <-wch:
+				assert.Nil(t, wresp.Err(), "checking watch error")
+				events = append(events, wresp.Events...)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for watch events")
+			}
+		}
+		return events
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+	feed(0, 5)
+	events := receive(wch, 5)
+	cancel()
+
+	// Changes made while there is no watcher.
+	feed(5, 10)
+	lastRev := events[len(events)-1].Kv.ModRevision
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	wch = client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithRev(lastRev+1))
+	go feed(10, 15)
+	events = append(events, receive(wch, 10)...)
+	assert.Len(t, events, 15, "checking events")
+	for i, ev := range events {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i), string(ev.Kv.Key), "checking key")
+		assert.Equal(t, int64(i+2), ev.Kv.ModRevision, "checking revision")
+	}
+
+	select {
+	case wresp := <-wch:
+		t.Fatalf("unexpected watch response: %v", wresp)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestEtcdAdapterWatchCompacted(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Put(context.Background(), "/apisix/routes/1", fmt.Sprintf("v%d", i))
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := client.Compact(context.Background(), 3)
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/1", clientv3.WithRev(2))
+	select {
+	case wresp := <-wch:
+		assert.Equal(t, rpctypes.ErrCompacted, wresp.Err(), "checking watch error")
+		assert.Equal(t, int64(3), wresp.CompactRevision, "checking compact revision")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch response")
+	}
+}
+
+func TestEtcdAdapterWatchProgressNotify(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		WatchProgressNotifyInterval: 200 * time.Millisecond,
+	})
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/upstreams/1", "v1")
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithProgressNotify(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+
+	select {
+	case wresp := <-wch:
+		assert.Len(t, wresp.Events, 1, "checking events")
+		assert.Equal(t, int64(3), wresp.Header.Revision, "checking revision")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch events")
+	}
+	_, err = client.Put(context.Background(), "/apisix/upstreams/1", "v2")
+	assert.Nil(t, err, "checking error")
+
+	// The watcher is idle, progress notifications are sent.
+	for i := 0; i < 2; i++ {
+		select {
+		case wresp := <-wch:
+			assert.True(t, wresp.IsProgressNotify(), "checking progress notification")
+			assert.Equal(t, int64(4), wresp.Header.Revision, "checking revision")
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for progress notification")
+		}
+	}
+}
+
+func TestEtcdAdapterWatchRequestProgress(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/upstreams/1", "v1")
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+	_, err = client.Put(context.Background(), "/apisix/upstreams/1", "v2")
+	assert.Nil(t, err, "checking error")
+
+	assert.Nil(t, client.RequestProgress(ctx), "checking error")
+	select {
+	case wresp := <-wch:
+		assert.True(t, wresp.IsProgressNotify(), "checking progress notification")
+		assert.Equal(t, int64(3), wresp.Header.Revision, "checking revision")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for progress notification")
+	}
+}
+
+func TestEtcdAdapterWatchFilters(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wchNoPut := client.Watch(ctx, "/apisix/", clientv3.WithPrefix(), clientv3.WithFilterPut(), clientv3.WithCreatedNotify())
+	wchNoDelete := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithFilterDelete(), clientv3.WithCreatedNotify())
+	wchAll := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wchNoPut)
+	waitCreated(t, wchNoDelete)
+	waitCreated(t, wchAll)
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+
+	for _, tc := range []struct {
+		name  string
+		ch    clientv3.WatchChan
+		types []mvccpb.Event_EventType
+	}{
+		{
+			name:  "no put",
+			ch:    wchNoPut,
+			types: []mvccpb.Event_EventType{mvccpb.DELETE},
+		},
+		{
+			name:  "no delete",
+			ch:    wchNoDelete,
+			types: []mvccpb.Event_EventType{mvccpb.PUT},
+		},
+		{
+			name:  "all",
+			ch:    wchAll,
+			types: []mvccpb.Event_EventType{mvccpb.PUT, mvccpb.DELETE},
+		},
+	} {
+		var types []mvccpb.Event_EventType
+		for len(types) < len(tc.types) {
+			select {
+			case wresp := <-tc.ch:
+				assert.Nil(t, wresp.Err(), "checking watch error")
+				for _, ev := range wresp.Events {
+					types = append(types, ev.Type)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for watch events: %s", tc.name)
+			}
+		}
+		assert.Equal(t, tc.types, types, "checking event types: %s", tc.name)
+	}
+
+	// Nothing follows the filtered events.
+	for _, ch := range []clientv3.WatchChan{wchNoPut, wchNoDelete} {
+		select {
+		case wresp := <-ch:
+			t.Fatalf("unexpected watch response: %v", wresp)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	// Progress notifications are not affected by the filters.
+	assert.Nil(t, client.RequestProgress(ctx), "checking error")
+	select {
+	case wresp := <-wchNoPut:
+		assert.True(t, wresp.IsProgressNotify(), "checking progress notification")
+		assert.Equal(t, int64(3), wresp.Header.Revision, "checking revision")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for progress notification")
+	}
+}
+
+func TestEtcdAdapterWatchPrevKV(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	_, err := client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
+	wchNoPrevKV := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+	waitCreated(t, wchNoPrevKV)
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Delete(context.Background(), "/apisix/routes/1")
+	assert.Nil(t, err, "checking error")
+
+	receive := func(wch clientv3.WatchChan) []*clientv3.Event {
+		var events []*clientv3.Event
+		for len(events) < 2 {
+			select {
+			case wresp := <-wch:
+				assert.Nil(t, wresp.Err(), "checking watch error")
+				events = append(events, wresp.Events...)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for watch events")
+			}
+		}
+		return events
+	}
+
+	events := receive(wch)
+	assert.Equal(t, "v2", string(events[0].Kv.Value), "checking value")
+	assert.Equal(t, &mvccpb.KeyValue{
+		Key:            []byte("/apisix/routes/1"),
+		CreateRevision: 2,
+		ModRevision:    2,
+		Version:        1,
+		Value:          []byte("v1"),
+	}, events[0].PrevKv, "checking prev kv")
+	assert.Equal(t, clientv3.EventTypeDelete, events[1].Type, "checking event type")
+	assert.Empty(t, events[1].Kv.Value, "checking value")
+	assert.Equal(t, int64(4), events[1].Kv.ModRevision, "checking revision")
+	assert.Equal(t, "v2", string(events[1].PrevKv.Value), "checking prev value")
+	assert.Equal(t, int64(3), events[1].PrevKv.ModRevision, "checking prev revision")
+	assert.Equal(t, int64(2), events[1].PrevKv.Version, "checking prev version")
+
+	for _, ev := range receive(wchNoPrevKV) {
+		assert.Nil(t, ev.PrevKv, "checking prev kv")
+	}
+}
+
+func TestEtcdAdapterWatchFragment(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		MaxWatchResponseBytes: 1024,
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithFragment(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	var events []*Event
+	for i := 0; i < 100; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%d", i),
+			Value: make([]byte, 100),
+			Type:  EventAdd,
+		})
+	}
+	a.EventCh() <- events
+
+	// The fragments are reassembled by the client.
+	select {
+	case wresp := <-wch:
+		assert.Nil(t, wresp.Err(), "checking watch error")
+		assert.Len(t, wresp.Events, 100, "checking events")
+		for i, ev := range wresp.Events {
+			assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i), string(ev.Kv.Key), "checking key")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch events")
+	}
+}
+
+func TestEtcdAdapterWatchSlowWatcher(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		WatcherBufferSize: 4,
+	})
+	defer shutdown()
+
+	// The slow stream is on another connection, so that it won't exhaust
+	// the flow control window of the fast one.
+	slowClient, err := clientv3.New(clientv3.Config{
+		Endpoints: client.Endpoints(),
+	})
+	assert.Nil(t, err, "creating etcd client")
+	defer slowClient.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow, err := etcdserverpb.NewWatchClient(slowClient.ActiveConnection()).Watch(ctx)
+	assert.Nil(t, err, "checking error")
+	err = slow.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+			CreateRequest: &etcdserverpb.WatchCreateRequest{
+				Key:      []byte("/apisix/routes/"),
+				RangeEnd: []byte("/apisix/routes0"),
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err := slow.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Created, "checking created flag")
+
+	wch := client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	waitCreated(t, wch)
+
+	// The slow stream doesn't receive any responses, the fast one still
+	// receives the events in time.
+	for i := 0; i < 400; i++ {
+		a.EventCh() <- []*Event{
+			{
+				Key:   fmt.Sprintf("/apisix/routes/%d", i),
+				Value: make([]byte, 8192),
+				Type:  EventAdd,
+			},
+		}
+		select {
+		case wresp := <-wch:
+			assert.Nil(t, wresp.Err(), "checking watch error")
+			assert.Len(t, wresp.Events, 1, "checking events")
+			assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i), string(wresp.Events[0].Kv.Key), "checking key")
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for watch events")
+		}
+	}
+
+	rev, err := client.Get(context.Background(), "/apisix/routes/0")
+	assert.Nil(t, err, "checking error")
+	_, err = client.Compact(context.Background(), rev.Header.Revision)
+	assert.Nil(t, err, "checking error")
+
+	// The slow watcher is canceled as the changes it misses are compacted.
+	for {
+		resp, err = slow.Recv()
+		assert.Nil(t, err, "checking error")
+		if resp.Canceled {
+			break
+		}
+	}
+	assert.Equal(t, backends.SlowWatcherCancelReason, resp.CancelReason, "checking cancel reason")
+	assert.Equal(t, rev.Header.Revision, resp.CompactRevision, "checking compact revision")
+	assert.Equal(t, int64(1), a.Stats().SlowWatchersCanceled, "checking slow watchers canceled")
+}
+
+func TestEtcdAdapterWatchID(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+	assert.Nil(t, err, "checking error")
+
+	create := func(id int64, key string) *etcdserverpb.WatchResponse {
+		err := stream.Send(&etcdserverpb.WatchRequest{
+			RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+				CreateRequest: &etcdserverpb.WatchCreateRequest{
+					Key:     []byte(key),
+					WatchId: id,
+				},
+			},
+		})
+		assert.Nil(t, err, "checking error")
+		resp, err := stream.Recv()
+		assert.Nil(t, err, "checking error")
+		assert.True(t, resp.Created, "checking created flag")
+		return resp
+	}
+
+	resp := create(7, "/apisix/routes/1")
+	assert.False(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(7), resp.WatchId, "checking watch id")
+	resp = create(backends.AutoWatchID, "/apisix/routes/2")
+	assert.Equal(t, int64(0), resp.WatchId, "checking watch id")
+
+	// The duplicate and negative ids are rejected.
+	resp = create(7, "/apisix/routes/2")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(invalidWatchID), resp.WatchId, "checking watch id")
+	assert.Equal(t, backends.ErrWatcherDuplicateID.Error(), resp.CancelReason, "checking cancel reason")
+	resp = create(invalidWatchID, "/apisix/routes/2")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, backends.ErrWatcherInvalidID.Error(), resp.CancelReason, "checking cancel reason")
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v1")
+	assert.Nil(t, err, "checking error")
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(7), resp.WatchId, "checking watch id")
+	assert.Len(t, resp.Events, 1, "checking events")
+
+	err = stream.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CancelRequest{
+			CancelRequest: &etcdserverpb.WatchCancelRequest{
+				WatchId: 7,
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(7), resp.WatchId, "checking watch id")
+}
+
+func TestEtcdAdapterWatchCompactBoundary(t *testing.T) {
+	_, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Put(context.Background(), "/apisix/routes/1", fmt.Sprintf("v%d", i))
+		assert.Nil(t, err, "checking error")
+	}
+	_, err := client.Compact(context.Background(), 3)
+	assert.Nil(t, err, "checking error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+	assert.Nil(t, err, "checking error")
+	create := func(startRev int64) {
+		err := stream.Send(&etcdserverpb.WatchRequest{
+			RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+				CreateRequest: &etcdserverpb.WatchCreateRequest{
+					Key:           []byte("/apisix/routes/1"),
+					StartRevision: startRev,
+				},
+			},
+		})
+		assert.Nil(t, err, "checking error")
+		resp, err := stream.Recv()
+		assert.Nil(t, err, "checking error")
+		assert.True(t, resp.Created, "checking created flag")
+	}
+
+	// The changes at the compact revision are still available.
+	create(3)
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.False(t, resp.Canceled, "checking canceled flag")
+	assert.Len(t, resp.Events, 2, "checking events")
+	assert.Equal(t, int64(3), resp.Events[0].Kv.ModRevision, "checking revision")
+	assert.Equal(t, int64(4), resp.Events[1].Kv.ModRevision, "checking revision")
+
+	create(2)
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Equal(t, int64(1), resp.WatchId, "checking watch id")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(3), resp.CompactRevision, "checking compact revision")
+	assert.Equal(t, rpctypes.ErrCompacted.Error(), resp.CancelReason, "checking cancel reason")
+	assert.Len(t, resp.Events, 0, "checking events")
+}
+
+func TestEtcdAdapterWatchLargeBatch(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+	assert.Nil(t, err, "checking error")
+	err = stream.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+			CreateRequest: &etcdserverpb.WatchCreateRequest{
+				Key:      []byte("/apisix/routes/"),
+				RangeEnd: []byte("/apisix/routes0"),
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Created, "checking created flag")
+
+	var events []*Event
+	for i := 0; i < 1000; i++ {
+		events = append(events, &Event{
+			Key:   fmt.Sprintf("/apisix/routes/%d", i),
+			Value: []byte("v1"),
+			Type:  EventAdd,
+		})
+	}
+	a.EventCh() <- events
+
+	// All the events of the batch are delivered in one response, in the
+	// order of the batch.
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Events, 1000, "checking events")
+	for i, ev := range resp.Events {
+		assert.Equal(t, fmt.Sprintf("/apisix/routes/%d", i), string(ev.Kv.Key), "checking key")
+		assert.Equal(t, int64(i+2), ev.Kv.ModRevision, "checking revision")
+	}
+	assert.Equal(t, int64(1001), resp.Header.Revision, "checking revision")
+
+	_, err = client.Put(context.Background(), "/apisix/routes/1", "v2")
+	assert.Nil(t, err, "checking error")
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.Len(t, resp.Events, 1, "checking events")
+	assert.Equal(t, int64(1002), resp.Events[0].Kv.ModRevision, "checking revision")
+}
+
+func TestEtcdAdapterWatchConcurrency(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, nil)
+	defer shutdown()
+
+	// All the watchers are multiplexed on the same gRPC stream.
+	watchers := 200
+	cancels := make([]context.CancelFunc, watchers)
+	wchs := make([]clientv3.WatchChan, watchers)
+	for i := 0; i < watchers; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cancels[i] = cancel
+		wchs[i] = client.Watch(ctx, "/apisix/routes/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+		waitCreated(t, wchs[i])
+	}
+
+	// Half of the watchers are canceled while the events are applied.
+	writes := 100
+	go func() {
+		for i := 0; i < writes; i++ {
+			a.EventCh() <- []*Event{
+				{
+					Key:   fmt.Sprintf("/apisix/routes/%d", i),
+					Value: []byte("v1"),
+					Type:  EventAdd,
+				},
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < watchers; i += 2 {
+			cancels[i]()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < watchers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var rev int64 = 1
+			for rev < int64(writes+1) {
+				select {
+				case wresp, ok := <-wchs[i]:
+					if !ok {
+						assert.Equal(t, 0, i%2, "checking watcher %d closed", i)
+						return
+					}
+					for _, ev := range wresp.Events {
+						assert.Equal(t, rev+1, ev.Kv.ModRevision, "checking revision of watcher %d", i)
+						rev = ev.Kv.ModRevision
+					}
+				case <-time.After(10 * time.Second):
+					t.Errorf("timed out waiting for events of watcher %d", i)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestEtcdAdapterMaxWatchers(t *testing.T) {
+	a, client, shutdown := startTestAdapter(t, &AdapterOptions{
+		MaxWatchers: 2,
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newStream := func() etcdserverpb.Watch_WatchClient {
+		stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+		assert.Nil(t, err, "checking error")
+		return stream
+	}
+	create := func(stream etcdserverpb.Watch_WatchClient) *etcdserverpb.WatchResponse {
+		err := stream.Send(&etcdserverpb.WatchRequest{
+			RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+				CreateRequest: &etcdserverpb.WatchCreateRequest{
+					Key: []byte("/apisix/routes/1"),
+				},
+			},
+		})
+		assert.Nil(t, err, "checking error")
+		resp, err := stream.Recv()
+		assert.Nil(t, err, "checking error")
+		assert.True(t, resp.Created, "checking created flag")
+		return resp
+	}
+
+	s1, s2 := newStream(), newStream()
+	assert.False(t, create(s1).Canceled, "checking canceled flag")
+	assert.False(t, create(s2).Canceled, "checking canceled flag")
+	assert.Equal(t, int64(2), a.Stats().ActiveWatchers, "checking active watchers")
+
+	// The limit is shared by all the streams.
+	for _, stream := range []etcdserverpb.Watch_WatchClient{s1, s2} {
+		resp := create(stream)
+		assert.True(t, resp.Canceled, "checking canceled flag")
+		assert.Equal(t, errTooManyWatchers.Error(), resp.CancelReason, "checking cancel reason")
+	}
+
+	err := s1.Send(&etcdserverpb.WatchRequest{
+		RequestUnion: &etcdserverpb.WatchRequest_CancelRequest{
+			CancelRequest: &etcdserverpb.WatchCancelRequest{
+				WatchId: 0,
+			},
+		},
+	})
+	assert.Nil(t, err, "checking error")
+	resp, err := s1.Recv()
+	assert.Nil(t, err, "checking error")
+	assert.True(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(1), a.Stats().ActiveWatchers, "checking active watchers")
+
+	resp = create(s2)
+	assert.False(t, resp.Canceled, "checking canceled flag")
+	assert.Equal(t, int64(1), resp.WatchId, "checking watch id")
+	assert.Equal(t, int64(2), a.Stats().ActiveWatchers, "checking active watchers")
+
+	// The slots are freed when the stream is closed.
+	assert.Nil(t, s2.CloseSend(), "checking error")
+	cancel()
+	assert.Eventually(t, func() bool {
+		return a.Stats().ActiveWatchers == 0
+	}, 5*time.Second, 10*time.Millisecond, "checking active watchers")
+}